@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// maxRequestIDLength is the longest request ID accepted from clients.
+	maxRequestIDLength = 128
+)
+
+var (
+	proxyRequests        = newCounter("gemini_proxy_requests_total", "Requests to the proxy, by endpoint and status code.")
+	proxyRequestDuration = newHistogram("gemini_proxy_request_duration_seconds", "Time until the proxy finished responding, streams included, by endpoint.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+)
+
+// requestInfoContextKey is the context key of the requestInfo of a request.
+type requestInfoContextKey struct{}
+
+// requestInfo is the ID of a request, and what its handler noted of it for its
+// access log. Batches run their requests with the context of the request that
+// created them, so it can be noted after it is logged.
+type requestInfo struct {
+	id string
+
+	mu      sync.Mutex
+	model   string
+	client  int32
+	traceID string
+	err     error
+}
+
+// requestID returns the ID of the request of a context, or "" if it has none.
+func requestID(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoContextKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// validRequestID reports whether a request ID from a client can be used: it is
+// not too long, and is printable ASCII without spaces, so it cannot forge log
+// lines or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// setRequestIDHeader sets the X-Request-ID header of an upstream request to the
+// ID of the request of ctx, if it has one, so that it can be traced across
+// systems.
+func setRequestIDHeader(h http.Header, ctx context.Context) {
+	if id := requestID(ctx); id != "" {
+		h.Set(requestIDHeader, id)
+	}
+}
+
+// requestLog returns the logger of a request, with its ID, if it has one, path
+// and user agent.
+func requestLog(r *http.Request) zerolog.Logger {
+	logger := log.With()
+	if id := requestID(r.Context()); id != "" {
+		logger = logger.Str("request-id", id)
+	}
+	return logger.
+		Str("path", r.URL.Path).
+		Str("user-agent", r.Header.Get("User-Agent")).
+		Logger()
+}
+
+// requestEndpoint returns the pattern of the route of a request, or "other" if
+// it has none, to label it by in metrics and traces.
+func requestEndpoint(r *http.Request) string {
+	if _, pattern := http.DefaultServeMux.Handler(r); pattern != "" {
+		return pattern
+	}
+	return "other"
+}
+
+// noteRequest notes the model of a request, if any, and the client index it
+// is sent with, for its access log.
+func noteRequest(ctx context.Context, model string, client int32) {
+	if info, ok := ctx.Value(requestInfoContextKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		info.model, info.client = model, client
+	}
+}
+
+// noteTrace notes the ID of the sampled trace of a request, for its access log.
+func noteTrace(ctx context.Context, traceID string) {
+	if info, ok := ctx.Value(requestInfoContextKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		info.traceID = traceID
+	}
+}
+
+// noteError notes why a request failed, for its access log, which is then
+// logged as an error. Only the first error noted is kept, as later ones tend
+// to follow from it.
+func noteError(ctx context.Context, err error) {
+	if info, ok := ctx.Value(requestInfoContextKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		if info.err == nil {
+			info.err = err
+		}
+	}
+}
+
+// accessLogHandler gives requests an ID, that of their X-Request-ID header if
+// it is valid, returning it in the same header, and logs a line for each once
+// next has responded, with its status code, duration, size and what its handler
+// noted, counting it in the request metrics by endpoint. This is the only line
+// logged for a request that fails with an error noted with noteError. Requests
+// to metricsEndpoint are counted but not logged.
+func accessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = openai.NewID("req_")
+		}
+		info := &requestInfo{id: id, client: -1}
+		w.Header().Set(requestIDHeader, id)
+		// Gemini API requests over gRPC, such as for cached contents, carry
+		// the ID in their metadata.
+		ctx := metadata.AppendToOutgoingContext(r.Context(), "x-request-id", id)
+		aw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(ctx, requestInfoContextKey{}, info)))
+		duration := time.Since(start)
+
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		endpoint := requestEndpoint(r)
+		proxyRequests.add(1, "endpoint", endpoint, "code", strconv.Itoa(status))
+		proxyRequestDuration.observe(duration.Seconds(), "endpoint", endpoint)
+		if metricsRequest(r) {
+			// Scrapes would drown out the requests.
+			return
+		}
+
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		event := log.Info()
+		if info.err != nil {
+			event = log.Error().Err(info.err)
+		}
+		event = event.
+			Str("request-id", info.id).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Int("status-code", status).
+			Dur("duration", duration).
+			Int64("bytes", aw.bytes).
+			Str("user-agent", r.Header.Get("User-Agent"))
+		if addr, err := clientAddr(r); err == nil {
+			event = event.Stringer("ip", addr)
+		}
+		if info.model != "" {
+			event = event.Str("model", info.model)
+		}
+		if info.client >= 0 {
+			event = event.Int32("client", info.client)
+		}
+		if info.traceID != "" {
+			event = event.Str("trace-id", info.traceID)
+		}
+		event.Msg("Handled request")
+	})
+}
+
+// statusWriter records the status code and size of a response, for the
+// middleware that reports on responses and the writers that alter them.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes streamed responses.
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	adminKeysEndpoint       = "/admin/keys"
+	adminKeyEndpoint        = "/admin/keys/{id}"
+	adminKeyDisableEndpoint = "/admin/keys/{id}/disable"
+	adminKeyEnableEndpoint  = "/admin/keys/{id}/enable"
+	adminKeyRotateEndpoint  = "/admin/keys/{id}/rotate"
+	adminReloadEndpoint     = "/admin/reload"
+	// adminUsageSaveInterval is how often the usage of admin keys is saved to
+	// AdminStoreFile, when it has changed.
+	adminUsageSaveInterval = time.Minute
+)
+
+// adminKey is a proxy API key managed with the admin API. Only the hash of the
+// key is kept, so the key itself is only shown when it is created or rotated.
+type adminKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"hash"`
+	Disabled   bool       `json:"disabled"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	Requests   int64      `json:"requests"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// adminKeyResponse is an admin key as returned by the admin API, with the key
+// itself when it has just been created or rotated.
+type adminKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Key        string     `json:"key,omitempty"`
+	Disabled   bool       `json:"disabled"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	Requests   int64      `json:"requests"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func (k *adminKey) response(key string) adminKeyResponse {
+	return adminKeyResponse{
+		ID:         k.ID,
+		Name:       k.Name,
+		Key:        key,
+		Disabled:   k.Disabled,
+		CreatedAt:  k.CreatedAt,
+		RotatedAt:  k.RotatedAt,
+		Requests:   k.Requests,
+		LastUsedAt: k.LastUsedAt,
+	}
+}
+
+// adminStore is the admin keys, persisted to AdminStoreFile.
+type adminStore struct {
+	mu     sync.Mutex
+	keys   []*adminKey
+	byHash map[string]*adminKey
+	// dirty is whether usage has changed since the store was saved.
+	dirty bool
+}
+
+// adminKeys is the store of admin keys, or nil when AdminStoreFile is not set.
+var adminKeys *adminStore
+
+func hashAdminKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAdminKeySecret() string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	return "sk-proxy-" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// loadAdminStore reads the admin keys from AdminStoreFile, which is created
+// when they are first saved.
+func loadAdminStore() (*adminStore, error) {
+	store := &adminStore{byHash: map[string]*adminKey{}}
+	b, err := os.ReadFile(AdminStoreFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read ADMIN_STORE_FILE")
+	}
+	var contents struct {
+		Keys []*adminKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &contents); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal ADMIN_STORE_FILE")
+	}
+	store.keys = contents.Keys
+	for _, key := range store.keys {
+		store.byHash[key.Hash] = key
+	}
+	log.Info().Int("keys", len(store.keys)).Msg("Loaded admin keys")
+	return store, nil
+}
+
+// save writes the store to AdminStoreFile, replacing it at once so that it is
+// never left half written. It must be called with the lock held.
+func (s *adminStore) save() error {
+	b, err := json.MarshalIndent(struct {
+		Keys []*adminKey `json:"keys"`
+	}{s.keys}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal admin keys")
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(AdminStoreFile), filepath.Base(AdminStoreFile)+".*")
+	if err != nil {
+		return errors.Wrap(err, "failed to save admin keys")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to save admin keys")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to save admin keys")
+	}
+	if err := os.Rename(tmp.Name(), AdminStoreFile); err != nil {
+		return errors.Wrap(err, "failed to save admin keys")
+	}
+	s.dirty = false
+	return nil
+}
+
+// use returns the ID of the enabled admin key of a token, counting its use.
+func (s *adminStore) use(token string, now time.Time) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.byHash[hashAdminKey(token)]
+	if !ok || key.Disabled {
+		return "", false
+	}
+	key.Requests++
+	key.LastUsedAt = &now
+	s.dirty = true
+	return key.ID, true
+}
+
+// saveUsage saves the store every adminUsageSaveInterval when usage has changed.
+func (s *adminStore) saveUsage() {
+	for range time.Tick(adminUsageSaveInterval) {
+		s.mu.Lock()
+		if s.dirty {
+			if err := s.save(); err != nil {
+				log.Error().Err(err).Msg("")
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// adminHandler requires requests to the admin API to present AdminApiKey as a
+// bearer token.
+func adminHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(AdminApiKey)) != 1 {
+			writeInvalidAPIKey(w, r, errors.New("request has no valid admin API key"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newAdminMux returns the routes of the admin API.
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminKeysEndpoint, adminKeysHandler)
+	mux.HandleFunc(adminKeyEndpoint, adminKeyHandler)
+	mux.HandleFunc(adminKeyDisableEndpoint, adminKeyUpdateHandler(func(key *adminKey, now time.Time) string {
+		key.Disabled = true
+		return ""
+	}))
+	mux.HandleFunc(adminKeyEnableEndpoint, adminKeyUpdateHandler(func(key *adminKey, now time.Time) string {
+		key.Disabled = false
+		return ""
+	}))
+	mux.HandleFunc(adminKeyRotateEndpoint, adminKeyUpdateHandler(func(key *adminKey, now time.Time) string {
+		secret := newAdminKeySecret()
+		delete(adminKeys.byHash, key.Hash)
+		key.Hash = hashAdminKey(secret)
+		key.RotatedAt = &now
+		adminKeys.byHash[key.Hash] = key
+		return secret
+	}))
+	mux.HandleFunc(adminReloadEndpoint, adminReloadHandler)
+	return mux
+}
+
+// adminReloadHandler reloads the config, responding with a 204, or a 500 with
+// the error if the config is invalid.
+func adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := reloadConfig(); err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to reload config"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminKeysHandler(w http.ResponseWriter, r *http.Request) {
+	requestLogger := requestLog(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		adminKeys.mu.Lock()
+		keys := make([]adminKeyResponse, len(adminKeys.keys))
+		for i, key := range adminKeys.keys {
+			keys[i] = key.response("")
+		}
+		adminKeys.mu.Unlock()
+		writeJSON(w, r, struct {
+			Keys []adminKeyResponse `json:"keys"`
+		}{keys})
+	case http.MethodPost:
+		var createReq struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&createReq); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "Invalid request body")
+			noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+			return
+		}
+		secret := newAdminKeySecret()
+		key := &adminKey{
+			ID:        openai.NewID("key_"),
+			Name:      createReq.Name,
+			Hash:      hashAdminKey(secret),
+			CreatedAt: time.Now().UTC(),
+		}
+		adminKeys.mu.Lock()
+		adminKeys.keys = append(adminKeys.keys, key)
+		adminKeys.byHash[key.Hash] = key
+		err := adminKeys.save()
+		resp := key.response(secret)
+		adminKeys.mu.Unlock()
+		if err != nil {
+			writeAdminStoreError(w, r, err)
+			return
+		}
+		requestLogger.Info().Str("key", key.ID).Msg("Created admin key")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, r, resp)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func adminKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminKeys.mu.Lock()
+	key, ok := findAdminKey(w, r)
+	var resp adminKeyResponse
+	if ok {
+		resp = key.response("")
+	}
+	adminKeys.mu.Unlock()
+	if ok {
+		writeJSON(w, r, resp)
+	}
+}
+
+// adminKeyUpdateHandler returns a handler that updates the admin key named in
+// the request path with update, responding with the key, and the secret update
+// returns, if any.
+func adminKeyUpdateHandler(update func(key *adminKey, now time.Time) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestLogger := requestLog(r)
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		adminKeys.mu.Lock()
+		key, ok := findAdminKey(w, r)
+		if !ok {
+			adminKeys.mu.Unlock()
+			return
+		}
+		secret := update(key, time.Now().UTC())
+		err := adminKeys.save()
+		resp := key.response(secret)
+		adminKeys.mu.Unlock()
+		if err != nil {
+			writeAdminStoreError(w, r, err)
+			return
+		}
+		requestLogger.Info().Str("key", key.ID).Msg("Updated admin key")
+		writeJSON(w, r, resp)
+	}
+}
+
+// findAdminKey returns the admin key named in the request path, writing a 404
+// if there is none. It must be called with the lock of adminKeys held.
+func findAdminKey(w http.ResponseWriter, r *http.Request) (*adminKey, bool) {
+	i := slices.IndexFunc(adminKeys.keys, func(key *adminKey) bool {
+		return key.ID == r.PathValue("id")
+	})
+	if i < 0 {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "No key found with id "+r.PathValue("id"))
+		return nil, false
+	}
+	return adminKeys.keys[i], true
+}
+
+func writeAdminStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, http.StatusInternalServerError, "server_error", "Failed to save keys")
+	noteError(r.Context(), err)
+}
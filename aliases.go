@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// currentModelAliases are the model aliases, from loadModelAliases, as of the
+// last reload.
+var currentModelAliases atomic.Pointer[map[string]string]
+
+// parseModelMap parses names mapped to models, in the form NAME=MODEL;NAME=MODEL.
+func parseModelMap(s string) (map[string]string, error) {
+	models := map[string]string{}
+	for _, mapping := range strings.Split(s, ";") {
+		if mapping == "" {
+			continue
+		}
+		name, model, ok := strings.Cut(mapping, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid mapping: %s", mapping)
+		}
+		models[strings.TrimSpace(name)] = strings.TrimSpace(model)
+	}
+	return models, nil
+}
+
+// loadModelAliases reads the aliases from MODEL_ALIASES_FILE, a JSON object of
+// aliases to models, then adds those of MODEL_ALIASES.
+func loadModelAliases() (map[string]string, error) {
+	aliases := map[string]string{}
+	if ModelAliasesFile != "" {
+		b, err := os.ReadFile(ModelAliasesFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read MODEL_ALIASES_FILE")
+		}
+		if err := json.Unmarshal(b, &aliases); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal MODEL_ALIASES_FILE")
+		}
+	}
+	envAliases, err := parseModelMap(ModelAliases)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse MODEL_ALIASES")
+	}
+	for alias, model := range envAliases {
+		aliases[alias] = model
+	}
+	return aliases, nil
+}
+
+// resolveModelAlias returns the model an alias maps to, or the model itself.
+// The "models/" prefix of Gemini model names is dropped, so that models are
+// named the same with or without it.
+func resolveModelAlias(model string) string {
+	model = strings.TrimPrefix(model, "models/")
+	if aliased, ok := (*currentModelAliases.Load())[model]; ok {
+		return aliased
+	}
+	return model
+}
+
+// modelAliasHandler replaces aliased models in JSON request bodies, and drops
+// the "models/" prefix of model names, before they are handled by next.
+// Requests for models their virtual key cannot use are rejected.
+func modelAliasHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if r.Method != http.MethodPost || mediaType == "multipart/form-data" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var model string
+		err := rewriteRequestModel(r, func(requestModel string) string {
+			model = resolveModelAlias(requestModel)
+			return model
+		})
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+			return
+		}
+		if model != "" && !allowedModel(r.Context(), model) {
+			writeModelNotAllowed(w, r, model)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rewriteRequestModel replaces the model of a JSON request body with the result
+// of f. Bodies that are not JSON objects are left for the handler to reject.
+func rewriteRequestModel(r *http.Request, f func(model string) string) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// Numbers are kept as written, so large integers such as seeds survive.
+	decoder.UseNumber()
+	if decoder.Decode(&fields) != nil {
+		return nil
+	}
+	model, _ := fields["model"].(string)
+	rewritten := f(model)
+	if rewritten == model {
+		return nil
+	}
+	fields["model"] = rewritten
+
+	// fields was decoded from JSON, so it always re-encodes.
+	body, _ = json.Marshal(fields)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return nil
+}
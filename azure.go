@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// azureDeploymentHandler serves an Azure OpenAI-style deployment route with next.
+// Azure requests name the deployment in the URL rather than a model in the body,
+// so the model is set from the deployment before the request is handled.
+func azureDeploymentHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+
+		var model string
+		err := rewriteRequestModel(r, func(string) string {
+			deployment := r.PathValue("deployment")
+			var ok bool
+			model, ok = azureDeployments[deployment]
+			if !ok {
+				model = deployment
+			}
+			model = resolveModelAlias(model)
+			return model
+		})
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+			return
+		}
+		if !allowedModel(r.Context(), model) {
+			writeModelNotAllowed(w, r, model)
+			return
+		}
+		next(w, r)
+	}
+}
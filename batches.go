@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// batchCompletionWindow is how long batches can run, and how long batches
+	// and their files are kept once they are done or uploaded.
+	batchCompletionWindow = 24 * time.Hour
+	// maxBatchFileSize is the largest batch input or training file, that of the
+	// OpenAI Batch API, as these files are kept in memory.
+	maxBatchFileSize = 200 << 20
+	// batchMaxAttempts is how many times a request that was rate limited or
+	// failed upstream is tried before it is recorded as failed.
+	batchMaxAttempts = 4
+	batchRetryDelay  = 2 * time.Second
+)
+
+// batchEndpoints are the endpoints batch requests can target, served in-process
+// by the same handlers as regular requests.
+var batchEndpoints = map[string]http.HandlerFunc{
+	openAIChatCompletionsEndpoint: chatCompletionsHandler,
+	openAICompletionsEndpoint:     completionsHandler,
+	openAIEmbeddingsEndpoint:      embeddingsHandler,
+	openAIResponsesEndpoint:       responsesHandler,
+}
+
+// Batches and their files only live in memory, as Gemini has nowhere to keep
+// them and its File API does not allow downloads. They are only visible to
+// their owner, and removed batchCompletionWindow after they are done or
+// uploaded.
+var (
+	batchesMu  sync.Mutex
+	batchJobs  = map[string]*batchJob{}
+	batchOrder []string
+	batchFiles = map[string]*batchFile{}
+)
+
+type batchFile struct {
+	// owner is the batchOwner of the request that uploaded the file, or of the
+	// batch that it is the output of.
+	owner string
+	file  *openai.FileResponse
+	data  []byte
+}
+
+type batchJob struct {
+	mu sync.Mutex
+	// owner is the batchOwner of the request that created the batch.
+	owner  string
+	batch  *openai.BatchResponse
+	cancel context.CancelFunc
+	// doneAt is when the batch finished, zero while it runs.
+	doneAt time.Time
+}
+
+// batchOwner identifies who a request acts for, from the tenant or virtual
+// key, proxy API key, or Gemini API key it presented. Requests with none of
+// them share their batches.
+func batchOwner(ctx context.Context) string {
+	if vk, ok := ctx.Value(virtualKeyContextKey{}).(*virtualKey); ok {
+		if vk.tenant != nil {
+			return "tenant:" + vk.tenant.name
+		}
+		return "key:" + vk.id
+	}
+	if id, ok := ctx.Value(proxyKeyContextKey{}).(string); ok {
+		return "proxy:" + id
+	}
+	if index, ok := ctx.Value(passthroughKey{}).(int32); ok {
+		// The whole hash is used, as that of keyID is short enough to collide.
+		sum := sha256.Sum256([]byte(clientKey(index)))
+		return "gemini:" + hex.EncodeToString(sum[:])
+	}
+	return ""
+}
+
+// expireBatches removes the batches and files that have expired. batchesMu
+// must be held.
+func expireBatches(now time.Time) {
+	for id, file := range batchFiles {
+		if now.Unix() >= file.file.ExpiresAt {
+			delete(batchFiles, id)
+		}
+	}
+	batchOrder = slices.DeleteFunc(batchOrder, func(id string) bool {
+		job := batchJobs[id]
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		if job.doneAt.IsZero() || now.Before(job.doneAt.Add(batchCompletionWindow)) {
+			return false
+		}
+		delete(batchJobs, id)
+		return true
+	})
+}
+
+func (j *batchJob) snapshot() *openai.BatchResponse {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	batch := *j.batch
+	requestCounts := *j.batch.RequestCounts
+	batch.RequestCounts = &requestCounts
+	return &batch
+}
+
+func (j *batchJob) update(f func(batch *openai.BatchResponse)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(j.batch)
+}
+
+func storeBatchFile(owner string, filename string, purpose string, data []byte) *openai.FileResponse {
+	now := time.Now()
+	file := &openai.FileResponse{
+		ID:        openai.NewID("file-"),
+		Object:    "file",
+		Bytes:     int64(len(data)),
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(batchCompletionWindow).Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+		Status:    "processed",
+	}
+	batchesMu.Lock()
+	defer batchesMu.Unlock()
+	expireBatches(now)
+	batchFiles[file.ID] = &batchFile{owner: owner, file: file, data: data}
+	return file
+}
+
+// loadBatchFile returns the batch file with an ID, if it belongs to owner.
+func loadBatchFile(owner string, id string) (*batchFile, bool) {
+	batchesMu.Lock()
+	defer batchesMu.Unlock()
+	expireBatches(time.Now())
+	file, ok := batchFiles[id]
+	if !ok || file.owner != owner {
+		return nil, false
+	}
+	return file, ok
+}
+
+// ownedBatchFiles returns the batch files that belong to owner.
+func ownedBatchFiles(owner string) []*openai.FileResponse {
+	batchesMu.Lock()
+	defer batchesMu.Unlock()
+	expireBatches(time.Now())
+	var files []*openai.FileResponse
+	for _, file := range batchFiles {
+		if file.owner == owner {
+			files = append(files, file.file)
+		}
+	}
+	return files
+}
+
+// deleteBatchFile deletes a batch file.
+func deleteBatchFile(id string) {
+	batchesMu.Lock()
+	defer batchesMu.Unlock()
+	delete(batchFiles, id)
+}
+
+func batchesHandler(w http.ResponseWriter, r *http.Request) {
+	requestLogger := requestLog(r)
+
+	switch r.Method {
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+			return
+		}
+
+		var openAIReq openai.BatchRequest
+		err = json.Unmarshal(body, &openAIReq)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+			return
+		}
+
+		owner := batchOwner(r.Context())
+		inputFile, ok := loadBatchFile(owner, openAIReq.InputFileID)
+		switch {
+		case !ok:
+			err = errors.Errorf("no batch file found with id %s, input files must be uploaded with purpose batch", openAIReq.InputFileID)
+		case batchEndpoints[openAIReq.Endpoint] == nil:
+			err = errors.Errorf("unsupported endpoint: %s", openAIReq.Endpoint)
+		case openAIReq.CompletionWindow != "24h":
+			err = errors.Errorf("unsupported completion_window: %s", openAIReq.CompletionWindow)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			noteError(r.Context(), errors.Wrap(err, "invalid batch request"))
+			return
+		}
+
+		now := time.Now()
+		// Batches outlive their request, but keep the Gemini API key it presented.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), batchCompletionWindow)
+		job := &batchJob{
+			owner: owner,
+			batch: &openai.BatchResponse{
+				ID:               openai.NewID("batch_"),
+				Object:           "batch",
+				Endpoint:         openAIReq.Endpoint,
+				InputFileID:      openAIReq.InputFileID,
+				CompletionWindow: openAIReq.CompletionWindow,
+				Status:           "validating",
+				CreatedAt:        now.Unix(),
+				ExpiresAt:        genai.Ptr(now.Add(batchCompletionWindow).Unix()),
+				RequestCounts:    &openai.BatchRequestCounts{},
+				Metadata:         openAIReq.Metadata,
+			},
+			cancel: cancel,
+		}
+		batchesMu.Lock()
+		batchJobs[job.batch.ID] = job
+		batchOrder = append(batchOrder, job.batch.ID)
+		batchesMu.Unlock()
+		requestLogger.Info().Str("batch", job.batch.ID).Str("endpoint", openAIReq.Endpoint).Msg("Processing request")
+
+		// The client of a key the request presented is held until the batch is
+		// done, so that it is not closed while the batch uses it.
+		index, passthrough := ctx.Value(passthroughKey{}).(int32)
+		if passthrough {
+			startClient(index)
+		}
+		go func() {
+			runBatch(ctx, job, inputFile.data)
+			if passthrough {
+				doneClient(index)
+			}
+		}()
+
+		writeJSON(w, r, job.snapshot())
+	case http.MethodGet:
+		openAIResp := &openai.BatchListResponse{
+			Object: "list",
+			Data:   []*openai.BatchResponse{},
+		}
+		owner := batchOwner(r.Context())
+		batchesMu.Lock()
+		expireBatches(time.Now())
+		// Batches are listed newest first.
+		for i := len(batchOrder) - 1; i >= 0; i-- {
+			if job := batchJobs[batchOrder[i]]; job.owner == owner {
+				openAIResp.Data = append(openAIResp.Data, job.snapshot())
+			}
+		}
+		batchesMu.Unlock()
+		if len(openAIResp.Data) > 0 {
+			openAIResp.FirstID = &openAIResp.Data[0].ID
+			openAIResp.LastID = &openAIResp.Data[len(openAIResp.Data)-1].ID
+		}
+
+		writeJSON(w, r, openAIResp)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, ok := findBatchJob(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, r, job.snapshot())
+}
+
+func batchCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, ok := findBatchJob(w, r)
+	if !ok {
+		return
+	}
+
+	job.update(func(batch *openai.BatchResponse) {
+		if batch.Status == "validating" || batch.Status == "in_progress" {
+			batch.Status = "cancelling"
+			batch.CancellingAt = genai.Ptr(time.Now().Unix())
+			job.cancel()
+		}
+	})
+
+	writeJSON(w, r, job.snapshot())
+}
+
+// findBatchJob returns the batch named in the request path, writing a 404 if
+// there is none that belongs to the request's owner.
+func findBatchJob(w http.ResponseWriter, r *http.Request) (*batchJob, bool) {
+	batchesMu.Lock()
+	expireBatches(time.Now())
+	job, ok := batchJobs[r.PathValue("id")]
+	batchesMu.Unlock()
+	ok = ok && job.owner == batchOwner(r.Context())
+	if !ok {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "No batch found with id "+r.PathValue("id"))
+	}
+	return job, ok
+}
+
+func runBatch(ctx context.Context, job *batchJob, input []byte) {
+	defer job.cancel()
+	// The ID never changes, so it is safe to read without the lock.
+	batchLogger := log.With().Str("batch", job.batch.ID).Logger()
+	endpoint := job.snapshot().Endpoint
+
+	lines, batchErrors := parseBatchInput(input, endpoint)
+	if len(batchErrors) > 0 {
+		job.update(func(batch *openai.BatchResponse) {
+			batch.Status = "failed"
+			batch.FailedAt = genai.Ptr(time.Now().Unix())
+			batch.Errors = &openai.BatchErrors{Object: "list", Data: batchErrors}
+		})
+		batchLogger.Error().Int("errors", len(batchErrors)).Msg("Batch failed validation")
+		return
+	}
+	job.update(func(batch *openai.BatchResponse) {
+		batch.Status = "in_progress"
+		batch.InProgressAt = genai.Ptr(time.Now().Unix())
+		batch.RequestCounts.Total = len(lines)
+	})
+
+	outputs := make([]*openai.BatchOutputLine, len(lines))
+	semaphore := make(chan struct{}, BatchConcurrency)
+	var wg sync.WaitGroup
+	for i, line := range lines {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			outputs[i] = runBatchRequest(ctx, batchEndpoints[endpoint], line)
+			job.update(func(batch *openai.BatchResponse) {
+				if outputs[i].Response.StatusCode < http.StatusBadRequest {
+					batch.RequestCounts.Completed++
+				} else {
+					batch.RequestCounts.Failed++
+				}
+			})
+		}()
+	}
+	wg.Wait()
+
+	job.update(func(batch *openai.BatchResponse) {
+		if batch.Status == "in_progress" {
+			batch.Status = "finalizing"
+			batch.FinalizingAt = genai.Ptr(time.Now().Unix())
+		}
+	})
+
+	// Successful responses go to the output file and failed ones to the error file.
+	var output, errorOutput bytes.Buffer
+	for _, line := range outputs {
+		if line == nil {
+			continue
+		}
+		// line was built from valid JSON, so it always encodes.
+		data, _ := json.Marshal(line)
+		if line.Response.StatusCode < http.StatusBadRequest {
+			output.Write(append(data, '\n'))
+		} else {
+			errorOutput.Write(append(data, '\n'))
+		}
+	}
+
+	var outputFileID, errorFileID *string
+	if output.Len() > 0 {
+		outputFileID = &storeBatchFile(job.owner, fmt.Sprintf("%s_output.jsonl", job.batch.ID), "batch_output", output.Bytes()).ID
+	}
+	if errorOutput.Len() > 0 {
+		errorFileID = &storeBatchFile(job.owner, fmt.Sprintf("%s_error.jsonl", job.batch.ID), "batch_output", errorOutput.Bytes()).ID
+	}
+
+	job.update(func(batch *openai.BatchResponse) {
+		batch.OutputFileID = outputFileID
+		batch.ErrorFileID = errorFileID
+		job.doneAt = time.Now()
+		now := job.doneAt.Unix()
+		switch {
+		case batch.Status == "cancelling":
+			batch.Status = "cancelled"
+			batch.CancelledAt = &now
+		case ctx.Err() != nil:
+			batch.Status = "expired"
+			batch.ExpiredAt = &now
+		default:
+			batch.Status = "completed"
+			batch.CompletedAt = &now
+		}
+		batchLogger.Info().
+			Str("status", batch.Status).
+			Int("completed", batch.RequestCounts.Completed).
+			Int("failed", batch.RequestCounts.Failed).
+			Msg("Batch finished")
+	})
+}
+
+// parseBatchInput parses the lines of a batch input file, returning an error
+// for each line that cannot be run.
+func parseBatchInput(input []byte, endpoint string) ([]*openai.BatchInputLine, []*openai.BatchError) {
+	var lines []*openai.BatchInputLine
+	var batchErrors []*openai.BatchError
+	customIDs := map[string]bool{}
+	for i, data := range bytes.Split(input, []byte("\n")) {
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		lineNumber := i + 1
+		var line openai.BatchInputLine
+		var body struct {
+			Stream bool `json:"stream"`
+		}
+		var err error
+		switch {
+		case json.Unmarshal(data, &line) != nil:
+			err = errors.New("line is not valid JSON")
+		case line.CustomID == "":
+			err = errors.New("custom_id is required")
+		case customIDs[line.CustomID]:
+			err = errors.Errorf("duplicate custom_id: %s", line.CustomID)
+		case line.Method != http.MethodPost:
+			err = errors.Errorf("unsupported method: %s", line.Method)
+		case line.URL != endpoint:
+			err = errors.Errorf("url %s does not match the batch endpoint %s", line.URL, endpoint)
+		case json.Unmarshal(line.Body, &body) != nil:
+			err = errors.New("body must be a JSON object")
+		case body.Stream:
+			err = errors.New("streaming is not supported in batches")
+		}
+		if err != nil {
+			batchErrors = append(batchErrors, &openai.BatchError{
+				Code:    "invalid_request",
+				Message: err.Error(),
+				Line:    &lineNumber,
+			})
+			continue
+		}
+		customIDs[line.CustomID] = true
+		lines = append(lines, &line)
+	}
+	if len(lines) == 0 && len(batchErrors) == 0 {
+		batchErrors = append(batchErrors, &openai.BatchError{
+			Code:    "empty_file",
+			Message: "the input file contains no requests",
+		})
+	}
+	return lines, batchErrors
+}
+
+// runBatchRequest runs a single batch request through its endpoint handler,
+// retrying with backoff while it is rate limited or fails upstream.
+func runBatchRequest(ctx context.Context, handler http.HandlerFunc, line *openai.BatchInputLine) *openai.BatchOutputLine {
+	var recorder *batchResponseRecorder
+	for attempt := range batchMaxAttempts {
+		if attempt > 0 {
+			select {
+			case <-time.After(batchRetryDelay << (attempt - 1)):
+			case <-ctx.Done():
+			}
+		}
+		recorder = &batchResponseRecorder{header: http.Header{}}
+		// Each request notes its own error, as that of the batch is logged.
+		info := &requestInfo{id: requestID(ctx), client: -1}
+		r, err := http.NewRequestWithContext(context.WithValue(ctx, requestInfoContextKey{}, info), line.Method, line.URL, bytes.NewReader(line.Body))
+		if err != nil {
+			recorder.WriteHeader(http.StatusInternalServerError)
+			_, _ = recorder.Write([]byte(err.Error()))
+			break
+		}
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("User-Agent", "batch")
+		handler(recorder, r)
+		if info.err != nil {
+			log.
+				Error().
+				Err(info.err).
+				Str("request-id", info.id).
+				Str("custom-id", line.CustomID).
+				Int("status-code", recorder.statusCode).
+				Msg("Batch request failed")
+		}
+		if recorder.statusCode != http.StatusTooManyRequests && recorder.statusCode < http.StatusInternalServerError {
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	body := recorder.body.Bytes()
+	if !json.Valid(body) {
+		// Plain text errors are wrapped in an OpenAI error body.
+		body, _ = json.Marshal(&openai.ErrorResponse{Error: &openai.Error{
+			Message: string(bytes.TrimSpace(body)),
+			Type:    "server_error",
+		}})
+	}
+	return &openai.BatchOutputLine{
+		ID:       openai.NewID("batch_req_"),
+		CustomID: line.CustomID,
+		Response: &openai.BatchOutputResponse{
+			StatusCode: recorder.statusCode,
+			RequestID:  openai.NewID("req_"),
+			Body:       body,
+		},
+	}
+}
+
+// batchResponseRecorder captures the response of a handler run for a batch request.
+type batchResponseRecorder struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *batchResponseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *batchResponseRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+}
+
+func (r *batchResponseRecorder) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(data)
+}
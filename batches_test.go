@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBatchInput(t *testing.T) {
+	line := func(customID string, method string, url string, body string) string {
+		return `{"custom_id": "` + customID + `", "method": "` + method + `", "url": "` + url + `", "body": ` + body + `}`
+	}
+	for _, tc := range []struct {
+		name       string
+		input      []string
+		wantLines  []string
+		wantErrors []string
+	}{
+		{
+			name: "valid",
+			input: []string{
+				line("a", "POST", openAIEmbeddingsEndpoint, `{"input": "a"}`),
+				"",
+				line("b", "POST", openAIEmbeddingsEndpoint, `{"input": "b"}`),
+			},
+			wantLines: []string{"a", "b"},
+		},
+		{
+			name: "duplicate custom_id",
+			input: []string{
+				line("a", "POST", openAIEmbeddingsEndpoint, `{"input": "a"}`),
+				line("a", "POST", openAIEmbeddingsEndpoint, `{"input": "b"}`),
+			},
+			wantLines:  []string{"a"},
+			wantErrors: []string{"2: duplicate custom_id: a"},
+		},
+		{
+			name:       "missing custom_id",
+			input:      []string{line("", "POST", openAIEmbeddingsEndpoint, `{}`)},
+			wantErrors: []string{"1: custom_id is required"},
+		},
+		{
+			name:       "method",
+			input:      []string{line("a", "GET", openAIEmbeddingsEndpoint, `{}`)},
+			wantErrors: []string{"1: unsupported method: GET"},
+		},
+		{
+			name:       "other endpoint",
+			input:      []string{line("a", "POST", openAIChatCompletionsEndpoint, `{}`)},
+			wantErrors: []string{"1: url /v1/chat/completions does not match the batch endpoint /v1/embeddings"},
+		},
+		{
+			name:       "body that is not an object",
+			input:      []string{line("a", "POST", openAIEmbeddingsEndpoint, `"a"`)},
+			wantErrors: []string{"1: body must be a JSON object"},
+		},
+		{
+			name:       "stream",
+			input:      []string{line("a", "POST", openAIEmbeddingsEndpoint, `{"stream": true}`)},
+			wantErrors: []string{"1: streaming is not supported in batches"},
+		},
+		{
+			name:       "invalid JSON",
+			input:      []string{"{"},
+			wantErrors: []string{"1: line is not valid JSON"},
+		},
+		{
+			name:       "empty",
+			input:      []string{"", " "},
+			wantErrors: []string{"0: the input file contains no requests"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lines, batchErrors := parseBatchInput([]byte(strings.Join(tc.input, "\n")), openAIEmbeddingsEndpoint)
+			var customIDs []string
+			for _, line := range lines {
+				customIDs = append(customIDs, line.CustomID)
+			}
+			if strings.Join(customIDs, ",") != strings.Join(tc.wantLines, ",") {
+				t.Errorf("lines %q, want %q", customIDs, tc.wantLines)
+			}
+			var errs []string
+			for _, batchError := range batchErrors {
+				lineNumber := 0
+				if batchError.Line != nil {
+					lineNumber = *batchError.Line
+				}
+				errs = append(errs, strconv.Itoa(lineNumber)+": "+batchError.Message)
+			}
+			if strings.Join(errs, "\n") != strings.Join(tc.wantErrors, "\n") {
+				t.Errorf("errors %q, want %q", errs, tc.wantErrors)
+			}
+		})
+	}
+}
+
+func TestBatchCancelledMidRun(t *testing.T) {
+	const endpoint = "/v1/test"
+	// The request runs until the batch is cancelled.
+	started := make(chan struct{}, 1)
+	batchEndpoints[endpoint] = func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+		writeError(w, http.StatusBadRequest, "invalid_request_error", r.Context().Err().Error())
+	}
+	defer delete(batchEndpoints, endpoint)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &batchJob{
+		batch: &openai.BatchResponse{
+			ID:            openai.NewID("batch_"),
+			Endpoint:      endpoint,
+			Status:        "validating",
+			RequestCounts: &openai.BatchRequestCounts{},
+		},
+		cancel: cancel,
+	}
+	batchesMu.Lock()
+	batchJobs[job.batch.ID] = job
+	batchOrder = append(batchOrder, job.batch.ID)
+	batchesMu.Unlock()
+
+	input := `{"custom_id": "a", "method": "POST", "url": "/v1/test", "body": {}}`
+	done := make(chan struct{})
+	go func() {
+		runBatch(ctx, job, []byte(input))
+		close(done)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch request did not start")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/batches/"+job.batch.ID+"/cancel", nil)
+	r.SetPathValue("id", job.batch.ID)
+	w := httptest.NewRecorder()
+	batchCancelHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("cancel status %d: %s", w.Code, w.Body)
+	}
+	if status := job.snapshot().Status; status != "cancelling" {
+		t.Errorf("status %s after cancel, want cancelling", status)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch did not finish after cancel")
+	}
+	batch := job.snapshot()
+	if batch.Status != "cancelled" {
+		t.Errorf("status %s, want cancelled", batch.Status)
+	}
+	if batch.CancellingAt == nil || batch.CancelledAt == nil {
+		t.Errorf("cancelling_at %v, cancelled_at %v, want both set", batch.CancellingAt, batch.CancelledAt)
+	}
+	if batch.RequestCounts.Total != 1 || batch.RequestCounts.Failed != 1 {
+		t.Errorf("request counts %+v, want 1 failed of 1", batch.RequestCounts)
+	}
+	if batch.ErrorFileID == nil {
+		t.Error("no error file for the cancelled request")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// limitedBody is a request body limited by http.MaxBytesReader, which records
+// whether the limit was exceeded.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// bodyLimitHandler rejects requests with bodies over MaxRequestBodySize with a
+// 413, before they are handled by next if they declare their length. Uploads
+// to the files endpoint have the File API's limit instead.
+func bodyLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if MaxRequestBodySize == 0 || r.URL.Path == openAIFilesEndpoint {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > MaxRequestBodySize {
+			writeBodyTooLarge(w, r)
+			return
+		}
+		body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, MaxRequestBodySize)}
+		r.Body = body
+		// Handlers reject bodies they fail to read as bad requests.
+		next.ServeHTTP(&errorOverrideWriter{statusWriter: statusWriter{ResponseWriter: w}, override: func(w http.ResponseWriter, status int) bool {
+			if status < http.StatusBadRequest || !body.exceeded {
+				return false
+			}
+			writeBodyTooLarge(w, r)
+			return true
+		}}, r)
+	})
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request) {
+	code := "request_too_large"
+	writeErrorResponse(w, http.StatusRequestEntityTooLarge, &openai.Error{
+		Message: "The request body is larger than the limit of " + strconv.FormatInt(MaxRequestBodySize, 10) + " bytes",
+		Type:    "invalid_request_error",
+		Code:    &code,
+	})
+	noteError(r.Context(), errors.Errorf("request body of %d bytes is too large", r.ContentLength))
+}
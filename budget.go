@@ -0,0 +1,199 @@
+package main
+
+import (
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	// Gemini's daily quotas reset at midnight Pacific time, which needs the
+	// time zone database even where the system has none.
+	_ "time/tzdata"
+)
+
+var pacificTime = mustLoadLocation("America/Los_Angeles")
+
+func mustLoadLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return location
+}
+
+// keyLimits are the budgets of a key, in requests per minute and per day.
+// Zero is unlimited.
+type keyLimits struct {
+	rpm int
+	rpd int
+}
+
+// parseKeyLimits parses the rpm and rpd budgets of a key, keeping those of
+// defaults that are not given.
+func parseKeyLimits(query url.Values, defaults keyLimits) (keyLimits, error) {
+	limits := defaults
+	for name, limit := range map[string]*int{"rpm": &limits.rpm, "rpd": &limits.rpd} {
+		if !query.Has(name) {
+			continue
+		}
+		v, err := strconv.Atoi(query.Get(name))
+		if err != nil || v < 0 {
+			return keyLimits{}, errors.Errorf("%s must be a non-negative integer", name)
+		}
+		*limit = v
+	}
+	return limits, nil
+}
+
+// keyBudget counts the requests to Gemini with a key, in minutes from the
+// first request of each, and in days from midnight Pacific time, as Gemini's
+// quotas are.
+type keyBudget struct {
+	mu          sync.Mutex
+	limits      keyLimits
+	minute      time.Time
+	minuteCount int
+	day         time.Time
+	dayCount    int
+}
+
+func (b *keyBudget) setLimits(limits keyLimits) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limits = limits
+}
+
+// roll starts new windows for the budget if the current ones have ended.
+func (b *keyBudget) roll(now time.Time) {
+	if now.Sub(b.minute) >= time.Minute {
+		b.minute, b.minuteCount = now, 0
+	}
+	if day := startOfPacificDay(now); !day.Equal(b.day) {
+		b.day, b.dayCount = day, 0
+	}
+}
+
+// take counts a request against the budget.
+func (b *keyBudget) take(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(now)
+	b.minuteCount++
+	b.dayCount++
+}
+
+// exhaustedUntil returns when the budget has requests again if it is
+// exhausted, or the zero time otherwise.
+func (b *keyBudget) exhaustedUntil(now time.Time) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(now)
+	var until time.Time
+	if b.limits.rpd > 0 && b.dayCount >= b.limits.rpd {
+		until = startOfPacificDay(now).AddDate(0, 0, 1)
+	}
+	if b.limits.rpm > 0 && b.minuteCount >= b.limits.rpm && until.IsZero() {
+		until = b.minute.Add(time.Minute)
+	}
+	return until
+}
+
+// state returns the tightest of the budget's limits, or false if it has none.
+func (b *keyBudget) state(now time.Time) (rateLimit, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(now)
+	var limit rateLimit
+	ok := false
+	if b.limits.rpm > 0 {
+		limit, ok = rateLimit{limit: b.limits.rpm, remaining: max(0, b.limits.rpm-b.minuteCount), reset: b.minute.Add(time.Minute).Sub(now)}, true
+	}
+	if b.limits.rpd > 0 {
+		day := rateLimit{limit: b.limits.rpd, remaining: max(0, b.limits.rpd-b.dayCount), reset: startOfPacificDay(now).AddDate(0, 0, 1).Sub(now)}
+		limit, ok = tighterRateLimit(limit, ok, day), true
+	}
+	return limit, ok
+}
+
+func startOfPacificDay(t time.Time) time.Time {
+	t = t.In(pacificTime)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, pacificTime)
+}
+
+// exhaustedUntil returns when the first key of group g has requests again if
+// all of them are out of budget, or the zero time otherwise.
+func (p *keyPool) exhaustedUntil(g *keyGroup, now time.Time) time.Time {
+	var until time.Time
+	for i := range p.keys {
+		if !g.active(i) {
+			continue
+		}
+		keyUntil := p.budgets[i].exhaustedUntil(now)
+		if keyUntil.IsZero() {
+			return time.Time{}
+		}
+		if until.IsZero() || keyUntil.Before(until) {
+			until = keyUntil
+		}
+	}
+	return until
+}
+
+// state returns the sum of the limits of the active keys of group g, or false
+// if any of them is unlimited. It resets when the first key's does.
+func (p *keyPool) state(g *keyGroup, now time.Time) (rateLimit, bool) {
+	var sum rateLimit
+	ok := false
+	for i := range p.keys {
+		if !g.active(i) {
+			continue
+		}
+		limit, limited := p.budgets[i].state(now)
+		if !limited {
+			return rateLimit{}, false
+		}
+		if !ok || limit.reset < sum.reset {
+			sum.reset = limit.reset
+		}
+		sum.limit += limit.limit
+		sum.remaining += limit.remaining
+		ok = true
+	}
+	return sum, ok
+}
+
+// keyBudgetHandler rejects requests with a 429 while all keys are out of
+// budget, before they are handled by next, with a Retry-After of when the
+// first key has requests again. Requests with their own key are not rejected.
+// Responses have the rate limit headers of the keys and the request's virtual key.
+func keyBudgetHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(passthroughKey{}).(int32); ok || metricsRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pool := keys()
+		g := pool.group(r.Context())
+		now := time.Now()
+		vk, _ := r.Context().Value(virtualKeyContextKey{}).(*virtualKey)
+		setRateLimitHeaders(w.Header(), vk, pool, g, now)
+		until := pool.exhaustedUntil(g, now)
+		if until.IsZero() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		code := "rate_limit_exceeded"
+		writeErrorResponse(w, http.StatusTooManyRequests, &openai.Error{
+			Message: "All Gemini API keys are out of their request budgets, retry after " + strconv.Itoa(retryAfter) + " seconds",
+			Type:    "requests",
+			Code:    &code,
+		})
+		noteError(r.Context(), errors.New("Gemini API keys are out of budget"))
+	})
+}
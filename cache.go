@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	embeddingCacheHits   = newCounter("gemini_proxy_embedding_cache_hits_total", "Embedding inputs served from the cache.")
+	embeddingCacheMisses = newCounter("gemini_proxy_embedding_cache_misses_total", "Embedding inputs not found in the cache.")
+)
+
+// embeddingCache caches embeddings keyed by openai.EmbeddingInputKeys.
+type embeddingCache interface {
+	// get returns the cached embedding of each key, nil where there is none.
+	get(keys []string) [][]float32
+	set(keys []string, values [][]float32)
+}
+
+// lruEmbeddingCache is an in-memory embeddingCache that evicts the least
+// recently used embeddings.
+type lruEmbeddingCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEmbeddingCacheEntry struct {
+	key     string
+	values  []float32
+	expires time.Time
+}
+
+func newLRUEmbeddingCache(size int, ttl time.Duration) *lruEmbeddingCache {
+	return &lruEmbeddingCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (c *lruEmbeddingCache) get(keys []string) [][]float32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make([][]float32, len(keys))
+	for i, key := range keys {
+		element, ok := c.entries[key]
+		if !ok {
+			continue
+		}
+		entry := element.Value.(*lruEmbeddingCacheEntry)
+		if c.ttl > 0 && time.Now().After(entry.expires) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+			continue
+		}
+		c.order.MoveToFront(element)
+		values[i] = entry.values
+	}
+	return values
+}
+
+func (c *lruEmbeddingCache) set(keys []string, values [][]float32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, key := range keys {
+		entry := &lruEmbeddingCacheEntry{key: key, values: values[i], expires: time.Now().Add(c.ttl)}
+		if element, ok := c.entries[key]; ok {
+			element.Value = entry
+			c.order.MoveToFront(element)
+			continue
+		}
+		c.entries[key] = c.order.PushFront(entry)
+	}
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEmbeddingCacheEntry).key)
+	}
+}
+
+// redisEmbeddingCache is an embeddingCache in Redis, so that replicas of the
+// proxy share embeddings and keep them across restarts. Redis errors are
+// logged and treated as misses.
+type redisEmbeddingCache struct {
+	client *redisClient
+	ttl    time.Duration
+}
+
+const redisEmbeddingCachePrefix = "gemini-to-openai-proxy:embedding:"
+
+func (c *redisEmbeddingCache) get(keys []string) [][]float32 {
+	values := make([][]float32, len(keys))
+	args := []string{"MGET"}
+	for _, key := range keys {
+		args = append(args, redisEmbeddingCachePrefix+key)
+	}
+	reply, err := c.client.do(args...)
+	if err != nil {
+		log.Warn().Err(errors.Wrap(err, "failed to get cached embeddings")).Msg("")
+		return values
+	}
+	replies, _ := reply.([]interface{})
+	for i, reply := range replies {
+		if data, ok := reply.(string); ok && i < len(values) {
+			values[i] = decodeEmbedding(data)
+		}
+	}
+	return values
+}
+
+func (c *redisEmbeddingCache) set(keys []string, values [][]float32) {
+	for i, key := range keys {
+		args := []string{"SET", redisEmbeddingCachePrefix + key, encodeEmbedding(values[i])}
+		if c.ttl > 0 {
+			args = append(args, "PX", strconv.FormatInt(c.ttl.Milliseconds(), 10))
+		}
+		if _, err := c.client.do(args...); err != nil {
+			log.Warn().Err(errors.Wrap(err, "failed to cache embedding")).Msg("")
+			return
+		}
+	}
+}
+
+// encodeEmbedding packs an embedding as little-endian float32s.
+func encodeEmbedding(values []float32) string {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(v))
+	}
+	return string(b)
+}
+
+func decodeEmbedding(data string) []float32 {
+	values := make([]float32, len(data)/4)
+	for i := range values {
+		values[i] = math.Float32frombits(binary.LittleEndian.Uint32([]byte(data[4*i:])))
+	}
+	return values
+}
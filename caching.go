@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Cached contents belong to the project of the key that created them, so
+// remember which client owns each one.
+var cachedContentClients sync.Map
+
+// findCachedContentClient returns the index of the client that owns the named
+// cached content, asking each client in turn if it is not already known.
+func findCachedContentClient(ctx context.Context, name string) (int32, error) {
+	clients := requestClients(ctx)
+	if index, ok := cachedContentClients.Load(name); ok && slices.Contains(clients, index.(int32)) {
+		return index.(int32), nil
+	}
+	lastErr := errors.Errorf("no client can use %s", name)
+	for _, i := range clients {
+		_, err := geminiClient(i).GetCachedContent(ctx, name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		cachedContentClients.Store(name, i)
+		return i, nil
+	}
+	return 0, lastErr
+}
+
+func cachedContentsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+			return
+		}
+
+		var openAIReq openai.CachedContentRequest
+		err = json.Unmarshal(body, &openAIReq)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+			return
+		}
+
+		cachedContent, err := openai.ConvertOpenAICachedContentRequestToGemini(&openAIReq)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			noteError(r.Context(), errors.Wrap(err, "failed to convert OpenAI request to Gemini request"))
+			return
+		}
+
+		useIndex, err := nextClient(r.Context())
+		if err != nil {
+			writeNoKeyAvailable(w, r, err)
+			return
+		}
+		defer doneClient(useIndex)
+		noteRequest(r.Context(), openAIReq.Model, useIndex)
+
+		cachedContent, err = geminiClient(useIndex).CreateCachedContent(r.Context(), cachedContent)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			noteError(r.Context(), errors.Wrap(err, "failed to create cached content"))
+			return
+		}
+		cachedContentClients.Store(cachedContent.Name, useIndex)
+
+		writeJSON(w, r, openai.ConvertGeminiCachedContentToOpenAI(cachedContent))
+	case http.MethodGet:
+		openAIResp := &openai.CachedContentListResponse{
+			Object: "list",
+			Data:   []*openai.CachedContentResponse{},
+		}
+		for _, i := range requestClients(r.Context()) {
+			iter := geminiClient(i).ListCachedContents(r.Context())
+			for {
+				cachedContent, err := iter.Next()
+				if err == iterator.Done {
+					break
+				}
+				if err != nil {
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					noteError(r.Context(), errors.Wrap(err, "failed to list cached contents"))
+					return
+				}
+				cachedContentClients.Store(cachedContent.Name, i)
+				openAIResp.Data = append(openAIResp.Data, openai.ConvertGeminiCachedContentToOpenAI(cachedContent))
+			}
+		}
+
+		writeJSON(w, r, openAIResp)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func cachedContentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := openai.CachedContentName(r.PathValue("id"))
+	useIndex, err := findCachedContentClient(r.Context(), name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "No cached content found with id "+openai.CachedContentID(name))
+		noteError(r.Context(), errors.Wrap(err, "failed to find cached content"))
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		err = geminiClient(useIndex).DeleteCachedContent(r.Context(), name)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			noteError(r.Context(), errors.Wrap(err, "failed to delete cached content"))
+			return
+		}
+		cachedContentClients.Delete(name)
+
+		writeJSON(w, r, &openai.DeleteResponse{
+			ID:      openai.CachedContentID(name),
+			Object:  "cached_content",
+			Deleted: true,
+		})
+		return
+	}
+
+	cachedContent, err := geminiClient(useIndex).GetCachedContent(r.Context(), name)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to get cached content"))
+		return
+	}
+
+	writeJSON(w, r, openai.ConvertGeminiCachedContentToOpenAI(cachedContent))
+}
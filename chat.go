@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func chatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	requestLogger := requestLog(r)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+		return
+	}
+
+	var openAIReq openai.ChatCompletionRequest
+	err = json.Unmarshal(body, &openAIReq)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+		return
+	}
+
+	useIndex, err := chatClient(r.Context(), &openAIReq)
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	noteRequest(r.Context(), openAIReq.Model, useIndex)
+
+	generativeModel := geminiClient(useIndex).GenerativeModel(openAIReq.Model)
+	generativeModel.SafetySettings = defaultSafetySettings
+
+	session, parts, err := openai.ConvertOpenAIChatRequestToGemini(&openAIReq, generativeModel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert OpenAI request to Gemini request"))
+		return
+	}
+
+	if openAIReq.Seed != nil {
+		// The genai SDK cannot send a seed, so generations are not reproducible.
+		requestLogger.Warn().Int64("seed", *openAIReq.Seed).Msg("Ignoring seed, which is not supported")
+	}
+	fingerprint := systemFingerprint(openAIReq.Model)
+
+	id := openai.NewID("chatcmpl-")
+	created := time.Now().Unix()
+
+	if openAIReq.Stream {
+		stream := generateChatContentStream(r.Context(), generativeModel, session, parts, openAIReq.N)
+		var usage func(*genai.UsageMetadata) interface{}
+		if openAIReq.StreamOptions != nil && openAIReq.StreamOptions.IncludeUsage {
+			usage = func(usageMetadata *genai.UsageMetadata) interface{} {
+				chunk := openai.ConvertGeminiUsageToOpenAIStreamChunk(usageMetadata, id, created, openAIReq.Model)
+				chunk.SystemFingerprint = fingerprint
+				return chunk
+			}
+		}
+		converter := streamConverter{
+			chunk: func(geminiResp *genai.GenerateContentResponse) []serverSentEvent {
+				chunk := openai.ConvertGeminiChatStreamResponseToOpenAI(geminiResp, id, created, openAIReq.Model)
+				chunk.SystemFingerprint = fingerprint
+				return []serverSentEvent{{data: chunk}}
+			},
+			finish: chatStreamFinish(usage),
+		}
+		streamGeminiResponses(w, r, stream, converter)
+		return
+	}
+
+	geminiResp, err := generateChatContent(r.Context(), generativeModel, session, parts, openAIReq.N)
+	var blockedErr *genai.BlockedError
+	if errors.As(err, &blockedErr) {
+		var openAIErr *openai.Error
+		geminiResp, openAIErr = openai.ConvertGeminiBlockedErrorToOpenAI(blockedErr)
+		if openAIErr != nil {
+			writeErrorResponse(w, http.StatusBadRequest, openAIErr)
+			noteError(r.Context(), errors.Wrap(err, "generation was blocked"))
+			return
+		}
+		err = nil
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to generate content"))
+		return
+	}
+
+	openAIResp := openai.ConvertGeminiChatResponseToOpenAI(geminiResp, id, created, openAIReq.Model)
+	openAIResp.SystemFingerprint = fingerprint
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(openAIResp)
+	if err != nil {
+		noteError(r.Context(), errors.Wrap(err, "failed to encode response"))
+		return
+	}
+}
+
+// systemFingerprint identifies the backend configuration serving a model, so
+// that clients can tell when generations may change for reasons other than
+// sampling. Gemini reports none, so it is derived from the model and the
+// settings of the proxy that change its generations.
+func systemFingerprint(model string) string {
+	sum := sha256.Sum256([]byte(model + "\n" + GeminiEndpoint + "\n" + GeminiSafetySettings))
+	return "fp_" + hex.EncodeToString(sum[:5])
+}
+
+// chatClient picks the client for a chat request, preferring the one that owns
+// any cached content or files it references. Like nextClient, the client must
+// be released with doneClient.
+func chatClient(ctx context.Context, openAIReq *openai.ChatCompletionRequest) (int32, error) {
+	if openAIReq.CachedContent != "" {
+		// Cached contents can only be used with the key that created them.
+		cacheIndex, err := findCachedContentClient(ctx, openai.CachedContentName(openAIReq.CachedContent))
+		if err == nil {
+			return startClient(cacheIndex), nil
+		}
+	} else if fileIDs := openai.MessageFileIDs(openAIReq.Messages); len(fileIDs) > 0 {
+		// Files can likewise only be used with the key that uploaded them.
+		fileIndex, err := findFileClient(ctx, openai.FileName(fileIDs[0]))
+		if err == nil {
+			return startClient(fileIndex), nil
+		}
+	} else if strings.HasPrefix(openAIReq.Model, "tunedModels/") {
+		// Tuned models can likewise only be used with the key that created them.
+		tunedIndex, err := findTunedModelClient(ctx, openAIReq.Model)
+		if err == nil {
+			return startClient(tunedIndex), nil
+		}
+	}
+	return nextClient(ctx)
+}
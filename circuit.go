@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+var keyCircuitOpen = newGauge("gemini_proxy_key_circuit_open", "Whether the circuit breaker of a Gemini API key is open, by key.")
+
+// circuitBreaker stops a key being given requests after KeyCircuitFailures
+// consecutive failures, for KeyCircuitCooldown. After the cooldown the key is
+// half-open: it is given requests again, and the next failure opens it again
+// while a success closes it.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+}
+
+// keyErrorReasons are the google.rpc.ErrorInfo reasons of errors with a key
+// itself, rather than with the resource or project a request names.
+var keyErrorReasons = []string{
+	"API_KEY_INVALID",
+	"API_KEY_SERVICE_BLOCKED",
+	"CONSUMER_SUSPENDED",
+	"PERMISSION_DENIED",
+	"SERVICE_DISABLED",
+}
+
+// record records the outcome of a request with a key. Requests fail if they
+// get no response, a server error, a 401, or a 400 or 403 whose reason is the
+// key itself. Other 403s, such as for files and cached contents of other
+// projects, say nothing about the key, and rate limits are left to the
+// budgets.
+func (c *circuitBreaker) record(id string, resp *http.Response, err error, now time.Time) {
+	if KeyCircuitFailures == 0 {
+		return
+	}
+	failed := err != nil || resp.StatusCode >= http.StatusInternalServerError ||
+		resp.StatusCode == http.StatusUnauthorized || keyRejected(resp)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !failed {
+		if !c.openedAt.IsZero() {
+			log.Info().Str("key", id).Msg("Circuit breaker closed")
+			keyCircuitOpen.set(0, "key", id)
+		}
+		c.failures, c.openedAt = 0, time.Time{}
+		return
+	}
+	c.failures++
+	if c.failures >= KeyCircuitFailures {
+		if c.openedAt.IsZero() {
+			log.Warn().Str("key", id).Int("failures", c.failures).Msg("Circuit breaker opened")
+			keyCircuitOpen.set(1, "key", id)
+		}
+		c.openedAt = now
+	}
+}
+
+// open reports whether the breaker is open, rather than closed or half-open.
+func (c *circuitBreaker) open(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.openedAt.IsZero() && now.Sub(c.openedAt) < KeyCircuitCooldown
+}
+
+// keyRejected reports whether a response is a 400 or 403 for the key of the
+// request, reading its error details and leaving its body to be read again.
+func keyRejected(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusForbidden {
+		return false
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	var errResp struct {
+		Error struct {
+			Details []struct {
+				Type   string `json:"@type"`
+				Reason string `json:"reason"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &errResp) != nil {
+		return false
+	}
+	for _, detail := range errResp.Error.Details {
+		if detail.Type == "type.googleapis.com/google.rpc.ErrorInfo" && slices.Contains(keyErrorReasons, detail.Reason) {
+			return true
+		}
+	}
+	return false
+}
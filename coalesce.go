@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// embeddingCoalescer buffers single-input embedding requests for
+// EmbeddingCoalesceWindow and embeds those that can share a batch together, so
+// clients that embed one text at a time use fewer upstream requests.
+type embeddingCoalescer struct {
+	mu      sync.Mutex
+	pending map[string]*coalescedEmbedding
+}
+
+type coalescedEmbedding struct {
+	// ctx carries the values, such as the tenant and request ID, of the first
+	// request to join the batch, without its cancellation, since the batch
+	// outlives the requests that joined it. It has the deadline of the first
+	// request's upstream timeout instead.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	useIndex   int32
+	openAIReqs []*openai.EmbedRequest
+	done       chan struct{}
+	resp       *genai.BatchEmbedContentsResponse
+	err        error
+}
+
+var embeddingRequestCoalescer = &embeddingCoalescer{pending: map[string]*coalescedEmbedding{}}
+
+// embed embeds the inputs of an embedding request with those of other requests
+// made within EmbeddingCoalesceWindow.
+func (c *embeddingCoalescer) embed(ctx context.Context, useIndex int32, openAIReq *openai.EmbedRequest) (*genai.BatchEmbedContentsResponse, error) {
+	key := openai.EmbeddingBatchKey(openAIReq)
+	if isPassthroughClient(useIndex) {
+		// Requests with their own key are only embedded with others that present it.
+		key = strconv.Itoa(int(useIndex)) + "/" + key
+	} else if vk, ok := ctx.Value(virtualKeyContextKey{}).(*virtualKey); ok {
+		// Likewise those of virtual keys, with others of the same key, as usage
+		// is counted against the key and tenant of the batch.
+		key = "vk:" + vk.id + "/" + key
+	}
+	c.mu.Lock()
+	batch, ok := c.pending[key]
+	if !ok {
+		// The batch holds its client, as the requests that joined it can finish first.
+		batch = &coalescedEmbedding{useIndex: startClient(useIndex), done: make(chan struct{})}
+		batch.ctx, batch.cancel = context.WithoutCancel(ctx), func() {}
+		if deadline, ok := ctx.Deadline(); ok {
+			batch.ctx, batch.cancel = context.WithDeadline(batch.ctx, deadline)
+		}
+		c.pending[key] = batch
+		time.AfterFunc(EmbeddingCoalesceWindow, func() { c.flush(key, batch) })
+	}
+	offset := 0
+	for _, pendingReq := range batch.openAIReqs {
+		offset += embedRequestInputCount(pendingReq)
+	}
+	batch.openAIReqs = append(batch.openAIReqs, openAIReq)
+	c.mu.Unlock()
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if batch.err != nil && len(batch.openAIReqs) > 1 {
+		// One request can fail the batch, such as with an invalid input, so each
+		// request is embedded on its own for a result of its own.
+		return embedInBatches(ctx, useIndex, openAIReq)
+	}
+	if batch.err != nil {
+		return nil, batch.err
+	}
+	count := embedRequestInputCount(openAIReq)
+	return &genai.BatchEmbedContentsResponse{Embeddings: batch.resp.Embeddings[offset : offset+count]}, nil
+}
+
+func (c *embeddingCoalescer) flush(key string, batch *coalescedEmbedding) {
+	c.mu.Lock()
+	delete(c.pending, key)
+	c.mu.Unlock()
+
+	batch.resp, batch.err = embedInBatches(batch.ctx, batch.useIndex, openai.MergeEmbedRequests(batch.openAIReqs))
+	batch.cancel()
+	doneClient(batch.useIndex)
+	close(batch.done)
+}
+
+func embedRequestInputCount(openAIReq *openai.EmbedRequest) int {
+	if inputs, ok := openAIReq.Input.([]interface{}); ok {
+		return len(inputs)
+	}
+	return 1
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEmbeddingCoalescer(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// failMerged makes Gemini reject requests of more than one input.
+		failMerged bool
+		wantCalls  int32
+	}{
+		{name: "merged", wantCalls: 1},
+		{name: "merged request fails", failMerged: true, wantCalls: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, ":batchEmbedContents") {
+					http.NotFound(w, r)
+					return
+				}
+				calls.Add(1)
+				var req struct {
+					Requests []struct {
+						Content struct {
+							Parts []struct {
+								Text string `json:"text"`
+							} `json:"parts"`
+						} `json:"content"`
+					} `json:"requests"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if tc.failMerged && len(req.Requests) > 1 {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte(`{"error": {"code": 400, "message": "invalid", "status": "INVALID_ARGUMENT"}}`))
+					return
+				}
+				// Each embedding is the length of its text, to tell them apart.
+				var resp struct {
+					Embeddings []map[string][]float32 `json:"embeddings"`
+				}
+				for _, embedReq := range req.Requests {
+					text := embedReq.Content.Parts[0].Text
+					resp.Embeddings = append(resp.Embeddings, map[string][]float32{"values": {float32(len(text))}})
+				}
+				_ = json.NewEncoder(w).Encode(resp)
+			}))
+			defer server.Close()
+			setTestKeyPool(t, server.URL)
+			defer func(window time.Duration) { EmbeddingCoalesceWindow = window }(EmbeddingCoalesceWindow)
+			EmbeddingCoalesceWindow = 50 * time.Millisecond
+
+			inputs := []string{"a", "bb"}
+			values := make([]float32, len(inputs))
+			errs := make([]error, len(inputs))
+			var wg sync.WaitGroup
+			for i, input := range inputs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := embeddingRequestCoalescer.embed(context.Background(), 0, &openai.EmbedRequest{Model: "text-embedding-004", Input: input})
+					if err == nil && len(resp.Embeddings) == 1 {
+						values[i] = resp.Embeddings[0].Values[0]
+					}
+					errs[i] = err
+				}()
+			}
+			wg.Wait()
+
+			for i, input := range inputs {
+				if errs[i] != nil {
+					t.Errorf("input %q: %v", input, errs[i])
+				} else if values[i] != float32(len(input)) {
+					t.Errorf("input %q: embedding %v, want %v", input, values[i], len(input))
+				}
+			}
+			if got := calls.Load(); got != tc.wantCalls {
+				t.Errorf("%d upstream calls, want %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
+
+// setTestKeyPool replaces the key pool with one of a single key sent to
+// endpoint, restoring the pool when the test finishes.
+func setTestKeyPool(t *testing.T, endpoint string) {
+	t.Helper()
+	previousPool, previousEndpoint := currentKeyPool.Load(), GeminiEndpoint
+	GeminiEndpoint = endpoint
+	pool := (*keyPool)(nil).clone()
+	if _, err := pool.add(apiKey{key: "test", weight: 1}); err != nil {
+		t.Fatal(err)
+	}
+	currentKeyPool.Store(pool)
+	t.Cleanup(func() {
+		currentKeyPool.Store(previousPool)
+		GeminiEndpoint = previousEndpoint
+		_ = pool.close()
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+)
+
+func cohereEmbedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+		return
+	}
+
+	var cohereReq openai.CohereEmbedRequest
+	err = json.Unmarshal(body, &cohereReq)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+		return
+	}
+
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	cohereReq.Model = defaultEmbeddingModel(r.Context(), useIndex, cohereReq.Model)
+	noteRequest(r.Context(), cohereReq.Model, useIndex)
+
+	embeddingModel := geminiClient(useIndex).EmbeddingModel(cohereReq.Model)
+
+	geminiBatchReq, err := openai.ConvertCohereEmbedRequestToGemini(&cohereReq, embeddingModel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert Cohere request to Gemini request"))
+		return
+	}
+
+	geminiBatchResp, err := embeddingModel.BatchEmbedContents(r.Context(), geminiBatchReq)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to batch embed contents"))
+		return
+	}
+
+	writeJSON(w, r, openai.ConvertGeminiResponseToCohereEmbed(geminiBatchResp, &cohereReq, openai.NewID("")))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func completionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	requestLogger := requestLog(r)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+		return
+	}
+
+	var openAIReq openai.CompletionRequest
+	err = json.Unmarshal(body, &openAIReq)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+		return
+	}
+
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	noteRequest(r.Context(), openAIReq.Model, useIndex)
+
+	generativeModel := geminiClient(useIndex).GenerativeModel(openAIReq.Model)
+	generativeModel.SafetySettings = defaultSafetySettings
+
+	prompts, err := openai.ConvertOpenAICompletionRequestToGemini(&openAIReq, generativeModel)
+	if err == nil && openAIReq.Stream && (len(prompts) > 1 || openAIReq.Echo) {
+		err = errors.New("streaming is only supported for a single prompt without echo")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert OpenAI request to Gemini request"))
+		return
+	}
+
+	if openAIReq.Seed != nil {
+		// The genai SDK cannot send a seed, so generations are not reproducible.
+		requestLogger.Warn().Int64("seed", *openAIReq.Seed).Msg("Ignoring seed, which is not supported")
+	}
+	fingerprint := systemFingerprint(openAIReq.Model)
+
+	id := openai.NewID("cmpl-")
+	created := time.Now().Unix()
+
+	if openAIReq.Stream {
+		var usage func(*genai.UsageMetadata) interface{}
+		if openAIReq.StreamOptions != nil && openAIReq.StreamOptions.IncludeUsage {
+			usage = func(usageMetadata *genai.UsageMetadata) interface{} {
+				chunk := openai.ConvertGeminiUsageToOpenAICompletionStreamChunk(usageMetadata, id, created, openAIReq.Model)
+				chunk.SystemFingerprint = fingerprint
+				return chunk
+			}
+		}
+		converter := streamConverter{
+			chunk: func(geminiResp *genai.GenerateContentResponse) []serverSentEvent {
+				chunk := openai.ConvertGeminiCompletionStreamResponseToOpenAI(geminiResp, id, created, openAIReq.Model)
+				chunk.SystemFingerprint = fingerprint
+				return []serverSentEvent{{data: chunk}}
+			},
+			finish: chatStreamFinish(usage),
+		}
+		streamGeminiResponses(w, r, generativeModel.GenerateContentStream(r.Context(), genai.Text(prompts[0])), converter)
+		return
+	}
+
+	geminiResps := make([]*genai.GenerateContentResponse, len(prompts))
+	errs := make([]error, len(prompts))
+	semaphore := make(chan struct{}, CompletionConcurrency)
+	var wg sync.WaitGroup
+	for i, prompt := range prompts {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			geminiResps[i], errs[i] = generativeModel.GenerateContent(r.Context(), genai.Text(prompt))
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		var blockedErr *genai.BlockedError
+		if errors.As(err, &blockedErr) {
+			var openAIErr *openai.Error
+			geminiResps[i], openAIErr = openai.ConvertGeminiBlockedErrorToOpenAI(blockedErr)
+			if openAIErr != nil {
+				writeErrorResponse(w, http.StatusBadRequest, openAIErr)
+				noteError(r.Context(), errors.Wrap(err, "generation was blocked"))
+				return
+			}
+			err = nil
+		}
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			noteError(r.Context(), errors.Wrap(err, "failed to generate content"))
+			return
+		}
+	}
+
+	openAIResp := openai.ConvertGeminiCompletionResponsesToOpenAI(geminiResps, prompts, openAIReq.N, openAIReq.Echo, id, created, openAIReq.Model)
+	openAIResp.SystemFingerprint = fingerprint
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(openAIResp)
+	if err != nil {
+		noteError(r.Context(), errors.Wrap(err, "failed to encode response"))
+		return
+	}
+}
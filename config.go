@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const (
+	// configFilePollInterval is how often the config file is checked for
+	// changes.
+	configFilePollInterval = 30 * time.Second
+)
+
+// settingNames are the names of the proxy's settings, as environment
+// variables. Each can also be set with a command-line flag, e.g. -listen-addr,
+// or in the config file, e.g. listen_addr.
+var settingNames = []string{
+	"ADMIN_API_KEY",
+	"ADMIN_LISTEN_ADDR",
+	"ADMIN_STORE_FILE",
+	"AZURE_DEPLOYMENTS",
+	"BATCH_CONCURRENCY",
+	"COHERE_API_KEY",
+	"COMPLETION_CONCURRENCY",
+	"CORS_ALLOWED_HEADERS",
+	"CORS_ALLOWED_ORIGINS",
+	"DEFAULT_EMBEDDING_MODEL",
+	"DEFAULT_EMBEDDING_MODEL_FORCE",
+	"EMBEDDING_CACHE_SIZE",
+	"EMBEDDING_CACHE_TTL",
+	"EMBEDDING_COALESCE_WINDOW",
+	"EMBEDDING_CONCURRENCY",
+	"EMBEDDING_COUNT_TOKENS",
+	"EMBEDDING_NORMALIZE",
+	"EMBEDDING_PARTIAL_FAILURES",
+	"EMBEDDING_PROVIDERS",
+	"EMBEDDING_TRUNCATE",
+	"GEMINI_API_ENDPOINT",
+	"GEMINI_API_KEY",
+	"GEMINI_API_KEY_FILE",
+	"GEMINI_API_KEY_SECRET",
+	"GEMINI_MODERATION_MODEL",
+	"GEMINI_RERANK_MODEL",
+	"GEMINI_SAFETY_SETTINGS",
+	"GEMINI_TOKEN_COUNT_MODEL",
+	"GEMINI_TRANSCRIPTION_MODEL",
+	"GZIP",
+	"H2C",
+	"HEDGE_DELAY",
+	"HMAC_MAX_SKEW",
+	"HMAC_SECRETS",
+	"IDLE_TIMEOUT",
+	"IP_ALLOWLIST",
+	"IP_DENYLIST",
+	"JWT_AUDIENCE",
+	"JWT_ISSUER",
+	"JWT_JWKS_URL",
+	"KEY_CIRCUIT_COOLDOWN",
+	"KEY_CIRCUIT_FAILURES",
+	"KEY_HEALTH_CHECK_INTERVAL",
+	"KEY_PASSTHROUGH",
+	"KEY_PASSTHROUGH_CLIENTS",
+	"KEY_RETRIES",
+	"KEY_RPD",
+	"KEY_RPM",
+	"KEY_SECRET_REFRESH_INTERVAL",
+	"KEY_SELECTION",
+	"LISTEN_ADDR",
+	"MAX_REQUEST_BODY_SIZE",
+	"METRICS_LISTEN_ADDR",
+	"MODEL_ALIASES",
+	"MODEL_ALIASES_FILE",
+	"MODEL_LIST_PREFIX",
+	"OIDC_CLIENT_ID",
+	"OIDC_CLIENT_SECRET",
+	"OIDC_INTROSPECTION_CACHE_TTL",
+	"OIDC_INTROSPECTION_URL",
+	"OPENAI_API_KEY",
+	"OPENAI_BASE_URL",
+	"OTEL_EXPORTER_OTLP_ENDPOINT",
+	"OTEL_EXPORTER_OTLP_HEADERS",
+	"OTEL_METRICS_EXPORTER",
+	"OTEL_METRIC_EXPORT_INTERVAL",
+	"OTEL_SERVICE_NAME",
+	"OTEL_TRACES_SAMPLER_ARG",
+	"PPROF",
+	"PROXY_API_KEYS",
+	"READ_HEADER_TIMEOUT",
+	"READ_TIMEOUT",
+	"REDIS_URL",
+	"RETRY_BASE_DELAY",
+	"RETRY_BUDGET",
+	"RETRY_JITTER",
+	"SHUTDOWN_TIMEOUT",
+	"STICKY_KEYS",
+	"TEI_MODEL",
+	"TLS_CERT_FILE",
+	"TLS_CLIENT_CA_FILE",
+	"TLS_KEY_FILE",
+	"TRUSTED_PROXIES",
+	"UPSTREAM_TIMEOUT",
+	"UPSTREAM_TIMEOUTS",
+	"VERTEX_FAILOVER_LATENCY",
+	"VIRTUAL_KEYS_FILE",
+	"VOYAGE_API_KEY",
+	"WRITE_TIMEOUT",
+}
+
+// settingListSeparators are the separators of settings whose lists are not
+// separated by semicolons.
+var settingListSeparators = map[string]string{
+	"CORS_ALLOWED_HEADERS": ", ",
+}
+
+var (
+	// configFile is the config file of -config or CONFIG_FILE.
+	configFile string
+	// flagSettings are the settings given by command-line flags, by name.
+	flagSettings map[string]string
+	// settings are the settings given by command-line flags, or else by the
+	// config file, by name. Variables that read settings depend on it, so it is
+	// loaded before them.
+	settings = loadSettings(os.Args[1:])
+	// reloadConfigMu serializes reloads of the config file.
+	reloadConfigMu sync.Mutex
+)
+
+// setting returns a setting from the environment, or else from settings.
+// Empty environment variables are unset, as compose files leave them.
+func setting(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return settings[name]
+}
+
+// loadSettings parses command-line flags, and reads the config file of -config
+// or CONFIG_FILE, exiting if either is invalid.
+func loadSettings(args []string) map[string]string {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.StringVar(&configFile, "config", os.Getenv("CONFIG_FILE"), "YAML config file (CONFIG_FILE)")
+	values := map[string]*string{}
+	for _, name := range settingNames {
+		values[name] = flags.String(settingFlag(name), "", name)
+	}
+	// Tests of the package are run with test flags, which are not settings.
+	if !testing.Testing() {
+		_ = flags.Parse(args)
+	}
+
+	flagSettings = map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		if i := slices.IndexFunc(settingNames, func(name string) bool { return settingFlag(name) == f.Name }); i >= 0 {
+			flagSettings[settingNames[i]] = *values[settingNames[i]]
+		}
+	})
+	loaded, err := readSettings()
+	if err != nil {
+		log.
+			Fatal().
+			Err(err).
+			Msg("")
+	}
+	return loaded
+}
+
+// readSettings reads the config file, if any, and overrides its settings with
+// flagSettings.
+func readSettings() (map[string]string, error) {
+	loaded := map[string]string{}
+	if configFile != "" {
+		var err error
+		loaded, err = readConfigFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for name, value := range flagSettings {
+		loaded[name] = value
+	}
+	return loaded, nil
+}
+
+// settingFlag returns the command-line flag of a setting, e.g. listen-addr.
+func settingFlag(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+}
+
+// readConfigFile reads the settings of a YAML config file, whose keys are the
+// names of settings in lower case, e.g. listen_addr, or nested under their
+// prefixes, e.g. gemini: {api_key: ...}. Lists are joined as the environment
+// variables separate them, and maps, such as of model aliases, as KEY=VALUE.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config file")
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal config file")
+	}
+	loaded := map[string]string{}
+	if err := flattenConfig("", config, loaded); err != nil {
+		return nil, errors.Wrap(err, "invalid config file")
+	}
+	return loaded, nil
+}
+
+func flattenConfig(prefix string, config map[string]interface{}, loaded map[string]string) error {
+	for key, value := range config {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		if !slices.Contains(settingNames, name) {
+			nested, ok := value.(map[string]interface{})
+			if !ok {
+				return errors.Errorf("unknown setting %s", strings.ToLower(name))
+			}
+			if err := flattenConfig(name, nested, loaded); err != nil {
+				return err
+			}
+			continue
+		}
+		s, err := configValue(name, value)
+		if err != nil {
+			return err
+		}
+		loaded[name] = s
+	}
+	return nil
+}
+
+// configValue returns the value of a setting in the config file as its
+// environment variable would be.
+func configValue(name string, value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			if _, ok := item.([]interface{}); ok {
+				return "", errors.Errorf("%s must be a list of values", strings.ToLower(name))
+			}
+			if _, ok := item.(map[string]interface{}); ok {
+				return "", errors.Errorf("%s must be a list of values", strings.ToLower(name))
+			}
+			items[i] = fmt.Sprint(item)
+		}
+		separator, ok := settingListSeparators[name]
+		if !ok {
+			separator = ";"
+		}
+		return strings.Join(items, separator), nil
+	case map[string]interface{}:
+		var mappings []string
+		for k, v := range value {
+			mappings = append(mappings, k+"="+fmt.Sprint(v))
+		}
+		sort.Strings(mappings)
+		return strings.Join(mappings, ";"), nil
+	default:
+		return fmt.Sprint(value), nil
+	}
+}
+
+// reloadConfig reads the config file again, and applies its Gemini API keys,
+// key budgets, and model aliases, reloading the key pool, with its key pools
+// of VirtualKeysFile, and ModelAliasesFile. Other settings take effect on
+// restart. Nothing is applied if any of them is invalid.
+func reloadConfig() error {
+	reloadConfigMu.Lock()
+	defer reloadConfigMu.Unlock()
+
+	loaded, err := readSettings()
+	if err != nil {
+		return err
+	}
+	settings = loaded
+	budgets := map[string]int{"KEY_RPM": 0, "KEY_RPD": 0}
+	for name := range budgets {
+		if s := setting(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return errors.Errorf("%s must be a non-negative integer", name)
+			}
+			budgets[name] = n
+		}
+	}
+	previousAliases, previousAliasesFile := ModelAliases, ModelAliasesFile
+	ModelAliases, ModelAliasesFile = setting("MODEL_ALIASES"), setting("MODEL_ALIASES_FILE")
+	aliases, err := loadModelAliases()
+	if err != nil {
+		ModelAliases, ModelAliasesFile = previousAliases, previousAliasesFile
+		return err
+	}
+
+	keyPoolMu.Lock()
+	previousKey, previousRPM, previousRPD := GeminiApiKey, KeyRPM, KeyRPD
+	GeminiApiKey, KeyRPM, KeyRPD = setting("GEMINI_API_KEY"), budgets["KEY_RPM"], budgets["KEY_RPD"]
+	keyPoolMu.Unlock()
+	if err := reloadKeys(); err != nil {
+		keyPoolMu.Lock()
+		GeminiApiKey, KeyRPM, KeyRPD = previousKey, previousRPM, previousRPD
+		keyPoolMu.Unlock()
+		ModelAliases, ModelAliasesFile = previousAliases, previousAliasesFile
+		return err
+	}
+	currentModelAliases.Store(&aliases)
+	log.Info().Int("aliases", len(aliases)).Msg("Reloaded config")
+	return nil
+}
+
+// watchConfig reloads the config on SIGHUP, and when the contents of the config
+// file change.
+func watchConfig() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	var poll <-chan time.Time
+	var contents []byte
+	if configFile != "" {
+		contents, _ = os.ReadFile(configFile)
+		ticker := time.NewTicker(configFilePollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		select {
+		case <-hangup:
+		case <-poll:
+			b, err := os.ReadFile(configFile)
+			if err != nil || bytes.Equal(b, contents) {
+				continue
+			}
+			contents = b
+		}
+		if err := reloadConfig(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload config")
+		}
+	}
+}
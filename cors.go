@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers that browsers let apps read.
+var corsExposedHeaders = strings.Join([]string{
+	"Retry-After",
+	"X-Request-ID",
+	"X-Ratelimit-Limit-Requests",
+	"X-Ratelimit-Remaining-Requests",
+	"X-Ratelimit-Reset-Requests",
+	"X-Ratelimit-Limit-Tokens",
+	"X-Ratelimit-Remaining-Tokens",
+	"X-Ratelimit-Reset-Tokens",
+}, ", ")
+
+// corsOrigins are the origins of CORSAllowedOrigins.
+var corsOrigins []string
+
+// corsAllowsOrigin reports whether apps from an origin can call the proxy.
+func corsAllowsOrigin(origin string) bool {
+	return slices.Contains(corsOrigins, "*") || slices.Contains(corsOrigins, origin)
+}
+
+// corsHandler lets browser apps from corsOrigins call the proxy, answering
+// their preflight requests, before other requests are handled by next.
+func corsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(corsOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		allowed := corsAllowsOrigin(origin)
+		if allowed {
+			if slices.Contains(corsOrigins, "*") {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+		}
+		if !preflight {
+			if allowed {
+				w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Preflight requests carry no credentials, so they are answered here,
+		// without CORS headers for other origins, which browsers then refuse.
+		if allowed {
+			headers := CORSAllowedHeaders
+			if headers == "" {
+				// SDKs send headers of their own, such as OpenAI's X-Stainless-*.
+				headers = r.Header.Get("Access-Control-Request-Headers")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Max-Age", "600")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
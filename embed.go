@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// invalidEmbedRequestError is an embedding request that the proxy or Gemini
+// rejected, which is reported to the client as a 400.
+type invalidEmbedRequestError struct {
+	error
+}
+
+// batchEmbedContents embeds the inputs of an embedding request, with the
+// provider of its model's prefix or else Gemini. Inputs over a Gemini model's
+// token limit are rejected or truncated first, and inputs in
+// embeddingInputCache are served from it. The rest are embedded once per
+// distinct input, and the embeddings truncated to the request's dimensions and
+// normalized if requested. If the request allows partial failures and the
+// provider rejects a batch, its inputs are embedded one at a time and those
+// rejected are returned as errors.
+func batchEmbedContents(ctx context.Context, useIndex int32, openAIReq *openai.EmbedRequest) (*genai.BatchEmbedContentsResponse, []*openai.EmbedError, error) {
+	var embedder Embedder = geminiEmbedder{useIndex: useIndex}
+	if provider := providerEmbedder(openAIReq.Model); provider != nil {
+		embedder = provider
+	} else if err := limitEmbeddingInputs(ctx, useIndex, openAIReq); err != nil {
+		return nil, nil, err
+	}
+
+	keys, err := openai.EmbeddingInputKeys(openAIReq)
+	if err != nil {
+		return nil, nil, invalidEmbedRequestError{err}
+	}
+	var embedErrs []*openai.EmbedError
+	merged := &genai.BatchEmbedContentsResponse{Embeddings: make([]*genai.ContentEmbedding, len(keys))}
+	uncached := make([]int, 0, len(keys))
+	if embeddingInputCache != nil {
+		for i, values := range embeddingInputCache.get(keys) {
+			if values != nil {
+				merged.Embeddings[i] = &genai.ContentEmbedding{Values: values}
+			} else {
+				uncached = append(uncached, i)
+			}
+		}
+		embeddingCacheHits.add(float64(len(keys) - len(uncached)))
+		embeddingCacheMisses.add(float64(len(uncached)))
+	} else {
+		for i := range keys {
+			uncached = append(uncached, i)
+		}
+	}
+
+	// Duplicate inputs are embedded once, by the first index with their key.
+	var unique []int
+	uniqueIndex := map[string]int{}
+	for _, i := range uncached {
+		if _, ok := uniqueIndex[keys[i]]; !ok {
+			uniqueIndex[keys[i]] = len(unique)
+			unique = append(unique, i)
+		}
+	}
+
+	if len(unique) > 0 {
+		embed := embedder.Embed
+		if _, ok := embedder.(geminiEmbedder); ok && EmbeddingCoalesceWindow > 0 && len(unique) == 1 {
+			embed = func(ctx context.Context, openAIReq *openai.EmbedRequest) (*genai.BatchEmbedContentsResponse, error) {
+				return embeddingRequestCoalescer.embed(ctx, useIndex, openAIReq)
+			}
+		}
+		uniqueReq := openai.SelectEmbeddingInputs(openAIReq, unique)
+		geminiBatchResp, err := embed(ctx, uniqueReq)
+		var inputErrs []error
+		if err != nil && openAIReq.PartialFailures != nil && *openAIReq.PartialFailures && embedInputErrorMessage(err) != "" {
+			geminiBatchResp, inputErrs, err = embedEachInput(ctx, embedder, uniqueReq)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, i := range uncached {
+			j := uniqueIndex[keys[i]]
+			if inputErrs != nil && inputErrs[j] != nil {
+				embedErrs = append(embedErrs, &openai.EmbedError{Index: i, Message: embedInputErrorMessage(inputErrs[j])})
+				continue
+			}
+			merged.Embeddings[i] = &genai.ContentEmbedding{Values: geminiBatchResp.Embeddings[j].Values}
+		}
+		if embeddingInputCache != nil {
+			var uniqueKeys []string
+			var uniqueValues [][]float32
+			for j, i := range unique {
+				if inputErrs == nil || inputErrs[j] == nil {
+					uniqueKeys = append(uniqueKeys, keys[i])
+					uniqueValues = append(uniqueValues, geminiBatchResp.Embeddings[j].Values)
+				}
+			}
+			embeddingInputCache.set(uniqueKeys, uniqueValues)
+		}
+	}
+
+	if openAIReq.Dimensions != 0 {
+		openai.TruncateEmbeddings(merged, openAIReq.Dimensions)
+	}
+	normalize := EmbeddingNormalize
+	if openAIReq.Normalize != nil {
+		normalize = *openAIReq.Normalize
+	}
+	if normalize {
+		openai.NormalizeEmbeddings(merged)
+	}
+	return merged, embedErrs, nil
+}
+
+// embedEachInput embeds the inputs of an embedding request one at a time, to
+// find those the embedder rejects. The embeddings of rejected inputs are nil,
+// with their errors at the same index.
+func embedEachInput(ctx context.Context, embedder Embedder, openAIReq *openai.EmbedRequest) (*genai.BatchEmbedContentsResponse, []error, error) {
+	count := embedRequestInputCount(openAIReq)
+	geminiBatchResp := &genai.BatchEmbedContentsResponse{Embeddings: make([]*genai.ContentEmbedding, count)}
+	errs := make([]error, count)
+	semaphore := make(chan struct{}, EmbeddingConcurrency)
+	var wg sync.WaitGroup
+	for i := range count {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			inputResp, err := embedder.Embed(ctx, openai.SelectEmbeddingInputs(openAIReq, []int{i}))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			geminiBatchResp.Embeddings[i] = inputResp.Embeddings[0]
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		// Only rejected inputs are reported per input; other failures fail the request.
+		if err != nil && embedInputErrorMessage(err) == "" {
+			return nil, nil, err
+		}
+	}
+	return geminiBatchResp, errs, nil
+}
+
+// embedInputErrorMessage returns the message of an error that Gemini rejected
+// an input with, or "" for other errors.
+func embedInputErrorMessage(err error) string {
+	var invalidErr invalidEmbedRequestError
+	if errors.As(err, &invalidErr) {
+		return invalidErr.Error()
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest {
+		return apiErr.Message
+	}
+	return ""
+}
+
+// embedInBatches splits the inputs of an embedding request into batches within
+// Gemini's limit, which are embedded EmbeddingConcurrency at a time and merged in order.
+func embedInBatches(ctx context.Context, useIndex int32, openAIReq *openai.EmbedRequest) (*genai.BatchEmbedContentsResponse, error) {
+	var embeds []func() (*genai.BatchEmbedContentsResponse, error)
+	for _, batchReq := range openai.SplitEmbedRequest(openAIReq) {
+		embed, err := newEmbedBatch(ctx, useIndex, batchReq)
+		if err != nil {
+			return nil, invalidEmbedRequestError{err}
+		}
+		embeds = append(embeds, embed)
+	}
+
+	return embedConcurrently(embeds)
+}
+
+// embedConcurrently runs the embedding functions of the batches of a request
+// EmbeddingConcurrency at a time, merging their embeddings in order.
+func embedConcurrently(embeds []func() (*genai.BatchEmbedContentsResponse, error)) (*genai.BatchEmbedContentsResponse, error) {
+	geminiBatchResps := make([]*genai.BatchEmbedContentsResponse, len(embeds))
+	errs := make([]error, len(embeds))
+	semaphore := make(chan struct{}, EmbeddingConcurrency)
+	var wg sync.WaitGroup
+	for i, embed := range embeds {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			geminiBatchResps[i], errs[i] = embed()
+		}()
+	}
+	wg.Wait()
+
+	merged := &genai.BatchEmbedContentsResponse{}
+	for i, geminiBatchResp := range geminiBatchResps {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		merged.Embeddings = append(merged.Embeddings, geminiBatchResp.Embeddings...)
+	}
+	return merged, nil
+}
+
+// newEmbedBatch converts a batch of an embedding request, returning a function
+// that embeds it.
+func newEmbedBatch(ctx context.Context, useIndex int32, openAIReq *openai.EmbedRequest) (func() (*genai.BatchEmbedContentsResponse, error), error) {
+	if openAIReq.Dimensions != 0 && openai.SupportsOutputDimensionality(openAIReq) {
+		geminiBatchReq, err := openai.ConvertOpenAIRequestWithDimensionsToGemini(openAIReq)
+		if err != nil {
+			return nil, err
+		}
+		return func() (*genai.BatchEmbedContentsResponse, error) {
+			geminiBatchResp, err := generativeClient(useIndex).BatchEmbedContents(ctx, geminiBatchReq)
+			var apiErr *googleapi.Error
+			if errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest {
+				// Gemini rejects dimensions larger than the model's.
+				return nil, invalidEmbedRequestError{errors.New(apiErr.Message)}
+			}
+			if err != nil {
+				return nil, err
+			}
+			return openai.ConvertGeminiProtoResponseToGemini(geminiBatchResp), nil
+		}, nil
+	}
+
+	embeddingModel := geminiClient(useIndex).EmbeddingModel(openai.EmbeddingModelName(openAIReq.Model))
+	geminiBatchReq, err := openai.ConvertOpenAIRequestToGemini(openAIReq, embeddingModel)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*genai.BatchEmbedContentsResponse, error) {
+		return embeddingModel.BatchEmbedContents(ctx, geminiBatchReq)
+	}, nil
+}
+
+// modelInfos caches the info of each model, nil for models that Gemini does
+// not know.
+var modelInfos sync.Map
+
+// defaultEmbeddingModel returns DefaultEmbeddingModel in place of a model that
+// is empty or unknown to Gemini, or any model if DefaultEmbeddingModelForce is
+// set. A task type suffix of the model is kept.
+func defaultEmbeddingModel(ctx context.Context, useIndex int32, model string) string {
+	if DefaultEmbeddingModel == "" {
+		return model
+	}
+	if model != "" && !DefaultEmbeddingModelForce {
+		if providerEmbedder(model) != nil {
+			return model
+		}
+		info, err := modelInfo(ctx, useIndex, openai.EmbeddingModelName(model))
+		if err != nil || info != nil {
+			return model
+		}
+	}
+	if _, taskType, ok := strings.Cut(model, "#"); ok {
+		return DefaultEmbeddingModel + "#" + taskType
+	}
+	return DefaultEmbeddingModel
+}
+
+// limitEmbeddingInputs rejects inputs longer than the input token limit of the
+// model, or truncates them if the request asks to. Tokens are counted with
+// GeminiTokenCountModel, as embedding models cannot count tokens.
+func limitEmbeddingInputs(ctx context.Context, useIndex int32, openAIReq *openai.EmbedRequest) error {
+	texts, err := openai.EmbeddingInputTexts(openAIReq)
+	if err != nil {
+		return invalidEmbedRequestError{err}
+	}
+	model := openai.EmbeddingModelName(openAIReq.Model)
+	info, err := modelInfo(ctx, useIndex, model)
+	if err != nil || info == nil {
+		// Unknown models are left for Gemini to reject.
+		return nil
+	}
+	limit := int(info.InputTokenLimit)
+
+	counts := make([]int, len(texts))
+	errs := make([]error, len(texts))
+	semaphore := make(chan struct{}, EmbeddingConcurrency)
+	var wg sync.WaitGroup
+	for i, text := range texts {
+		// A token covers at least one byte, so shorter texts cannot exceed the limit.
+		if len(text) <= limit {
+			continue
+		}
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			geminiResp, err := geminiClient(useIndex).GenerativeModel(GeminiTokenCountModel).CountTokens(ctx, genai.Text(text))
+			if err != nil {
+				errs[i] = errors.Wrap(err, "failed to count tokens")
+				return
+			}
+			counts[i] = int(geminiResp.TotalTokens)
+		}()
+	}
+	wg.Wait()
+
+	truncate := EmbeddingTruncate
+	if openAIReq.Truncate != nil {
+		truncate = *openAIReq.Truncate
+	}
+	for i, text := range texts {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		if counts[i] <= limit {
+			continue
+		}
+		if !truncate {
+			return invalidEmbedRequestError{errors.Errorf("input[%d] is %d tokens, more than the %d token limit of %s", i, counts[i], limit, model)}
+		}
+		// Cut the text in proportion to its tokens, leaving a margin for the
+		// difference between tokenizers.
+		keep := len(text) * limit / counts[i] * 9 / 10
+		openai.SetEmbeddingInputText(openAIReq, i, strings.ToValidUTF8(text[:keep], ""))
+	}
+	return nil
+}
+
+// modelInfo returns the info of a model, or nil if Gemini does not know it.
+func modelInfo(ctx context.Context, useIndex int32, model string) (*genai.ModelInfo, error) {
+	if info, ok := modelInfos.Load(model); ok {
+		return info.(*genai.ModelInfo), nil
+	}
+	info, err := geminiClient(useIndex).EmbeddingModel(model).Info(ctx)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		info, err = nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get model")
+	}
+	modelInfos.Store(model, info)
+	return info, nil
+}
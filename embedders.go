@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	cohereEmbedURL = "https://api.cohere.com/v2/embed"
+	voyageEmbedURL = "https://api.voyageai.com/v1/embeddings"
+	// cohereBatchSize and providerBatchSize are the most inputs sent in one
+	// request to Cohere and to other providers.
+	cohereBatchSize   = 96
+	providerBatchSize = 128
+)
+
+var embedderRequests = newCounter("gemini_proxy_embedder_requests_total", "Requests to embedding providers other than Gemini, by provider and status code.")
+
+// Embedder embeds the inputs of embedding requests with a provider.
+type Embedder interface {
+	// Embed embeds the inputs of an embedding request, returning their
+	// embeddings in order. Inputs the provider rejects fail with an
+	// invalidEmbedRequestError.
+	Embed(ctx context.Context, openAIReq *openai.EmbedRequest) (*genai.BatchEmbedContentsResponse, error)
+}
+
+// embedders are the embedding providers by model prefix, from EmbeddingProviders.
+var embedders map[string]Embedder
+
+// providerEmbedder returns the provider of an embedding model with the longest
+// of their prefixes, or nil for models of Gemini.
+func providerEmbedder(model string) Embedder {
+	var embedder Embedder
+	longest := -1
+	for prefix, provider := range embedders {
+		if strings.HasPrefix(model, prefix) && len(prefix) > longest {
+			embedder, longest = provider, len(prefix)
+		}
+	}
+	return embedder
+}
+
+// parseEmbedders parses embedding providers in the form PREFIX=PROVIDER;PREFIX=PROVIDER,
+// where each provider is cohere, voyage, or the base URL of an OpenAI-compatible API.
+func parseEmbedders(s string) (map[string]Embedder, error) {
+	providers, err := parseModelMap(s)
+	if err != nil {
+		return nil, err
+	}
+	parsed := map[string]Embedder{}
+	for prefix, provider := range providers {
+		if prefix == "" {
+			return nil, errors.Errorf("embedding provider %s has no model prefix", provider)
+		}
+		switch {
+		case provider == "cohere":
+			if CohereApiKey == "" {
+				return nil, errors.New("COHERE_API_KEY is required for cohere")
+			}
+			parsed[prefix] = &cohereEmbedder{prefix: prefix, url: cohereEmbedURL, apiKey: CohereApiKey}
+		case provider == "voyage":
+			if VoyageApiKey == "" {
+				return nil, errors.New("VOYAGE_API_KEY is required for voyage")
+			}
+			parsed[prefix] = &openAICompatibleEmbedder{
+				name:       provider,
+				prefix:     prefix,
+				url:        voyageEmbedURL,
+				apiKey:     VoyageApiKey,
+				inputTypes: openai.VoyageInputTypes,
+			}
+		case strings.HasPrefix(provider, "http://") || strings.HasPrefix(provider, "https://"):
+			base, err := url.Parse(strings.TrimSuffix(provider, "/"))
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse embedding provider %s", provider)
+			}
+			parsed[prefix] = &openAICompatibleEmbedder{name: base.Host, prefix: prefix, url: base.JoinPath("embeddings").String()}
+		default:
+			return nil, errors.Errorf("unknown embedding provider: %s", provider)
+		}
+	}
+	return parsed, nil
+}
+
+// geminiEmbedder embeds with Gemini, using the client at useIndex.
+type geminiEmbedder struct {
+	useIndex int32
+}
+
+func (e geminiEmbedder) Embed(ctx context.Context, openAIReq *openai.EmbedRequest) (*genai.BatchEmbedContentsResponse, error) {
+	return embedInBatches(ctx, e.useIndex, openAIReq)
+}
+
+// cohereEmbedder embeds with Cohere's v2 embed API the models with prefix,
+// which is dropped from the model sent to Cohere.
+type cohereEmbedder struct {
+	prefix string
+	url    string
+	apiKey string
+}
+
+func (e *cohereEmbedder) Embed(ctx context.Context, openAIReq *openai.EmbedRequest) (*genai.BatchEmbedContentsResponse, error) {
+	model := strings.TrimPrefix(openai.EmbeddingModelName(openAIReq.Model), e.prefix)
+	return embedInProviderBatches(openAIReq, cohereBatchSize, func(batchReq *openai.EmbedRequest, count int) (*genai.BatchEmbedContentsResponse, error) {
+		cohereReq, err := openai.ConvertOpenAIRequestToCohere(batchReq, model)
+		if err != nil {
+			return nil, invalidEmbedRequestError{err}
+		}
+		var cohereResp openai.CohereEmbedByTypeResponse
+		if err := postEmbedRequest(ctx, "cohere", e.url, e.apiKey, cohereReq, &cohereResp); err != nil {
+			return nil, err
+		}
+		return openai.ConvertCohereResponseToGemini(&cohereResp, count)
+	})
+}
+
+// openAICompatibleEmbedder embeds with the embeddings API of an OpenAI-compatible
+// provider the models with prefix, which is dropped from the model sent to it.
+// Task types are sent as their inputTypes, if any.
+type openAICompatibleEmbedder struct {
+	name       string
+	prefix     string
+	url        string
+	apiKey     string
+	inputTypes map[genai.TaskType]string
+}
+
+func (e *openAICompatibleEmbedder) Embed(ctx context.Context, openAIReq *openai.EmbedRequest) (*genai.BatchEmbedContentsResponse, error) {
+	model := strings.TrimPrefix(openai.EmbeddingModelName(openAIReq.Model), e.prefix)
+	return embedInProviderBatches(openAIReq, providerBatchSize, func(batchReq *openai.EmbedRequest, count int) (*genai.BatchEmbedContentsResponse, error) {
+		providerReq, err := openai.ConvertOpenAIRequestToProvider(batchReq, model, e.inputTypes)
+		if err != nil {
+			return nil, invalidEmbedRequestError{err}
+		}
+		var providerResp openai.ProviderEmbedResponse
+		if err := postEmbedRequest(ctx, e.name, e.url, e.apiKey, providerReq, &providerResp); err != nil {
+			return nil, err
+		}
+		return openai.ConvertProviderResponseToGemini(&providerResp, count)
+	})
+}
+
+// embedInProviderBatches splits the inputs of an embedding request into batches
+// of up to size inputs, which are embedded by embed EmbeddingConcurrency at a
+// time and merged in order.
+func embedInProviderBatches(openAIReq *openai.EmbedRequest, size int, embed func(batchReq *openai.EmbedRequest, count int) (*genai.BatchEmbedContentsResponse, error)) (*genai.BatchEmbedContentsResponse, error) {
+	count := embedRequestInputCount(openAIReq)
+	var embeds []func() (*genai.BatchEmbedContentsResponse, error)
+	for start := 0; start < count; start += size {
+		var indices []int
+		for i := start; i < min(start+size, count); i++ {
+			indices = append(indices, i)
+		}
+		batchReq := openai.SelectEmbeddingInputs(openAIReq, indices)
+		embeds = append(embeds, func() (*genai.BatchEmbedContentsResponse, error) {
+			return embed(batchReq, len(indices))
+		})
+	}
+	return embedConcurrently(embeds)
+}
+
+// postEmbedRequest sends an embedding request to a provider, authenticated with
+// apiKey if it is set, and decodes its response. Requests the provider rejects
+// as invalid fail with an invalidEmbedRequestError.
+func postEmbedRequest(ctx context.Context, provider string, endpoint string, apiKey string, providerReq interface{}, providerResp interface{}) error {
+	body, err := json.Marshal(providerReq)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal request body")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setRequestIDHeader(req.Header, ctx)
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		embedderRequests.add(1, "provider", provider, "code", "error")
+		return errors.Wrapf(err, "failed to send request to %s", provider)
+	}
+	defer resp.Body.Close()
+	embedderRequests.add(1, "provider", provider, "code", strconv.Itoa(resp.StatusCode))
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read response from %s", provider)
+	}
+	switch {
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity:
+		return invalidEmbedRequestError{errors.Errorf("%s rejected the request: %s", provider, respBody)}
+	case resp.StatusCode != http.StatusOK:
+		return errors.Errorf("%s returned %d: %s", provider, resp.StatusCode, respBody)
+	}
+	if err := json.Unmarshal(respBody, providerResp); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal response from %s", provider)
+	}
+	return nil
+}
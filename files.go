@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+const (
+	// maxFileSize matches the upload limit of the Gemini File API.
+	maxFileSize = 2 << 30
+	// filePurpose is reported for files whose purpose is not known, as Gemini
+	// does not store one.
+	filePurpose = "user_data"
+)
+
+// Files belong to the project of the key that uploaded them, so remember which
+// client owns each one.
+var fileClients sync.Map
+
+// findFileClient returns the index of the client that owns the named file,
+// asking each client in turn if it is not already known.
+func findFileClient(ctx context.Context, name string) (int32, error) {
+	clients := requestClients(ctx)
+	if index, ok := fileClients.Load(name); ok && slices.Contains(clients, index.(int32)) {
+		return index.(int32), nil
+	}
+	lastErr := errors.Errorf("no client can use %s", name)
+	for _, i := range clients {
+		_, err := geminiClient(i).GetFile(ctx, name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		fileClients.Store(name, i)
+		return i, nil
+	}
+	return 0, lastErr
+}
+
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxFileSize+1<<20)
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "file is required")
+			noteError(r.Context(), errors.Wrap(err, "failed to read file"))
+			return
+		}
+		defer file.Close()
+		purpose := r.FormValue("purpose")
+		if purpose == "" {
+			purpose = filePurpose
+		}
+
+		// Batch input and training files are kept by the proxy, as Gemini files cannot be read back.
+		if purpose == "batch" || purpose == "fine-tune" {
+			if header.Size > maxBatchFileSize {
+				writeError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", "Files with purpose "+purpose+" can be at most "+strconv.Itoa(maxBatchFileSize)+" bytes")
+				noteError(r.Context(), errors.Errorf("%s file of %d bytes is too large", purpose, header.Size))
+				return
+			}
+			data, err := io.ReadAll(file)
+			if err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				noteError(r.Context(), errors.Wrap(err, "failed to read file"))
+				return
+			}
+			writeJSON(w, r, storeBatchFile(batchOwner(r.Context()), header.Filename, purpose, data))
+			return
+		}
+
+		mimeType := header.Header.Get("Content-Type")
+		if mimeType == "" || mimeType == "application/octet-stream" {
+			mimeType = mime.TypeByExtension(filepath.Ext(header.Filename))
+		}
+
+		useIndex, err := nextClient(r.Context())
+		if err != nil {
+			writeNoKeyAvailable(w, r, err)
+			return
+		}
+		defer doneClient(useIndex)
+		noteRequest(r.Context(), "", useIndex)
+
+		geminiFile, err := geminiClient(useIndex).UploadFile(r.Context(), "", file, &genai.UploadFileOptions{
+			DisplayName: header.Filename,
+			MIMEType:    mimeType,
+		})
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			noteError(r.Context(), errors.Wrap(err, "failed to upload file"))
+			return
+		}
+		fileClients.Store(geminiFile.Name, useIndex)
+
+		writeJSON(w, r, openai.ConvertGeminiFileToOpenAI(geminiFile, purpose))
+	case http.MethodGet:
+		openAIResp := &openai.FileListResponse{
+			Object: "list",
+			Data:   []*openai.FileResponse{},
+		}
+		openAIResp.Data = append(openAIResp.Data, ownedBatchFiles(batchOwner(r.Context()))...)
+		for _, i := range requestClients(r.Context()) {
+			iter := geminiClient(i).ListFiles(r.Context())
+			for {
+				geminiFile, err := iter.Next()
+				if err == iterator.Done {
+					break
+				}
+				if err != nil {
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					noteError(r.Context(), errors.Wrap(err, "failed to list files"))
+					return
+				}
+				fileClients.Store(geminiFile.Name, i)
+				openAIResp.Data = append(openAIResp.Data, openai.ConvertGeminiFileToOpenAI(geminiFile, filePurpose))
+			}
+		}
+
+		writeJSON(w, r, openAIResp)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func fileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if file, ok := loadBatchFile(batchOwner(r.Context()), r.PathValue("id")); ok {
+		if r.Method == http.MethodDelete {
+			deleteBatchFile(file.file.ID)
+			writeJSON(w, r, &openai.DeleteResponse{
+				ID:      file.file.ID,
+				Object:  "file",
+				Deleted: true,
+			})
+			return
+		}
+		writeJSON(w, r, file.file)
+		return
+	}
+
+	name := openai.FileName(r.PathValue("id"))
+	useIndex, err := findFileClient(r.Context(), name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "No such File object: "+openai.FileID(name))
+		noteError(r.Context(), errors.Wrap(err, "failed to find file"))
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		err = geminiClient(useIndex).DeleteFile(r.Context(), name)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			noteError(r.Context(), errors.Wrap(err, "failed to delete file"))
+			return
+		}
+		fileClients.Delete(name)
+
+		writeJSON(w, r, &openai.DeleteResponse{
+			ID:      openai.FileID(name),
+			Object:  "file",
+			Deleted: true,
+		})
+		return
+	}
+
+	geminiFile, err := geminiClient(useIndex).GetFile(r.Context(), name)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to get file"))
+		return
+	}
+
+	writeJSON(w, r, openai.ConvertGeminiFileToOpenAI(geminiFile, filePurpose))
+}
+
+// fileContentHandler serves the content of batch files. Files in the Gemini File
+// API cannot be downloaded.
+func fileContentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, ok := loadBatchFile(batchOwner(r.Context()), r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "No batch file found with id "+r.PathValue("id")+", only batch file content can be downloaded")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	_, err := w.Write(file.data)
+	if err != nil {
+		noteError(r.Context(), errors.Wrap(err, "failed to write file content"))
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"context"
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Tuned models belong to the project of the key that created them, so
+// remember which client owns each one.
+var tunedModelClients sync.Map
+
+// findTunedModelClient returns the index of the client that owns the named
+// tuned model, asking each client in turn if it is not already known.
+func findTunedModelClient(ctx context.Context, name string) (int32, error) {
+	clients := requestClients(ctx)
+	if index, ok := tunedModelClients.Load(name); ok && slices.Contains(clients, index.(int32)) {
+		return index.(int32), nil
+	}
+	lastErr := errors.Errorf("no client can use %s", name)
+	for _, i := range clients {
+		_, err := modelClient(i).GetTunedModel(ctx, &generativelanguagepb.GetTunedModelRequest{Name: name})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		tunedModelClients.Store(name, i)
+		return i, nil
+	}
+	return 0, lastErr
+}
+
+// listTunedModels calls f with each tuned model the request's clients own,
+// and the client that owns it.
+func listTunedModels(ctx context.Context, f func(tunedModel *generativelanguagepb.TunedModel, useIndex int32)) error {
+	for _, i := range requestClients(ctx) {
+		iter := modelClient(i).ListTunedModels(ctx, &generativelanguagepb.ListTunedModelsRequest{})
+		for {
+			tunedModel, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			tunedModelClients.Store(tunedModel.Name, i)
+			f(tunedModel, i)
+		}
+	}
+	return nil
+}
+
+func fineTuningJobsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+			return
+		}
+
+		var openAIReq openai.FineTuningJobRequest
+		err = json.Unmarshal(body, &openAIReq)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+			return
+		}
+
+		// Training files are kept by the proxy, like batch input files.
+		trainingFile, ok := loadBatchFile(batchOwner(r.Context()), openAIReq.TrainingFile)
+		if !ok {
+			err = errors.Errorf("no training file found with id %s, training files must be uploaded with purpose fine-tune", openAIReq.TrainingFile)
+			writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			noteError(r.Context(), errors.Wrap(err, "invalid fine-tuning request"))
+			return
+		}
+
+		geminiReq, err := openai.ConvertOpenAIFineTuningRequestToGemini(&openAIReq, trainingFile.data)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			noteError(r.Context(), errors.Wrap(err, "failed to convert OpenAI request to Gemini request"))
+			return
+		}
+
+		useIndex, err := nextClient(r.Context())
+		if err != nil {
+			writeNoKeyAvailable(w, r, err)
+			return
+		}
+		defer doneClient(useIndex)
+		noteRequest(r.Context(), openAIReq.Model, useIndex)
+
+		op, err := modelClient(useIndex).CreateTunedModel(r.Context(), geminiReq)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			noteError(r.Context(), errors.Wrap(err, "failed to create tuned model"))
+			return
+		}
+		// The operation is named after the tuned model it creates.
+		tunedModel := geminiReq.TunedModel
+		tunedModel.Name, _, _ = strings.Cut(op.Name(), "/operations/")
+		tunedModel.State = generativelanguagepb.TunedModel_CREATING
+		tunedModel.CreateTime = timestamppb.Now()
+		tunedModelClients.Store(tunedModel.Name, useIndex)
+
+		job := openai.ConvertGeminiTunedModelToOpenAI(tunedModel)
+		job.TrainingFile = openAIReq.TrainingFile
+		writeJSON(w, r, job)
+	case http.MethodGet:
+		openAIResp := &openai.FineTuningJobListResponse{
+			Object: "list",
+			Data:   []*openai.FineTuningJob{},
+		}
+		err := listTunedModels(r.Context(), func(tunedModel *generativelanguagepb.TunedModel, _ int32) {
+			openAIResp.Data = append(openAIResp.Data, openai.ConvertGeminiTunedModelToOpenAI(tunedModel))
+		})
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			noteError(r.Context(), errors.Wrap(err, "failed to list tuned models"))
+			return
+		}
+
+		writeJSON(w, r, openAIResp)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func fineTuningJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tunedModel, _, ok := findTunedModel(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, r, openai.ConvertGeminiTunedModelToOpenAI(tunedModel))
+}
+
+// fineTuningJobCancelHandler cancels a fine-tuning job by deleting the tuned
+// model it is creating, as Gemini cannot stop tuning otherwise.
+func fineTuningJobCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tunedModel, useIndex, ok := findTunedModel(w, r)
+	if !ok {
+		return
+	}
+	if tunedModel.State != generativelanguagepb.TunedModel_CREATING {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "Only running fine-tuning jobs can be cancelled")
+		noteError(r.Context(), errors.Errorf("tuned model %s is not being created", tunedModel.Name))
+		return
+	}
+
+	err := modelClient(useIndex).DeleteTunedModel(r.Context(), &generativelanguagepb.DeleteTunedModelRequest{Name: tunedModel.Name})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to delete tuned model"))
+		return
+	}
+	tunedModelClients.Delete(tunedModel.Name)
+
+	job := openai.ConvertGeminiTunedModelToOpenAI(tunedModel)
+	job.Status = "cancelled"
+	writeJSON(w, r, job)
+}
+
+// findTunedModel returns the tuned model of the fine-tuning job named in the
+// request path and the client that owns it, writing a 404 if there is none.
+func findTunedModel(w http.ResponseWriter, r *http.Request) (*generativelanguagepb.TunedModel, int32, bool) {
+	name := openai.TunedModelName(r.PathValue("id"))
+	useIndex, err := findTunedModelClient(r.Context(), name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "No fine-tuning job found with id "+r.PathValue("id"))
+		noteError(r.Context(), errors.Wrap(err, "failed to find tuned model"))
+		return nil, 0, false
+	}
+
+	tunedModel, err := modelClient(useIndex).GetTunedModel(r.Context(), &generativelanguagepb.GetTunedModelRequest{Name: name})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to get tuned model"))
+		return nil, 0, false
+	}
+	return tunedModel, useIndex, true
+}
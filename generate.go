@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+	"slices"
+	"sync"
+)
+
+type generateContentStream interface {
+	Next() (*genai.GenerateContentResponse, error)
+}
+
+// generateChatContent sends the chat to Gemini and returns n candidates.
+// ChatSession always asks for a single candidate, so single-turn chats use
+// CandidateCount directly and multi-turn chats fan out one request per candidate.
+func generateChatContent(ctx context.Context, model *genai.GenerativeModel, session *genai.ChatSession, parts []genai.Part, n int) (*genai.GenerateContentResponse, error) {
+	if n <= 1 {
+		return session.SendMessage(ctx, parts...)
+	}
+	if len(session.History) == 0 {
+		model.SetCandidateCount(int32(n))
+		return model.GenerateContent(ctx, parts...)
+	}
+
+	responses := make([]*genai.GenerateContentResponse, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = cloneChatSession(model, session).SendMessage(ctx, parts...)
+		}()
+	}
+	wg.Wait()
+
+	merged := &genai.GenerateContentResponse{UsageMetadata: &genai.UsageMetadata{}}
+	for i, resp := range responses {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if merged.PromptFeedback == nil {
+			merged.PromptFeedback = resp.PromptFeedback
+		}
+		// The prompt is identical across requests, so only count it once.
+		if resp.UsageMetadata != nil {
+			merged.UsageMetadata.PromptTokenCount = resp.UsageMetadata.PromptTokenCount
+			merged.UsageMetadata.CandidatesTokenCount += resp.UsageMetadata.CandidatesTokenCount
+		}
+		for _, candidate := range resp.Candidates {
+			candidate.Index = int32(i)
+			merged.Candidates = append(merged.Candidates, candidate)
+		}
+	}
+	merged.UsageMetadata.TotalTokenCount = merged.UsageMetadata.PromptTokenCount + merged.UsageMetadata.CandidatesTokenCount
+	return merged, nil
+}
+
+func generateChatContentStream(ctx context.Context, model *genai.GenerativeModel, session *genai.ChatSession, parts []genai.Part, n int) generateContentStream {
+	if n <= 1 {
+		return session.SendMessageStream(ctx, parts...)
+	}
+	if len(session.History) == 0 {
+		model.SetCandidateCount(int32(n))
+		return model.GenerateContentStream(ctx, parts...)
+	}
+
+	stream := &mergedContentStream{
+		results: make(chan mergedContentStreamResult),
+		usage:   make([]*genai.UsageMetadata, n),
+	}
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			iter := cloneChatSession(model, session).SendMessageStream(ctx, parts...)
+			for {
+				resp, err := iter.Next()
+				if err == iterator.Done {
+					return
+				}
+				if resp != nil {
+					for _, candidate := range resp.Candidates {
+						candidate.Index = int32(i)
+					}
+					resp.UsageMetadata = stream.addUsage(i, resp.UsageMetadata)
+				}
+				select {
+				case stream.results <- mergedContentStreamResult{resp: resp, err: err}:
+				case <-ctx.Done():
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(stream.results)
+	}()
+	return stream
+}
+
+func cloneChatSession(model *genai.GenerativeModel, session *genai.ChatSession) *genai.ChatSession {
+	clone := model.StartChat()
+	clone.History = slices.Clone(session.History)
+	return clone
+}
+
+type mergedContentStreamResult struct {
+	resp *genai.GenerateContentResponse
+	err  error
+}
+
+// mergedContentStream interleaves several streams, with candidate indexes
+// rewritten to identify the originating stream.
+type mergedContentStream struct {
+	results chan mergedContentStreamResult
+	err     error
+
+	usageMu sync.Mutex
+	usage   []*genai.UsageMetadata
+}
+
+// addUsage records the latest usage of stream i and returns the usage
+// aggregated across all streams, counting the shared prompt once.
+func (s *mergedContentStream) addUsage(i int, usageMetadata *genai.UsageMetadata) *genai.UsageMetadata {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	if usageMetadata != nil {
+		s.usage[i] = usageMetadata
+	}
+	aggregated := &genai.UsageMetadata{}
+	for _, u := range s.usage {
+		if u == nil {
+			continue
+		}
+		aggregated.PromptTokenCount = u.PromptTokenCount
+		aggregated.CandidatesTokenCount += u.CandidatesTokenCount
+	}
+	aggregated.TotalTokenCount = aggregated.PromptTokenCount + aggregated.CandidatesTokenCount
+	return aggregated
+}
+
+func (s *mergedContentStream) Next() (*genai.GenerateContentResponse, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	result, ok := <-s.results
+	if !ok {
+		s.err = iterator.Done
+		return nil, s.err
+	}
+	if result.err != nil {
+		s.err = result.err
+		return nil, s.err
+	}
+	return result.resp, nil
+}
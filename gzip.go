@@ -0,0 +1,114 @@
+package main
+
+import (
+	"cmp"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// acceptsGzip reports whether a request accepts gzip responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			v, err := strconv.ParseFloat(q, 64)
+			return err == nil && v > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipHandler compresses responses with gzip for requests that accept it, when
+// Gzip is set. Streams are not compressed, so that events arrive as they are
+// sent, nor are responses that are already encoded.
+func gzipHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Gzip || r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		gw := &gzipWriter{statusWriter: statusWriter{ResponseWriter: w}}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipWriter compresses a response, unless it is a stream, is already encoded,
+// or has no body.
+type gzipWriter struct {
+	statusWriter
+	gz *gzip.Writer
+	// pending is the status of a response whose header waits on its first write
+	// to sniff its content type, as net/http would, before it is compressed.
+	pending int
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.status != 0 || w.pending != 0 {
+		return
+	}
+	if w.Header().Get("Content-Type") == "" && status != http.StatusNoContent && status != http.StatusNotModified {
+		w.pending = status
+		return
+	}
+	w.writeHeader(status)
+}
+
+func (w *gzipWriter) writeHeader(status int) {
+	h := w.Header()
+	contentType := h.Get("Content-Type")
+	if status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && contentType != "" &&
+		!strings.HasPrefix(contentType, "text/event-stream") && !strings.HasPrefix(contentType, "application/x-ndjson") {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.statusWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.writeHeader(cmp.Or(w.pending, http.StatusOK))
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.statusWriter.Write(b)
+}
+
+// Flush flushes streamed responses.
+func (w *gzipWriter) Flush() {
+	if w.status == 0 && w.pending != 0 {
+		w.writeHeader(w.pending)
+	}
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	w.statusWriter.Flush()
+}
+
+func (w *gzipWriter) close() {
+	if w.status == 0 && w.pending != 0 {
+		w.writeHeader(w.pending)
+	}
+	if w.gz != nil {
+		_ = w.gz.Close()
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
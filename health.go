@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/googleapi"
+	"net/http"
+	"time"
+)
+
+// keyHealthCheckTimeout bounds each health check of a key.
+const keyHealthCheckTimeout = 10 * time.Second
+
+// healthProbeKey marks the context of health checks, which keyTransport sends
+// once, without hedging, and without counting them against budgets.
+type healthProbeKey struct{}
+
+var healthyKeys = newGauge("gemini_proxy_healthy_keys", "Gemini API keys that passed their last health check.")
+
+// checkKeyHealth checks the health of each key every KeyHealthCheckInterval,
+// until ctx is done.
+func checkKeyHealth(ctx context.Context) {
+	healthyKeys.set(float64(len(keys().keys)))
+	ticker := time.NewTicker(KeyHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		pool := keys()
+		healthy := 0
+		for i := range pool.keys {
+			if !pool.inUse(i) {
+				continue
+			}
+			err := checkClientHealth(ctx, int32(i))
+			wasUnhealthy := pool.unhealthy[i].Swap(err != nil)
+			switch {
+			case err != nil && !wasUnhealthy:
+				log.Warn().Err(err).Int("client", i).Msg("Key is unhealthy, removing it from rotation")
+			case err == nil && wasUnhealthy:
+				log.Info().Int("client", i).Msg("Key is healthy, returning it to rotation")
+			}
+			if err == nil {
+				healthy++
+			}
+		}
+		healthyKeys.set(float64(healthy))
+	}
+}
+
+// isHealthProbe reports whether a request is a health check.
+func isHealthProbe(ctx context.Context) bool {
+	probe, _ := ctx.Value(healthProbeKey{}).(bool)
+	return probe
+}
+
+// checkClientHealth counts tokens with GeminiTokenCountModel, which fails if a
+// client's key is invalid, and is supported by both API keys and Vertex AI.
+// Keys that are only rate limited are healthy.
+func checkClientHealth(ctx context.Context, useIndex int32) error {
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, healthProbeKey{}, true), keyHealthCheckTimeout)
+	defer cancel()
+	_, err := geminiClient(useIndex).GenerativeModel(GeminiTokenCountModel).CountTokens(ctx, genai.Text("ping"))
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to count tokens")
+	}
+	return nil
+}
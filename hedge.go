@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+var upstreamHedges = newCounter("gemini_proxy_upstream_hedged_requests_total", "Requests to the Gemini API hedged with a second key, by method and which of them was used.")
+
+// hedgeResult is the response to one of the requests of a hedged request.
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	hedge  bool
+	cancel context.CancelFunc
+}
+
+// cancelOnClose is a response body that cancels the request's context when
+// it is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// hedgeKeyRequest sends a request with the key of a client, and again with the
+// next key if it has not responded within HedgeDelay. The first successful
+// response is used, and the other request is cancelled.
+func hedgeKeyRequest(req *http.Request, index int) (*http.Response, error) {
+	results := make(chan hedgeResult, 2)
+	cancels := map[bool]context.CancelFunc{}
+	send := func(index int, hedge bool) error {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[hedge] = cancel
+		hedgeReq := req.WithContext(ctx)
+		hedgeReq.Body = body
+		go func() {
+			resp, err := sendKeyRequest(hedgeReq, index, true)
+			results <- hedgeResult{resp: resp, err: err, hedge: hedge, cancel: cancel}
+		}()
+		return nil
+	}
+	if err := send(index, false); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(HedgeDelay)
+	defer timer.Stop()
+	pending := 1
+	hedged := false
+	for {
+		select {
+		case <-timer.C:
+			next := nextKeyClient(req.Context(), index)
+			if next == index || send(next, true) != nil {
+				continue
+			}
+			pending++
+			hedged = true
+			continue
+		case result := <-results:
+			pending--
+			succeeded := result.err == nil && result.resp.StatusCode < http.StatusInternalServerError
+			if !succeeded && pending > 0 {
+				// The other request may still succeed.
+				if result.resp != nil {
+					_ = result.resp.Body.Close()
+				}
+				result.cancel()
+				continue
+			}
+			if hedged {
+				winner := "primary"
+				if result.hedge {
+					winner = "hedge"
+				}
+				upstreamHedges.add(1, "method", upstreamMethod(req), "winner", winner)
+			}
+			// Requests still in flight are cancelled, and their responses discarded.
+			if pending > 0 {
+				cancels[!result.hedge]()
+			}
+			go func(pending int) {
+				for range pending {
+					loser := <-results
+					if loser.resp != nil {
+						_ = loser.resp.Body.Close()
+					}
+					loser.cancel()
+				}
+			}(pending)
+			if result.err != nil {
+				result.cancel()
+				return nil, result.err
+			}
+			result.resp.Body = cancelOnClose{ReadCloser: result.resp.Body, cancel: result.cancel}
+			return result.resp, nil
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hmacSignatureHeader = "X-Signature"
+	hmacTimestampHeader = "X-Signature-Timestamp"
+)
+
+// hmacSecrets are the secrets of HMACSecrets.
+var hmacSecrets [][]byte
+
+// hmacSignatures are the signatures of requests that have been accepted, until
+// their timestamps are too old to be accepted again, so that they cannot be
+// replayed.
+var hmacSignatures = &seenSignatures{seen: map[string]time.Time{}}
+
+type seenSignatures struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	swept time.Time
+}
+
+// add records a signature until it expires, reporting whether it was new.
+func (s *seenSignatures) add(signature string, expires time.Time, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) >= HMACMaxSkew {
+		for seen, seenExpires := range s.seen {
+			if now.After(seenExpires) {
+				delete(s.seen, seen)
+			}
+		}
+		s.swept = now
+	}
+	if seenExpires, ok := s.seen[signature]; ok && !now.After(seenExpires) {
+		return false
+	}
+	s.seen[signature] = expires
+	return true
+}
+
+// parseHMACSecrets parses secrets in the form SECRET;SECRET.
+func parseHMACSecrets(s string) [][]byte {
+	var secrets [][]byte
+	for _, secret := range strings.Split(s, ";") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, []byte(secret))
+		}
+	}
+	return secrets
+}
+
+// verifyHMACSignature verifies that the signature of a request is the hex
+// HMAC-SHA256 with one of hmacSecrets of its timestamp, a dot and its body, that
+// the timestamp is within HMACMaxSkew of now, and that the signature has not
+// been seen before.
+func verifyHMACSignature(timestamp string, signature string, body []byte, now time.Time) error {
+	if timestamp == "" || signature == "" {
+		return errors.New("request is not signed")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "invalid signature timestamp")
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := now.Sub(signedAt); skew > HMACMaxSkew || skew < -HMACMaxSkew {
+		return errors.Errorf("signature timestamp is %s from now", skew.Round(time.Second))
+	}
+	mac, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return errors.Wrap(err, "invalid signature")
+	}
+	valid := false
+	for _, secret := range hmacSecrets {
+		h := hmac.New(sha256.New, secret)
+		h.Write([]byte(timestamp + "."))
+		h.Write(body)
+		if hmac.Equal(h.Sum(nil), mac) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	if !hmacSignatures.add(hex.EncodeToString(mac), signedAt.Add(HMACMaxSkew), now) {
+		return errors.New("signature has been used before")
+	}
+	return nil
+}
+
+// hmacHandler requires requests to be signed with one of hmacSecrets, when they
+// are set, before they are handled by next. Requests without a valid signature
+// are rejected with a 401.
+func hmacHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(hmacSecrets) == 0 || metricsRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = verifyHMACSignature(r.Header.Get(hmacTimestampHeader), r.Header.Get(hmacSignatureHeader), body, time.Now())
+		}
+		if err != nil {
+			code := "invalid_signature"
+			writeErrorResponse(w, http.StatusUnauthorized, &openai.Error{
+				Message: "The request signature is missing or invalid",
+				Type:    "invalid_request_error",
+				Code:    &code,
+			})
+			noteError(r.Context(), err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// introspectionTimeout is how long OIDCIntrospectionURL can take to respond.
+const introspectionTimeout = 10 * time.Second
+
+// introspectionResult is the cached introspection of a token: the ID of its
+// client if it is active.
+type introspectionResult struct {
+	id      string
+	active  bool
+	expires time.Time
+}
+
+// introspections caches introspections by the hash of their token, so that the
+// tokens themselves are not kept.
+type introspections struct {
+	mu      sync.Mutex
+	results map[[sha256.Size]byte]introspectionResult
+	swept   time.Time
+}
+
+var tokenIntrospections = &introspections{results: map[[sha256.Size]byte]introspectionResult{}}
+
+// introspect returns the ID of the client of a token, from its subject or
+// client ID, and whether it is active, introspecting it with OIDCIntrospectionURL
+// unless it was within OIDCIntrospectionCacheTTL.
+func (i *introspections) introspect(token string, now time.Time) (string, bool, error) {
+	hash := sha256.Sum256([]byte(token))
+	i.mu.Lock()
+	result, ok := i.results[hash]
+	i.mu.Unlock()
+	if ok && now.Before(result.expires) {
+		return result.id, result.active, nil
+	}
+
+	result, err := introspectToken(token, now)
+	if err != nil {
+		return "", false, err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if now.Sub(i.swept) >= OIDCIntrospectionCacheTTL {
+		for cached, cachedResult := range i.results {
+			if !now.Before(cachedResult.expires) {
+				delete(i.results, cached)
+			}
+		}
+		i.swept = now
+	}
+	i.results[hash] = result
+	return result.id, result.active, nil
+}
+
+// introspectToken introspects a token with OIDCIntrospectionURL, as in RFC
+// 7662, authenticated as OIDCClientID when it is set. Active tokens are cached
+// until they expire, if that is within OIDCIntrospectionCacheTTL.
+func introspectToken(token string, now time.Time) (introspectionResult, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, OIDCIntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return introspectionResult{}, errors.Wrap(err, "failed to create introspection request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if OIDCClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(OIDCClientID), url.QueryEscape(OIDCClientSecret))
+	}
+	client := &http.Client{Timeout: introspectionTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return introspectionResult{}, errors.Wrap(err, "failed to introspect token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return introspectionResult{}, errors.Errorf("failed to introspect token: %s returned %d", OIDCIntrospectionURL, resp.StatusCode)
+	}
+	var introspection struct {
+		Active    bool     `json:"active"`
+		Subject   string   `json:"sub"`
+		ClientID  string   `json:"client_id"`
+		ExpiresAt *float64 `json:"exp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&introspection); err != nil {
+		return introspectionResult{}, errors.Wrap(err, "failed to unmarshal introspection")
+	}
+	result := introspectionResult{
+		id:      cmp.Or(introspection.Subject, introspection.ClientID, keyID(token)),
+		active:  introspection.Active,
+		expires: now.Add(OIDCIntrospectionCacheTTL),
+	}
+	if result.active && introspection.ExpiresAt != nil {
+		if expires := time.Unix(int64(*introspection.ExpiresAt), 0); expires.Before(result.expires) {
+			result.expires = expires
+		}
+		if !now.Before(result.expires) {
+			result.active = false
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipAllowlist, ipDenylist and trustedProxies are the networks of IPAllowlist,
+// IPDenylist and TrustedProxies.
+var ipAllowlist, ipDenylist, trustedProxies []netip.Prefix
+
+// parsePrefixes parses networks in the form CIDR;CIDR, where a bare address is
+// a network of that address alone.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range strings.Split(s, ";") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid address %s", cidr)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %s", cidr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client of a request. Requests from
+// trustedProxies are from the last address of their X-Forwarded-For header
+// that is not itself a trusted proxy, as each proxy appends the address it
+// received the request from, and earlier addresses can be forged by clients.
+func clientAddr(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, errors.Wrapf(err, "invalid remote address %s", r.RemoteAddr)
+	}
+	addr = addr.Unmap()
+	if !containsAddr(trustedProxies, addr) {
+		return addr, nil
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		hopAddr, err := netip.ParseAddr(hop)
+		if err != nil {
+			return netip.Addr{}, errors.Wrapf(err, "invalid X-Forwarded-For address %s", hop)
+		}
+		addr = hopAddr.Unmap()
+		if !containsAddr(trustedProxies, addr) {
+			break
+		}
+	}
+	return addr, nil
+}
+
+// ipFilterHandler rejects requests from clients in ipDenylist, or not in
+// ipAllowlist when it is set, with a 403 before they are handled by next.
+func ipFilterHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(ipAllowlist) == 0 && len(ipDenylist) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		addr, err := clientAddr(r)
+		if err == nil && (containsAddr(ipDenylist, addr) || len(ipAllowlist) > 0 && !containsAddr(ipAllowlist, addr)) {
+			err = errors.Errorf("client address %s is not allowed", addr)
+		}
+		if err != nil {
+			code := "ip_not_allowed"
+			writeErrorResponse(w, http.StatusForbidden, &openai.Error{
+				Message: "Requests from your IP address are not allowed",
+				Type:    "invalid_request_error",
+				Code:    &code,
+			})
+			noteError(r.Context(), err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
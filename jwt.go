@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefreshInterval is how long the keys of JWTJwksURL are used before
+	// they are fetched again, and jwksMinRefreshInterval the least time between
+	// fetches for tokens signed with unknown keys, as when keys are rotated.
+	jwksRefreshInterval    = 5 * time.Minute
+	jwksMinRefreshInterval = 30 * time.Second
+	jwksFetchTimeout       = 10 * time.Second
+	// jwtLeeway is how far clocks can differ when checking the times of tokens.
+	jwtLeeway = time.Minute
+)
+
+// jwtAlgorithms are the hashes of the supported signing algorithms.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// jwtClaims are the claims of a token that are checked.
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// audiences returns the audience of the claims, which is a string or a list.
+func (c *jwtClaims) audiences() []string {
+	var audience string
+	if json.Unmarshal(c.Audience, &audience) == nil {
+		return []string{audience}
+	}
+	var audiences []string
+	_ = json.Unmarshal(c.Audience, &audiences)
+	return audiences
+}
+
+// jwks are the public keys of JWTJwksURL by key ID.
+type jwks struct {
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+var jwtKeys = &jwks{}
+
+// key returns the public key with an ID, fetching the keys if they are stale
+// or do not have it.
+func (k *jwks) key(id string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.keys[id]
+	if age := time.Since(k.fetched); !ok && age >= jwksMinRefreshInterval || age >= jwksRefreshInterval {
+		keys, err := fetchJWKS(JWTJwksURL)
+		if err != nil {
+			// The keys fetched before are used until they can be fetched again.
+			log.Error().Err(err).Msg("")
+		} else {
+			k.keys = keys
+		}
+		k.fetched = time.Now()
+		key, ok = k.keys[id]
+	}
+	if !ok {
+		return nil, errors.Errorf("unknown key %s", id)
+	}
+	return key, nil
+}
+
+// fetchJWKS fetches a JSON Web Key Set, keeping its RSA and EC signing keys.
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	client := &http.Client{Timeout: jwksFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch JWKS")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to fetch JWKS: %s returned %d", url, resp.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal JWKS")
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		values, err := decodeJWKValues(jwk.N, jwk.E, jwk.X, jwk.Y)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %s", jwk.Kid)
+		}
+		switch jwk.Kty {
+		case "RSA":
+			keys[jwk.Kid] = &rsa.PublicKey{N: values[0], E: int(values[1].Int64())}
+		case "EC":
+			curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[jwk.Crv]
+			if curve == nil {
+				continue
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{Curve: curve, X: values[2], Y: values[3]}
+		}
+	}
+	return keys, nil
+}
+
+func decodeJWKValues(values ...string) ([]*big.Int, error) {
+	ints := make([]*big.Int, len(values))
+	for i, value := range values {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		ints[i] = new(big.Int).SetBytes(b)
+	}
+	return ints, nil
+}
+
+// verifyJWT verifies the signature of a token with the keys of JWTJwksURL, that
+// it is current, and that it is for JWTIssuer and JWTAudience, if they are set.
+// It returns the token's claims.
+func verifyJWT(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "malformed header")
+	}
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, errors.Errorf("unsupported algorithm %s", header.Alg)
+	}
+	key, err := jwtKeys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed signature")
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifyJWTSignature(header.Alg, key, hash, h.Sum(nil), signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "malformed claims")
+	}
+	seconds := float64(now.Unix())
+	leeway := jwtLeeway.Seconds()
+	switch {
+	case claims.ExpiresAt != nil && seconds > *claims.ExpiresAt+leeway:
+		return nil, errors.New("token has expired")
+	case claims.NotBefore != nil && seconds < *claims.NotBefore-leeway:
+		return nil, errors.New("token is not valid yet")
+	case JWTIssuer != "" && claims.Issuer != JWTIssuer:
+		return nil, errors.Errorf("token has issuer %s", claims.Issuer)
+	case JWTAudience != "" && !slices.Contains(claims.audiences(), JWTAudience):
+		return nil, errors.New("token is not for JWT_AUDIENCE")
+	}
+	return &claims, nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest []byte, signature []byte) error {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+			return nil
+		}
+		if strings.HasPrefix(alg, "PS") && rsa.VerifyPSS(key, hash, digest, signature, nil) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		// ECDSA signatures are the concatenated r and s of the curve's size.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	generativelanguage "cloud.google.com/go/ai/generativelanguage/apiv1beta"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/upstream"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/option"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// keyFilePollInterval is how often GeminiApiKeyFile is checked for changes.
+	// GeminiApiKeySecret is checked every KeySecretRefreshInterval.
+	keyFilePollInterval = 30 * time.Second
+)
+
+// keyPool is the configured Gemini API keys and their clients. Keys are only
+// ever added, so that a client index refers to the same key for the life of
+// the proxy. Keys removed by a reload are retired, with a weight of zero, and
+// no longer given to new requests.
+type keyPool struct {
+	keys []string
+	// ids identify the keys in metrics without revealing them.
+	ids []string
+	// keyGroup is the configured keys, used by requests without a virtual key.
+	keyGroup
+	// groups are the named key pools of virtual keys.
+	groups            map[string]*keyGroup
+	geminiClients     []*genai.Client
+	generativeClients []*generativelanguage.GenerativeClient
+	modelClients      []*generativelanguage.ModelClient
+	// inFlight are the numbers of requests in flight on each client.
+	inFlight []*atomic.Int32
+	// unhealthy marks the clients whose keys failed their last health check.
+	unhealthy []*atomic.Bool
+	// budgets count the requests of each key against its budgets.
+	budgets []*keyBudget
+	// breakers are the circuit breakers of the keys.
+	breakers []*circuitBreaker
+	// vertex are the Vertex AI backends of Vertex AI entries, nil for API keys.
+	vertex []*vertexBackend
+}
+
+// keyGroup is a set of keys in the pool that requests are spread across.
+type keyGroup struct {
+	// weights are the weights of the keys by client index, zero for keys not in
+	// the group, such as retired keys.
+	weights []int
+	// selector picks the client of each request, nil if the group is empty.
+	selector upstream.KeySelector
+}
+
+var (
+	currentKeyPool atomic.Pointer[keyPool]
+	// keyPoolMu serializes reloads of the key pool.
+	keyPoolMu sync.Mutex
+	// keysContents is the Gemini API keys as read at the last reload.
+	keysContents string
+
+	errNoKeyAvailable = errors.New("no Gemini API key is available")
+)
+
+// keys returns the current key pool.
+func keys() *keyPool {
+	return currentKeyPool.Load()
+}
+
+// geminiClient returns the SDK client of a client index.
+func geminiClient(useIndex int32) *genai.Client {
+	if isPassthroughClient(useIndex) {
+		return passthroughClients.client(useIndex).geminiClient
+	}
+	return keys().geminiClients[useIndex]
+}
+
+// clientKey returns the key of a client index.
+func clientKey(useIndex int32) string {
+	if isPassthroughClient(useIndex) {
+		return passthroughClients.client(useIndex).key
+	}
+	return keys().keys[useIndex]
+}
+
+// generativeClient returns the API client of a client index, for requests the
+// SDK cannot express.
+func generativeClient(useIndex int32) *generativelanguage.GenerativeClient {
+	if isPassthroughClient(useIndex) {
+		return passthroughClients.client(useIndex).generativeClient
+	}
+	return keys().generativeClients[useIndex]
+}
+
+// modelClient returns the models API client of a client index, for tuned
+// models.
+func modelClient(useIndex int32) *generativelanguage.ModelClient {
+	if isPassthroughClient(useIndex) {
+		return passthroughClients.client(useIndex).modelClient
+	}
+	return keys().modelClients[useIndex]
+}
+
+// keyID returns a short hash of a key, to tell keys apart in metrics.
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// active reports whether a client's key is in the group.
+func (g *keyGroup) active(i int) bool {
+	return i < len(g.weights) && g.weights[i] > 0
+}
+
+// inUse reports whether a client's key is in any group, rather than retired.
+func (p *keyPool) inUse(i int) bool {
+	if p.active(i) {
+		return true
+	}
+	for _, g := range p.groups {
+		if g.active(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// group returns the keys a request is spread across: those of the pool of its
+// virtual key, or the configured keys.
+func (p *keyPool) group(ctx context.Context) *keyGroup {
+	if vk, ok := ctx.Value(virtualKeyContextKey{}).(*virtualKey); ok && vk.pool != "" {
+		if g, ok := p.groups[vk.pool]; ok {
+			return g
+		}
+	}
+	return &p.keyGroup
+}
+
+// available reports whether a client's key is healthy, within its budgets, and
+// its circuit breaker is not open.
+func (p *keyPool) available(i int, now time.Time) bool {
+	return !p.unhealthy[i].Load() && p.budgets[i].exhaustedUntil(now).IsZero() && !p.breakers[i].open(now)
+}
+
+// apiKey is a Gemini API key, or Vertex AI entry, with its weight and request
+// budgets.
+type apiKey struct {
+	key    string
+	weight int
+	limits keyLimits
+	// credentials is the service account key file of a Vertex AI entry.
+	credentials string
+}
+
+// parseApiKeys parses Gemini API keys with optional weights and request
+// budgets, in the form KEY:WEIGHT?rpm=N&rpd=N;KEY. Keys can also be separated
+// by newlines. Keys without a weight have a weight of 1, and keys without
+// budgets have those of KeyRPM and KeyRPD. A key can instead be a Vertex AI
+// entry, vertex://PROJECT/REGION, with a credentials parameter for its service
+// account key file.
+func parseApiKeys(s string) ([]apiKey, error) {
+	var keys []apiKey
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key := apiKey{key: entry, weight: 1, limits: keyLimits{rpm: KeyRPM, rpd: KeyRPD}}
+		if i := strings.Index(key.key, "?"); i >= 0 {
+			query, err := url.ParseQuery(key.key[i+1:])
+			if err != nil {
+				return nil, errors.Wrapf(err, "key %d: invalid budgets", len(keys))
+			}
+			if key.limits, err = parseKeyLimits(query, key.limits); err != nil {
+				return nil, errors.Wrapf(err, "key %d", len(keys))
+			}
+			key.credentials = query.Get("credentials")
+			key.key = key.key[:i]
+		}
+		if i := strings.LastIndex(key.key, ":"); i >= 0 && !strings.HasPrefix(key.key[i:], "://") {
+			w, err := strconv.Atoi(key.key[i+1:])
+			if err != nil || w <= 0 {
+				return nil, errors.Errorf("key %d: weight must be a positive integer", len(keys))
+			}
+			key.key, key.weight = key.key[:i], w
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// readApiKeys reads the Gemini API keys from GeminiApiKeySecret or
+// GeminiApiKeyFile if either is set, or GeminiApiKey otherwise.
+func readApiKeys() (string, error) {
+	if GeminiApiKeySecret != "" {
+		return readSecretApiKeys()
+	}
+	if GeminiApiKeyFile == "" {
+		return GeminiApiKey, nil
+	}
+	b, err := os.ReadFile(GeminiApiKeyFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read GEMINI_API_KEY_FILE")
+	}
+	return string(b), nil
+}
+
+// reloadKeys reads the Gemini API keys and replaces the key pool, creating
+// clients for new keys and retiring those no longer listed.
+func reloadKeys() error {
+	keyPoolMu.Lock()
+	defer keyPoolMu.Unlock()
+
+	s, err := readApiKeys()
+	if err != nil {
+		return err
+	}
+	newKeys, err := parseApiKeys(s)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse Gemini API keys")
+	}
+	if len(newKeys) == 0 && !KeyPassthrough && VirtualKeysFile == "" {
+		return errors.New("no Gemini API keys")
+	}
+
+	pool := keys().clone()
+	pool.weights = make([]int, len(pool.keys))
+	added := 0
+	for _, key := range newKeys {
+		index := slices.Index(pool.keys, key.key)
+		if index < 0 {
+			index, err = pool.add(key)
+			if err != nil {
+				return err
+			}
+			added++
+		}
+		pool.weights[index] += key.weight
+		pool.budgets[index].setLimits(key.limits)
+	}
+	if err := pool.keyGroup.newSelector(); err != nil {
+		return err
+	}
+	var virtualKeys map[string]*virtualKey
+	if VirtualKeysFile != "" {
+		virtualKeys, err = loadVirtualKeys(pool)
+		if err != nil {
+			return err
+		}
+	}
+	currentKeyPool.Store(pool)
+	currentVirtualKeys.Store(&virtualKeys)
+	keysContents = s
+	log.Info().Int("keys", len(newKeys)).Int("added", added).Msg("Loaded Gemini API keys")
+	return nil
+}
+
+// clone returns a copy of the pool that keys can be added to, or an empty pool
+// if p is nil.
+func (p *keyPool) clone() *keyPool {
+	if p == nil {
+		return &keyPool{}
+	}
+	return &keyPool{
+		keys:              slices.Clone(p.keys),
+		ids:               slices.Clone(p.ids),
+		keyGroup:          keyGroup{weights: slices.Clone(p.weights), selector: p.selector},
+		groups:            p.groups,
+		geminiClients:     slices.Clone(p.geminiClients),
+		generativeClients: slices.Clone(p.generativeClients),
+		modelClients:      slices.Clone(p.modelClients),
+		inFlight:          slices.Clone(p.inFlight),
+		unhealthy:         slices.Clone(p.unhealthy),
+		budgets:           slices.Clone(p.budgets),
+		breakers:          slices.Clone(p.breakers),
+		vertex:            slices.Clone(p.vertex),
+	}
+}
+
+// close closes the clients of the pool, returning the first error.
+func (p *keyPool) close() error {
+	if p == nil {
+		return nil
+	}
+	var firstErr error
+	for i := range p.keys {
+		if err := p.geminiClients[i].Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrap(err, "failed to close Gemini client")
+		}
+		if err := p.generativeClients[i].Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrap(err, "failed to close Gemini API client")
+		}
+		if err := p.modelClients[i].Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrap(err, "failed to close Gemini models client")
+		}
+	}
+	return firstErr
+}
+
+// add adds a key to the pool with a weight of zero, creating its clients, and
+// returns its client index.
+func (p *keyPool) add(key apiKey) (int, error) {
+	client, generativeClient, modelClient, err := newClients(&keyTransport{index: len(p.keys)}, key.key)
+	if err != nil {
+		return 0, err
+	}
+	var vertex *vertexBackend
+	if strings.HasPrefix(key.key, vertexScheme) {
+		vertex, err = newVertexBackend(key.key, key.credentials)
+		if err != nil {
+			return 0, err
+		}
+	}
+	p.keys = append(p.keys, key.key)
+	p.ids = append(p.ids, keyID(key.key))
+	p.weights = append(p.weights, 0)
+	p.geminiClients = append(p.geminiClients, client)
+	p.generativeClients = append(p.generativeClients, generativeClient)
+	p.modelClients = append(p.modelClients, modelClient)
+	p.inFlight = append(p.inFlight, &atomic.Int32{})
+	p.unhealthy = append(p.unhealthy, &atomic.Bool{})
+	p.budgets = append(p.budgets, &keyBudget{})
+	p.breakers = append(p.breakers, &circuitBreaker{})
+	p.vertex = append(p.vertex, vertex)
+	return len(p.keys) - 1, nil
+}
+
+// newClients creates the clients of a key, authenticated by transport, for
+// GeminiEndpoint if it is set.
+func newClients(transport *keyTransport, key string) (*genai.Client, *generativelanguage.GenerativeClient, *generativelanguage.ModelClient, error) {
+	// The key is still needed for cached contents, which the SDK does not send through the HTTP client.
+	opts := []option.ClientOption{option.WithAPIKey(key), option.WithHTTPClient(&http.Client{Transport: transport})}
+	if GeminiEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(GeminiEndpoint))
+	}
+	client, err := genai.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to create Gemini client")
+	}
+	generativeClient, err := generativelanguage.NewGenerativeRESTClient(context.Background(), opts...)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to create Gemini API client")
+	}
+	modelClient, err := generativelanguage.NewModelRESTClient(context.Background(), opts...)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to create Gemini models client")
+	}
+	return client, generativeClient, modelClient, nil
+}
+
+// watchKeys reloads the Gemini API keys when the contents of GeminiApiKeySecret
+// or GeminiApiKeyFile change. They are also reloaded with the config, on
+// SIGHUP.
+func watchKeys() {
+	if GeminiApiKeySecret == "" && GeminiApiKeyFile == "" {
+		return
+	}
+	interval := keyFilePollInterval
+	if GeminiApiKeySecret != "" {
+		interval = KeySecretRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s, err := readApiKeys()
+		keyPoolMu.Lock()
+		unchanged := s == keysContents
+		keyPoolMu.Unlock()
+		if err != nil || unchanged {
+			continue
+		}
+		if err := reloadKeys(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload Gemini API keys")
+		}
+	}
+}
+
+// newSelector creates the group's selector for its weights, with KeySelection.
+func (g *keyGroup) newSelector() error {
+	if !slices.ContainsFunc(g.weights, func(weight int) bool { return weight > 0 }) {
+		g.selector = nil
+		return nil
+	}
+	selector, err := upstream.NewKeySelector(KeySelection, g.weights)
+	if err != nil {
+		return err
+	}
+	g.selector = selector
+	return nil
+}
+
+// selectorClients is the state of the pool's clients as a selector sees it.
+type selectorClients struct {
+	pool *keyPool
+	now  time.Time
+}
+
+func (c selectorClients) Available(i int) bool {
+	return c.pool.available(i, c.now)
+}
+
+func (c selectorClients) InFlight(i int) int {
+	return int(c.pool.inFlight[i].Load())
+}
+
+// nextClient returns the client for the next request, which must be released
+// with doneClient when the request finishes. Requests that present their own
+// key with KeyPassthrough use its client. Otherwise the client is picked from
+// the request's group by KeySelection, or by the client's identity with
+// StickyKeys. Clients that are unhealthy, out of
+// budget or have an open circuit breaker are skipped, unless all of them are.
+// errNoKeyAvailable is returned if the group has no keys to pick from.
+func nextClient(ctx context.Context) (int32, error) {
+	if index, ok := ctx.Value(passthroughKey{}).(int32); ok {
+		return startClient(index), nil
+	}
+	pool := keys()
+	g := pool.group(ctx)
+	if g.selector == nil {
+		return 0, errNoKeyAvailable
+	}
+	clients := selectorClients{pool: pool, now: time.Now()}
+	var index int
+	if identity, ok := ctx.Value(stickyIdentityKey{}).(string); ok {
+		index = upstream.SelectSticky(identity, g.weights, clients)
+	} else {
+		index = g.selector.Select(clients)
+	}
+	if index < 0 {
+		return 0, errNoKeyAvailable
+	}
+	return startClient(int32(index)), nil
+}
+
+// writeNoKeyAvailable responds to a request for which nextClient found no key
+// with a 503.
+func writeNoKeyAvailable(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, http.StatusServiceUnavailable, "server_error", "No Gemini API key is available for this request")
+	noteError(r.Context(), err)
+}
+
+// startClient counts a request in flight on a client, returning the client.
+func startClient(useIndex int32) int32 {
+	if isPassthroughClient(useIndex) {
+		passthroughClients.hold(useIndex)
+		return useIndex
+	}
+	keys().inFlight[useIndex].Add(1)
+	return useIndex
+}
+
+// doneClient counts a request on a client as finished.
+func doneClient(useIndex int32) {
+	if isPassthroughClient(useIndex) {
+		passthroughClients.release(useIndex)
+		return
+	}
+	keys().inFlight[useIndex].Add(-1)
+}
+
+// keyTransport authenticates Gemini API requests of a client with its key. Model
+// requests that are rate limited are retried up to KeyRetries times, each with
+// the next key in use and a jittered backoff, and are hedged with the next key
+// after HedgeDelay. Requests of the clients of keys presented by clients are
+// sent with key instead.
+type keyTransport struct {
+	index int
+	key   string
+}
+
+func (t *keyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if vk, ok := req.Context().Value(virtualKeyContextKey{}).(*virtualKey); ok {
+		// Models are checked again here, as handlers also use models that
+		// requests do not name, such as defaults. Counting tokens is left to
+		// the request's model, as usage is counted with GeminiTokenCountModel.
+		if model := upstreamModel(req); model != "" && upstreamMethod(req) != "countTokens" && !vk.allows(model) {
+			return googleErrorResponse(req, http.StatusForbidden, "The model "+model+" is not allowed for this API key"), nil
+		}
+	}
+	// Health checks test the key they are sent with, so are not retried with others.
+	retryable := t.key == "" && !isHealthProbe(req.Context()) && retryableKeyRequest(req)
+	var resp *http.Response
+	var err error
+	if t.key != "" {
+		resp, err = sendPassthroughRequest(req, t.key)
+	} else if retryable && HedgeDelay > 0 {
+		resp, err = hedgeKeyRequest(req, t.index)
+	} else {
+		resp, err = sendKeyRequest(req, t.index, retryable)
+	}
+	if vk, ok := req.Context().Value(virtualKeyContextKey{}).(*virtualKey); ok && vk.tenant != nil && err == nil {
+		resp.Body = &tenantUsageBody{ReadCloser: resp.Body, tenant: vk.tenant}
+	}
+	return resp, err
+}
+
+// sendKeyRequest sends a request with the key of a client, retrying it with
+// the next key if it is retryable, and is rate limited or fails transiently,
+// within the retry budget.
+func sendKeyRequest(req *http.Request, index int, retryable bool) (*http.Response, error) {
+	retries := 0
+	if retryable {
+		retries = KeyRetries
+	}
+	// Health checks are not requests of clients, so count against no budget.
+	probe := isHealthProbe(req.Context())
+	if !probe {
+		upstreamRetryBudget.deposit()
+	}
+	for attempt := 0; ; attempt++ {
+		pool := keys()
+		keyReq := req.Clone(req.Context())
+		keyReq.Header.Set("X-Goog-Api-Key", pool.keys[index])
+		setRequestIDHeader(keyReq.Header, req.Context())
+		if attempt > 0 {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			keyReq.Body = body
+		}
+		start := time.Now()
+		if !probe {
+			pool.budgets[index].take(start)
+		}
+		var resp *http.Response
+		var err error
+		if pool.vertex[index] != nil {
+			// Vertex AI backends record each region they try.
+			resp, err = pool.vertex[index].roundTrip(keyReq, pool.ids[index])
+		} else {
+			resp, err = upstreamTransport.RoundTrip(keyReq)
+			observeUpstreamRequest(req, pool.ids[index], "", start, resp, err)
+		}
+		if req.Context().Err() == nil {
+			// Requests cancelled by the client say nothing about the key.
+			pool.breakers[index].record(pool.ids[index], resp, err, time.Now())
+		}
+		reason := retryReason(req, resp, err)
+		if reason == "" || attempt >= retries {
+			return resp, err
+		}
+		method := upstreamMethod(req)
+		if !upstreamRetryBudget.withdraw() {
+			upstreamRetriesExhausted.add(1, "method", method, "reason", reason)
+			return resp, err
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		upstreamRetries.add(1, "method", method, "reason", reason)
+
+		delay := retryDelay(attempt)
+		log.Warn().Err(err).Str("path", req.URL.Path).Int("client", index).Str("reason", reason).Dur("delay", delay).Msg("Retrying request with the next key")
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		index = nextKeyClient(req.Context(), index)
+	}
+}
+
+// sendPassthroughRequest sends a request with a key presented by a client. It
+// is not retried, nor counted against budgets or by a circuit breaker, which
+// are those of the configured keys.
+func sendPassthroughRequest(req *http.Request, key string) (*http.Response, error) {
+	keyReq := req.Clone(req.Context())
+	keyReq.Header.Set("X-Goog-Api-Key", key)
+	setRequestIDHeader(keyReq.Header, req.Context())
+	start := time.Now()
+	resp, err := upstreamTransport.RoundTrip(keyReq)
+	observeUpstreamRequest(req, passthroughKeyID, "", start, resp, err)
+	return resp, err
+}
+
+// nextKeyClient returns the next client after index in the group of a request
+// that is available, or index if there is none.
+func nextKeyClient(ctx context.Context, index int) int {
+	pool := keys()
+	g := pool.group(ctx)
+	for j := 1; j <= len(pool.keys); j++ {
+		if next := (index + j) % len(pool.keys); g.active(next) && pool.available(next, time.Now()) {
+			return next
+		}
+	}
+	return index
+}
+
+// retryableKeyRequest reports whether a request can be retried with another
+// key. Only model methods are retried, and not those that reference cached
+// contents or files, which belong to a single key.
+func retryableKeyRequest(req *http.Request) bool {
+	if !strings.Contains(req.URL.Path, "/models/") || !strings.Contains(req.URL.Path, ":") {
+		return false
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return false
+	}
+	return !bytes.Contains(b, []byte(`"cachedContents/`)) && !bytes.Contains(b, []byte(`"files/`))
+}
+
+var (
+	upstreamRequests = newCounter("gemini_proxy_upstream_requests_total", "Requests to the Gemini API, by key, Vertex AI region, method and status code.")
+	upstreamErrors   = newCounter("gemini_proxy_upstream_errors_total", "Requests to the Gemini API that failed or returned an error status, by key, Vertex AI region, method and status code.")
+	upstreamDuration = newHistogram("gemini_proxy_upstream_request_duration_seconds", "Time until the Gemini API responded, by key, Vertex AI region and method.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+)
+
+// observeUpstreamRequest records a request to the Gemini API in the upstream
+// metrics, labelled with the region of Vertex AI requests. Requests that
+// failed without a response have the code "error", or "cancelled" if they were
+// cancelled, such as hedged requests that lost, which are not errors.
+func observeUpstreamRequest(req *http.Request, id string, region string, start time.Time, resp *http.Response, err error) {
+	labels := []string{"key", id}
+	if region != "" {
+		labels = append(labels, "region", region)
+	}
+	labels = append(labels, "method", upstreamMethod(req))
+	code := "error"
+	cancelled := err != nil && req.Context().Err() != nil
+	switch {
+	case cancelled:
+		code = "cancelled"
+	case err == nil:
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	codeLabels := append(slices.Clip(labels), "code", code)
+	upstreamRequests.add(1, codeLabels...)
+	if !cancelled && (err != nil || resp.StatusCode >= http.StatusBadRequest) {
+		upstreamErrors.add(1, codeLabels...)
+	}
+	upstreamDuration.observe(time.Since(start).Seconds(), labels...)
+}
+
+// upstreamModel returns the model of a Gemini API request, or "" if it is not
+// for a model.
+func upstreamModel(req *http.Request) string {
+	_, rest, ok := strings.Cut(req.URL.Path, "/models/")
+	if !ok {
+		return ""
+	}
+	model, _, _ := strings.Cut(rest, ":")
+	return model
+}
+
+// upstreamMethod names the Gemini API method of a request, such as
+// batchEmbedContents for custom methods, or GET models for standard ones.
+func upstreamMethod(req *http.Request) string {
+	if i := strings.LastIndex(req.URL.Path, ":"); i >= 0 {
+		return req.URL.Path[i+1:]
+	}
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "v1") && i+1 < len(segments) {
+			return req.Method + " " + segments[i+1]
+		}
+	}
+	return req.Method
+}
@@ -1,59 +1,338 @@
 package main
 
 import (
+	"cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
 	"context"
 	"encoding/json"
 	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/upstream"
 	"github.com/google/generative-ai-go/genai"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
 	"io"
 	"net/http"
-	"os"
+	"net/url"
 	"slices"
+	"strconv"
 	"strings"
-	"sync/atomic"
+	"time"
 )
 
 const (
-	openAIEmbeddingsEndpoint = "/v1/embeddings"
-	openAIModelsEndpoints    = "/v1/models"
+	openAIEmbeddingsEndpoint       = "/v1/embeddings"
+	openAIModelsEndpoints          = "/v1/models"
+	openAIModelEndpoint            = "/v1/models/{model...}"
+	openAIChatCompletionsEndpoint  = "/v1/chat/completions"
+	openAICompletionsEndpoint      = "/v1/completions"
+	cachedContentsEndpoint         = "/v1/cached_contents"
+	cachedContentEndpoint          = "/v1/cached_contents/{id}"
+	openAIResponsesEndpoint        = "/v1/responses"
+	anthropicMessagesEndpoint      = "/v1/messages"
+	ollamaTagsEndpoint             = "/api/tags"
+	ollamaEmbedEndpoint            = "/api/embed"
+	ollamaEmbeddingsEndpoint       = "/api/embeddings"
+	ollamaChatEndpoint             = "/api/chat"
+	azureEmbeddingsEndpoint        = "/openai/deployments/{deployment}/embeddings"
+	azureChatCompletionsEndpoint   = "/openai/deployments/{deployment}/chat/completions"
+	azureCompletionsEndpoint       = "/openai/deployments/{deployment}/completions"
+	openAITranscriptionsEndpoint   = "/v1/audio/transcriptions"
+	openAIModerationsEndpoint      = "/v1/moderations"
+	openAIFilesEndpoint            = "/v1/files"
+	openAIFileEndpoint             = "/v1/files/{id}"
+	openAIFileContentEndpoint      = "/v1/files/{id}/content"
+	openAIBatchesEndpoint          = "/v1/batches"
+	openAIBatchEndpoint            = "/v1/batches/{id}"
+	openAIBatchCancelEndpoint      = "/v1/batches/{id}/cancel"
+	openAIFineTuningJobsEndpoint   = "/v1/fine_tuning/jobs"
+	openAIFineTuningJobEndpoint    = "/v1/fine_tuning/jobs/{id}"
+	openAIFineTuningCancelEndpoint = "/v1/fine_tuning/jobs/{id}/cancel"
+	cohereEmbedEndpoint            = "/v1/embed"
+	teiEmbedEndpoint               = "/embed"
+	teiInfoEndpoint                = "/info"
+	rerankEndpoint                 = "/v1/rerank"
+	rerankV2Endpoint               = "/v2/rerank"
+	countTokensEndpoint            = "/utils/count_tokens"
+	metricsEndpoint                = "/metrics"
 )
 
 var (
-	GeminiApiKey  = os.Getenv("GEMINI_API_KEY")
-	GeminiApiKeys = strings.Split(GeminiApiKey, ";")
-	ListenAddr    = os.Getenv("LISTEN_ADDR")
-	geminiClients []*genai.Client
-	currentClient atomic.Int32
+	// GeminiApiKey is the Gemini API keys, in the form KEY;KEY. A key can be given
+	// a weight, KEY:WEIGHT, to take that many times the requests of other keys.
+	// GeminiApiKeyFile is a file of keys in the same form, used instead if set,
+	// which is reloaded when it changes.
+	GeminiApiKey     = setting("GEMINI_API_KEY")
+	GeminiApiKeyFile = setting("GEMINI_API_KEY_FILE")
+	ListenAddr       = setting("LISTEN_ADDR")
+	// TLSCertFile and TLSKeyFile are a PEM certificate and key to serve HTTPS
+	// with instead of HTTP, which are reloaded when they change, and on SIGHUP.
+	// TLSClientCAFile is a PEM bundle of CAs, which requires clients to present a
+	// certificate signed by one of them when set.
+	TLSCertFile     = setting("TLS_CERT_FILE")
+	TLSKeyFile      = setting("TLS_KEY_FILE")
+	TLSClientCAFile = setting("TLS_CLIENT_CA_FILE")
+	// H2C serves HTTP/2 without TLS as well as HTTP/1.1 when TLSCertFile is not
+	// set, for meshes and load balancers that multiplex plaintext connections.
+	// HTTP/2 is always served with TLS.
+	H2C = setting("H2C") == "true"
+	// MetricsListenAddr, when set, serves metricsEndpoint on a listener of its
+	// own instead of ListenAddr, out of reach of clients, and with Pprof the
+	// profiles of net/http/pprof under /debug/pprof/, for diagnosing latency or
+	// memory growth.
+	MetricsListenAddr = setting("METRICS_LISTEN_ADDR")
+	Pprof             = setting("PPROF") == "true"
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout are the
+	// timeouts of the listeners' connections, as in http.Server, so that slow or
+	// idle clients cannot hold them open. WriteTimeout includes the time taken
+	// to generate responses, streams included, so it is unlimited by default.
+	ReadHeaderTimeout = 10 * time.Second
+	ReadTimeout       = 5 * time.Minute
+	WriteTimeout      time.Duration
+	IdleTimeout       = 2 * time.Minute
+	// Gzip compresses responses for requests that accept gzip, other than streams.
+	Gzip = setting("GZIP") != "false"
+	// CORSAllowedOrigins are the origins, in the form ORIGIN;ORIGIN or *, of
+	// browser apps that can call the proxy, with the request headers of
+	// CORSAllowedHeaders, in the form HEADER, HEADER, or any when it is not set.
+	CORSAllowedOrigins = setting("CORS_ALLOWED_ORIGINS")
+	CORSAllowedHeaders = setting("CORS_ALLOWED_HEADERS")
+	// IPAllowlist and IPDenylist are networks in the form CIDR;CIDR. Requests
+	// from clients in IPDenylist, or not in IPAllowlist when it is set, are
+	// rejected. Clients are identified by X-Forwarded-For for requests from
+	// TrustedProxies, such as load balancers.
+	IPAllowlist    = setting("IP_ALLOWLIST")
+	IPDenylist     = setting("IP_DENYLIST")
+	TrustedProxies = setting("TRUSTED_PROXIES")
+	// HMACSecrets are secrets in the form SECRET;SECRET, which requests must be
+	// signed with when set, in the X-Signature header, as the hex HMAC-SHA256 of
+	// their X-Signature-Timestamp, a dot and their body. Timestamps more than
+	// HMACMaxSkew from now are rejected, as are signatures used before.
+	HMACSecrets = setting("HMAC_SECRETS")
+	HMACMaxSkew = 5 * time.Minute
+	// UpstreamTimeout is how long a request can take to be served from Gemini
+	// before it is cancelled with a 504, and UpstreamTimeouts overrides it for
+	// endpoints, in the form ENDPOINT=DURATION;ENDPOINT=DURATION. Generation
+	// endpoints default to 10 minutes, and embeddings to one.
+	UpstreamTimeout  = 2 * time.Minute
+	UpstreamTimeouts = setting("UPSTREAM_TIMEOUTS")
+	// MaxRequestBodySize is the largest request body accepted, in bytes, other
+	// than for file uploads. Larger requests are rejected with a 413. Zero is
+	// unlimited.
+	MaxRequestBodySize int64 = 32 << 20
+	// ShutdownTimeout is how long requests in flight are given to finish on
+	// SIGTERM or SIGINT before the proxy exits.
+	ShutdownTimeout = 30 * time.Second
+	// OTLPEndpoint is the base URL of an OpenTelemetry collector, e.g.
+	// http://otel-collector:4318, that spans of requests are sent to with OTLP
+	// over HTTP, with the headers of OTLPHeaders, in the form KEY=VALUE,KEY=VALUE.
+	// New traces are sampled with a probability of OTelTracesSamplerArg, and
+	// traces of incoming requests as their trace context says.
+	OTLPEndpoint         = setting("OTEL_EXPORTER_OTLP_ENDPOINT")
+	OTLPHeaders          = setting("OTEL_EXPORTER_OTLP_HEADERS")
+	OTelServiceName      = setting("OTEL_SERVICE_NAME")
+	OTelTracesSamplerArg = 1.0
+	// OTelMetricsExporter, when otlp, sends the metrics to OTLPEndpoint every
+	// OTelMetricExportInterval, as well as serving them on /metrics.
+	OTelMetricsExporter      = setting("OTEL_METRICS_EXPORTER")
+	OTelMetricExportInterval = time.Minute
+	// GeminiEndpoint is the base URL of the Gemini API used instead of
+	// https://generativelanguage.googleapis.com, such as a regional endpoint,
+	// an egress gateway or a mock server. Cached contents do not work with it, as
+	// the SDK manages them over gRPC, which cannot take a URL.
+	GeminiEndpoint = setting("GEMINI_API_ENDPOINT")
+	// GeminiApiKeySecret is a GCP Secret Manager or Vault secret of keys in the
+	// same form, used instead if set, which is read again every
+	// KeySecretRefreshInterval.
+	GeminiApiKeySecret       = setting("GEMINI_API_KEY_SECRET")
+	KeySecretRefreshInterval = 5 * time.Minute
+	// KeyRetries is how many times a model request that is rate limited or fails
+	// transiently is retried, each time with the next key.
+	KeyRetries = 2
+	// RetryBaseDelay is the delay before the first retry, doubling with each
+	// retry, and RetryJitter is the fraction of it taken off at random.
+	RetryBaseDelay = 250 * time.Millisecond
+	RetryJitter    = 1.0
+	// RetryBudget is the fraction of requests to Gemini that can be retried.
+	RetryBudget = 0.2
+	// HedgeDelay is how long a model request can go without a response before
+	// it is sent again with the next key, using whichever responds first.
+	// Requests are not hedged when it is zero.
+	HedgeDelay time.Duration
+	// KeyRPM and KeyRPD are the default budgets of each key, in requests to
+	// Gemini per minute and per day. Keys out of budget are skipped. Zero is
+	// unlimited.
+	KeyRPM = 0
+	KeyRPD = 0
+	// KeyCircuitFailures is how many consecutive failures of a key open its
+	// circuit breaker, which is disabled when zero, and KeyCircuitCooldown is how
+	// long it stays open.
+	KeyCircuitFailures = 5
+	KeyCircuitCooldown = 30 * time.Second
+	// VertexFailoverLatency is how long a Vertex AI region can take to respond
+	// before requests prefer the entry's next region, for KeyCircuitCooldown.
+	// Latency is not considered when it is zero.
+	VertexFailoverLatency time.Duration
+	// KeyHealthCheckInterval is how often each key is checked, removing keys
+	// that fail from rotation until they pass. Keys are not checked when it is zero.
+	KeyHealthCheckInterval time.Duration
+	// KeyPassthrough uses the bearer token of each request as its Gemini API key,
+	// for proxies shared by users with their own keys. Requests without one use
+	// the configured keys.
+	KeyPassthrough = setting("KEY_PASSTHROUGH") == "true"
+	// KeyPassthroughClients is how many keys presented by clients with
+	// KeyPassthrough keep their clients. The least recently used are closed
+	// when more are presented.
+	KeyPassthroughClients = 1000
+	// VirtualKeysFile is a JSON file of API keys issued by the proxy, each mapped
+	// to a named pool of Gemini API keys, request budgets and allowed models.
+	// Requests must present one when it is set.
+	VirtualKeysFile = setting("VIRTUAL_KEYS_FILE")
+	// ProxyApiKeys are the API keys that requests must present, in the form
+	// KEY;KEY, when set, as a bearer token or an api-key or x-api-key header.
+	ProxyApiKeys = setting("PROXY_API_KEYS")
+	// AdminStoreFile is a JSON file of proxy API keys managed with the admin API,
+	// which requests can present as well as ProxyApiKeys. The admin API is served
+	// on AdminListenAddr, when it is set, to requests presenting AdminApiKey.
+	AdminStoreFile  = setting("ADMIN_STORE_FILE")
+	AdminListenAddr = setting("ADMIN_LISTEN_ADDR")
+	AdminApiKey     = setting("ADMIN_API_KEY")
+	// JWTJwksURL is the JSON Web Key Set of an identity provider, whose signed
+	// JWTs requests can present instead of proxy API keys, if issued by
+	// JWTIssuer and for JWTAudience when they are set.
+	JWTJwksURL  = setting("JWT_JWKS_URL")
+	JWTIssuer   = setting("JWT_ISSUER")
+	JWTAudience = setting("JWT_AUDIENCE")
+	// OIDCIntrospectionURL is the token introspection endpoint of an OIDC
+	// provider, with which opaque bearer tokens are checked instead of, or as
+	// well as, proxy API keys, authenticated as OIDCClientID when it is set.
+	// Each token's introspection is cached for OIDCIntrospectionCacheTTL, or
+	// until it expires.
+	OIDCIntrospectionURL      = setting("OIDC_INTROSPECTION_URL")
+	OIDCClientID              = setting("OIDC_CLIENT_ID")
+	OIDCClientSecret          = setting("OIDC_CLIENT_SECRET")
+	OIDCIntrospectionCacheTTL = time.Minute
+	// StickyKeys sends the requests of each client to the same Gemini API key, by
+	// their virtual key, or the user field of their request.
+	StickyKeys = setting("STICKY_KEYS") == "true"
+	// OpenAIApiKey sends requests for models that Gemini does not know to the
+	// OpenAI API at OpenAIBaseURL, authenticated with this key, when it is set.
+	OpenAIApiKey  = setting("OPENAI_API_KEY")
+	OpenAIBaseURL = "https://api.openai.com/v1"
+	// KeySelection is how requests are spread across the Gemini API keys, one of
+	// upstream.Strategies.
+	KeySelection = setting("KEY_SELECTION")
+	// GeminiSafetySettings are the default safety settings for generation requests,
+	// in the form HARM_CATEGORY_HARASSMENT=BLOCK_NONE;HARM_CATEGORY_HATE_SPEECH=BLOCK_ONLY_HIGH.
+	GeminiSafetySettings  = setting("GEMINI_SAFETY_SETTINGS")
+	defaultSafetySettings []*genai.SafetySetting
+	// AzureDeployments maps Azure OpenAI deployment names to Gemini models, in the
+	// form DEPLOYMENT=MODEL;DEPLOYMENT=MODEL. Unmapped deployments are used as the model name.
+	AzureDeployments = setting("AZURE_DEPLOYMENTS")
+	azureDeployments map[string]string
+	// ModelAliases maps model names that clients send to Gemini models, in the form
+	// ALIAS=MODEL;ALIAS=MODEL. ModelAliasesFile is a JSON object of the same.
+	ModelAliases     = setting("MODEL_ALIASES")
+	ModelAliasesFile = setting("MODEL_ALIASES_FILE")
+	// ModelListPrefix keeps the "models/" prefix of Gemini model names in the IDs
+	// of listed models.
+	ModelListPrefix = setting("MODEL_LIST_PREFIX") == "true"
+	// GeminiTranscriptionModel is the model used for transcription requests that
+	// name a Whisper model.
+	GeminiTranscriptionModel = setting("GEMINI_TRANSCRIPTION_MODEL")
+	// GeminiModerationModel is the model whose safety ratings are used for
+	// moderation requests that name an OpenAI moderation model.
+	GeminiModerationModel = setting("GEMINI_MODERATION_MODEL")
+	// GeminiTokenCountModel is the model that counts the tokens of embedding
+	// requests with EmbeddingCountTokens, as embedding models cannot count
+	// tokens.
+	GeminiTokenCountModel = setting("GEMINI_TOKEN_COUNT_MODEL")
+	// EmbeddingCountTokens counts the tokens of embedding requests with
+	// GeminiTokenCountModel, at the cost of a request to Gemini each, instead of
+	// estimating them from the length of their inputs.
+	EmbeddingCountTokens = setting("EMBEDDING_COUNT_TOKENS") == "true"
+	// GeminiRerankModel is the embedding model used to rank documents for
+	// rerank requests that name a Cohere or Jina rerank model.
+	GeminiRerankModel = setting("GEMINI_RERANK_MODEL")
+	// BatchConcurrency is the number of batch requests run at once per batch,
+	// to stay within the Gemini rate limits.
+	BatchConcurrency = 4
+	// EmbeddingConcurrency is the number of batches of a large embedding request
+	// embedded at once.
+	EmbeddingConcurrency = 4
+	// CompletionConcurrency is the number of prompts of a completion request
+	// generated at once, as each is a request to Gemini on the same key.
+	CompletionConcurrency = 4
+	// EmbeddingTruncate truncates embedding inputs over the model's input token
+	// limit by default, instead of rejecting them.
+	EmbeddingTruncate = setting("EMBEDDING_TRUNCATE") == "true"
+	// EmbeddingNormalize scales embeddings to unit length by default.
+	EmbeddingNormalize = setting("EMBEDDING_NORMALIZE") == "true"
+	// EmbeddingCacheSize is the number of embeddings kept in memory by
+	// embeddingInputCache, which is disabled when zero. RedisURL caches them in
+	// Redis instead. Entries expire after EmbeddingCacheTTL, or never when it is zero.
+	EmbeddingCacheSize  = 0
+	EmbeddingCacheTTL   time.Duration
+	RedisURL            = setting("REDIS_URL")
+	embeddingInputCache embeddingCache
+	// EmbeddingCoalesceWindow is how long embedding requests are buffered to be
+	// embedded together, which is disabled when zero.
+	EmbeddingCoalesceWindow time.Duration
+	// EmbeddingPartialFailures allows embedding requests to partially fail by
+	// default, returning errors for the inputs Gemini rejects.
+	EmbeddingPartialFailures = setting("EMBEDDING_PARTIAL_FAILURES") == "true"
+	// DefaultEmbeddingModel is used by embedding requests that name no model or
+	// one unknown to Gemini, or by all embedding requests if
+	// DefaultEmbeddingModelForce is set.
+	DefaultEmbeddingModel      = setting("DEFAULT_EMBEDDING_MODEL")
+	DefaultEmbeddingModelForce = setting("DEFAULT_EMBEDDING_MODEL_FORCE") == "true"
+	// EmbeddingProviders embeds with other providers the embedding models with
+	// their prefixes, in the form PREFIX=PROVIDER;PREFIX=PROVIDER, where each
+	// provider is cohere, voyage, or the base URL of an OpenAI-compatible API.
+	EmbeddingProviders = setting("EMBEDDING_PROVIDERS")
+	CohereApiKey       = setting("COHERE_API_KEY")
+	VoyageApiKey       = setting("VOYAGE_API_KEY")
+	// TEIModel is the embedding model used by the text-embeddings-inference
+	// endpoints, whose requests do not name one.
+	TEIModel = setting("TEI_MODEL")
 )
 
+func writeError(w http.ResponseWriter, statusCode int, errorType string, message string) {
+	writeErrorResponse(w, statusCode, &openai.Error{
+		Message: message,
+		Type:    errorType,
+	})
+}
+
+func writeErrorResponse(w http.ResponseWriter, statusCode int, openAIErr *openai.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(&openai.ErrorResponse{Error: openAIErr})
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		noteError(r.Context(), errors.Wrap(err, "failed to encode response"))
+	}
+}
+
 func embeddingsHandler(w http.ResponseWriter, r *http.Request) {
-	requestLogger := log.With().
-		Str("path", r.URL.Path).
-		Str("user-agent", r.Header.Get("User-Agent")).
-		Logger()
+	requestLogger := requestLog(r)
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-		requestLogger.
-			Error().
-			Int("status-code", http.StatusMethodNotAllowed).
-			Msg("")
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
-		requestLogger.
-			Error().
-			Err(errors.Wrap(err, "failed to read request body")).
-			Int("status-code", http.StatusBadRequest).
-			Msg("")
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
 		return
 	}
 
@@ -61,73 +340,93 @@ func embeddingsHandler(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(body, &openAIReq)
 	if err != nil {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
-		requestLogger.
-			Error().
-			Err(errors.Wrap(err, "failed to unmarshal request body")).
-			Int("status-code", http.StatusBadRequest).
-			Msg("")
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
 		return
 	}
 
-	useIndex := currentClient.Add(1) % int32(len(geminiClients))
-	requestLogger.Info().Str("model", openAIReq.Model).Int32("client", useIndex).Msg("Processing request")
-
-	embeddingModel := geminiClients[useIndex].EmbeddingModel(openAIReq.Model)
-
-	geminiBatchReq, err := openai.ConvertOpenAIRequestToGemini(&openAIReq, embeddingModel)
+	useIndex, err := nextClient(r.Context())
 	if err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
-		requestLogger.
-			Error().
-			Err(errors.Wrap(err, "failed to convert OpenAI request to Gemini request")).
-			Int("status-code", http.StatusBadRequest).
-			Msg("")
+		writeNoKeyAvailable(w, r, err)
 		return
 	}
+	defer doneClient(useIndex)
+	openAIReq.Model = defaultEmbeddingModel(r.Context(), useIndex, openAIReq.Model)
+	noteRequest(r.Context(), openAIReq.Model, useIndex)
+
+	// Embedding responses carry no token counts, so the inputs are estimated,
+	// or counted alongside with EmbeddingCountTokens.
+	usage := make(chan *openai.Usage, 1)
+	if EmbeddingCountTokens {
+		go func() {
+			usage <- countEmbeddingTokens(r.Context(), requestLogger, useIndex, &openAIReq)
+		}()
+	} else {
+		usage <- openai.EstimateEmbeddingUsage(&openAIReq)
+	}
 
-	geminiBatchResp, err := embeddingModel.BatchEmbedContents(r.Context(), geminiBatchReq)
+	if openAIReq.PartialFailures == nil {
+		openAIReq.PartialFailures = &EmbeddingPartialFailures
+	}
+	geminiBatchResp, embedErrs, err := batchEmbedContents(r.Context(), useIndex, &openAIReq)
+	var invalidErr invalidEmbedRequestError
+	if errors.As(err, &invalidErr) {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", invalidErr.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to batch embed contents"))
+		return
+	}
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		requestLogger.
-			Error().
-			Err(errors.Wrap(err, "failed to batch embed contents")).
-			Int("status-code", http.StatusInternalServerError).
-			Msg("")
+		noteError(r.Context(), errors.Wrap(err, "failed to batch embed contents"))
 		return
 	}
 
-	openAIResp := openai.ConvertGeminiResponseToOpenAI(geminiBatchResp, openAIReq.Model)
+	openAIResp := openai.ConvertGeminiResponseToOpenAI(geminiBatchResp, &openAIReq)
+	openAIResp.Errors = embedErrs
+	if embeddingUsage := <-usage; embeddingUsage != nil {
+		openAIResp.Usage = embeddingUsage
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(openAIResp)
+	if err != nil {
+		noteError(r.Context(), errors.Wrap(err, "failed to encode response"))
+		return
+	}
+}
+
+// countEmbeddingTokens counts the tokens of an embedding request with
+// GeminiTokenCountModel, returning nil if they cannot be counted.
+func countEmbeddingTokens(ctx context.Context, requestLogger zerolog.Logger, useIndex int32, openAIReq *openai.EmbedRequest) *openai.Usage {
+	parts, err := openai.ConvertOpenAIEmbedRequestToGeminiTokenCount(openAIReq)
+	if err != nil {
+		return nil
+	}
+	geminiResp, err := geminiClient(useIndex).GenerativeModel(GeminiTokenCountModel).CountTokens(ctx, parts...)
 	if err != nil {
 		requestLogger.
-			Error().
-			Err(errors.Wrap(err, "failed to encode response")).
-			Int("status-code", http.StatusInternalServerError).
+			Warn().
+			Err(errors.Wrap(err, "failed to count tokens")).
 			Msg("")
-		return
+		return nil
 	}
+	return openai.ConvertGeminiTokenCountToOpenAIUsage(geminiResp)
 }
 
 func modelsHandler(w http.ResponseWriter, r *http.Request) {
-	requestLogger := log.With().
-		Str("path", r.URL.Path).
-		Str("user-agent", r.Header.Get("User-Agent")).
-		Logger()
-
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-		requestLogger.
-			Error().
-			Int("status-code", http.StatusMethodNotAllowed).
-			Msg("")
 		return
 	}
 
 	var models []*openai.ModelResponseData
 
-	iter := geminiClients[0].ListModels(r.Context())
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	iter := geminiClient(useIndex).ListModels(r.Context())
 	for {
 		m, err := iter.Next()
 		if err == iterator.Done {
@@ -135,57 +434,573 @@ func modelsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		if err != nil {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			requestLogger.Error().Err(err).Msg("Failed to list models")
+			noteError(r.Context(), errors.Wrap(err, "failed to list models"))
 			return
 		}
-		if !slices.Contains(m.SupportedGenerationMethods, "embedContent") {
+		if !slices.Contains(m.SupportedGenerationMethods, "embedContent") &&
+			!slices.Contains(m.SupportedGenerationMethods, "generateContent") ||
+			!allowedModel(r.Context(), m.Name) {
+			continue
+		}
+		models = append(models, openai.ConvertGeminiModelToOpenAI(m, ModelListPrefix))
+	}
+	modelAliases := *currentModelAliases.Load()
+	var aliases []string
+	for alias := range modelAliases {
+		aliases = append(aliases, alias)
+	}
+	slices.Sort(aliases)
+	for _, alias := range aliases {
+		if !allowedModel(r.Context(), modelAliases[alias]) {
 			continue
 		}
 		models = append(models, &openai.ModelResponseData{
 			Object:  "model",
-			ID:      m.Name,
-			Created: 0,
+			ID:      alias,
 			OwnedBy: "google",
 		})
 	}
+	// Tuned models are listed once they can be used, by their full names.
+	err = listTunedModels(r.Context(), func(tunedModel *generativelanguagepb.TunedModel, _ int32) {
+		if tunedModel.State != generativelanguagepb.TunedModel_ACTIVE || !allowedModel(r.Context(), tunedModel.Name) {
+			return
+		}
+		models = append(models, &openai.ModelResponseData{
+			Object:  "model",
+			ID:      tunedModel.Name,
+			Created: uint(tunedModel.GetCreateTime().GetSeconds()),
+			OwnedBy: "user",
+		})
+	})
+	if err != nil {
+		// Keys that cannot tune models, such as Vertex AI ones, still list the others.
+		requestLogger := requestLog(r)
+		requestLogger.Warn().Err(err).Msg("Failed to list tuned models")
+	}
 
-	err := json.NewEncoder(w).Encode(&openai.ModelResponse{
+	err = json.NewEncoder(w).Encode(&openai.ModelResponse{
 		Object: "list",
 		Data:   models,
 	})
 	if err != nil {
-		requestLogger.
-			Error().
-			Err(errors.Wrap(err, "failed to encode response")).
-			Int("status-code", http.StatusInternalServerError).
-			Msg("")
+		noteError(r.Context(), errors.Wrap(err, "failed to encode response"))
+		return
+	}
+}
+
+func modelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	model := r.PathValue("model")
+	if !allowedModel(r.Context(), resolveModelAlias(model)) {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "The model '"+model+"' does not exist")
+		noteError(r.Context(), errors.Errorf("model %s is not allowed for virtual key", model))
+		return
+	}
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	m, err := geminiClient(useIndex).GenerativeModel(resolveModelAlias(model)).Info(r.Context())
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "The model '"+model+"' does not exist")
+		noteError(r.Context(), errors.Wrap(err, "failed to get model"))
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to get model"))
 		return
 	}
+
+	modelResp := openai.ConvertGeminiModelToOpenAI(m, ModelListPrefix)
+	if _, ok := (*currentModelAliases.Load())[model]; ok {
+		modelResp.ID = model
+	}
+	writeJSON(w, r, modelResp)
 }
 
 func main() {
 	if ListenAddr == "" {
 		ListenAddr = ":8080"
 	}
-	if GeminiApiKey == "" {
+	if GeminiTranscriptionModel == "" {
+		GeminiTranscriptionModel = "gemini-2.0-flash"
+	}
+	if GeminiModerationModel == "" {
+		GeminiModerationModel = "gemini-2.0-flash"
+	}
+	if GeminiTokenCountModel == "" {
+		GeminiTokenCountModel = "gemini-2.0-flash"
+	}
+	if GeminiRerankModel == "" {
+		GeminiRerankModel = "text-embedding-004"
+	}
+	if concurrency := setting("EMBEDDING_CONCURRENCY"); concurrency != "" {
+		var err error
+		EmbeddingConcurrency, err = strconv.Atoi(concurrency)
+		if err != nil || EmbeddingConcurrency < 1 {
+			log.Fatal().Msg("EMBEDDING_CONCURRENCY must be a positive integer")
+			return
+		}
+	}
+	if size := setting("EMBEDDING_CACHE_SIZE"); size != "" {
+		var err error
+		EmbeddingCacheSize, err = strconv.Atoi(size)
+		if err != nil || EmbeddingCacheSize < 0 {
+			log.Fatal().Msg("EMBEDDING_CACHE_SIZE must be a non-negative integer")
+			return
+		}
+	}
+	if ttl := setting("EMBEDDING_CACHE_TTL"); ttl != "" {
+		var err error
+		EmbeddingCacheTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatal().Err(errors.Wrap(err, "failed to parse EMBEDDING_CACHE_TTL")).Msg("")
+			return
+		}
+	}
+	if window := setting("EMBEDDING_COALESCE_WINDOW"); window != "" {
+		var err error
+		EmbeddingCoalesceWindow, err = time.ParseDuration(window)
+		if err != nil {
+			log.Fatal().Err(errors.Wrap(err, "failed to parse EMBEDDING_COALESCE_WINDOW")).Msg("")
+			return
+		}
+	}
+	if RedisURL != "" {
+		client, err := newRedisClient(RedisURL)
+		if err != nil {
+			log.Fatal().Err(errors.Wrap(err, "failed to parse REDIS_URL")).Msg("")
+			return
+		}
+		embeddingInputCache = &redisEmbeddingCache{client: client, ttl: EmbeddingCacheTTL}
+	} else if EmbeddingCacheSize > 0 {
+		embeddingInputCache = newLRUEmbeddingCache(EmbeddingCacheSize, EmbeddingCacheTTL)
+	}
+	if concurrency := setting("COMPLETION_CONCURRENCY"); concurrency != "" {
+		var err error
+		CompletionConcurrency, err = strconv.Atoi(concurrency)
+		if err != nil || CompletionConcurrency < 1 {
+			log.Fatal().Msg("COMPLETION_CONCURRENCY must be a positive integer")
+			return
+		}
+	}
+	if concurrency := setting("BATCH_CONCURRENCY"); concurrency != "" {
+		var err error
+		BatchConcurrency, err = strconv.Atoi(concurrency)
+		if err != nil || BatchConcurrency < 1 {
+			log.Fatal().Msg("BATCH_CONCURRENCY must be a positive integer")
+			return
+		}
+	}
+	if OTelServiceName == "" {
+		OTelServiceName = "gemini-to-openai-proxy"
+	}
+	if TEIModel == "" {
+		TEIModel = "text-embedding-004"
+	}
+	noKeys := GeminiApiKey == "" && GeminiApiKeyFile == "" && GeminiApiKeySecret == ""
+	if noKeys && !KeyPassthrough && VirtualKeysFile == "" {
 		log.Fatal().Msg("GEMINI_API_KEY is required")
 	}
-	currentClient.Store(0)
+	if noKeys && (ProxyApiKeys != "" || AdminStoreFile != "" || JWTJwksURL != "" || OIDCIntrospectionURL != "") {
+		// Their requests use the configured keys, even with KEY_PASSTHROUGH.
+		log.Fatal().Msg("PROXY_API_KEYS, ADMIN_STORE_FILE, JWT_JWKS_URL and OIDC_INTROSPECTION_URL require GEMINI_API_KEY")
+	}
+	if interval := setting("KEY_HEALTH_CHECK_INTERVAL"); interval != "" {
+		var err error
+		KeyHealthCheckInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal().Err(errors.Wrap(err, "failed to parse KEY_HEALTH_CHECK_INTERVAL")).Msg("")
+			return
+		}
+	}
+	if interval := setting("KEY_SECRET_REFRESH_INTERVAL"); interval != "" {
+		var err error
+		KeySecretRefreshInterval, err = time.ParseDuration(interval)
+		if err != nil || KeySecretRefreshInterval <= 0 {
+			log.Fatal().Msg("KEY_SECRET_REFRESH_INTERVAL must be a positive duration")
+			return
+		}
+	}
+	if rpm := setting("KEY_RPM"); rpm != "" {
+		var err error
+		KeyRPM, err = strconv.Atoi(rpm)
+		if err != nil || KeyRPM < 0 {
+			log.Fatal().Msg("KEY_RPM must be a non-negative integer")
+			return
+		}
+	}
+	if rpd := setting("KEY_RPD"); rpd != "" {
+		var err error
+		KeyRPD, err = strconv.Atoi(rpd)
+		if err != nil || KeyRPD < 0 {
+			log.Fatal().Msg("KEY_RPD must be a non-negative integer")
+			return
+		}
+	}
+	if failures := setting("KEY_CIRCUIT_FAILURES"); failures != "" {
+		var err error
+		KeyCircuitFailures, err = strconv.Atoi(failures)
+		if err != nil || KeyCircuitFailures < 0 {
+			log.Fatal().Msg("KEY_CIRCUIT_FAILURES must be a non-negative integer")
+			return
+		}
+	}
+	if cooldown := setting("KEY_CIRCUIT_COOLDOWN"); cooldown != "" {
+		var err error
+		KeyCircuitCooldown, err = time.ParseDuration(cooldown)
+		if err != nil {
+			log.Fatal().Err(errors.Wrap(err, "failed to parse KEY_CIRCUIT_COOLDOWN")).Msg("")
+			return
+		}
+	}
+	if ttl := setting("OIDC_INTROSPECTION_CACHE_TTL"); ttl != "" {
+		var err error
+		OIDCIntrospectionCacheTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatal().Err(errors.Wrap(err, "failed to parse OIDC_INTROSPECTION_CACHE_TTL")).Msg("")
+			return
+		}
+		if OIDCIntrospectionCacheTTL < 0 {
+			log.Fatal().Msg("OIDC_INTROSPECTION_CACHE_TTL must be non-negative")
+			return
+		}
+	}
+	for name, timeout := range map[string]*time.Duration{
+		"READ_HEADER_TIMEOUT": &ReadHeaderTimeout,
+		"READ_TIMEOUT":        &ReadTimeout,
+		"WRITE_TIMEOUT":       &WriteTimeout,
+		"IDLE_TIMEOUT":        &IdleTimeout,
+		"UPSTREAM_TIMEOUT":    &UpstreamTimeout,
+	} {
+		if s := setting(name); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				log.Fatal().Msg(name + " must be a non-negative duration, zero for no timeout")
+				return
+			}
+			*timeout = d
+		}
+	}
+	if timeout := setting("SHUTDOWN_TIMEOUT"); timeout != "" {
+		var err error
+		ShutdownTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatal().Err(errors.Wrap(err, "failed to parse SHUTDOWN_TIMEOUT")).Msg("")
+			return
+		}
+	}
+	if ratio := setting("OTEL_TRACES_SAMPLER_ARG"); ratio != "" {
+		var err error
+		OTelTracesSamplerArg, err = strconv.ParseFloat(ratio, 64)
+		if err != nil || OTelTracesSamplerArg < 0 || OTelTracesSamplerArg > 1 {
+			log.Fatal().Msg("OTEL_TRACES_SAMPLER_ARG must be a number from 0 to 1")
+			return
+		}
+	}
+	if interval := setting("OTEL_METRIC_EXPORT_INTERVAL"); interval != "" {
+		// The interval is in milliseconds, as OTel SDKs take it.
+		ms, err := strconv.Atoi(interval)
+		if err != nil || ms <= 0 {
+			log.Fatal().Msg("OTEL_METRIC_EXPORT_INTERVAL must be a positive number of milliseconds")
+			return
+		}
+		OTelMetricExportInterval = time.Duration(ms) * time.Millisecond
+	}
+	if skew := setting("HMAC_MAX_SKEW"); skew != "" {
+		var err error
+		HMACMaxSkew, err = time.ParseDuration(skew)
+		if err != nil {
+			log.Fatal().Err(errors.Wrap(err, "failed to parse HMAC_MAX_SKEW")).Msg("")
+			return
+		}
+		if HMACMaxSkew <= 0 {
+			log.Fatal().Msg("HMAC_MAX_SKEW must be positive")
+			return
+		}
+	}
+	if latency := setting("VERTEX_FAILOVER_LATENCY"); latency != "" {
+		var err error
+		VertexFailoverLatency, err = time.ParseDuration(latency)
+		if err != nil {
+			log.Fatal().Err(errors.Wrap(err, "failed to parse VERTEX_FAILOVER_LATENCY")).Msg("")
+			return
+		}
+	}
+	if delay := setting("HEDGE_DELAY"); delay != "" {
+		var err error
+		HedgeDelay, err = time.ParseDuration(delay)
+		if err != nil {
+			log.Fatal().Err(errors.Wrap(err, "failed to parse HEDGE_DELAY")).Msg("")
+			return
+		}
+	}
+	if delay := setting("RETRY_BASE_DELAY"); delay != "" {
+		var err error
+		RetryBaseDelay, err = time.ParseDuration(delay)
+		if err != nil {
+			log.Fatal().Err(errors.Wrap(err, "failed to parse RETRY_BASE_DELAY")).Msg("")
+			return
+		}
+	}
+	if jitter := setting("RETRY_JITTER"); jitter != "" {
+		var err error
+		RetryJitter, err = strconv.ParseFloat(jitter, 64)
+		if err != nil || RetryJitter < 0 || RetryJitter > 1 {
+			log.Fatal().Msg("RETRY_JITTER must be a number from 0 to 1")
+			return
+		}
+	}
+	if budget := setting("RETRY_BUDGET"); budget != "" {
+		var err error
+		RetryBudget, err = strconv.ParseFloat(budget, 64)
+		if err != nil || RetryBudget < 0 {
+			log.Fatal().Msg("RETRY_BUDGET must be a non-negative number")
+			return
+		}
+	}
+	if clients := setting("KEY_PASSTHROUGH_CLIENTS"); clients != "" {
+		var err error
+		KeyPassthroughClients, err = strconv.Atoi(clients)
+		if err != nil || KeyPassthroughClients < 1 {
+			log.Fatal().Msg("KEY_PASSTHROUGH_CLIENTS must be a positive integer")
+			return
+		}
+	}
+	if retries := setting("KEY_RETRIES"); retries != "" {
+		var err error
+		KeyRetries, err = strconv.Atoi(retries)
+		if err != nil || KeyRetries < 0 {
+			log.Fatal().Msg("KEY_RETRIES must be a non-negative integer")
+			return
+		}
+	}
+	if size := setting("MAX_REQUEST_BODY_SIZE"); size != "" {
+		var err error
+		MaxRequestBodySize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || MaxRequestBodySize < 0 {
+			log.Fatal().Msg("MAX_REQUEST_BODY_SIZE must be a non-negative integer")
+			return
+		}
+	}
+	switch KeySelection {
+	case "":
+		KeySelection = "weighted"
+	case "least-in-flight":
+		// least-in-flight is the former name of least-loaded.
+		KeySelection = "least-loaded"
+	}
+	if !slices.Contains(upstream.Strategies, KeySelection) {
+		log.Fatal().Msg("KEY_SELECTION must be one of " + strings.Join(upstream.Strategies, ", "))
+	}
+	if GeminiEndpoint != "" {
+		endpoint, err := url.Parse(GeminiEndpoint)
+		if err != nil || endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+			log.Fatal().Msg("GEMINI_API_ENDPOINT must be an http or https URL")
+			return
+		}
+	}
+	if (TLSCertFile == "") != (TLSKeyFile == "") {
+		log.Fatal().Msg("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		return
+	}
+	if TLSClientCAFile != "" && TLSCertFile == "" {
+		log.Fatal().Msg("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		return
+	}
+	if OTelMetricsExporter == "otlp" && OTLPEndpoint == "" {
+		log.Fatal().Msg("OTEL_METRICS_EXPORTER=otlp requires OTEL_EXPORTER_OTLP_ENDPOINT")
+		return
+	}
+	if Pprof && MetricsListenAddr == "" {
+		log.Fatal().Msg("PPROF requires METRICS_LISTEN_ADDR")
+		return
+	}
+	if AdminListenAddr != "" && (AdminStoreFile == "" || AdminApiKey == "") {
+		log.Fatal().Msg("ADMIN_LISTEN_ADDR requires ADMIN_STORE_FILE and ADMIN_API_KEY")
+		return
+	}
+	if baseURL := setting("OPENAI_BASE_URL"); baseURL != "" {
+		OpenAIBaseURL = baseURL
+	}
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnixMs
-	for _, key := range GeminiApiKeys {
-		client, err := genai.NewClient(context.Background(), option.WithAPIKey(key))
+	var err error
+	defaultSafetySettings, err = openai.ParseSafetySettings(GeminiSafetySettings)
+	if err != nil {
+		log.
+			Fatal().
+			Err(errors.Wrap(err, "failed to parse GEMINI_SAFETY_SETTINGS")).
+			Msg("")
+		return
+	}
+	azureDeployments, err = parseModelMap(AzureDeployments)
+	if err != nil {
+		log.
+			Fatal().
+			Err(errors.Wrap(err, "failed to parse AZURE_DEPLOYMENTS")).
+			Msg("")
+		return
+	}
+	proxyKeys = parseProxyKeys(ProxyApiKeys)
+	embedders, err = parseEmbedders(EmbeddingProviders)
+	if err != nil {
+		log.
+			Fatal().
+			Err(errors.Wrap(err, "failed to parse EMBEDDING_PROVIDERS")).
+			Msg("")
+		return
+	}
+	ipAllowlist, err = parsePrefixes(IPAllowlist)
+	if err != nil {
+		log.
+			Fatal().
+			Err(errors.Wrap(err, "failed to parse IP_ALLOWLIST")).
+			Msg("")
+		return
+	}
+	ipDenylist, err = parsePrefixes(IPDenylist)
+	if err != nil {
+		log.
+			Fatal().
+			Err(errors.Wrap(err, "failed to parse IP_DENYLIST")).
+			Msg("")
+		return
+	}
+	hmacSecrets = parseHMACSecrets(HMACSecrets)
+	for _, origin := range strings.Split(CORSAllowedOrigins, ";") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			corsOrigins = append(corsOrigins, origin)
+		}
+	}
+	upstreamTimeouts, err = parseUpstreamTimeouts(UpstreamTimeouts)
+	if err != nil {
+		log.
+			Fatal().
+			Err(errors.Wrap(err, "failed to parse UPSTREAM_TIMEOUTS")).
+			Msg("")
+		return
+	}
+	if AdminStoreFile != "" {
+		adminKeys, err = loadAdminStore()
 		if err != nil {
 			log.
 				Fatal().
-				Err(errors.Wrap(err, "failed to create Gemini client")).
-				Int("status-code", http.StatusInternalServerError).
+				Err(err).
 				Msg("")
 			return
 		}
-		geminiClients = append(geminiClients, client)
+		go adminKeys.saveUsage()
+	}
+	otlpHeaders, err = parseOTLPHeaders(OTLPHeaders)
+	if err != nil {
+		log.
+			Fatal().
+			Err(errors.Wrap(err, "failed to parse OTEL_EXPORTER_OTLP_HEADERS")).
+			Msg("")
+		return
+	}
+	if tracing() {
+		go exportSpans()
+	}
+	if OTelMetricsExporter == "otlp" {
+		go exportMetrics()
+	}
+	trustedProxies, err = parsePrefixes(TrustedProxies)
+	if err != nil {
+		log.
+			Fatal().
+			Err(errors.Wrap(err, "failed to parse TRUSTED_PROXIES")).
+			Msg("")
+		return
+	}
+	err = reloadKeys()
+	if err != nil {
+		log.
+			Fatal().
+			Err(err).
+			Msg("")
+		return
+	}
+	go watchKeys()
+	aliases, err := loadModelAliases()
+	if err != nil {
+		log.
+			Fatal().
+			Err(err).
+			Msg("")
+		return
+	}
+	currentModelAliases.Store(&aliases)
+	go watchConfig()
+	if KeyHealthCheckInterval > 0 {
+		go checkKeyHealth(context.Background())
 	}
 	http.HandleFunc(openAIEmbeddingsEndpoint, embeddingsHandler)
 	http.HandleFunc(openAIModelsEndpoints, modelsHandler)
-	log.Info().Msgf("Listening on %s", ListenAddr)
-	log.Fatal().Err(http.ListenAndServe(ListenAddr, nil)).Msg("Failed to listen and serve")
+	http.HandleFunc(openAIModelEndpoint, modelHandler)
+	http.HandleFunc(openAIChatCompletionsEndpoint, chatCompletionsHandler)
+	http.HandleFunc(openAICompletionsEndpoint, completionsHandler)
+	http.HandleFunc(cachedContentsEndpoint, cachedContentsHandler)
+	http.HandleFunc(cachedContentEndpoint, cachedContentHandler)
+	http.HandleFunc(openAIResponsesEndpoint, responsesHandler)
+	http.HandleFunc(anthropicMessagesEndpoint, anthropicMessagesHandler)
+	http.HandleFunc(ollamaTagsEndpoint, ollamaTagsHandler)
+	http.HandleFunc(ollamaEmbedEndpoint, ollamaEmbedHandler)
+	http.HandleFunc(ollamaEmbeddingsEndpoint, ollamaEmbedHandler)
+	http.HandleFunc(ollamaChatEndpoint, ollamaChatHandler)
+	http.HandleFunc(azureEmbeddingsEndpoint, azureDeploymentHandler(embeddingsHandler))
+	http.HandleFunc(azureChatCompletionsEndpoint, azureDeploymentHandler(chatCompletionsHandler))
+	http.HandleFunc(azureCompletionsEndpoint, azureDeploymentHandler(completionsHandler))
+	http.HandleFunc(openAITranscriptionsEndpoint, transcriptionsHandler)
+	http.HandleFunc(openAIModerationsEndpoint, moderationsHandler)
+	http.HandleFunc(openAIFilesEndpoint, filesHandler)
+	http.HandleFunc(openAIFileEndpoint, fileHandler)
+	http.HandleFunc(openAIFileContentEndpoint, fileContentHandler)
+	http.HandleFunc(openAIBatchesEndpoint, batchesHandler)
+	http.HandleFunc(openAIBatchEndpoint, batchHandler)
+	http.HandleFunc(openAIBatchCancelEndpoint, batchCancelHandler)
+	http.HandleFunc(openAIFineTuningJobsEndpoint, fineTuningJobsHandler)
+	http.HandleFunc(openAIFineTuningJobEndpoint, fineTuningJobHandler)
+	http.HandleFunc(openAIFineTuningCancelEndpoint, fineTuningJobCancelHandler)
+	http.HandleFunc(cohereEmbedEndpoint, cohereEmbedHandler)
+	http.HandleFunc(teiEmbedEndpoint, teiEmbedHandler)
+	http.HandleFunc(teiInfoEndpoint, teiInfoHandler)
+	http.HandleFunc(rerankEndpoint, rerankHandler)
+	http.HandleFunc(rerankV2Endpoint, rerankHandler)
+	http.HandleFunc(countTokensEndpoint, countTokensHandler)
+	if MetricsListenAddr == "" {
+		http.HandleFunc(metricsEndpoint, metricsHandler)
+	}
+	var adminServer *http.Server
+	if AdminListenAddr != "" {
+		adminServer = newServer(AdminListenAddr, adminHandler(newAdminMux()))
+	}
+	var metricsServer *http.Server
+	if MetricsListenAddr != "" {
+		metricsServer = newServer(MetricsListenAddr, newMetricsMux())
+	}
+	server := newServer(ListenAddr, accessLogHandler(tracingHandler(gzipHandler(corsHandler(ipFilterHandler(bodyLimitHandler(hmacHandler(proxyKeyHandler(virtualKeyHandler(keyPassthroughHandler(keyBudgetHandler(upstreamTimeoutHandler(modelAliasHandler(openAIUpstreamHandler(stickyKeyHandler(http.DefaultServeMux))))))))))))))))
+	if TLSCertFile == "" && H2C {
+		// Shutdown does not wait for requests on h2c connections, which are hijacked.
+		server.Handler = h2c.NewHandler(server.Handler, &http2.Server{})
+	}
+	if TLSCertFile != "" {
+		server.TLSConfig, err = serverTLSConfig()
+		if err != nil {
+			log.
+				Fatal().
+				Err(err).
+				Msg("")
+			return
+		}
+	}
+	serve(server, adminServer, metricsServer)
 }
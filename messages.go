@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+)
+
+func anthropicMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "Failed to read request body")
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+		return
+	}
+
+	var anthropicReq openai.AnthropicMessagesRequest
+	err = json.Unmarshal(body, &anthropicReq)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "Request body is not valid JSON: "+err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+		return
+	}
+
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeAnthropicError(w, http.StatusServiceUnavailable, "No Gemini API key is available for this request")
+		noteError(r.Context(), err)
+		return
+	}
+	defer doneClient(useIndex)
+	noteRequest(r.Context(), anthropicReq.Model, useIndex)
+
+	generativeModel := geminiClient(useIndex).GenerativeModel(anthropicReq.Model)
+	generativeModel.SafetySettings = defaultSafetySettings
+
+	chatReq, err := openai.ConvertAnthropicMessagesRequestToChat(&anthropicReq)
+	var session *genai.ChatSession
+	var parts []genai.Part
+	if err == nil {
+		session, parts, err = openai.ConvertOpenAIChatRequestToGemini(chatReq, generativeModel)
+	}
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert Anthropic request to Gemini request"))
+		return
+	}
+
+	if anthropicReq.Stream {
+		stream := openai.NewAnthropicMessagesStream(anthropicReq.Model)
+		converter := streamConverter{
+			start: func() []serverSentEvent {
+				return anthropicServerSentEvents(stream.Start())
+			},
+			chunk: func(geminiResp *genai.GenerateContentResponse) []serverSentEvent {
+				return anthropicServerSentEvents(stream.Convert(geminiResp))
+			},
+			finish: func(*genai.UsageMetadata) []serverSentEvent {
+				return anthropicServerSentEvents(stream.Finish())
+			},
+			writeError: writeAnthropicError,
+			error: func(message string) []serverSentEvent {
+				return []serverSentEvent{{event: "error", data: openai.NewAnthropicError(http.StatusInternalServerError, message)}}
+			},
+		}
+		streamGeminiResponses(w, r, session.SendMessageStream(r.Context(), parts...), converter)
+		return
+	}
+
+	geminiResp, err := session.SendMessage(r.Context(), parts...)
+	var blockedErr *genai.BlockedError
+	if errors.As(err, &blockedErr) {
+		var openAIErr *openai.Error
+		geminiResp, openAIErr = openai.ConvertGeminiBlockedErrorToOpenAI(blockedErr)
+		if openAIErr != nil {
+			writeAnthropicError(w, http.StatusBadRequest, openAIErr.Message)
+			noteError(r.Context(), errors.Wrap(err, "generation was blocked"))
+			return
+		}
+		err = nil
+	}
+	if err != nil {
+		writeAnthropicError(w, http.StatusInternalServerError, "Internal Server Error")
+		noteError(r.Context(), errors.Wrap(err, "failed to generate content"))
+		return
+	}
+
+	chatResp := openai.ConvertGeminiChatResponseToOpenAI(geminiResp, "", 0, anthropicReq.Model)
+	anthropicResp := openai.ConvertChatCompletionToAnthropic(chatResp)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(anthropicResp)
+	if err != nil {
+		noteError(r.Context(), errors.Wrap(err, "failed to encode response"))
+		return
+	}
+}
+
+// writeAnthropicError responds with an Anthropic API error, in the shape
+// Anthropic SDKs parse, rather than OpenAI's.
+func writeAnthropicError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(openai.NewAnthropicError(statusCode, message))
+}
+
+func anthropicServerSentEvents(events []*openai.AnthropicStreamEvent) []serverSentEvent {
+	serverSentEvents := make([]serverSentEvent, len(events))
+	for i, event := range events {
+		serverSentEvents[i] = serverSentEvent{event: event.Type, data: event}
+	}
+	return serverSentEvents
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is a Prometheus counter or gauge, exposed on metricsEndpoint in the
+// Prometheus text format.
+type metric struct {
+	name string
+	help string
+	kind string
+
+	mu     sync.Mutex
+	values map[string]float64
+	// labels are the labels of each series, by key in values.
+	labels map[string][]string
+}
+
+// histogram is a Prometheus histogram, exposed alongside metrics.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []interface {
+		write(b *strings.Builder)
+		otlp(start time.Time, now time.Time) map[string]interface{}
+	}
+)
+
+func newMetric(name, kind, help string) *metric {
+	m := &metric{name: name, help: help, kind: kind, values: map[string]float64{}, labels: map[string][]string{}}
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, m)
+	return m
+}
+
+// newHistogram creates a histogram with the given bucket upper bounds, in
+// increasing order.
+func newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, series: map[string]*histogramSeries{}}
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, h)
+	return h
+}
+
+func newCounter(name, help string) *metric {
+	return newMetric(name, "counter", help)
+}
+
+func newGauge(name, help string) *metric {
+	return newMetric(name, "gauge", help)
+}
+
+// add adds v to the series with the given labels, as alternating names and values.
+func (m *metric) add(v float64, labels ...string) {
+	key := metricLabels(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] += v
+	m.labels[key] = labels
+}
+
+// set sets the series with the given labels, as alternating names and values.
+func (m *metric) set(v float64, labels ...string) {
+	key := metricLabels(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = v
+	m.labels[key] = labels
+}
+
+// observe records v in the series with the given labels, as alternating names and values.
+func (h *histogram) observe(v float64, labels ...string) {
+	key := metricLabels(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += v
+	series.count++
+}
+
+func metricLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metric) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if len(m.values) == 0 && m.kind == "counter" {
+		fmt.Fprintf(b, "%s 0\n", m.name)
+		return
+	}
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s%s %g\n", m.name, key, m.values[key])
+	}
+}
+
+func (h *histogram) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		for i, bound := range h.buckets {
+			le := metricLabels(append(slices.Clip(series.labels), "le", fmt.Sprintf("%g", bound)))
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, le, series.counts[i])
+		}
+		le := metricLabels(append(slices.Clip(series.labels), "le", "+Inf"))
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, le, series.count)
+		fmt.Fprintf(b, "%s_sum%s %g\n", h.name, key, series.sum)
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, key, series.count)
+	}
+}
+
+// metricsRequest reports whether a request is a scrape of metricsEndpoint on
+// ListenAddr, which the middleware of the proxy's own requests leaves alone.
+// With MetricsListenAddr, metrics are served there instead, and requests for
+// them on ListenAddr are handled like any other.
+func metricsRequest(r *http.Request) bool {
+	return MetricsListenAddr == "" && r.URL.Path == metricsEndpoint
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var b strings.Builder
+	metricsMu.Lock()
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	metricsMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(b.String()))
+}
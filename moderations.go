@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+func moderationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+		return
+	}
+
+	var openAIReq openai.ModerationRequest
+	err = json.Unmarshal(body, &openAIReq)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+		return
+	}
+
+	// OpenAI clients send their own moderation model names, which Gemini does not know.
+	model := openAIReq.Model
+	if model == "" || strings.Contains(model, "moderation") {
+		model = GeminiModerationModel
+	}
+
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	noteRequest(r.Context(), model, useIndex)
+
+	generativeModel := geminiClient(useIndex).GenerativeModel(model)
+
+	inputs, err := openai.ConvertOpenAIModerationRequestToGemini(&openAIReq, generativeModel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert OpenAI request to Gemini request"))
+		return
+	}
+
+	geminiResps := make([]*genai.GenerateContentResponse, len(inputs))
+	errs := make([]error, len(inputs))
+	var wg sync.WaitGroup
+	for i, input := range inputs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			geminiResps[i], errs[i] = generativeModel.GenerateContent(r.Context(), genai.Text(input))
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		// Blocked requests still carry the safety ratings being asked for.
+		var blockedErr *genai.BlockedError
+		if errors.As(err, &blockedErr) {
+			geminiResps[i] = &genai.GenerateContentResponse{PromptFeedback: blockedErr.PromptFeedback}
+			if blockedErr.Candidate != nil {
+				geminiResps[i].Candidates = []*genai.Candidate{blockedErr.Candidate}
+			}
+			err = nil
+		}
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			noteError(r.Context(), errors.Wrap(err, "failed to generate content"))
+			return
+		}
+	}
+
+	writeJSON(w, r, openai.ConvertGeminiModerationResponsesToOpenAI(geminiResps, openai.NewID("modr-"), model))
+}
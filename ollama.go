@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+	"io"
+	"net/http"
+	"slices"
+)
+
+func ollamaTagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ollamaResp := &openai.OllamaTagsResponse{Models: []*openai.OllamaModel{}}
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	iter := geminiClient(useIndex).ListModels(r.Context())
+	for {
+		m, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			noteError(r.Context(), errors.Wrap(err, "failed to list models"))
+			return
+		}
+		if !slices.Contains(m.SupportedGenerationMethods, "embedContent") &&
+			!slices.Contains(m.SupportedGenerationMethods, "generateContent") ||
+			!allowedModel(r.Context(), m.Name) {
+			continue
+		}
+		ollamaResp.Models = append(ollamaResp.Models, openai.ConvertGeminiModelToOllama(m))
+	}
+
+	writeJSON(w, r, ollamaResp)
+}
+
+// ollamaEmbedHandler serves both /api/embed and the older /api/embeddings,
+// which takes a single prompt and returns a single embedding.
+func ollamaEmbedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+		return
+	}
+
+	var ollamaReq openai.OllamaEmbedRequest
+	err = json.Unmarshal(body, &ollamaReq)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+		return
+	}
+	openAIReq := openai.ConvertOllamaEmbedRequestToOpenAI(&ollamaReq)
+
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	openAIReq.Model = defaultEmbeddingModel(r.Context(), useIndex, openAIReq.Model)
+	noteRequest(r.Context(), openAIReq.Model, useIndex)
+
+	geminiBatchResp, _, err := batchEmbedContents(r.Context(), useIndex, openAIReq)
+	var invalidErr invalidEmbedRequestError
+	if errors.As(err, &invalidErr) {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", invalidErr.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to batch embed contents"))
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to batch embed contents"))
+		return
+	}
+
+	ollamaResp := openai.ConvertGeminiResponseToOllamaEmbed(geminiBatchResp, ollamaReq.Model)
+	if r.URL.Path == ollamaEmbeddingsEndpoint {
+		embeddingsResp := &openai.OllamaEmbeddingsResponse{Embedding: []float32{}}
+		if len(ollamaResp.Embeddings) > 0 {
+			embeddingsResp.Embedding = ollamaResp.Embeddings[0]
+		}
+		writeJSON(w, r, embeddingsResp)
+		return
+	}
+
+	writeJSON(w, r, ollamaResp)
+}
+
+func ollamaChatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+		return
+	}
+
+	var ollamaReq openai.OllamaChatRequest
+	err = json.Unmarshal(body, &ollamaReq)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+		return
+	}
+
+	chatReq, err := openai.ConvertOllamaChatRequestToChat(&ollamaReq)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert Ollama request to Gemini request"))
+		return
+	}
+
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	noteRequest(r.Context(), chatReq.Model, useIndex)
+
+	generativeModel := geminiClient(useIndex).GenerativeModel(chatReq.Model)
+	generativeModel.SafetySettings = defaultSafetySettings
+
+	session, parts, err := openai.ConvertOpenAIChatRequestToGemini(chatReq, generativeModel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert Ollama request to Gemini request"))
+		return
+	}
+
+	if chatReq.Stream {
+		stream := openai.NewOllamaChatStream(ollamaReq.Model)
+		converter := streamConverter{
+			chunk: func(geminiResp *genai.GenerateContentResponse) []serverSentEvent {
+				return []serverSentEvent{{data: stream.Convert(geminiResp)}}
+			},
+			finish: func(*genai.UsageMetadata) []serverSentEvent {
+				return []serverSentEvent{{data: stream.Finish()}}
+			},
+			ndjson: true,
+		}
+		streamGeminiResponses(w, r, session.SendMessageStream(r.Context(), parts...), converter)
+		return
+	}
+
+	geminiResp, err := session.SendMessage(r.Context(), parts...)
+	var blockedErr *genai.BlockedError
+	if errors.As(err, &blockedErr) {
+		var openAIErr *openai.Error
+		geminiResp, openAIErr = openai.ConvertGeminiBlockedErrorToOpenAI(blockedErr)
+		if openAIErr != nil {
+			writeErrorResponse(w, http.StatusBadRequest, openAIErr)
+			noteError(r.Context(), errors.Wrap(err, "generation was blocked"))
+			return
+		}
+		err = nil
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to generate content"))
+		return
+	}
+
+	chatResp := openai.ConvertGeminiChatResponseToOpenAI(geminiResp, "", 0, ollamaReq.Model)
+	writeJSON(w, r, openai.ConvertChatCompletionToOllama(chatResp))
+}
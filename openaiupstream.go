@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// openAIUpstreamEndpoints are the endpoints whose requests can be sent to OpenAI.
+var openAIUpstreamEndpoints = []string{
+	openAIEmbeddingsEndpoint,
+	openAIChatCompletionsEndpoint,
+	openAICompletionsEndpoint,
+	openAIResponsesEndpoint,
+}
+
+var openAIUpstreamRequests = newCounter("gemini_proxy_openai_upstream_requests_total", "Requests sent to OpenAI for models that Gemini does not know, by path and status code.")
+
+// newOpenAIUpstreamProxy creates the reverse proxy to OpenAIBaseURL, which
+// authenticates requests with OpenAIApiKey in place of the client's key.
+func newOpenAIUpstreamProxy() (*httputil.ReverseProxy, error) {
+	base, err := url.Parse(strings.TrimSuffix(OpenAIBaseURL, "/"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse OPENAI_BASE_URL")
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(base)
+			// OpenAIBaseURL includes the API version, as OpenAI's SDKs expect.
+			r.Out.URL.Path = base.Path + strings.TrimPrefix(r.In.URL.Path, "/v1")
+			r.Out.URL.RawPath = ""
+			r.Out.Header.Set("Authorization", "Bearer "+OpenAIApiKey)
+			r.Out.Header.Del("Api-Key")
+			r.Out.Header.Del("X-Api-Key")
+			setRequestIDHeader(r.Out.Header, r.In.Context())
+		},
+		// Streamed responses are sent on as they arrive.
+		FlushInterval: -1,
+		Transport:     upstreamTransport,
+		ModifyResponse: func(resp *http.Response) error {
+			openAIUpstreamRequests.add(1, "path", resp.Request.URL.Path, "code", strconv.Itoa(resp.StatusCode))
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			openAIUpstreamRequests.add(1, "path", r.URL.Path, "code", "error")
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			noteError(r.Context(), errors.Wrap(err, "failed to proxy request to OpenAI"))
+		},
+	}, nil
+}
+
+// openAIUpstreamHandler sends OpenAI API requests for models that Gemini does
+// not know to OpenAI instead, when OpenAIApiKey is set, before they would be
+// handled by next. Models are looked up from the request body after aliases
+// are resolved. Embedding requests are not sent with DefaultEmbeddingModelForce,
+// nor for the models of EmbeddingProviders.
+func openAIUpstreamHandler(next http.Handler) http.Handler {
+	if OpenAIApiKey == "" {
+		return next
+	}
+	proxy, err := newOpenAIUpstreamProxy()
+	if err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if r.Method != http.MethodPost || mediaType == "multipart/form-data" ||
+			!slices.Contains(openAIUpstreamEndpoints, r.URL.Path) ||
+			r.URL.Path == openAIEmbeddingsEndpoint && DefaultEmbeddingModelForce {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var fields struct {
+			Model string `json:"model"`
+		}
+		if json.Unmarshal(body, &fields) != nil || fields.Model == "" ||
+			r.URL.Path == openAIEmbeddingsEndpoint && providerEmbedder(fields.Model) != nil ||
+			geminiKnowsModel(r, fields.Model) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		requestLogger := requestLog(r)
+		requestLogger.Info().Str("model", fields.Model).Msg("Sending request for unknown model to OpenAI")
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// geminiKnowsModel reports whether Gemini knows a model, or might, if it cannot
+// be looked up.
+func geminiKnowsModel(r *http.Request, model string) bool {
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		// The handler reports that there is no key.
+		return true
+	}
+	defer doneClient(useIndex)
+	info, err := modelInfo(r.Context(), useIndex, openai.EmbeddingModelName(model))
+	if err != nil {
+		log.Warn().Err(err).Str("model", model).Msg("Failed to look up model, sending it to Gemini")
+		return true
+	}
+	return info != nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	otlpExportTimeout = 10 * time.Second
+	otlpScopeName     = "github.com/cheahjs/gemini-to-openai-proxy"
+)
+
+// otlpHeaders are the headers of requests to OTLPEndpoint, from OTLPHeaders.
+var otlpHeaders http.Header
+
+// parseOTLPHeaders parses the headers of requests to an OTLP collector, in the
+// form KEY=VALUE,KEY=VALUE with URL-encoded values, as OTel SDKs take them.
+// Semicolons separate them too.
+func parseOTLPHeaders(s string) (http.Header, error) {
+	headers := http.Header{}
+	for _, header := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' }) {
+		key, value, ok := strings.Cut(header, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid header: %s", header)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid header: %s", header)
+		}
+		headers.Set(strings.TrimSpace(key), value)
+	}
+	return headers, nil
+}
+
+// otlpKeyValue is an attribute in OTLP's JSON encoding.
+type otlpKeyValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func stringAttribute(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+// intAttribute is an integer attribute, which OTLP's JSON encoding writes as a
+// string.
+func intAttribute(key string, value int) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: map[string]string{"intValue": strconv.Itoa(value)}}
+}
+
+// otlpResource is the resource of the proxy's telemetry, named OTelServiceName.
+func otlpResource() map[string]interface{} {
+	return map[string]interface{}{
+		"attributes": []otlpKeyValue{stringAttribute("service.name", OTelServiceName)},
+	}
+}
+
+// otlpTime returns a time in OTLP's JSON encoding, nanoseconds since the epoch
+// as a string.
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// postOTLP sends telemetry to a signal's path of OTLPEndpoint, e.g. /v1/traces,
+// with OTLP's JSON encoding over HTTP.
+func postOTLP(path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal OTLP request")
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(OTLPEndpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create OTLP request")
+	}
+	for key, values := range otlpHeaders {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: otlpExportTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send OTLP request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("failed to send OTLP request: %s returned %d: %s", req.URL, resp.StatusCode, bytes.TrimSpace(b))
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// metricsStart is when the proxy started counting its metrics.
+var metricsStart = time.Now()
+
+// otlpAttributes returns labels, as alternating names and values, as OTLP
+// attributes.
+func otlpAttributes(labels []string) []otlpKeyValue {
+	attributes := []otlpKeyValue{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		attributes = append(attributes, stringAttribute(labels[i], labels[i+1]))
+	}
+	return attributes
+}
+
+// otlp returns the metric in OTLP's JSON encoding: a cumulative sum for
+// counters, counted since start, or a gauge.
+func (m *metric) otlp(start time.Time, now time.Time) map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	points := make([]map[string]interface{}, len(keys))
+	for i, key := range keys {
+		points[i] = map[string]interface{}{
+			"attributes":   otlpAttributes(m.labels[key]),
+			"timeUnixNano": otlpTime(now),
+			"asDouble":     m.values[key],
+		}
+		if m.kind == "counter" {
+			points[i]["startTimeUnixNano"] = otlpTime(start)
+		}
+	}
+	v := map[string]interface{}{"name": m.name, "description": m.help}
+	if m.kind == "counter" {
+		v["sum"] = map[string]interface{}{"dataPoints": points, "aggregationTemporality": 2, "isMonotonic": true}
+	} else {
+		v["gauge"] = map[string]interface{}{"dataPoints": points}
+	}
+	return v
+}
+
+// otlp returns the histogram in OTLP's JSON encoding, as a cumulative
+// histogram since start. OTLP counts each bucket on its own rather than with
+// those below it, as Prometheus does.
+func (h *histogram) otlp(start time.Time, now time.Time) map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	points := make([]map[string]interface{}, len(keys))
+	for i, key := range keys {
+		series := h.series[key]
+		counts := make([]string, len(h.buckets)+1)
+		var below uint64
+		for j, count := range series.counts {
+			counts[j] = strconv.FormatUint(count-below, 10)
+			below = count
+		}
+		counts[len(h.buckets)] = strconv.FormatUint(series.count-below, 10)
+		points[i] = map[string]interface{}{
+			"attributes":        otlpAttributes(series.labels),
+			"startTimeUnixNano": otlpTime(start),
+			"timeUnixNano":      otlpTime(now),
+			"count":             strconv.FormatUint(series.count, 10),
+			"sum":               series.sum,
+			"bucketCounts":      counts,
+			"explicitBounds":    h.buckets,
+		}
+	}
+	return map[string]interface{}{
+		"name":        h.name,
+		"description": h.help,
+		"histogram":   map[string]interface{}{"dataPoints": points, "aggregationTemporality": 2},
+	}
+}
+
+// otlpDataPoints returns the data points of a metric in OTLP's JSON encoding.
+func otlpDataPoints(v map[string]interface{}) []map[string]interface{} {
+	for _, kind := range []string{"sum", "gauge", "histogram"} {
+		if data, ok := v[kind].(map[string]interface{}); ok {
+			return data["dataPoints"].([]map[string]interface{})
+		}
+	}
+	return nil
+}
+
+// exportMetrics sends the metrics to OTLPEndpoint every
+// OTelMetricExportInterval, as well as serving them on metricsEndpoint.
+func exportMetrics() {
+	ticker := time.NewTicker(OTelMetricExportInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		flushMetrics()
+	}
+}
+
+// flushMetrics sends the metrics to OTLPEndpoint. Metrics without series yet
+// are left out, and nothing is sent until there are some.
+func flushMetrics() {
+	now := time.Now()
+	metricsMu.Lock()
+	var encoded []map[string]interface{}
+	for _, m := range metrics {
+		if v := m.otlp(metricsStart, now); len(otlpDataPoints(v)) > 0 {
+			encoded = append(encoded, v)
+		}
+	}
+	metricsMu.Unlock()
+	if len(encoded) == 0 {
+		return
+	}
+	err := postOTLP("/v1/metrics", map[string]interface{}{
+		"resourceMetrics": []map[string]interface{}{{
+			"resource": otlpResource(),
+			"scopeMetrics": []map[string]interface{}{{
+				"scope":   map[string]string{"name": otlpScopeName},
+				"metrics": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to export metrics")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	generativelanguage "cloud.google.com/go/ai/generativelanguage/apiv1beta"
+	"container/list"
+	"context"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// passthroughKey is the context key of the client index of the Gemini API key
+// presented by a request.
+type passthroughKey struct{}
+
+// passthroughClientBase is the first client index of the clients of keys
+// presented by clients. They are kept apart from the key pool, so that clients
+// cannot grow it, or its metrics, by presenting new keys.
+const passthroughClientBase = 1 << 30
+
+// passthroughKeyID stands in for the keys presented by clients in metrics.
+const passthroughKeyID = "passthrough"
+
+// passthroughClient is the client of a key presented by a client.
+type passthroughClient struct {
+	index            int32
+	key              string
+	geminiClient     *genai.Client
+	generativeClient *generativelanguage.GenerativeClient
+	modelClient      *generativelanguage.ModelClient
+	// holds counts the requests and batches using the client. A client that
+	// has been evicted is closed once they are done.
+	holds   int
+	evicted bool
+	element *list.Element
+}
+
+// passthroughCache keeps the clients of the KeyPassthroughClients keys most
+// recently presented by clients.
+type passthroughCache struct {
+	mu sync.Mutex
+	// recent is the cached clients, most recently used first.
+	recent  *list.List
+	byKey   map[string]*passthroughClient
+	byIndex map[int32]*passthroughClient
+	next    int32
+}
+
+var passthroughClients = &passthroughCache{
+	recent:  list.New(),
+	byKey:   map[string]*passthroughClient{},
+	byIndex: map[int32]*passthroughClient{},
+}
+
+// isPassthroughClient reports whether a client index is that of a key
+// presented by a client.
+func isPassthroughClient(useIndex int32) bool {
+	return useIndex >= passthroughClientBase
+}
+
+// acquire returns the client index of a key presented by a client, creating
+// its clients if it is not cached, and holds it until release. Configured keys
+// keep their clients, and are not held.
+func (c *passthroughCache) acquire(key string) (int32, error) {
+	if index := slices.Index(keys().keys, key); index >= 0 {
+		return int32(index), nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.byKey[key]; ok {
+		c.recent.MoveToFront(client.element)
+		client.holds++
+		return client.index, nil
+	}
+	index := c.nextIndex()
+	geminiClient, generativeClient, modelClient, err := newClients(&keyTransport{index: int(index), key: key}, key)
+	if err != nil {
+		return 0, err
+	}
+	client := &passthroughClient{
+		index:            index,
+		key:              key,
+		geminiClient:     geminiClient,
+		generativeClient: generativeClient,
+		modelClient:      modelClient,
+		holds:            1,
+	}
+	client.element = c.recent.PushFront(client)
+	c.byKey[key] = client
+	c.byIndex[index] = client
+	for c.recent.Len() > KeyPassthroughClients {
+		evicted := c.recent.Remove(c.recent.Back()).(*passthroughClient)
+		delete(c.byKey, evicted.key)
+		evicted.evicted = true
+		if evicted.holds == 0 {
+			c.close(evicted)
+		}
+	}
+	return index, nil
+}
+
+// nextIndex returns an unused client index for a new client.
+func (c *passthroughCache) nextIndex() int32 {
+	for {
+		index := passthroughClientBase + c.next
+		c.next = (c.next + 1) % passthroughClientBase
+		if _, ok := c.byIndex[index]; !ok {
+			return index
+		}
+	}
+}
+
+// client returns the client of a client index.
+func (c *passthroughCache) client(useIndex int32) *passthroughClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.byIndex[useIndex]
+}
+
+// hold holds the client of a client index, such as for a batch that outlives
+// the request that created it, until release.
+func (c *passthroughCache) hold(useIndex int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byIndex[useIndex].holds++
+}
+
+// release releases a hold on the client of a client index, closing it if it
+// has been evicted and is no longer used.
+func (c *passthroughCache) release(useIndex int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client := c.byIndex[useIndex]
+	if client.holds--; client.holds == 0 && client.evicted {
+		c.close(client)
+	}
+}
+
+func (c *passthroughCache) close(client *passthroughClient) {
+	delete(c.byIndex, client.index)
+	if err := client.geminiClient.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close Gemini client")
+	}
+	if err := client.generativeClient.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close Gemini API client")
+	}
+	if err := client.modelClient.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close Gemini models client")
+	}
+}
+
+// requestClients returns the clients a request can use: that of its own key
+// with KeyPassthrough, or otherwise those of the configured keys.
+func requestClients(ctx context.Context) []int32 {
+	if index, ok := ctx.Value(passthroughKey{}).(int32); ok {
+		return []int32{index}
+	}
+	clients := make([]int32, len(keys().keys))
+	for i := range clients {
+		clients[i] = int32(i)
+	}
+	return clients
+}
+
+// keyPassthroughHandler uses the token of requests, as found by requestToken,
+// as their Gemini API key when KeyPassthrough is set, before they are handled
+// by next. Requests without one use the configured keys, and are rejected if
+// there are none.
+// Requests with a virtual key or a proxy API key use the configured keys, and
+// are rejected with a 503 if there are none.
+func keyPassthroughHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !KeyPassthrough || metricsRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		_, virtual := r.Context().Value(virtualKeyContextKey{}).(*virtualKey)
+		_, proxy := r.Context().Value(proxyKeyContextKey{}).(string)
+		key := requestToken(r)
+		if virtual || proxy || key == "" {
+			if keys().group(r.Context()).selector != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if virtual || proxy {
+				writeNoKeyAvailable(w, r, errNoKeyAvailable)
+				return
+			}
+			code := "invalid_api_key"
+			writeErrorResponse(w, http.StatusUnauthorized, &openai.Error{
+				Message: "A Gemini API key must be given as a bearer token or in an api-key or x-api-key header",
+				Type:    "invalid_request_error",
+				Code:    &code,
+			})
+			noteError(r.Context(), errors.New("request has no Gemini API key"))
+			return
+		}
+
+		index, err := passthroughClients.acquire(key)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			noteError(r.Context(), err)
+			return
+		}
+		if isPassthroughClient(index) {
+			defer passthroughClients.release(index)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), passthroughKey{}, index)))
+	})
+}
@@ -0,0 +1,333 @@
+package openai
+
+import (
+	"encoding/json"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// ConvertAnthropicMessagesRequestToChat translates an Anthropic Messages API
+// request into the equivalent chat completion request.
+func ConvertAnthropicMessagesRequestToChat(anthropicReq *AnthropicMessagesRequest) (*ChatCompletionRequest, error) {
+	chatReq := &ChatCompletionRequest{
+		Model:                anthropicReq.Model,
+		Temperature:          anthropicReq.Temperature,
+		TopP:                 anthropicReq.TopP,
+		TopK:                 anthropicReq.TopK,
+		MaxTokens:            anthropicReq.MaxTokens,
+		Stream:               anthropicReq.Stream,
+		GeminiSafetySettings: anthropicReq.GeminiSafetySettings,
+	}
+	if anthropicReq.Metadata != nil {
+		chatReq.User = anthropicReq.Metadata.UserID
+	}
+	if len(anthropicReq.StopSequences) > 0 {
+		chatReq.Stop = stopSequences(anthropicReq.StopSequences)
+	}
+
+	if anthropicReq.System != nil {
+		chatReq.Messages = append(chatReq.Messages, &ChatCompletionMessage{
+			Role:    "system",
+			Content: anthropicReq.System,
+		})
+	}
+
+	for i, message := range anthropicReq.Messages {
+		messages, err := convertAnthropicMessage(message)
+		if err != nil {
+			return nil, errors.Wrapf(err, "messages[%d]", i)
+		}
+		chatReq.Messages = append(chatReq.Messages, messages...)
+	}
+
+	for _, tool := range anthropicReq.Tools {
+		// Server tools such as web search are passed through to be rejected.
+		if tool.Type != "" && tool.Type != "custom" {
+			chatReq.Tools = append(chatReq.Tools, &Tool{Type: tool.Type})
+			continue
+		}
+		chatReq.Tools = append(chatReq.Tools, &Tool{
+			Type: "function",
+			Function: &FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+
+	if toolChoice := anthropicReq.ToolChoice; toolChoice != nil {
+		switch toolChoice.Type {
+		case "auto", "none":
+			chatReq.ToolChoice = toolChoice.Type
+		case "any":
+			chatReq.ToolChoice = "required"
+		case "tool":
+			chatReq.ToolChoice = map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": toolChoice.Name},
+			}
+		default:
+			return nil, errors.Errorf("unsupported tool_choice type: %s", toolChoice.Type)
+		}
+	}
+
+	return chatReq, nil
+}
+
+// convertAnthropicMessage converts a message into chat messages. Tool results
+// are carried in user messages by Anthropic and become separate tool messages.
+func convertAnthropicMessage(message *AnthropicMessage) ([]*ChatCompletionMessage, error) {
+	blocks, ok := message.Content.([]interface{})
+	if !ok {
+		return []*ChatCompletionMessage{{Role: message.Role, Content: message.Content}}, nil
+	}
+
+	var messages []*ChatCompletionMessage
+	var content []interface{}
+	var toolCalls []*ToolCall
+	for i, rawBlock := range blocks {
+		var block AnthropicContentBlock
+		if err := remarshal(rawBlock, &block); err != nil {
+			return nil, errors.Wrapf(err, "content[%d]", i)
+		}
+		switch block.Type {
+		case "text":
+			content = append(content, rawBlock)
+		case "tool_use":
+			arguments, err := json.Marshal(block.Input)
+			if err != nil {
+				return nil, errors.Wrapf(err, "content[%d]: failed to marshal input", i)
+			}
+			toolCalls = append(toolCalls, &ToolCall{
+				ID:   block.ID,
+				Type: "function",
+				Function: &FunctionCall{
+					Name:      block.Name,
+					Arguments: string(arguments),
+				},
+			})
+		case "tool_result":
+			messages = append(messages, &ChatCompletionMessage{
+				Role:       "tool",
+				Content:    block.Content,
+				ToolCallID: block.ToolUseID,
+			})
+		case "thinking", "redacted_thinking":
+			// Thinking blocks are returned as is by clients and have no Gemini equivalent.
+		default:
+			return nil, errors.Errorf("content[%d]: unsupported content block type: %s", i, block.Type)
+		}
+	}
+	if len(content) > 0 || len(toolCalls) > 0 {
+		messages = append(messages, &ChatCompletionMessage{
+			Role:      message.Role,
+			Content:   content,
+			ToolCalls: toolCalls,
+		})
+	}
+	return messages, nil
+}
+
+func ConvertChatCompletionToAnthropic(chatResp *ChatCompletionResponse) *AnthropicMessagesResponse {
+	anthropicResp := newAnthropicMessagesResponse(chatResp.Model)
+
+	if len(chatResp.Choices) > 0 {
+		choice := chatResp.Choices[0]
+		if text, ok := choice.Message.Content.(string); ok && text != "" {
+			anthropicResp.Content = append(anthropicResp.Content, &AnthropicContentBlock{
+				Type: "text",
+				Text: &text,
+			})
+		}
+		for _, toolCall := range choice.Message.ToolCalls {
+			anthropicResp.Content = append(anthropicResp.Content, newAnthropicToolUseBlock(toolCall))
+		}
+		anthropicResp.StopReason = convertAnthropicStopReason(choice.FinishReason)
+	}
+
+	if chatResp.Usage != nil {
+		anthropicResp.Usage = &AnthropicUsage{
+			InputTokens:  chatResp.Usage.PromptTokens,
+			OutputTokens: chatResp.Usage.CompletionTokens,
+		}
+	}
+
+	return anthropicResp
+}
+
+func newAnthropicMessagesResponse(model string) *AnthropicMessagesResponse {
+	return &AnthropicMessagesResponse{
+		ID:      NewID("msg_"),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   model,
+		Content: []*AnthropicContentBlock{},
+		Usage:   &AnthropicUsage{},
+	}
+}
+
+func newAnthropicToolUseBlock(toolCall *ToolCall) *AnthropicContentBlock {
+	input := map[string]interface{}{}
+	_ = json.Unmarshal([]byte(toolCall.Function.Arguments), &input)
+	return &AnthropicContentBlock{
+		Type:  "tool_use",
+		ID:    NewID("toolu_"),
+		Name:  toolCall.Function.Name,
+		Input: input,
+	}
+}
+
+func convertAnthropicStopReason(finishReason *string) *string {
+	if finishReason == nil {
+		return nil
+	}
+	var reason string
+	switch *finishReason {
+	case "length":
+		reason = "max_tokens"
+	case "tool_calls":
+		reason = "tool_use"
+	case "content_filter":
+		reason = "refusal"
+	default:
+		reason = "end_turn"
+	}
+	return &reason
+}
+
+// AnthropicMessagesStream converts a Gemini stream into Anthropic Messages API
+// stream events. Consecutive text is streamed into one text block, and each
+// function call becomes its own tool_use block.
+type AnthropicMessagesStream struct {
+	message      *AnthropicMessagesResponse
+	blockIndex   int
+	textOpen     bool
+	finishReason *string
+}
+
+func NewAnthropicMessagesStream(model string) *AnthropicMessagesStream {
+	return &AnthropicMessagesStream{message: newAnthropicMessagesResponse(model)}
+}
+
+func (s *AnthropicMessagesStream) Start() []*AnthropicStreamEvent {
+	return []*AnthropicStreamEvent{{Type: "message_start", Message: s.message}}
+}
+
+func (s *AnthropicMessagesStream) Convert(geminiResp *genai.GenerateContentResponse) []*AnthropicStreamEvent {
+	var events []*AnthropicStreamEvent
+	if geminiResp.UsageMetadata != nil {
+		usage := ConvertGeminiUsageToOpenAI(geminiResp.UsageMetadata)
+		s.message.Usage = &AnthropicUsage{
+			InputTokens:  usage.PromptTokens,
+			OutputTokens: usage.CompletionTokens,
+		}
+	}
+	if len(geminiResp.Candidates) == 0 {
+		return events
+	}
+	candidate := geminiResp.Candidates[0]
+
+	if text := candidateText(candidate); text != "" {
+		if !s.textOpen {
+			s.textOpen = true
+			events = append(events, &AnthropicStreamEvent{
+				Type:         "content_block_start",
+				Index:        genai.Ptr(s.blockIndex),
+				ContentBlock: &AnthropicContentBlock{Type: "text", Text: genai.Ptr("")},
+			})
+		}
+		events = append(events, &AnthropicStreamEvent{
+			Type:  "content_block_delta",
+			Index: genai.Ptr(s.blockIndex),
+			Delta: &AnthropicStreamDelta{Type: "text_delta", Text: &text},
+		})
+	}
+
+	for _, toolCall := range candidateToolCalls(candidate, false) {
+		events = append(events, s.closeText()...)
+		block := newAnthropicToolUseBlock(toolCall)
+		// Gemini returns function calls whole, so the input is sent in one delta.
+		events = append(events,
+			&AnthropicStreamEvent{
+				Type:         "content_block_start",
+				Index:        genai.Ptr(s.blockIndex),
+				ContentBlock: &AnthropicContentBlock{Type: "tool_use", ID: block.ID, Name: block.Name, Input: map[string]interface{}{}},
+			},
+			&AnthropicStreamEvent{
+				Type:  "content_block_delta",
+				Index: genai.Ptr(s.blockIndex),
+				Delta: &AnthropicStreamDelta{Type: "input_json_delta", PartialJSON: &toolCall.Function.Arguments},
+			},
+			&AnthropicStreamEvent{
+				Type:  "content_block_stop",
+				Index: genai.Ptr(s.blockIndex),
+			},
+		)
+		s.blockIndex++
+	}
+
+	if finishReason := convertFinishReason(candidate); finishReason != nil {
+		s.finishReason = finishReason
+	}
+	return events
+}
+
+func (s *AnthropicMessagesStream) closeText() []*AnthropicStreamEvent {
+	if !s.textOpen {
+		return nil
+	}
+	s.textOpen = false
+	event := &AnthropicStreamEvent{
+		Type:  "content_block_stop",
+		Index: genai.Ptr(s.blockIndex),
+	}
+	s.blockIndex++
+	return []*AnthropicStreamEvent{event}
+}
+
+func (s *AnthropicMessagesStream) Finish() []*AnthropicStreamEvent {
+	if s.finishReason == nil {
+		s.finishReason = genai.Ptr("stop")
+	}
+	events := s.closeText()
+	return append(events,
+		&AnthropicStreamEvent{
+			Type:  "message_delta",
+			Delta: &AnthropicStreamDelta{StopReason: convertAnthropicStopReason(s.finishReason)},
+			Usage: s.message.Usage,
+		},
+		&AnthropicStreamEvent{Type: "message_stop"},
+	)
+}
+
+// anthropicErrorTypes are the Anthropic API error types of HTTP status codes.
+// Other 4xx codes are invalid requests, and 5xx codes internal errors.
+var anthropicErrorTypes = map[int]string{
+	http.StatusBadRequest:            "invalid_request_error",
+	http.StatusUnauthorized:          "authentication_error",
+	http.StatusForbidden:             "permission_error",
+	http.StatusNotFound:              "not_found_error",
+	http.StatusRequestEntityTooLarge: "request_too_large",
+	http.StatusTooManyRequests:       "rate_limit_error",
+	http.StatusServiceUnavailable:    "overloaded_error",
+	529:                              "overloaded_error",
+}
+
+// NewAnthropicError returns the Anthropic API error body of a status code and
+// message, as Anthropic SDKs parse it, which is also the data of the error
+// event of a stream.
+func NewAnthropicError(statusCode int, message string) *AnthropicErrorResponse {
+	errorType, ok := anthropicErrorTypes[statusCode]
+	if !ok {
+		errorType = "invalid_request_error"
+		if statusCode >= http.StatusInternalServerError {
+			errorType = "api_error"
+		}
+	}
+	return &AnthropicErrorResponse{
+		Type:  "error",
+		Error: &AnthropicError{Type: errorType, Message: message},
+	}
+}
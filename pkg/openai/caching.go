@@ -0,0 +1,67 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+const cachedContentNamePrefix = "cachedContents/"
+
+func ConvertOpenAICachedContentRequestToGemini(openAIReq *CachedContentRequest) (*genai.CachedContent, error) {
+	if openAIReq.Model == "" {
+		return nil, errors.New("model is required")
+	}
+	if openAIReq.TTLSeconds < 0 {
+		return nil, errors.New("ttl_seconds must not be negative")
+	}
+
+	systemInstruction, contents, err := convertMessages(openAIReq.Messages)
+	if err != nil {
+		return nil, err
+	}
+	tools, toolConfig, err := convertTools(openAIReq.Tools, openAIReq.ToolChoice)
+	if err != nil {
+		return nil, err
+	}
+
+	return &genai.CachedContent{
+		Model:             openAIReq.Model,
+		DisplayName:       openAIReq.DisplayName,
+		SystemInstruction: systemInstruction,
+		Contents:          contents,
+		Tools:             tools,
+		ToolConfig:        toolConfig,
+		Expiration: genai.ExpireTimeOrTTL{
+			TTL: time.Duration(openAIReq.TTLSeconds) * time.Second,
+		},
+	}, nil
+}
+
+func ConvertGeminiCachedContentToOpenAI(cachedContent *genai.CachedContent) *CachedContentResponse {
+	openAIResp := &CachedContentResponse{
+		ID:          CachedContentID(cachedContent.Name),
+		Object:      "cached_content",
+		Model:       strings.TrimPrefix(cachedContent.Model, "models/"),
+		DisplayName: cachedContent.DisplayName,
+		CreatedAt:   cachedContent.CreateTime.Unix(),
+		ExpiresAt:   cachedContent.Expiration.ExpireTime.Unix(),
+	}
+	if cachedContent.UsageMetadata != nil {
+		openAIResp.Usage = &CachedContentUsage{
+			TotalTokens: int(cachedContent.UsageMetadata.TotalTokenCount),
+		}
+	}
+	return openAIResp
+}
+
+// CachedContentID returns the ID clients use for a cached content name.
+func CachedContentID(name string) string {
+	return strings.TrimPrefix(name, cachedContentNamePrefix)
+}
+
+// CachedContentName returns the Gemini resource name for a cached content ID.
+func CachedContentName(id string) string {
+	return cachedContentNamePrefix + CachedContentID(id)
+}
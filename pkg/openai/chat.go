@@ -0,0 +1,376 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// ConvertOpenAIChatRequestToGemini translates a chat completion request into a
+// Gemini chat session and the parts of its last message. The responses,
+// Anthropic messages and Ollama chat endpoints convert their requests to chat
+// completion requests first, so that every endpoint maps to Gemini the same way.
+func ConvertOpenAIChatRequestToGemini(openAIReq *ChatCompletionRequest, model *genai.GenerativeModel) (*genai.ChatSession, []genai.Part, error) {
+	if len(openAIReq.Messages) == 0 {
+		return nil, nil, errors.New("messages must not be empty")
+	}
+
+	// max_completion_tokens supersedes the deprecated max_tokens.
+	maxTokens := openAIReq.MaxCompletionTokens
+	if maxTokens == nil {
+		maxTokens = openAIReq.MaxTokens
+	}
+	err := applyGenerationParameters(&generationParameters{
+		N:                openAIReq.N,
+		Stop:             openAIReq.Stop,
+		Temperature:      openAIReq.Temperature,
+		TopP:             openAIReq.TopP,
+		TopK:             openAIReq.TopK,
+		MaxTokens:        maxTokens,
+		Logprobs:         openAIReq.Logprobs || (openAIReq.TopLogprobs != nil && *openAIReq.TopLogprobs > 0),
+		PresencePenalty:  openAIReq.PresencePenalty,
+		FrequencyPenalty: openAIReq.FrequencyPenalty,
+		SafetySettings:   openAIReq.GeminiSafetySettings,
+	}, model)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := applyResponseFormat(openAIReq.ResponseFormat, model); err != nil {
+		return nil, nil, err
+	}
+
+	if err := applyTools(openAIReq.Tools, openAIReq.ToolChoice, model); err != nil {
+		return nil, nil, err
+	}
+
+	if openAIReq.CachedContent != "" {
+		model.CachedContentName = CachedContentName(openAIReq.CachedContent)
+	}
+
+	systemInstruction, contents, err := convertMessages(openAIReq.Messages)
+	if err != nil {
+		return nil, nil, err
+	}
+	model.SystemInstruction = systemInstruction
+
+	if len(contents) == 0 || contents[len(contents)-1].Role != "user" {
+		return nil, nil, errors.New("last message must be from the user")
+	}
+
+	session := model.StartChat()
+	session.History = contents[:len(contents)-1]
+	return session, contents[len(contents)-1].Parts, nil
+}
+
+// convertMessages splits the conversation into Gemini's system instruction and contents.
+func convertMessages(messages []*ChatCompletionMessage) (*genai.Content, []*genai.Content, error) {
+	var systemParts []genai.Part
+	var contents []*genai.Content
+	functionNames := map[string]string{}
+	for i, message := range messages {
+		switch message.Role {
+		case "system", "developer":
+			parts, err := convertMessageContent(message.Content)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "messages[%d]", i)
+			}
+			systemParts = append(systemParts, parts...)
+		case "user":
+			parts, err := convertMessageContent(message.Content)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "messages[%d]", i)
+			}
+			contents = append(contents, &genai.Content{Role: "user", Parts: parts})
+		case "assistant":
+			parts, err := convertMessageContent(message.Content)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "messages[%d]", i)
+			}
+			toolCallParts, err := convertToolCalls(message.ToolCalls)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "messages[%d]", i)
+			}
+			for _, toolCall := range message.ToolCalls {
+				functionNames[toolCall.ID] = toolCall.Function.Name
+			}
+			contents = append(contents, &genai.Content{Role: "model", Parts: append(parts, toolCallParts...)})
+		case "tool", "function":
+			// "function" is the role used by the deprecated OpenAI functions API.
+			part, err := convertToolMessage(message, functionNames)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "messages[%d]", i)
+			}
+			contents = append(contents, &genai.Content{Role: "user", Parts: []genai.Part{part}})
+		default:
+			return nil, nil, errors.Errorf("messages[%d]: unsupported role: %s", i, message.Role)
+		}
+	}
+
+	var systemInstruction *genai.Content
+	if len(systemParts) > 0 {
+		systemInstruction = &genai.Content{Parts: systemParts}
+	}
+	return systemInstruction, mergeContents(contents), nil
+}
+
+// mergeContents drops empty turns and merges consecutive turns from the same role,
+// since Gemini requires user and model turns to alternate. This also groups the
+// results of parallel tool calls into the single turn Gemini expects.
+func mergeContents(contents []*genai.Content) []*genai.Content {
+	var merged []*genai.Content
+	for _, content := range contents {
+		if len(content.Parts) == 0 {
+			continue
+		}
+		if len(merged) > 0 && merged[len(merged)-1].Role == content.Role {
+			last := merged[len(merged)-1]
+			last.Parts = append(last.Parts, content.Parts...)
+			continue
+		}
+		merged = append(merged, content)
+	}
+	return merged
+}
+
+func applyResponseFormat(responseFormat *ResponseFormat, model *genai.GenerativeModel) error {
+	if responseFormat == nil {
+		return nil
+	}
+
+	switch responseFormat.Type {
+	case "", "text":
+	case "json_object":
+		model.ResponseMIMEType = "application/json"
+	case "json_schema":
+		if responseFormat.JSONSchema == nil || responseFormat.JSONSchema.Schema == nil {
+			return errors.New("response_format.json_schema.schema is required")
+		}
+		schema, err := ConvertJSONSchemaToGemini(responseFormat.JSONSchema.Schema)
+		if err != nil {
+			return errors.Wrap(err, "failed to convert response_format.json_schema")
+		}
+		if schema.Description == "" {
+			schema.Description = responseFormat.JSONSchema.Description
+		}
+		model.ResponseMIMEType = "application/json"
+		model.ResponseSchema = schema
+	default:
+		return errors.Errorf("unsupported response_format type: %s", responseFormat.Type)
+	}
+
+	return nil
+}
+
+func convertMessageContent(content interface{}) ([]genai.Part, error) {
+	switch v := content.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		return []genai.Part{genai.Text(v)}, nil
+	case []interface{}:
+		var parts []genai.Part
+		for _, item := range v {
+			part, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("unsupported content part: %T", item)
+			}
+			switch part["type"] {
+			// input_text and output_text are the Responses API equivalents.
+			case "text", "input_text", "output_text":
+				text, _ := part["text"].(string)
+				parts = append(parts, genai.Text(text))
+			// input_file is the Responses API equivalent.
+			case "file", "input_file":
+				id := contentPartFileID(part)
+				if id == "" {
+					return nil, errors.New("file content parts require a file_id")
+				}
+				parts = append(parts, genai.FileData{URI: fileURIPrefix + FileName(id)})
+			default:
+				return nil, errors.Errorf("unsupported content part type: %v", part["type"])
+			}
+		}
+		return parts, nil
+	default:
+		return nil, errors.Errorf("unsupported content type: %T", v)
+	}
+}
+
+func messageText(content interface{}) (string, error) {
+	parts, err := convertMessageContent(content)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, part := range parts {
+		if text, ok := part.(genai.Text); ok {
+			b.WriteString(string(text))
+		}
+	}
+	return b.String(), nil
+}
+
+func ConvertGeminiChatResponseToOpenAI(geminiResp *genai.GenerateContentResponse, id string, created int64, model string) *ChatCompletionResponse {
+	openAIResp := &ChatCompletionResponse{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: created,
+		Model:   model,
+	}
+
+	for _, candidate := range geminiResp.Candidates {
+		openAIResp.Choices = append(openAIResp.Choices, &ChatCompletionChoice{
+			Index:        int(candidate.Index),
+			Message:      convertCandidate(candidate, false),
+			FinishReason: convertFinishReason(candidate),
+		})
+	}
+
+	openAIResp.Usage = ConvertGeminiUsageToOpenAI(geminiResp.UsageMetadata)
+
+	return openAIResp
+}
+
+func ConvertGeminiChatStreamResponseToOpenAI(geminiResp *genai.GenerateContentResponse, id string, created int64, model string) *ChatCompletionResponse {
+	openAIResp := &ChatCompletionResponse{
+		ID:      id,
+		Object:  "chat.completion.chunk",
+		Created: created,
+		Model:   model,
+	}
+
+	for _, candidate := range geminiResp.Candidates {
+		openAIResp.Choices = append(openAIResp.Choices, &ChatCompletionChoice{
+			Index:        int(candidate.Index),
+			Delta:        convertCandidate(candidate, true),
+			FinishReason: convertFinishReason(candidate),
+		})
+	}
+
+	return openAIResp
+}
+
+func ConvertGeminiUsageToOpenAI(usageMetadata *genai.UsageMetadata) *ChatUsage {
+	if usageMetadata == nil {
+		return &ChatUsage{}
+	}
+	return &ChatUsage{
+		PromptTokens:     int(usageMetadata.PromptTokenCount),
+		CompletionTokens: int(usageMetadata.CandidatesTokenCount),
+		TotalTokens:      int(usageMetadata.TotalTokenCount),
+	}
+}
+
+func convertCandidate(candidate *genai.Candidate, stream bool) *ChatCompletionMessage {
+	message := &ChatCompletionMessage{
+		Role:      "assistant",
+		ToolCalls: candidateToolCalls(candidate, stream),
+	}
+	// Tool call only responses have a null content.
+	if text := candidateText(candidate); text != "" || len(message.ToolCalls) == 0 {
+		message.Content = text
+	}
+	return message
+}
+
+func ConvertGeminiUsageToOpenAIStreamChunk(usageMetadata *genai.UsageMetadata, id string, created int64, model string) *ChatCompletionResponse {
+	return &ChatCompletionResponse{
+		ID:      id,
+		Object:  "chat.completion.chunk",
+		Created: created,
+		Model:   model,
+		Choices: []*ChatCompletionChoice{},
+		Usage:   ConvertGeminiUsageToOpenAI(usageMetadata),
+	}
+}
+
+func candidateText(candidate *genai.Candidate) string {
+	if candidate.Content == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, part := range candidate.Content.Parts {
+		switch v := part.(type) {
+		case genai.Text:
+			b.WriteString(string(v))
+		case *genai.ExecutableCode:
+			// Code execution parts are rendered as markdown so clients without
+			// special handling still show them.
+			language := ""
+			if v.Language == genai.ExecutableCodePython {
+				language = "python"
+			}
+			b.WriteString("\n```" + language + "\n" + strings.TrimSuffix(v.Code, "\n") + "\n```\n")
+		case *genai.CodeExecutionResult:
+			switch v.Outcome {
+			case genai.CodeExecutionResultOutcomeFailed:
+				b.WriteString("\nExecution failed:")
+			case genai.CodeExecutionResultOutcomeDeadlineExceeded:
+				b.WriteString("\nExecution timed out:")
+			}
+			b.WriteString("\n```\n" + strings.TrimSuffix(v.Output, "\n") + "\n```\n")
+		}
+	}
+	return b.String()
+}
+
+func convertFinishReason(candidate *genai.Candidate) *string {
+	var reason string
+	switch candidate.FinishReason {
+	case genai.FinishReasonUnspecified:
+		return nil
+	case genai.FinishReasonMaxTokens:
+		reason = "length"
+	case genai.FinishReasonSafety, genai.FinishReasonRecitation:
+		reason = "content_filter"
+	default:
+		if len(candidate.FunctionCalls()) > 0 {
+			reason = "tool_calls"
+		} else {
+			reason = "stop"
+		}
+	}
+	return &reason
+}
+
+// ConvertGeminiBlockedErrorToOpenAI returns the response to send for a blocked
+// generation. If the blocked candidate still carries content it is returned as a
+// regular response with a content_filter finish reason, otherwise an error is.
+func ConvertGeminiBlockedErrorToOpenAI(blockedErr *genai.BlockedError) (*genai.GenerateContentResponse, *Error) {
+	if blockedErr.Candidate != nil && blockedErr.Candidate.Content != nil && len(blockedErr.Candidate.Content.Parts) > 0 {
+		return &genai.GenerateContentResponse{Candidates: []*genai.Candidate{blockedErr.Candidate}}, nil
+	}
+
+	var message string
+	var ratings []*genai.SafetyRating
+	switch {
+	case blockedErr.PromptFeedback != nil:
+		message = "The prompt was blocked by Gemini: " + blockedErr.PromptFeedback.BlockReason.String()
+		ratings = blockedErr.PromptFeedback.SafetyRatings
+	case blockedErr.Candidate != nil:
+		message = "The response was blocked by Gemini: " + blockedErr.Candidate.FinishReason.String()
+		ratings = blockedErr.Candidate.SafetyRatings
+	default:
+		message = "The response was blocked by Gemini"
+	}
+	var blockedCategories []string
+	for _, rating := range ratings {
+		if rating.Blocked {
+			blockedCategories = append(blockedCategories, rating.Category.String())
+		}
+	}
+	if len(blockedCategories) > 0 {
+		message += " (" + strings.Join(blockedCategories, ", ") + ")"
+	}
+
+	code := "content_filter"
+	return nil, &Error{
+		Message: message,
+		Type:    "invalid_request_error",
+		Code:    &code,
+	}
+}
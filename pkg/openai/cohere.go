@@ -0,0 +1,131 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"math"
+)
+
+var cohereInputTypes = map[string]genai.TaskType{
+	"search_document": genai.TaskTypeRetrievalDocument,
+	"search_query":    genai.TaskTypeRetrievalQuery,
+	"classification":  genai.TaskTypeClassification,
+	"clustering":      genai.TaskTypeClustering,
+}
+
+func ConvertCohereEmbedRequestToGemini(cohereReq *CohereEmbedRequest, model *genai.EmbeddingModel) (*genai.EmbeddingBatch, error) {
+	if cohereReq.InputType != "" {
+		taskType, ok := cohereInputTypes[cohereReq.InputType]
+		if !ok {
+			return nil, errors.Errorf("unsupported input_type: %s", cohereReq.InputType)
+		}
+		model.TaskType = taskType
+	}
+	if err := validateEmbeddingTypes(cohereReq.EmbeddingTypes); err != nil {
+		return nil, err
+	}
+	if len(cohereReq.Texts) == 0 {
+		return nil, errors.New("texts is required")
+	}
+
+	geminiBatchReq := model.NewBatch()
+	for _, text := range cohereReq.Texts {
+		geminiBatchReq.AddContent(genai.Text(text))
+	}
+	return geminiBatchReq, nil
+}
+
+func ConvertGeminiResponseToCohereEmbed(geminiBatchResp *genai.BatchEmbedContentsResponse, cohereReq *CohereEmbedRequest, id string) *CohereEmbedResponse {
+	cohereResp := &CohereEmbedResponse{
+		ID:    id,
+		Texts: cohereReq.Texts,
+		Meta:  &CohereMeta{APIVersion: &CohereAPIVersion{Version: "1"}},
+	}
+
+	var embeddings [][]float32
+	for _, geminiResp := range geminiBatchResp.Embeddings {
+		embeddings = append(embeddings, geminiResp.Values)
+	}
+	if len(cohereReq.EmbeddingTypes) == 0 {
+		cohereResp.ResponseType = "embeddings_floats"
+		cohereResp.Embeddings = embeddings
+		return cohereResp
+	}
+
+	byType := map[string]interface{}{}
+	for _, embeddingType := range cohereReq.EmbeddingTypes {
+		if embeddingType == "float" {
+			byType[embeddingType] = embeddings
+			continue
+		}
+		quantized := make([][]int, len(embeddings))
+		for i, embedding := range embeddings {
+			quantized[i] = quantizeEmbeddingType(embedding, embeddingType)
+		}
+		byType[embeddingType] = quantized
+	}
+	cohereResp.ResponseType = "embeddings_by_type"
+	cohereResp.Embeddings = byType
+	return cohereResp
+}
+
+func validateEmbeddingTypes(embeddingTypes []string) error {
+	for _, embeddingType := range embeddingTypes {
+		switch embeddingType {
+		case "float", "int8", "uint8", "binary", "ubinary":
+		default:
+			return errors.Errorf("unsupported embedding_types: %s", embeddingType)
+		}
+	}
+	return nil
+}
+
+// quantizeEmbeddingType quantizes an embedding to one of the embedding types
+// other than float.
+func quantizeEmbeddingType(embedding []float32, embeddingType string) []int {
+	switch embeddingType {
+	case "int8":
+		return quantizeEmbedding(embedding, 0)
+	case "uint8":
+		return quantizeEmbedding(embedding, 128)
+	case "binary":
+		return binarizeEmbedding(embedding, -128)
+	default:
+		return binarizeEmbedding(embedding, 0)
+	}
+}
+
+// quantizeEmbedding scales an embedding into the int8 range by its largest
+// magnitude, then shifts each value by offset.
+func quantizeEmbedding(embedding []float32, offset int) []int {
+	var scale float64
+	for _, v := range embedding {
+		scale = math.Max(scale, math.Abs(float64(v)))
+	}
+	quantized := make([]int, len(embedding))
+	if scale == 0 {
+		for i := range quantized {
+			quantized[i] = offset
+		}
+		return quantized
+	}
+	for i, v := range embedding {
+		quantized[i] = int(math.Round(float64(v)/scale*127)) + offset
+	}
+	return quantized
+}
+
+// binarizeEmbedding packs the sign of each dimension into bits, eight to a
+// byte with the first dimension in the highest bit, then shifts each byte by offset.
+func binarizeEmbedding(embedding []float32, offset int) []int {
+	packed := make([]int, (len(embedding)+7)/8)
+	for i, v := range embedding {
+		if v > 0 {
+			packed[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	for i := range packed {
+		packed[i] += offset
+	}
+	return packed
+}
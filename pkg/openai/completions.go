@@ -0,0 +1,113 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+)
+
+// ConvertOpenAICompletionRequestToGemini configures model from the request and
+// returns the prompts, each of which is sent to Gemini as a single-turn request.
+func ConvertOpenAICompletionRequestToGemini(openAIReq *CompletionRequest, model *genai.GenerativeModel) ([]string, error) {
+	if openAIReq.Suffix != "" {
+		return nil, errors.New("suffix is not supported")
+	}
+
+	err := applyGenerationParameters(&generationParameters{
+		N:                openAIReq.N,
+		Stop:             openAIReq.Stop,
+		Temperature:      openAIReq.Temperature,
+		TopP:             openAIReq.TopP,
+		MaxTokens:        openAIReq.MaxTokens,
+		Logprobs:         openAIReq.Logprobs != nil && *openAIReq.Logprobs > 0,
+		PresencePenalty:  openAIReq.PresencePenalty,
+		FrequencyPenalty: openAIReq.FrequencyPenalty,
+		SafetySettings:   openAIReq.GeminiSafetySettings,
+	}, model)
+	if err != nil {
+		return nil, err
+	}
+	if openAIReq.N > 1 {
+		model.SetCandidateCount(int32(openAIReq.N))
+	}
+
+	var prompts []string
+	switch v := openAIReq.Prompt.(type) {
+	case string:
+		prompts = append(prompts, v)
+	case []interface{}:
+		for _, prompt := range v {
+			if p, ok := prompt.(string); ok {
+				prompts = append(prompts, p)
+			} else {
+				return nil, errors.Errorf("unsupported prompt type: %T", prompt)
+			}
+		}
+	default:
+		return nil, errors.Errorf("unsupported prompt type: %T", v)
+	}
+	if len(prompts) == 0 {
+		return nil, errors.New("prompt must not be empty")
+	}
+
+	return prompts, nil
+}
+
+// ConvertGeminiCompletionResponsesToOpenAI merges the responses for each prompt.
+// As with OpenAI, the choices for prompt i start at index i*n.
+func ConvertGeminiCompletionResponsesToOpenAI(geminiResps []*genai.GenerateContentResponse, prompts []string, n int, echo bool, id string, created int64, model string) *CompletionResponse {
+	openAIResp := &CompletionResponse{
+		ID:      id,
+		Object:  "text_completion",
+		Created: created,
+		Model:   model,
+		Usage:   &ChatUsage{},
+	}
+
+	for i, geminiResp := range geminiResps {
+		for _, choice := range convertCompletionCandidates(geminiResp, i*max(n, 1)) {
+			if echo {
+				choice.Text = prompts[i] + choice.Text
+			}
+			openAIResp.Choices = append(openAIResp.Choices, choice)
+		}
+		usage := ConvertGeminiUsageToOpenAI(geminiResp.UsageMetadata)
+		openAIResp.Usage.PromptTokens += usage.PromptTokens
+		openAIResp.Usage.CompletionTokens += usage.CompletionTokens
+		openAIResp.Usage.TotalTokens += usage.TotalTokens
+	}
+
+	return openAIResp
+}
+
+func ConvertGeminiCompletionStreamResponseToOpenAI(geminiResp *genai.GenerateContentResponse, id string, created int64, model string) *CompletionResponse {
+	return &CompletionResponse{
+		ID:      id,
+		Object:  "text_completion",
+		Created: created,
+		Model:   model,
+		Choices: convertCompletionCandidates(geminiResp, 0),
+	}
+}
+
+func ConvertGeminiUsageToOpenAICompletionStreamChunk(usageMetadata *genai.UsageMetadata, id string, created int64, model string) *CompletionResponse {
+	return &CompletionResponse{
+		ID:      id,
+		Object:  "text_completion",
+		Created: created,
+		Model:   model,
+		Choices: []*CompletionChoice{},
+		Usage:   ConvertGeminiUsageToOpenAI(usageMetadata),
+	}
+}
+
+func convertCompletionCandidates(geminiResp *genai.GenerateContentResponse, indexOffset int) []*CompletionChoice {
+	var choices []*CompletionChoice
+	for _, candidate := range geminiResp.Candidates {
+		choices = append(choices, &CompletionChoice{
+			Text:         candidateText(candidate),
+			Index:        indexOffset + int(candidate.Index),
+			FinishReason: convertFinishReason(candidate),
+		})
+	}
+	return choices
+}
@@ -0,0 +1,91 @@
+package openai
+
+import (
+	"cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+)
+
+// VoyageInputTypes are the input types of Voyage AI by Gemini task type.
+var VoyageInputTypes = map[genai.TaskType]string{
+	genai.TaskTypeRetrievalQuery:    "query",
+	genai.TaskTypeRetrievalDocument: "document",
+}
+
+// ConvertOpenAIRequestToCohere converts an embedding request to a request of
+// Cohere's v2 embed API for model. Cohere requires an input type, which is
+// search_document unless the task type names another.
+func ConvertOpenAIRequestToCohere(openAIReq *EmbedRequest, model string) (*CohereEmbedRequest, error) {
+	texts, err := EmbeddingInputTexts(openAIReq)
+	if err != nil {
+		return nil, err
+	}
+	taskType, err := embeddingTaskType(openAIReq)
+	if err != nil {
+		return nil, err
+	}
+	inputType := ""
+	for name, cohereTaskType := range cohereInputTypes {
+		if cohereTaskType == taskType {
+			inputType = name
+		}
+	}
+	switch {
+	case taskType == genai.TaskTypeUnspecified:
+		inputType = "search_document"
+	case inputType == "":
+		return nil, errors.Errorf("task_type %s is not supported by Cohere", generativelanguagepb.TaskType(taskType))
+	}
+	return &CohereEmbedRequest{
+		Model:          model,
+		Texts:          texts,
+		InputType:      inputType,
+		EmbeddingTypes: []string{"float"},
+	}, nil
+}
+
+func ConvertCohereResponseToGemini(cohereResp *CohereEmbedByTypeResponse, count int) (*genai.BatchEmbedContentsResponse, error) {
+	if len(cohereResp.Embeddings.Float) != count {
+		return nil, errors.Errorf("expected %d embeddings, got %d", count, len(cohereResp.Embeddings.Float))
+	}
+	geminiBatchResp := &genai.BatchEmbedContentsResponse{}
+	for _, values := range cohereResp.Embeddings.Float {
+		geminiBatchResp.Embeddings = append(geminiBatchResp.Embeddings, &genai.ContentEmbedding{Values: values})
+	}
+	return geminiBatchResp, nil
+}
+
+// ConvertOpenAIRequestToProvider converts an embedding request to a request of
+// an OpenAI-compatible provider for model, with the input type of its task type
+// in inputTypes, if any.
+func ConvertOpenAIRequestToProvider(openAIReq *EmbedRequest, model string, inputTypes map[genai.TaskType]string) (*ProviderEmbedRequest, error) {
+	texts, err := EmbeddingInputTexts(openAIReq)
+	if err != nil {
+		return nil, err
+	}
+	taskType, err := embeddingTaskType(openAIReq)
+	if err != nil {
+		return nil, err
+	}
+	return &ProviderEmbedRequest{
+		Input:     texts,
+		Model:     model,
+		InputType: inputTypes[taskType],
+	}, nil
+}
+
+// ConvertProviderResponseToGemini orders the embeddings of a response of an
+// OpenAI-compatible provider to a request of count inputs by their index.
+func ConvertProviderResponseToGemini(providerResp *ProviderEmbedResponse, count int) (*genai.BatchEmbedContentsResponse, error) {
+	geminiBatchResp := &genai.BatchEmbedContentsResponse{Embeddings: make([]*genai.ContentEmbedding, count)}
+	for _, data := range providerResp.Data {
+		if data.Index < 0 || data.Index >= count || geminiBatchResp.Embeddings[data.Index] != nil {
+			return nil, errors.Errorf("unexpected embedding index %d", data.Index)
+		}
+		geminiBatchResp.Embeddings[data.Index] = &genai.ContentEmbedding{Values: data.Embedding}
+	}
+	if len(providerResp.Data) != count {
+		return nil, errors.Errorf("expected %d embeddings, got %d", count, len(providerResp.Data))
+	}
+	return geminiBatchResp, nil
+}
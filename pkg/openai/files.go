@@ -0,0 +1,81 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"strings"
+)
+
+const (
+	fileNamePrefix = "files/"
+	fileIDPrefix   = "file-"
+	fileURIPrefix  = "https://generativelanguage.googleapis.com/v1beta/"
+)
+
+// ConvertGeminiFileToOpenAI converts a Gemini file. Gemini does not store a
+// purpose, so files are reported with the given one.
+func ConvertGeminiFileToOpenAI(file *genai.File, purpose string) *FileResponse {
+	openAIResp := &FileResponse{
+		ID:        FileID(file.Name),
+		Object:    "file",
+		Bytes:     file.SizeBytes,
+		CreatedAt: file.CreateTime.Unix(),
+		Filename:  file.DisplayName,
+		Purpose:   purpose,
+		Status:    convertFileState(file.State),
+	}
+	if !file.ExpirationTime.IsZero() {
+		openAIResp.ExpiresAt = file.ExpirationTime.Unix()
+	}
+	return openAIResp
+}
+
+func convertFileState(state genai.FileState) string {
+	switch state {
+	case genai.FileStateActive:
+		return "processed"
+	case genai.FileStateFailed:
+		return "error"
+	default:
+		return "uploaded"
+	}
+}
+
+// FileID returns the ID clients use for a file name.
+func FileID(name string) string {
+	return fileIDPrefix + strings.TrimPrefix(strings.TrimPrefix(name, fileNamePrefix), fileIDPrefix)
+}
+
+// FileName returns the Gemini resource name for a file ID.
+func FileName(id string) string {
+	return fileNamePrefix + strings.TrimPrefix(strings.TrimPrefix(id, fileNamePrefix), fileIDPrefix)
+}
+
+// MessageFileIDs returns the IDs of the files attached to the messages.
+func MessageFileIDs(messages []*ChatCompletionMessage) []string {
+	var ids []string
+	for _, message := range messages {
+		parts, _ := message.Content.([]interface{})
+		for _, item := range parts {
+			if id := contentPartFileID(item); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+func contentPartFileID(item interface{}) string {
+	part, _ := item.(map[string]interface{})
+	switch part["type"] {
+	case "file":
+		file, _ := part["file"].(map[string]interface{})
+		id, _ := file["file_id"].(string)
+		return id
+	case "input_file":
+		// Responses API file parts carry the ID at the top level.
+		id, _ := part["file_id"].(string)
+		return id
+	default:
+		return ""
+	}
+}
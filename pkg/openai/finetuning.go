@@ -0,0 +1,213 @@
+package openai
+
+import (
+	"bytes"
+	"cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+const (
+	tunedModelNamePrefix    = "tunedModels/"
+	fineTuningJobIDPrefix   = "ftjob-"
+	fineTuningJobObjectType = "fine_tuning.job"
+)
+
+// FineTuningJobID returns the ID clients use for a tuned model name. Jobs and
+// their models are one and the same in Gemini.
+func FineTuningJobID(name string) string {
+	return fineTuningJobIDPrefix + strings.TrimPrefix(name, tunedModelNamePrefix)
+}
+
+// TunedModelName returns the Gemini resource name for a fine-tuning job ID.
+func TunedModelName(id string) string {
+	return tunedModelNamePrefix + strings.TrimPrefix(strings.TrimPrefix(id, tunedModelNamePrefix), fineTuningJobIDPrefix)
+}
+
+// ConvertOpenAIFineTuningRequestToGemini converts a fine-tuning job request and
+// the contents of its training file to a tuned model request. Gemini tunes on
+// single text inputs and outputs, so chat examples must be a single turn,
+// optionally with a system message.
+func ConvertOpenAIFineTuningRequestToGemini(openAIReq *FineTuningJobRequest, trainingData []byte) (*generativelanguagepb.CreateTunedModelRequest, error) {
+	if openAIReq.Model == "" {
+		return nil, errors.New("model is required")
+	}
+	if openAIReq.ValidationFile != "" {
+		return nil, errors.New("validation_file is not supported")
+	}
+
+	var examples []*generativelanguagepb.TuningExample
+	for i, line := range bytes.Split(trainingData, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		example, err := convertTrainingExample(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "training_file line %d", i+1)
+		}
+		examples = append(examples, example)
+	}
+	if len(examples) == 0 {
+		return nil, errors.New("training_file contains no examples")
+	}
+
+	hyperparameters, err := convertFineTuningHyperparameters(openAIReq.Hyperparameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return &generativelanguagepb.CreateTunedModelRequest{
+		TunedModel: &generativelanguagepb.TunedModel{
+			SourceModel: &generativelanguagepb.TunedModel_BaseModel{
+				BaseModel: "models/" + strings.TrimPrefix(openAIReq.Model, "models/"),
+			},
+			DisplayName: openAIReq.Suffix,
+			TuningTask: &generativelanguagepb.TuningTask{
+				TrainingData: &generativelanguagepb.Dataset{
+					Dataset: &generativelanguagepb.Dataset_Examples{
+						Examples: &generativelanguagepb.TuningExamples{Examples: examples},
+					},
+				},
+				Hyperparameters: hyperparameters,
+			},
+		},
+	}, nil
+}
+
+func convertTrainingExample(line []byte) (*generativelanguagepb.TuningExample, error) {
+	var example FineTuningTrainingExample
+	if err := json.Unmarshal(line, &example); err != nil {
+		return nil, errors.New("line is not valid JSON")
+	}
+	input, output := example.Prompt, example.Completion
+	if len(example.Messages) > 0 {
+		last := example.Messages[len(example.Messages)-1]
+		if last.Role != "assistant" {
+			return nil, errors.New("the last message must be from the assistant")
+		}
+		var inputs []string
+		for _, message := range example.Messages[:len(example.Messages)-1] {
+			if message.Role != "system" && message.Role != "developer" && message.Role != "user" {
+				return nil, errors.New("multi-turn examples are not supported")
+			}
+			text, err := messageText(message.Content)
+			if err != nil {
+				return nil, err
+			}
+			inputs = append(inputs, text)
+		}
+		text, err := messageText(last.Content)
+		if err != nil {
+			return nil, err
+		}
+		input, output = strings.Join(inputs, "\n\n"), text
+	}
+	if input == "" || output == "" {
+		return nil, errors.New("examples need messages, or a prompt and a completion")
+	}
+	return &generativelanguagepb.TuningExample{
+		ModelInput: &generativelanguagepb.TuningExample_TextInput{TextInput: input},
+		Output:     output,
+	}, nil
+}
+
+func convertFineTuningHyperparameters(params *FineTuningHyperparameters) (*generativelanguagepb.Hyperparameters, error) {
+	if params == nil {
+		return nil, nil
+	}
+	hyperparameters := &generativelanguagepb.Hyperparameters{}
+	if n, ok, err := hyperparameter(params.NEpochs, "n_epochs"); err != nil {
+		return nil, err
+	} else if ok {
+		if n < 1 || n != float64(int32(n)) {
+			return nil, errors.New("n_epochs must be a positive integer")
+		}
+		hyperparameters.EpochCount = ptr(int32(n))
+	}
+	if n, ok, err := hyperparameter(params.BatchSize, "batch_size"); err != nil {
+		return nil, err
+	} else if ok {
+		if n < 1 || n != float64(int32(n)) {
+			return nil, errors.New("batch_size must be a positive integer")
+		}
+		hyperparameters.BatchSize = ptr(int32(n))
+	}
+	if n, ok, err := hyperparameter(params.LearningRateMultiplier, "learning_rate_multiplier"); err != nil {
+		return nil, err
+	} else if ok {
+		if n <= 0 {
+			return nil, errors.New("learning_rate_multiplier must be positive")
+		}
+		hyperparameters.LearningRateOption = &generativelanguagepb.Hyperparameters_LearningRateMultiplier{LearningRateMultiplier: float32(n)}
+	}
+	return hyperparameters, nil
+}
+
+// hyperparameter returns the number of a hyperparameter, and whether it is
+// set rather than left to Gemini with "auto".
+func hyperparameter(v interface{}, name string) (float64, bool, error) {
+	switch v := v.(type) {
+	case nil:
+		return 0, false, nil
+	case string:
+		if v == "auto" {
+			return 0, false, nil
+		}
+	case float64:
+		return v, true, nil
+	}
+	return 0, false, errors.Errorf("%s must be a number or \"auto\"", name)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// ConvertGeminiTunedModelToOpenAI converts a tuned model to the fine-tuning
+// job that creates it. Gemini does not keep the training file, so it is not
+// reported.
+func ConvertGeminiTunedModelToOpenAI(tunedModel *generativelanguagepb.TunedModel) *FineTuningJob {
+	baseModel := tunedModel.GetBaseModel()
+	if source := tunedModel.GetTunedModelSource(); source != nil {
+		baseModel = source.BaseModel
+	}
+	job := &FineTuningJob{
+		ID:          FineTuningJobID(tunedModel.Name),
+		Object:      fineTuningJobObjectType,
+		Model:       strings.TrimPrefix(baseModel, "models/"),
+		CreatedAt:   tunedModel.GetCreateTime().GetSeconds(),
+		ResultFiles: []string{},
+	}
+
+	task := tunedModel.GetTuningTask()
+	switch tunedModel.State {
+	case generativelanguagepb.TunedModel_CREATING:
+		job.Status = "running"
+	case generativelanguagepb.TunedModel_ACTIVE:
+		job.Status = "succeeded"
+		job.FineTunedModel = &tunedModel.Name
+	case generativelanguagepb.TunedModel_FAILED:
+		job.Status = "failed"
+		job.Error = &FineTuningJobError{Code: "tuning_failed", Message: "Gemini failed to tune the model"}
+	default:
+		job.Status = "validating_files"
+	}
+	if completeTime := task.GetCompleteTime(); completeTime != nil && job.Status != "running" {
+		job.FinishedAt = ptr(completeTime.GetSeconds())
+	}
+
+	if hyperparameters := task.GetHyperparameters(); hyperparameters != nil {
+		job.Hyperparameters = &FineTuningHyperparameters{}
+		if hyperparameters.EpochCount != nil {
+			job.Hyperparameters.NEpochs = *hyperparameters.EpochCount
+		}
+		if hyperparameters.BatchSize != nil {
+			job.Hyperparameters.BatchSize = *hyperparameters.BatchSize
+		}
+		if multiplier, ok := hyperparameters.LearningRateOption.(*generativelanguagepb.Hyperparameters_LearningRateMultiplier); ok {
+			job.Hyperparameters.LearningRateMultiplier = multiplier.LearningRateMultiplier
+		}
+	}
+	return job
+}
@@ -1,24 +1,307 @@
 package openai
 
 import (
+	"cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"github.com/google/generative-ai-go/genai"
 	"github.com/pkg/errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 )
 
+// maxEmbeddingBatchSize is the most contents Gemini embeds in one batch request.
+const maxEmbeddingBatchSize = 100
+
 func ConvertOpenAIRequestToGemini(openAIReq *EmbedRequest, model *genai.EmbeddingModel) (*genai.EmbeddingBatch, error) {
-	if openAIReq.EncodingFormat != "" && openAIReq.EncodingFormat != "float" {
-		return nil, errors.New("unsupported encoding format")
+	inputs, err := embeddingInputs(openAIReq)
+	if err != nil {
+		return nil, err
+	}
+
+	taskType, err := embeddingTaskType(openAIReq)
+	if err != nil {
+		return nil, err
 	}
+	model.TaskType = taskType
 
 	geminiBatchReq := model.NewBatch()
+	for _, input := range inputs {
+		geminiBatchReq.AddContentWithTitle(input.title, genai.Text(input.text))
+	}
+
+	return geminiBatchReq, nil
+}
+
+// SplitEmbedRequest splits an embedding request into requests within Gemini's
+// batch limit.
+func SplitEmbedRequest(openAIReq *EmbedRequest) []*EmbedRequest {
+	inputs, ok := openAIReq.Input.([]interface{})
+	if !ok || len(inputs) <= maxEmbeddingBatchSize {
+		return []*EmbedRequest{openAIReq}
+	}
+	var openAIReqs []*EmbedRequest
+	for i := 0; i < len(inputs); i += maxEmbeddingBatchSize {
+		batchReq := *openAIReq
+		batchReq.Input = inputs[i:min(i+maxEmbeddingBatchSize, len(inputs))]
+		openAIReqs = append(openAIReqs, &batchReq)
+	}
+	return openAIReqs
+}
+
+// embeddingModelMetadata describes the embeddings of a Gemini embedding model.
+type embeddingModelMetadata struct {
+	// dimensions is the number of dimensions of the model's embeddings.
+	dimensions int
+	// outputDimensionality is whether the model accepts an output
+	// dimensionality, reducing its embeddings to any smaller number of dimensions.
+	outputDimensionality bool
+}
+
+// embeddingModels are the Gemini embedding models known to the proxy.
+var embeddingModels = map[string]embeddingModelMetadata{
+	"embedding-001":              {dimensions: 768},
+	"text-embedding-004":         {dimensions: 768, outputDimensionality: true},
+	"gemini-embedding-001":       {dimensions: 3072, outputDimensionality: true},
+	"gemini-embedding-exp-03-07": {dimensions: 3072, outputDimensionality: true},
+}
+
+// SupportsOutputDimensionality reports whether Gemini reduces the embeddings
+// of an embedding request's model to its dimensions. Other models' embeddings
+// are truncated by the proxy with TruncateEmbeddings.
+func SupportsOutputDimensionality(openAIReq *EmbedRequest) bool {
+	modelName := strings.TrimPrefix(EmbeddingModelName(openAIReq.Model), "models/")
+	return embeddingModels[modelName].outputDimensionality
+}
+
+// validateDimensions rejects dimensions that the embeddings of an embedding
+// request's model cannot be reduced to. Models unknown to the proxy are left
+// for Gemini to reject.
+func validateDimensions(openAIReq *EmbedRequest) error {
+	if openAIReq.Dimensions < 0 {
+		return errors.New("dimensions must be at least 1")
+	}
+	modelName := strings.TrimPrefix(EmbeddingModelName(openAIReq.Model), "models/")
+	model, ok := embeddingModels[modelName]
+	if ok && openAIReq.Dimensions > model.dimensions {
+		return errors.Errorf("dimensions must be at most %d for %s, got %d", model.dimensions, modelName, openAIReq.Dimensions)
+	}
+	return nil
+}
+
+// ConvertOpenAIRequestWithDimensionsToGemini builds the embedding request
+// directly, as the SDK's embedding batches cannot set an output dimensionality.
+func ConvertOpenAIRequestWithDimensionsToGemini(openAIReq *EmbedRequest) (*generativelanguagepb.BatchEmbedContentsRequest, error) {
+	modelName := strings.TrimPrefix(EmbeddingModelName(openAIReq.Model), "models/")
+	inputs, err := embeddingInputs(openAIReq)
+	if err != nil {
+		return nil, err
+	}
+	taskType, err := embeddingTaskType(openAIReq)
+	if err != nil {
+		return nil, err
+	}
+
+	model := "models/" + modelName
+	dimensions := int32(openAIReq.Dimensions)
+	geminiBatchReq := &generativelanguagepb.BatchEmbedContentsRequest{Model: model}
+	for _, input := range inputs {
+		request := &generativelanguagepb.EmbedContentRequest{
+			Model: model,
+			Content: &generativelanguagepb.Content{
+				Parts: []*generativelanguagepb.Part{{Data: &generativelanguagepb.Part_Text{Text: input.text}}},
+			},
+			OutputDimensionality: &dimensions,
+		}
+		if input.title != "" {
+			// As in the SDK, a title implies a retrieval document.
+			request.Title = &input.title
+			request.TaskType = generativelanguagepb.TaskType_RETRIEVAL_DOCUMENT.Enum()
+		} else if taskType != genai.TaskTypeUnspecified {
+			request.TaskType = generativelanguagepb.TaskType(taskType).Enum()
+		}
+		geminiBatchReq.Requests = append(geminiBatchReq.Requests, request)
+	}
+	return geminiBatchReq, nil
+}
+
+// ConvertGeminiProtoResponseToGemini converts a response from the underlying
+// API client to the SDK's type, so both share one conversion to OpenAI.
+func ConvertGeminiProtoResponseToGemini(geminiBatchResp *generativelanguagepb.BatchEmbedContentsResponse) *genai.BatchEmbedContentsResponse {
+	resp := &genai.BatchEmbedContentsResponse{}
+	for _, embedding := range geminiBatchResp.Embeddings {
+		resp.Embeddings = append(resp.Embeddings, &genai.ContentEmbedding{Values: embedding.Values})
+	}
+	return resp
+}
+
+// EmbeddingModelName drops a task type suffix, as in
+// text-embedding-004#retrieval_document, from an embedding model.
+func EmbeddingModelName(model string) string {
+	name, _, _ := strings.Cut(model, "#")
+	return name
+}
+
+// embeddingTaskType returns the Gemini task type named by task_type, or else by
+// the model's suffix.
+func embeddingTaskType(openAIReq *EmbedRequest) (genai.TaskType, error) {
+	name := openAIReq.TaskType
+	if name == "" {
+		_, name, _ = strings.Cut(openAIReq.Model, "#")
+	}
+	if name == "" {
+		return genai.TaskTypeUnspecified, nil
+	}
+	taskType, ok := generativelanguagepb.TaskType_value[strings.ToUpper(name)]
+	if !ok {
+		return genai.TaskTypeUnspecified, errors.Errorf("unsupported task_type: %s", name)
+	}
+	return genai.TaskType(taskType), nil
+}
+
+// EmbeddingInputTexts returns the texts of the inputs of an embedding request.
+func EmbeddingInputTexts(openAIReq *EmbedRequest) ([]string, error) {
+	inputs, err := embeddingInputs(openAIReq)
+	if err != nil {
+		return nil, err
+	}
+	texts := make([]string, len(inputs))
+	for i, input := range inputs {
+		texts[i] = input.text
+	}
+	return texts, nil
+}
+
+// SetEmbeddingInputText replaces the text of the input at index i of an
+// embedding request that EmbeddingInputTexts accepted.
+func SetEmbeddingInputText(openAIReq *EmbedRequest, i int, text string) {
+	inputs, ok := openAIReq.Input.([]interface{})
+	if !ok {
+		openAIReq.Input = text
+		return
+	}
+	if input, ok := inputs[i].(map[string]interface{}); ok {
+		input["text"] = text
+		return
+	}
+	inputs[i] = text
+}
+
+// EmbeddingInputKeys returns a key for each input of an embedding request that
+// identifies its embedding: a hash of the model, task type, dimensions, title and text.
+func EmbeddingInputKeys(openAIReq *EmbedRequest) ([]string, error) {
+	inputs, err := embeddingInputs(openAIReq)
+	if err != nil {
+		return nil, err
+	}
+	taskType, err := embeddingTaskType(openAIReq)
+	if err != nil {
+		return nil, err
+	}
+	model := strings.TrimPrefix(EmbeddingModelName(openAIReq.Model), "models/")
+	keys := make([]string, len(inputs))
+	for i, input := range inputs {
+		h := sha256.New()
+		// Lengths separate the fields, so no two inputs share a key.
+		for _, field := range []string{model, taskType.String(), strconv.Itoa(openAIReq.Dimensions), input.title, input.text} {
+			fmt.Fprintf(h, "%d:%s", len(field), field)
+		}
+		keys[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return keys, nil
+}
+
+// SelectEmbeddingInputs returns a copy of an embedding request with only the
+// inputs at indices, which EmbeddingInputKeys accepted.
+func SelectEmbeddingInputs(openAIReq *EmbedRequest, indices []int) *EmbedRequest {
+	selected := *openAIReq
+	inputs, ok := openAIReq.Input.([]interface{})
+	if !ok {
+		return &selected
+	}
+	selectedInputs := make([]interface{}, len(indices))
+	for i, index := range indices {
+		selectedInputs[i] = inputs[index]
+	}
+	selected.Input = selectedInputs
+	return &selected
+}
+
+// EmbeddingBatchKey returns a key shared by embedding requests that can be
+// embedded in one Gemini batch.
+func EmbeddingBatchKey(openAIReq *EmbedRequest) string {
+	// Requests with an unknown task type are rejected before they are batched.
+	taskType, _ := embeddingTaskType(openAIReq)
+	model := strings.TrimPrefix(EmbeddingModelName(openAIReq.Model), "models/")
+	return fmt.Sprintf("%s/%s/%d", model, taskType, openAIReq.Dimensions)
+}
+
+// MergeEmbedRequests combines embedding requests with the same EmbeddingBatchKey
+// into one, with the inputs of each in order.
+func MergeEmbedRequests(openAIReqs []*EmbedRequest) *EmbedRequest {
+	merged := *openAIReqs[0]
+	merged.Title = ""
+	var mergedInputs []interface{}
+	for _, openAIReq := range openAIReqs {
+		// Inputs were validated when the request was keyed.
+		inputs, _ := embeddingInputs(openAIReq)
+		for _, input := range inputs {
+			mergedInputs = append(mergedInputs, map[string]interface{}{"text": input.text, "title": input.title})
+		}
+	}
+	merged.Input = mergedInputs
+	return &merged
+}
+
+type embeddingInput struct {
+	text  string
+	title string
+}
+
+// embeddingInputs returns the texts of an embedding request with their titles.
+// Inputs are strings, or objects with a text and an optional title that
+// overrides the request's.
+func embeddingInputs(openAIReq *EmbedRequest) ([]embeddingInput, error) {
+	switch openAIReq.EncodingFormat {
+	case "", "float", "base64":
+	default:
+		return nil, errors.New("unsupported encoding format")
+	}
+	if err := validateEmbeddingTypes(openAIReq.EmbeddingTypes); err != nil {
+		return nil, err
+	}
+	if err := validateDimensions(openAIReq); err != nil {
+		return nil, err
+	}
+
+	var inputs []embeddingInput
 	switch v := openAIReq.Input.(type) {
 	case string:
-		geminiBatchReq.AddContent(genai.Text(v))
+		inputs = append(inputs, embeddingInput{text: v, title: openAIReq.Title})
 	case []interface{}:
-		for _, text := range v {
-			if t, ok := text.(string); ok {
-				geminiBatchReq.AddContent(genai.Text(t))
-			} else {
+		for i, item := range v {
+			switch t := item.(type) {
+			case string:
+				inputs = append(inputs, embeddingInput{text: t, title: openAIReq.Title})
+			case map[string]interface{}:
+				text, ok := t["text"].(string)
+				if !ok {
+					return nil, errors.Errorf("input[%d]: missing text", i)
+				}
+				title, _ := t["title"].(string)
+				if title == "" {
+					title = openAIReq.Title
+				}
+				inputs = append(inputs, embeddingInput{text: text, title: title})
+			case float64, []interface{}:
+				// Decoding tokens needs the tiktoken vocabulary of the OpenAI model.
+				return nil, errors.New("token array input is not supported, send input as text")
+			default:
 				return nil, errors.Errorf("unsupported input type: %T", t)
 			}
 		}
@@ -26,21 +309,49 @@ func ConvertOpenAIRequestToGemini(openAIReq *EmbedRequest, model *genai.Embeddin
 		return nil, errors.Errorf("unsupported input type: %T", v)
 	}
 
-	return geminiBatchReq, nil
+	if slices.ContainsFunc(inputs, func(input embeddingInput) bool { return input.title != "" }) {
+		taskType, err := embeddingTaskType(openAIReq)
+		if err != nil {
+			return nil, err
+		}
+		if taskType != genai.TaskTypeUnspecified && taskType != genai.TaskTypeRetrievalDocument {
+			return nil, errors.New("title is only supported with task_type RETRIEVAL_DOCUMENT")
+		}
+	}
+	return inputs, nil
 }
 
-func ConvertGeminiResponseToOpenAI(geminiBatchResp *genai.BatchEmbedContentsResponse, model string) *EmbedResponse {
+func ConvertGeminiResponseToOpenAI(geminiBatchResp *genai.BatchEmbedContentsResponse, openAIReq *EmbedRequest) *EmbedResponse {
 	openAIResp := &EmbedResponse{
 		Object: "list",
-		Model:  model,
+		Model:  openAIReq.Model,
 	}
 
 	for i, geminiResp := range geminiBatchResp.Embeddings {
-		openAIResp.Data = append(openAIResp.Data, &EmbedResponseData{
-			Object:    "embedding",
-			Embedding: geminiResp.Values,
-			Index:     i,
-		})
+		// Inputs that failed have no embedding.
+		if geminiResp == nil {
+			continue
+		}
+		data := &EmbedResponseData{
+			Object: "embedding",
+			Index:  i,
+		}
+		if len(openAIReq.EmbeddingTypes) == 0 || slices.Contains(openAIReq.EmbeddingTypes, "float") {
+			data.Embedding = geminiResp.Values
+			if openAIReq.EncodingFormat == "base64" {
+				data.Embedding = encodeEmbeddingBase64(geminiResp.Values)
+			}
+		}
+		for _, embeddingType := range openAIReq.EmbeddingTypes {
+			if embeddingType == "float" {
+				continue
+			}
+			if data.Embeddings == nil {
+				data.Embeddings = map[string][]int{}
+			}
+			data.Embeddings[embeddingType] = quantizeEmbeddingType(geminiResp.Values, embeddingType)
+		}
+		openAIResp.Data = append(openAIResp.Data, data)
 	}
 
 	openAIResp.Usage = &Usage{
@@ -50,3 +361,66 @@ func ConvertGeminiResponseToOpenAI(geminiBatchResp *genai.BatchEmbedContentsResp
 
 	return openAIResp
 }
+
+// TruncateEmbeddings shortens embeddings longer than dimensions, keeping the
+// leading dimensions as with Matryoshka embeddings, and renormalizes them.
+func TruncateEmbeddings(geminiBatchResp *genai.BatchEmbedContentsResponse, dimensions int) {
+	for _, embedding := range geminiBatchResp.Embeddings {
+		if embedding == nil || len(embedding.Values) <= dimensions {
+			continue
+		}
+		embedding.Values = normalizeEmbedding(embedding.Values[:dimensions])
+	}
+}
+
+// NormalizeEmbeddings scales each embedding of a response to unit length.
+func NormalizeEmbeddings(geminiBatchResp *genai.BatchEmbedContentsResponse) {
+	for _, embedding := range geminiBatchResp.Embeddings {
+		if embedding == nil {
+			continue
+		}
+		embedding.Values = normalizeEmbedding(embedding.Values)
+	}
+}
+
+// normalizeEmbedding scales an embedding to unit length.
+func normalizeEmbedding(embedding []float32) []float32 {
+	var sum float64
+	for _, v := range embedding {
+		sum += float64(v) * float64(v)
+	}
+	if sum == 0 {
+		return embedding
+	}
+	norm := math.Sqrt(sum)
+	normalized := make([]float32, len(embedding))
+	for i, v := range embedding {
+		normalized[i] = float32(float64(v) / norm)
+	}
+	return normalized
+}
+
+// encodeEmbeddingBase64 packs an embedding as little-endian float32s, which is
+// how OpenAI clients decode base64 embeddings.
+func encodeEmbeddingBase64(embedding []float32) string {
+	b := make([]byte, 4*len(embedding))
+	for i, v := range embedding {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(v))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// ConvertGeminiModelToOpenAI converts a Gemini model, whose ID drops the
+// "models/" prefix of its name unless keepPrefix is set.
+func ConvertGeminiModelToOpenAI(m *genai.ModelInfo, keepPrefix bool) *ModelResponseData {
+	id := m.Name
+	if !keepPrefix {
+		id = strings.TrimPrefix(id, "models/")
+	}
+	return &ModelResponseData{
+		Object:  "model",
+		ID:      id,
+		Created: 0,
+		OwnedBy: "google",
+	}
+}
@@ -0,0 +1,82 @@
+package openai
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestEmbeddingInputs(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		req     string
+		wantErr string
+		want    []embeddingInput
+	}{
+		{
+			name: "string",
+			req:  `{"input": "hello"}`,
+			want: []embeddingInput{{text: "hello"}},
+		},
+		{
+			name: "strings",
+			req:  `{"input": ["hello", "world"]}`,
+			want: []embeddingInput{{text: "hello"}, {text: "world"}},
+		},
+		{
+			name: "objects with titles",
+			req:  `{"input": [{"text": "a", "title": "A"}, {"text": "b"}], "title": "B", "task_type": "RETRIEVAL_DOCUMENT"}`,
+			want: []embeddingInput{{text: "a", title: "A"}, {text: "b", title: "B"}},
+		},
+		{
+			name:    "title without document task type",
+			req:     `{"input": "a", "title": "A", "task_type": "RETRIEVAL_QUERY"}`,
+			wantErr: "title is only supported with task_type RETRIEVAL_DOCUMENT",
+		},
+		{
+			name:    "object without text",
+			req:     `{"input": ["a", {"title": "B"}]}`,
+			wantErr: "input[1]: missing text",
+		},
+		{
+			name:    "tokens",
+			req:     `{"input": [15339, 1917]}`,
+			wantErr: "token array input is not supported, send input as text",
+		},
+		{
+			name:    "arrays of tokens",
+			req:     `{"input": [[15339], [1917]]}`,
+			wantErr: "token array input is not supported, send input as text",
+		},
+		{
+			name:    "number",
+			req:     `{"input": 1}`,
+			wantErr: "unsupported input type: float64",
+		},
+		{
+			name:    "encoding format",
+			req:     `{"input": "a", "encoding_format": "int8"}`,
+			wantErr: "unsupported encoding format",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var req EmbedRequest
+			if err := json.Unmarshal([]byte(tc.req), &req); err != nil {
+				t.Fatal(err)
+			}
+			inputs, err := embeddingInputs(&req)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(inputs, tc.want) {
+				t.Errorf("inputs %+v, want %+v", inputs, tc.want)
+			}
+		})
+	}
+}
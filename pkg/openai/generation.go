@@ -0,0 +1,126 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxCandidateCount is the largest candidateCount Gemini accepts.
+	maxCandidateCount = 8
+	// maxStopSequences is the largest number of stop sequences Gemini accepts.
+	maxStopSequences = 5
+)
+
+// generationParameters are the sampling parameters shared by the chat and
+// legacy completions APIs.
+type generationParameters struct {
+	N                int
+	Stop             interface{}
+	Temperature      *float32
+	TopP             *float32
+	TopK             *int32
+	MaxTokens        *int32
+	Logprobs         bool
+	PresencePenalty  *float32
+	FrequencyPenalty *float32
+	SafetySettings   []*SafetySetting
+}
+
+func applyGenerationParameters(params *generationParameters, model *genai.GenerativeModel) error {
+	if params.N < 0 || params.N > maxCandidateCount {
+		return errors.Errorf("n must be between 1 and %d", maxCandidateCount)
+	}
+
+	// The genai SDK does not expose Gemini's responseLogprobs/logprobs fields,
+	// so fail loudly instead of returning a response without them.
+	if params.Logprobs {
+		return errors.New("logprobs are not supported")
+	}
+
+	// Likewise for presencePenalty/frequencyPenalty. A zero penalty is a no-op
+	// and is accepted, since many clients send it unconditionally.
+	if params.PresencePenalty != nil && *params.PresencePenalty != 0 {
+		return errors.New("presence_penalty is not supported")
+	}
+	if params.FrequencyPenalty != nil && *params.FrequencyPenalty != 0 {
+		return errors.New("frequency_penalty is not supported")
+	}
+
+	stopSequences, err := convertStop(params.Stop)
+	if err != nil {
+		return err
+	}
+	model.StopSequences = stopSequences
+
+	if params.Temperature != nil {
+		if *params.Temperature < 0 || *params.Temperature > 2 {
+			return errors.New("temperature must be between 0 and 2")
+		}
+		model.SetTemperature(*params.Temperature)
+	}
+	if params.TopP != nil {
+		if *params.TopP < 0 || *params.TopP > 1 {
+			return errors.New("top_p must be between 0 and 1")
+		}
+		model.SetTopP(*params.TopP)
+	}
+	if params.TopK != nil {
+		if *params.TopK < 1 {
+			return errors.New("top_k must be at least 1")
+		}
+		model.SetTopK(*params.TopK)
+	}
+	if params.MaxTokens != nil {
+		if *params.MaxTokens < 1 {
+			return errors.New("max_tokens must be at least 1")
+		}
+		model.SetMaxOutputTokens(*params.MaxTokens)
+	}
+
+	// Request settings replace any proxy defaults already set on the model.
+	if params.SafetySettings != nil {
+		safetySettings, err := ConvertSafetySettingsToGemini(params.SafetySettings)
+		if err != nil {
+			return err
+		}
+		model.SafetySettings = safetySettings
+	}
+
+	return nil
+}
+
+// stopSequences converts a list of stop sequences into the form of a decoded
+// chat completion stop field.
+func stopSequences(sequences []string) []interface{} {
+	stop := make([]interface{}, len(sequences))
+	for i, sequence := range sequences {
+		stop[i] = sequence
+	}
+	return stop
+}
+
+func convertStop(stop interface{}) ([]string, error) {
+	var stopSequences []string
+	switch v := stop.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		stopSequences = []string{v}
+	case []interface{}:
+		for _, sequence := range v {
+			if s, ok := sequence.(string); ok {
+				stopSequences = append(stopSequences, s)
+			} else {
+				return nil, errors.Errorf("unsupported stop type: %T", sequence)
+			}
+		}
+	default:
+		return nil, errors.Errorf("unsupported stop type: %T", v)
+	}
+
+	if len(stopSequences) > maxStopSequences {
+		return nil, errors.Errorf("stop may contain at most %d sequences, got %d", maxStopSequences, len(stopSequences))
+	}
+	return stopSequences, nil
+}
@@ -0,0 +1,54 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"slices"
+	"testing"
+)
+
+func TestApplyGenerationParameters(t *testing.T) {
+	stop := func(n int) []interface{} {
+		sequences := make([]string, n)
+		for i := range sequences {
+			sequences[i] = string(rune('a' + i))
+		}
+		return stopSequences(sequences)
+	}
+	for _, tc := range []struct {
+		name    string
+		params  generationParameters
+		wantErr string
+		want    []string
+	}{
+		{name: "defaults"},
+		{name: "n of 8", params: generationParameters{N: 8}},
+		{name: "n over 8", params: generationParameters{N: 9}, wantErr: "n must be between 1 and 8"},
+		{name: "negative n", params: generationParameters{N: -1}, wantErr: "n must be between 1 and 8"},
+		{name: "stop string", params: generationParameters{Stop: "END"}, want: []string{"END"}},
+		{name: "5 stop sequences", params: generationParameters{Stop: stop(5)}, want: []string{"a", "b", "c", "d", "e"}},
+		{name: "6 stop sequences", params: generationParameters{Stop: stop(6)}, wantErr: "stop may contain at most 5 sequences, got 6"},
+		{name: "stop of numbers", params: generationParameters{Stop: []interface{}{1.0}}, wantErr: "unsupported stop type: float64"},
+		{name: "logprobs", params: generationParameters{Logprobs: true}, wantErr: "logprobs are not supported"},
+		{name: "zero presence penalty", params: generationParameters{PresencePenalty: genai.Ptr[float32](0)}},
+		{name: "presence penalty", params: generationParameters{PresencePenalty: genai.Ptr[float32](0.5)}, wantErr: "presence_penalty is not supported"},
+		{name: "temperature over 2", params: generationParameters{Temperature: genai.Ptr[float32](2.5)}, wantErr: "temperature must be between 0 and 2"},
+		{name: "max_tokens of 0", params: generationParameters{MaxTokens: genai.Ptr[int32](0)}, wantErr: "max_tokens must be at least 1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			model := &genai.GenerativeModel{}
+			err := applyGenerationParameters(&tc.params, model)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(model.StopSequences, tc.want) {
+				t.Errorf("stop sequences %q, want %q", model.StopSequences, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+package openai
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// NewID returns a random ID with prefix, such as "chatcmpl-" or "call_", for
+// the completions, responses, tool calls and other objects the proxy creates.
+func NewID(prefix string) string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
@@ -0,0 +1,108 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+)
+
+// moderationCategories maps Gemini harm categories to the OpenAI moderation
+// categories they cover. OpenAI categories without a Gemini equivalent are
+// always reported as unflagged.
+var moderationCategories = map[genai.HarmCategory][]string{
+	genai.HarmCategoryHarassment:       {"harassment", "harassment/threatening"},
+	genai.HarmCategoryHateSpeech:       {"hate", "hate/threatening"},
+	genai.HarmCategorySexuallyExplicit: {"sexual"},
+	genai.HarmCategoryDangerousContent: {"violence", "illicit", "illicit/violent", "self-harm"},
+}
+
+var allModerationCategories = []string{
+	"harassment", "harassment/threatening",
+	"hate", "hate/threatening",
+	"illicit", "illicit/violent",
+	"self-harm", "self-harm/intent", "self-harm/instructions",
+	"sexual", "sexual/minors",
+	"violence", "violence/graphic",
+}
+
+// Gemini only reports a probability bucket, so each is given a representative score.
+var harmProbabilityScores = map[genai.HarmProbability]float64{
+	genai.HarmProbabilityNegligible: 0.01,
+	genai.HarmProbabilityLow:        0.25,
+	genai.HarmProbabilityMedium:     0.6,
+	genai.HarmProbabilityHigh:       0.9,
+}
+
+// ConvertOpenAIModerationRequestToGemini returns the inputs to evaluate. The
+// model is configured to never block, so safety ratings are always returned.
+func ConvertOpenAIModerationRequestToGemini(openAIReq *ModerationRequest, model *genai.GenerativeModel) ([]string, error) {
+	var inputs []string
+	switch v := openAIReq.Input.(type) {
+	case string:
+		inputs = []string{v}
+	case []interface{}:
+		for i, item := range v {
+			switch input := item.(type) {
+			case string:
+				inputs = append(inputs, input)
+			case map[string]interface{}:
+				if input["type"] != "text" {
+					return nil, errors.Errorf("input[%d]: unsupported input type: %v", i, input["type"])
+				}
+				text, _ := input["text"].(string)
+				inputs = append(inputs, text)
+			default:
+				return nil, errors.Errorf("input[%d]: unsupported input type: %T", i, item)
+			}
+		}
+	default:
+		return nil, errors.Errorf("unsupported input type: %T", v)
+	}
+
+	model.SafetySettings = nil
+	for category := range moderationCategories {
+		model.SafetySettings = append(model.SafetySettings, &genai.SafetySetting{
+			Category:  category,
+			Threshold: genai.HarmBlockNone,
+		})
+	}
+	model.SetMaxOutputTokens(1)
+	return inputs, nil
+}
+
+func ConvertGeminiModerationResponsesToOpenAI(geminiResps []*genai.GenerateContentResponse, id string, model string) *ModerationResponse {
+	openAIResp := &ModerationResponse{
+		ID:      id,
+		Model:   model,
+		Results: []*ModerationResult{},
+	}
+	for _, geminiResp := range geminiResps {
+		result := &ModerationResult{
+			Categories:     map[string]bool{},
+			CategoryScores: map[string]float64{},
+		}
+		for _, category := range allModerationCategories {
+			result.Categories[category] = false
+			result.CategoryScores[category] = 0
+		}
+
+		// Prompt ratings describe the input, candidate ratings are a fallback
+		// for when the prompt feedback is omitted.
+		var ratings []*genai.SafetyRating
+		if geminiResp.PromptFeedback != nil {
+			ratings = geminiResp.PromptFeedback.SafetyRatings
+		}
+		if len(ratings) == 0 && len(geminiResp.Candidates) > 0 {
+			ratings = geminiResp.Candidates[0].SafetyRatings
+		}
+		for _, rating := range ratings {
+			flagged := rating.Probability >= genai.HarmProbabilityMedium
+			for _, category := range moderationCategories[rating.Category] {
+				result.Categories[category] = flagged
+				result.CategoryScores[category] = harmProbabilityScores[rating.Probability]
+			}
+			result.Flagged = result.Flagged || flagged
+		}
+		openAIResp.Results = append(openAIResp.Results, result)
+	}
+	return openAIResp
+}
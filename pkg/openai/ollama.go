@@ -0,0 +1,211 @@
+package openai
+
+import (
+	"encoding/json"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// OllamaModelName maps an Ollama model name to a Gemini model, dropping the
+// tag Ollama clients add by default.
+func OllamaModelName(name string) string {
+	return strings.TrimSuffix(name, ":latest")
+}
+
+func ConvertOllamaEmbedRequestToOpenAI(ollamaReq *OllamaEmbedRequest) *EmbedRequest {
+	openAIReq := &EmbedRequest{
+		Model: OllamaModelName(ollamaReq.Model),
+		Input: ollamaReq.Input,
+	}
+	if ollamaReq.Prompt != "" {
+		openAIReq.Input = ollamaReq.Prompt
+	}
+	return openAIReq
+}
+
+func ConvertGeminiResponseToOllamaEmbed(geminiBatchResp *genai.BatchEmbedContentsResponse, model string) *OllamaEmbedResponse {
+	ollamaResp := &OllamaEmbedResponse{
+		Model:      model,
+		Embeddings: [][]float32{},
+	}
+	for _, geminiResp := range geminiBatchResp.Embeddings {
+		ollamaResp.Embeddings = append(ollamaResp.Embeddings, geminiResp.Values)
+	}
+	return ollamaResp
+}
+
+func ConvertGeminiModelToOllama(m *genai.ModelInfo) *OllamaModel {
+	name := strings.TrimPrefix(m.Name, "models/")
+	return &OllamaModel{
+		Name:       name,
+		Model:      name,
+		ModifiedAt: time.Unix(0, 0).UTC().Format(time.RFC3339),
+	}
+}
+
+// ConvertOllamaChatRequestToChat translates an Ollama chat request into the
+// equivalent chat completion request.
+func ConvertOllamaChatRequestToChat(ollamaReq *OllamaChatRequest) (*ChatCompletionRequest, error) {
+	chatReq := &ChatCompletionRequest{
+		Model:  OllamaModelName(ollamaReq.Model),
+		Tools:  ollamaReq.Tools,
+		Stream: ollamaReq.Stream == nil || *ollamaReq.Stream,
+	}
+	if options := ollamaReq.Options; options != nil {
+		chatReq.Temperature = options.Temperature
+		chatReq.TopP = options.TopP
+		chatReq.TopK = options.TopK
+		chatReq.MaxTokens = options.NumPredict
+		chatReq.Seed = options.Seed
+		if len(options.Stop) > 0 {
+			chatReq.Stop = stopSequences(options.Stop)
+		}
+	}
+
+	switch v := ollamaReq.Format.(type) {
+	case nil:
+	case string:
+		if v != "json" {
+			return nil, errors.Errorf("unsupported format: %s", v)
+		}
+		chatReq.ResponseFormat = &ResponseFormat{Type: "json_object"}
+	case map[string]interface{}:
+		chatReq.ResponseFormat = &ResponseFormat{
+			Type:       "json_schema",
+			JSONSchema: &JSONSchema{Name: "response", Schema: v},
+		}
+	default:
+		return nil, errors.Errorf("unsupported format type: %T", v)
+	}
+
+	// Ollama tool calls have no ids, so tool messages without a tool_name are
+	// matched to the preceding tool calls in order.
+	var pendingToolCalls []*ToolCall
+	for i, message := range ollamaReq.Messages {
+		if len(message.Images) > 0 {
+			return nil, errors.Errorf("messages[%d]: images are not supported", i)
+		}
+		chatMessage := &ChatCompletionMessage{
+			Role:    message.Role,
+			Content: message.Content,
+		}
+		switch message.Role {
+		case "assistant":
+			pendingToolCalls = nil
+			for j, toolCall := range message.ToolCalls {
+				if toolCall.Function == nil {
+					return nil, errors.Errorf("messages[%d].tool_calls[%d]: missing function", i, j)
+				}
+				// Arguments was decoded from JSON, so it always re-encodes.
+				arguments, _ := json.Marshal(toolCall.Function.Arguments)
+				chatMessage.ToolCalls = append(chatMessage.ToolCalls, &ToolCall{
+					ID:   NewID("call_"),
+					Type: "function",
+					Function: &FunctionCall{
+						Name:      toolCall.Function.Name,
+						Arguments: string(arguments),
+					},
+				})
+			}
+			pendingToolCalls = chatMessage.ToolCalls
+		case "tool":
+			chatMessage.Name = message.ToolName
+			if chatMessage.Name == "" && len(pendingToolCalls) > 0 {
+				chatMessage.ToolCallID = pendingToolCalls[0].ID
+				pendingToolCalls = pendingToolCalls[1:]
+			}
+		}
+		chatReq.Messages = append(chatReq.Messages, chatMessage)
+	}
+
+	return chatReq, nil
+}
+
+func ConvertChatCompletionToOllama(chatResp *ChatCompletionResponse) *OllamaChatResponse {
+	ollamaResp := newOllamaChatResponse(chatResp.Model)
+	ollamaResp.Done = true
+
+	if len(chatResp.Choices) > 0 {
+		choice := chatResp.Choices[0]
+		ollamaResp.Message.Content, _ = choice.Message.Content.(string)
+		ollamaResp.Message.ToolCalls = convertOllamaToolCalls(choice.Message.ToolCalls)
+		ollamaResp.DoneReason = convertOllamaDoneReason(choice.FinishReason)
+	}
+
+	if chatResp.Usage != nil {
+		ollamaResp.PromptEvalCount = chatResp.Usage.PromptTokens
+		ollamaResp.EvalCount = chatResp.Usage.CompletionTokens
+	}
+
+	return ollamaResp
+}
+
+func newOllamaChatResponse(model string) *OllamaChatResponse {
+	return &OllamaChatResponse{
+		Model:     model,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		Message:   &OllamaMessage{Role: "assistant"},
+	}
+}
+
+func convertOllamaToolCalls(toolCalls []*ToolCall) []*OllamaToolCall {
+	var ollamaToolCalls []*OllamaToolCall
+	for _, toolCall := range toolCalls {
+		arguments := map[string]interface{}{}
+		_ = json.Unmarshal([]byte(toolCall.Function.Arguments), &arguments)
+		ollamaToolCalls = append(ollamaToolCalls, &OllamaToolCall{
+			Function: &OllamaFunctionCall{
+				Name:      toolCall.Function.Name,
+				Arguments: arguments,
+			},
+		})
+	}
+	return ollamaToolCalls
+}
+
+func convertOllamaDoneReason(finishReason *string) string {
+	if finishReason != nil && *finishReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+// OllamaChatStream converts a Gemini stream into Ollama chat stream responses,
+// ending with a done response that carries the finish reason and usage.
+type OllamaChatStream struct {
+	model        string
+	usage        *ChatUsage
+	finishReason *string
+}
+
+func NewOllamaChatStream(model string) *OllamaChatStream {
+	return &OllamaChatStream{model: model, usage: &ChatUsage{}}
+}
+
+func (s *OllamaChatStream) Convert(geminiResp *genai.GenerateContentResponse) *OllamaChatResponse {
+	if geminiResp.UsageMetadata != nil {
+		s.usage = ConvertGeminiUsageToOpenAI(geminiResp.UsageMetadata)
+	}
+	ollamaResp := newOllamaChatResponse(s.model)
+	if len(geminiResp.Candidates) == 0 {
+		return ollamaResp
+	}
+	candidate := geminiResp.Candidates[0]
+	ollamaResp.Message.Content = candidateText(candidate)
+	ollamaResp.Message.ToolCalls = convertOllamaToolCalls(candidateToolCalls(candidate, false))
+	if finishReason := convertFinishReason(candidate); finishReason != nil {
+		s.finishReason = finishReason
+	}
+	return ollamaResp
+}
+
+func (s *OllamaChatStream) Finish() *OllamaChatResponse {
+	ollamaResp := newOllamaChatResponse(s.model)
+	ollamaResp.Done = true
+	ollamaResp.DoneReason = convertOllamaDoneReason(s.finishReason)
+	ollamaResp.PromptEvalCount = s.usage.PromptTokens
+	ollamaResp.EvalCount = s.usage.CompletionTokens
+	return ollamaResp
+}
@@ -0,0 +1,95 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"math"
+	"sort"
+)
+
+// ConvertRerankRequestToGemini sets up the query and document models for
+// retrieval and returns batches of the documents, split to Gemini's batch limit.
+func ConvertRerankRequestToGemini(rerankReq *RerankRequest, queryModel, documentModel *genai.EmbeddingModel) ([]*genai.EmbeddingBatch, error) {
+	if rerankReq.Query == "" {
+		return nil, errors.New("query is required")
+	}
+	if len(rerankReq.Documents) == 0 {
+		return nil, errors.New("documents is required")
+	}
+	if rerankReq.TopN != nil && *rerankReq.TopN < 1 {
+		return nil, errors.New("top_n must be at least 1")
+	}
+	queryModel.TaskType = genai.TaskTypeRetrievalQuery
+	documentModel.TaskType = genai.TaskTypeRetrievalDocument
+
+	var geminiBatchReqs []*genai.EmbeddingBatch
+	for i, document := range rerankReq.Documents {
+		text, err := rerankDocumentText(document)
+		if err != nil {
+			return nil, errors.Wrapf(err, "documents[%d]", i)
+		}
+		if i%maxEmbeddingBatchSize == 0 {
+			geminiBatchReqs = append(geminiBatchReqs, documentModel.NewBatch())
+		}
+		geminiBatchReqs[len(geminiBatchReqs)-1].AddContent(genai.Text(text))
+	}
+	return geminiBatchReqs, nil
+}
+
+func rerankDocumentText(document interface{}) (string, error) {
+	switch v := document.(type) {
+	case string:
+		return v, nil
+	case map[string]interface{}:
+		if text, ok := v["text"].(string); ok {
+			return text, nil
+		}
+		return "", errors.New("missing text")
+	default:
+		return "", errors.Errorf("unsupported document type: %T", v)
+	}
+}
+
+// ConvertGeminiResponsesToRerank ranks the documents by the cosine similarity
+// of their embeddings to the query's.
+func ConvertGeminiResponsesToRerank(queryResp *genai.EmbedContentResponse, documentEmbeddings []*genai.ContentEmbedding, rerankReq *RerankRequest, id string) *RerankResponse {
+	rerankResp := &RerankResponse{
+		ID:      id,
+		Model:   rerankReq.Model,
+		Results: []*RerankResult{},
+		Meta:    &CohereMeta{APIVersion: &CohereAPIVersion{Version: "1"}},
+	}
+	for i, documentEmbedding := range documentEmbeddings {
+		result := &RerankResult{
+			Index:          i,
+			RelevanceScore: cosineSimilarity(queryResp.Embedding.Values, documentEmbedding.Values),
+		}
+		if rerankReq.ReturnDocuments {
+			// Documents were validated when the request was converted.
+			text, _ := rerankDocumentText(rerankReq.Documents[i])
+			result.Document = &RerankDocument{Text: text}
+		}
+		rerankResp.Results = append(rerankResp.Results, result)
+	}
+
+	sort.SliceStable(rerankResp.Results, func(i, j int) bool {
+		return rerankResp.Results[i].RelevanceScore > rerankResp.Results[j].RelevanceScore
+	})
+	if rerankReq.TopN != nil && *rerankReq.TopN < len(rerankResp.Results) {
+		rerankResp.Results = rerankResp.Results[:*rerankReq.TopN]
+	}
+	return rerankResp
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, normA, normB float64
+	for i := range min(len(a), len(b)) {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,364 @@
+package openai
+
+import (
+	"encoding/json"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+)
+
+// ConvertOpenAIResponsesRequestToChat translates a Responses API request into the
+// equivalent chat completion request.
+func ConvertOpenAIResponsesRequestToChat(openAIReq *ResponsesRequest) (*ChatCompletionRequest, error) {
+	if openAIReq.PreviousResponseID != "" {
+		return nil, errors.New("previous_response_id is not supported, responses are not stored")
+	}
+
+	chatReq := &ChatCompletionRequest{
+		Model:                openAIReq.Model,
+		Temperature:          openAIReq.Temperature,
+		TopP:                 openAIReq.TopP,
+		MaxCompletionTokens:  openAIReq.MaxOutputTokens,
+		Stream:               openAIReq.Stream,
+		User:                 openAIReq.User,
+		GeminiSafetySettings: openAIReq.GeminiSafetySettings,
+	}
+
+	if openAIReq.Instructions != "" {
+		chatReq.Messages = append(chatReq.Messages, &ChatCompletionMessage{
+			Role:    "system",
+			Content: openAIReq.Instructions,
+		})
+	}
+
+	switch v := openAIReq.Input.(type) {
+	case string:
+		chatReq.Messages = append(chatReq.Messages, &ChatCompletionMessage{
+			Role:    "user",
+			Content: v,
+		})
+	case []interface{}:
+		for i, rawItem := range v {
+			var item ResponsesInputItem
+			if err := remarshal(rawItem, &item); err != nil {
+				return nil, errors.Wrapf(err, "input[%d]", i)
+			}
+			message, err := convertResponsesInputItem(&item)
+			if err != nil {
+				return nil, errors.Wrapf(err, "input[%d]", i)
+			}
+			chatReq.Messages = append(chatReq.Messages, message)
+		}
+	default:
+		return nil, errors.Errorf("unsupported input type: %T", v)
+	}
+
+	for _, tool := range openAIReq.Tools {
+		if tool.Type != "function" {
+			chatReq.Tools = append(chatReq.Tools, &Tool{Type: tool.Type})
+			continue
+		}
+		chatReq.Tools = append(chatReq.Tools, &Tool{
+			Type: "function",
+			Function: &FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+
+	switch v := openAIReq.ToolChoice.(type) {
+	case map[string]interface{}:
+		// Responses names the function at the top level instead of under "function".
+		chatReq.ToolChoice = map[string]interface{}{
+			"type":     v["type"],
+			"function": map[string]interface{}{"name": v["name"]},
+		}
+	default:
+		chatReq.ToolChoice = v
+	}
+
+	if openAIReq.Text != nil && openAIReq.Text.Format != nil {
+		format := openAIReq.Text.Format
+		chatReq.ResponseFormat = &ResponseFormat{Type: format.Type}
+		if format.Type == "json_schema" {
+			chatReq.ResponseFormat.JSONSchema = &JSONSchema{
+				Name:        format.Name,
+				Description: format.Description,
+				Schema:      format.Schema,
+				Strict:      format.Strict,
+			}
+		}
+	}
+
+	return chatReq, nil
+}
+
+func convertResponsesInputItem(item *ResponsesInputItem) (*ChatCompletionMessage, error) {
+	switch item.Type {
+	case "", "message":
+		return &ChatCompletionMessage{
+			Role:    item.Role,
+			Content: item.Content,
+		}, nil
+	case "function_call":
+		return &ChatCompletionMessage{
+			Role: "assistant",
+			ToolCalls: []*ToolCall{{
+				ID:   item.CallID,
+				Type: "function",
+				Function: &FunctionCall{
+					Name:      item.Name,
+					Arguments: item.Arguments,
+				},
+			}},
+		}, nil
+	case "function_call_output":
+		return &ChatCompletionMessage{
+			Role:       "tool",
+			Content:    item.Output,
+			ToolCallID: item.CallID,
+		}, nil
+	default:
+		return nil, errors.Errorf("unsupported input item type: %s", item.Type)
+	}
+}
+
+func remarshal(in interface{}, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func ConvertChatCompletionToResponses(chatResp *ChatCompletionResponse, instructions string) *ResponsesResponse {
+	openAIResp := newResponsesResponse(chatResp.ID, chatResp.Created, chatResp.Model, instructions)
+	openAIResp.Status = "completed"
+
+	if len(chatResp.Choices) > 0 {
+		choice := chatResp.Choices[0]
+		if text, ok := choice.Message.Content.(string); ok {
+			openAIResp.Output = append(openAIResp.Output, newResponsesMessageItem(text, "completed"))
+		}
+		for _, toolCall := range choice.Message.ToolCalls {
+			openAIResp.Output = append(openAIResp.Output, newResponsesFunctionCallItem(toolCall, "completed"))
+		}
+		openAIResp.Status, openAIResp.IncompleteDetails = convertResponsesStatus(choice.FinishReason)
+	}
+
+	if chatResp.Usage != nil {
+		openAIResp.Usage = &ResponsesUsage{
+			InputTokens:  chatResp.Usage.PromptTokens,
+			OutputTokens: chatResp.Usage.CompletionTokens,
+			TotalTokens:  chatResp.Usage.TotalTokens,
+		}
+	}
+
+	return openAIResp
+}
+
+func newResponsesResponse(id string, created int64, model string, instructions string) *ResponsesResponse {
+	openAIResp := &ResponsesResponse{
+		ID:        id,
+		Object:    "response",
+		CreatedAt: created,
+		Model:     model,
+		Output:    []*ResponsesOutputItem{},
+	}
+	if instructions != "" {
+		openAIResp.Instructions = &instructions
+	}
+	return openAIResp
+}
+
+func newResponsesMessageItem(text string, status string) *ResponsesOutputItem {
+	return &ResponsesOutputItem{
+		Type:    "message",
+		ID:      NewID("msg_"),
+		Status:  status,
+		Role:    "assistant",
+		Content: []*ResponsesContent{newResponsesOutputText(text)},
+	}
+}
+
+func newResponsesOutputText(text string) *ResponsesContent {
+	return &ResponsesContent{
+		Type:        "output_text",
+		Text:        text,
+		Annotations: []interface{}{},
+	}
+}
+
+func newResponsesFunctionCallItem(toolCall *ToolCall, status string) *ResponsesOutputItem {
+	return &ResponsesOutputItem{
+		Type:      "function_call",
+		ID:        NewID("fc_"),
+		Status:    status,
+		CallID:    toolCall.ID,
+		Name:      toolCall.Function.Name,
+		Arguments: &toolCall.Function.Arguments,
+	}
+}
+
+func convertResponsesStatus(finishReason *string) (string, *ResponsesIncompleteDetails) {
+	if finishReason == nil {
+		return "completed", nil
+	}
+	switch *finishReason {
+	case "length":
+		return "incomplete", &ResponsesIncompleteDetails{Reason: "max_output_tokens"}
+	case "content_filter":
+		return "incomplete", &ResponsesIncompleteDetails{Reason: "content_filter"}
+	default:
+		return "completed", nil
+	}
+}
+
+// ResponsesStream converts a Gemini stream into Responses API stream events.
+// Text is streamed into a single message output item, and each function call
+// becomes its own output item.
+type ResponsesStream struct {
+	response       *ResponsesResponse
+	sequenceNumber int
+	textItem       *ResponsesOutputItem
+	textIndex      int
+	finishReason   *string
+}
+
+func NewResponsesStream(id string, created int64, model string, instructions string) *ResponsesStream {
+	response := newResponsesResponse(id, created, model, instructions)
+	response.Status = "in_progress"
+	return &ResponsesStream{response: response}
+}
+
+func (s *ResponsesStream) event(event *ResponsesStreamEvent) *ResponsesStreamEvent {
+	event.SequenceNumber = s.sequenceNumber
+	s.sequenceNumber++
+	return event
+}
+
+func (s *ResponsesStream) Start() []*ResponsesStreamEvent {
+	return []*ResponsesStreamEvent{
+		s.event(&ResponsesStreamEvent{Type: "response.created", Response: s.response}),
+		s.event(&ResponsesStreamEvent{Type: "response.in_progress", Response: s.response}),
+	}
+}
+
+func (s *ResponsesStream) Convert(geminiResp *genai.GenerateContentResponse) []*ResponsesStreamEvent {
+	var events []*ResponsesStreamEvent
+	if geminiResp.UsageMetadata != nil {
+		usage := ConvertGeminiUsageToOpenAI(geminiResp.UsageMetadata)
+		s.response.Usage = &ResponsesUsage{
+			InputTokens:  usage.PromptTokens,
+			OutputTokens: usage.CompletionTokens,
+			TotalTokens:  usage.TotalTokens,
+		}
+	}
+	if len(geminiResp.Candidates) == 0 {
+		return events
+	}
+	candidate := geminiResp.Candidates[0]
+
+	if text := candidateText(candidate); text != "" {
+		if s.textItem == nil {
+			s.textItem = newResponsesMessageItem("", "in_progress")
+			s.textIndex = len(s.response.Output)
+			s.response.Output = append(s.response.Output, s.textItem)
+			events = append(events,
+				s.event(&ResponsesStreamEvent{
+					Type:        "response.output_item.added",
+					OutputIndex: genai.Ptr(s.textIndex),
+					Item:        &ResponsesOutputItem{Type: "message", ID: s.textItem.ID, Status: "in_progress", Role: "assistant", Content: []*ResponsesContent{}},
+				}),
+				s.event(&ResponsesStreamEvent{
+					Type:         "response.content_part.added",
+					ItemID:       s.textItem.ID,
+					OutputIndex:  genai.Ptr(s.textIndex),
+					ContentIndex: genai.Ptr(0),
+					Part:         newResponsesOutputText(""),
+				}),
+			)
+		}
+		s.textItem.Content[0].Text += text
+		events = append(events, s.event(&ResponsesStreamEvent{
+			Type:         "response.output_text.delta",
+			ItemID:       s.textItem.ID,
+			OutputIndex:  genai.Ptr(s.textIndex),
+			ContentIndex: genai.Ptr(0),
+			Delta:        &text,
+		}))
+	}
+
+	for _, toolCall := range candidateToolCalls(candidate, false) {
+		item := newResponsesFunctionCallItem(toolCall, "completed")
+		outputIndex := len(s.response.Output)
+		s.response.Output = append(s.response.Output, item)
+		// Gemini returns function calls whole, so they are added and completed at once.
+		events = append(events,
+			s.event(&ResponsesStreamEvent{
+				Type:        "response.output_item.added",
+				OutputIndex: genai.Ptr(outputIndex),
+				Item:        &ResponsesOutputItem{Type: "function_call", ID: item.ID, Status: "in_progress", CallID: item.CallID, Name: item.Name, Arguments: genai.Ptr("")},
+			}),
+			s.event(&ResponsesStreamEvent{
+				Type:        "response.function_call_arguments.delta",
+				ItemID:      item.ID,
+				OutputIndex: genai.Ptr(outputIndex),
+				Delta:       item.Arguments,
+			}),
+			s.event(&ResponsesStreamEvent{
+				Type:        "response.function_call_arguments.done",
+				ItemID:      item.ID,
+				OutputIndex: genai.Ptr(outputIndex),
+				Arguments:   item.Arguments,
+			}),
+			s.event(&ResponsesStreamEvent{
+				Type:        "response.output_item.done",
+				OutputIndex: genai.Ptr(outputIndex),
+				Item:        item,
+			}),
+		)
+	}
+
+	if finishReason := convertFinishReason(candidate); finishReason != nil {
+		s.finishReason = finishReason
+	}
+	return events
+}
+
+func (s *ResponsesStream) Finish() []*ResponsesStreamEvent {
+	var events []*ResponsesStreamEvent
+	if s.textItem != nil {
+		s.textItem.Status = "completed"
+		text := s.textItem.Content[0].Text
+		events = append(events,
+			s.event(&ResponsesStreamEvent{
+				Type:         "response.output_text.done",
+				ItemID:       s.textItem.ID,
+				OutputIndex:  genai.Ptr(s.textIndex),
+				ContentIndex: genai.Ptr(0),
+				Text:         &text,
+			}),
+			s.event(&ResponsesStreamEvent{
+				Type:         "response.content_part.done",
+				ItemID:       s.textItem.ID,
+				OutputIndex:  genai.Ptr(s.textIndex),
+				ContentIndex: genai.Ptr(0),
+				Part:         s.textItem.Content[0],
+			}),
+			s.event(&ResponsesStreamEvent{
+				Type:        "response.output_item.done",
+				OutputIndex: genai.Ptr(s.textIndex),
+				Item:        s.textItem,
+			}),
+		)
+	}
+
+	s.response.Status, s.response.IncompleteDetails = convertResponsesStatus(s.finishReason)
+	eventType := "response.completed"
+	if s.response.Status == "incomplete" {
+		eventType = "response.incomplete"
+	}
+	return append(events, s.event(&ResponsesStreamEvent{Type: eventType, Response: s.response}))
+}
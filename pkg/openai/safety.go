@@ -0,0 +1,72 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+var harmCategories = map[string]genai.HarmCategory{
+	"HARM_CATEGORY_DEROGATORY":        genai.HarmCategoryDerogatory,
+	"HARM_CATEGORY_TOXICITY":          genai.HarmCategoryToxicity,
+	"HARM_CATEGORY_VIOLENCE":          genai.HarmCategoryViolence,
+	"HARM_CATEGORY_SEXUAL":            genai.HarmCategorySexual,
+	"HARM_CATEGORY_MEDICAL":           genai.HarmCategoryMedical,
+	"HARM_CATEGORY_DANGEROUS":         genai.HarmCategoryDangerous,
+	"HARM_CATEGORY_HARASSMENT":        genai.HarmCategoryHarassment,
+	"HARM_CATEGORY_HATE_SPEECH":       genai.HarmCategoryHateSpeech,
+	"HARM_CATEGORY_SEXUALLY_EXPLICIT": genai.HarmCategorySexuallyExplicit,
+	"HARM_CATEGORY_DANGEROUS_CONTENT": genai.HarmCategoryDangerousContent,
+}
+
+var harmBlockThresholds = map[string]genai.HarmBlockThreshold{
+	"HARM_BLOCK_THRESHOLD_UNSPECIFIED": genai.HarmBlockUnspecified,
+	"BLOCK_LOW_AND_ABOVE":              genai.HarmBlockLowAndAbove,
+	"BLOCK_MEDIUM_AND_ABOVE":           genai.HarmBlockMediumAndAbove,
+	"BLOCK_ONLY_HIGH":                  genai.HarmBlockOnlyHigh,
+	"BLOCK_NONE":                       genai.HarmBlockNone,
+}
+
+// ConvertSafetySettingsToGemini accepts the Gemini API names for categories and
+// thresholds, case-insensitively and with an optional HARM_CATEGORY_ prefix.
+func ConvertSafetySettingsToGemini(safetySettings []*SafetySetting) ([]*genai.SafetySetting, error) {
+	var geminiSafetySettings []*genai.SafetySetting
+	for _, safetySetting := range safetySettings {
+		categoryName := strings.ToUpper(safetySetting.Category)
+		if !strings.HasPrefix(categoryName, "HARM_CATEGORY_") {
+			categoryName = "HARM_CATEGORY_" + categoryName
+		}
+		category, ok := harmCategories[categoryName]
+		if !ok {
+			return nil, errors.Errorf("unsupported safety setting category: %s", safetySetting.Category)
+		}
+		threshold, ok := harmBlockThresholds[strings.ToUpper(safetySetting.Threshold)]
+		if !ok {
+			return nil, errors.Errorf("unsupported safety setting threshold: %s", safetySetting.Threshold)
+		}
+		geminiSafetySettings = append(geminiSafetySettings, &genai.SafetySetting{
+			Category:  category,
+			Threshold: threshold,
+		})
+	}
+	return geminiSafetySettings, nil
+}
+
+// ParseSafetySettings parses settings in the form CATEGORY=THRESHOLD;CATEGORY=THRESHOLD.
+func ParseSafetySettings(s string) ([]*genai.SafetySetting, error) {
+	var safetySettings []*SafetySetting
+	for _, setting := range strings.Split(s, ";") {
+		if setting == "" {
+			continue
+		}
+		category, threshold, ok := strings.Cut(setting, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid safety setting: %s", setting)
+		}
+		safetySettings = append(safetySettings, &SafetySetting{
+			Category:  strings.TrimSpace(category),
+			Threshold: strings.TrimSpace(threshold),
+		})
+	}
+	return ConvertSafetySettingsToGemini(safetySettings)
+}
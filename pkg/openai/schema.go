@@ -0,0 +1,214 @@
+package openai
+
+import (
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"slices"
+	"strings"
+)
+
+var jsonSchemaTypes = map[string]genai.Type{
+	"string":  genai.TypeString,
+	"number":  genai.TypeNumber,
+	"integer": genai.TypeInteger,
+	"boolean": genai.TypeBoolean,
+	"array":   genai.TypeArray,
+	"object":  genai.TypeObject,
+}
+
+// maxJSONSchemaRefs is the most $refs inlined into a schema, so that schemas
+// whose definitions refer to each other many times cannot grow without bound.
+const maxJSONSchemaRefs = 1000
+
+// ConvertJSONSchemaToGemini translates the subset of JSON Schema that Gemini
+// understands into a genai.Schema. Keywords without a Gemini equivalent are dropped.
+// Gemini schemas cannot refer to definitions, so local $refs, such as those to
+// the $defs that Pydantic and zod emit for nested models, are inlined. Remote
+// and recursive $refs cannot be, and are rejected.
+func ConvertJSONSchemaToGemini(jsonSchema map[string]interface{}) (*genai.Schema, error) {
+	c := &jsonSchemaConverter{root: jsonSchema}
+	return c.convert(jsonSchema)
+}
+
+// jsonSchemaConverter converts a JSON schema, root, inlining its $refs.
+type jsonSchemaConverter struct {
+	root map[string]interface{}
+	// refs are the $refs being inlined, innermost last, which a $ref within
+	// them cannot refer to again.
+	refs []string
+	// inlined counts the $refs inlined so far.
+	inlined int
+}
+
+// resolveRef returns the schema a local $ref, a JSON pointer such as
+// #/$defs/Step, points to within the root schema.
+func (c *jsonSchemaConverter) resolveRef(ref string) (map[string]interface{}, error) {
+	if ref == "#" || slices.Contains(c.refs, ref) {
+		return nil, errors.Errorf("unsupported recursive JSON schema $ref: %s", ref)
+	}
+	pointer, ok := strings.CutPrefix(ref, "#/")
+	if !ok {
+		return nil, errors.Errorf("unsupported remote JSON schema $ref: %s", ref)
+	}
+	if c.inlined++; c.inlined > maxJSONSchemaRefs {
+		return nil, errors.Errorf("JSON schema has more than %d $refs", maxJSONSchemaRefs)
+	}
+	var v interface{} = c.root
+	for _, token := range strings.Split(pointer, "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("JSON schema $ref not found: %s", ref)
+		}
+		if v, ok = m[token]; !ok {
+			return nil, errors.Errorf("JSON schema $ref not found: %s", ref)
+		}
+	}
+	schema, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("JSON schema $ref is not a schema: %s", ref)
+	}
+	return schema, nil
+}
+
+func (c *jsonSchemaConverter) convert(jsonSchema map[string]interface{}) (*genai.Schema, error) {
+	if v, ok := jsonSchema["$ref"]; ok {
+		ref, ok := v.(string)
+		if !ok {
+			return nil, errors.Errorf("unsupported JSON schema $ref: %v", v)
+		}
+		resolved, err := c.resolveRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		c.refs = append(c.refs, ref)
+		schema, err := c.convert(resolved)
+		c.refs = c.refs[:len(c.refs)-1]
+		if err != nil {
+			return nil, err
+		}
+		// Descriptions can be given alongside a $ref, for the property that
+		// uses the definition.
+		if description, ok := jsonSchema["description"].(string); ok {
+			schema.Description = description
+		}
+		return schema, nil
+	}
+
+	schema := &genai.Schema{}
+
+	if anyOf, ok := jsonSchema["anyOf"].([]interface{}); ok {
+		// Only the nullable form {"anyOf": [<schema>, {"type": "null"}]} can be expressed.
+		var inner map[string]interface{}
+		for _, v := range anyOf {
+			s, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("unsupported anyOf entry: %T", v)
+			}
+			if s["type"] == "null" {
+				schema.Nullable = true
+				continue
+			}
+			if inner != nil {
+				return nil, errors.New("unsupported JSON schema keyword: anyOf with multiple non-null schemas")
+			}
+			inner = s
+		}
+		if inner == nil {
+			return nil, errors.New("anyOf must contain a non-null schema")
+		}
+		innerSchema, err := c.convert(inner)
+		if err != nil {
+			return nil, err
+		}
+		innerSchema.Nullable = innerSchema.Nullable || schema.Nullable
+		if description, ok := jsonSchema["description"].(string); ok && innerSchema.Description == "" {
+			innerSchema.Description = description
+		}
+		return innerSchema, nil
+	}
+
+	switch t := jsonSchema["type"].(type) {
+	case string:
+		schemaType, ok := jsonSchemaTypes[t]
+		if !ok {
+			return nil, errors.Errorf("unsupported JSON schema type: %s", t)
+		}
+		schema.Type = schemaType
+	case []interface{}:
+		// Gemini has no union types, only a nullable flag.
+		for _, v := range t {
+			name, _ := v.(string)
+			if name == "null" {
+				schema.Nullable = true
+				continue
+			}
+			schemaType, ok := jsonSchemaTypes[name]
+			if !ok {
+				return nil, errors.Errorf("unsupported JSON schema type: %v", v)
+			}
+			if schema.Type != genai.TypeUnspecified {
+				return nil, errors.New("unsupported JSON schema type: multiple non-null types")
+			}
+			schema.Type = schemaType
+		}
+	case nil:
+		if _, ok := jsonSchema["properties"]; ok {
+			schema.Type = genai.TypeObject
+		} else if _, ok := jsonSchema["items"]; ok {
+			schema.Type = genai.TypeArray
+		} else if _, ok := jsonSchema["enum"]; ok {
+			schema.Type = genai.TypeString
+		} else {
+			return nil, errors.New("JSON schema is missing a type")
+		}
+	default:
+		return nil, errors.Errorf("unsupported JSON schema type: %T", t)
+	}
+
+	if description, ok := jsonSchema["description"].(string); ok {
+		schema.Description = description
+	}
+	if format, ok := jsonSchema["format"].(string); ok {
+		schema.Format = format
+	}
+	if enum, ok := jsonSchema["enum"].([]interface{}); ok {
+		for _, v := range enum {
+			schema.Enum = append(schema.Enum, fmt.Sprint(v))
+		}
+	}
+
+	if items, ok := jsonSchema["items"].(map[string]interface{}); ok {
+		itemsSchema, err := c.convert(items)
+		if err != nil {
+			return nil, errors.Wrap(err, "items")
+		}
+		schema.Items = itemsSchema
+	}
+
+	if properties, ok := jsonSchema["properties"].(map[string]interface{}); ok {
+		schema.Properties = make(map[string]*genai.Schema, len(properties))
+		for name, v := range properties {
+			property, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("unsupported property schema for %s: %T", name, v)
+			}
+			propertySchema, err := c.convert(property)
+			if err != nil {
+				return nil, errors.Wrapf(err, "property %s", name)
+			}
+			schema.Properties[name] = propertySchema
+		}
+	}
+
+	if required, ok := jsonSchema["required"].([]interface{}); ok {
+		for _, v := range required {
+			if name, ok := v.(string); ok {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+	}
+
+	return schema, nil
+}
@@ -0,0 +1,33 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+)
+
+func ConvertTEIEmbedRequestToOpenAI(teiReq *TEIEmbedRequest, model string) *EmbedRequest {
+	normalize := teiReq.Normalize == nil || *teiReq.Normalize
+	return &EmbedRequest{
+		Model:     model,
+		Input:     teiReq.Inputs,
+		Truncate:  teiReq.Truncate,
+		Normalize: &normalize,
+	}
+}
+
+func ConvertGeminiResponseToTEI(geminiBatchResp *genai.BatchEmbedContentsResponse) [][]float32 {
+	embeddings := [][]float32{}
+	for _, geminiResp := range geminiBatchResp.Embeddings {
+		embeddings = append(embeddings, geminiResp.Values)
+	}
+	return embeddings
+}
+
+func ConvertModelToTEIInfo(model string) *TEIInfoResponse {
+	return &TEIInfoResponse{
+		ModelID:            model,
+		ModelDtype:         "float32",
+		ModelType:          map[string]interface{}{"embedding": map[string]interface{}{"pooling": "mean"}},
+		MaxClientBatchSize: maxEmbeddingBatchSize,
+		Version:            "gemini-to-openai-proxy",
+	}
+}
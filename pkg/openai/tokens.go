@@ -0,0 +1,74 @@
+package openai
+
+import (
+	"github.com/google/generative-ai-go/genai"
+	"unicode/utf8"
+)
+
+// charsPerToken is the number of characters in a token, on average, for
+// estimates of token counts.
+const charsPerToken = 4
+
+// ConvertOpenAIChatRequestToGeminiTokenCount returns the parts of a chat request
+// to count. CountTokens takes a single content, so the conversation history is
+// counted as part of the final message, which can differ from the tokens of a
+// generation request by the few tokens that separate turns.
+func ConvertOpenAIChatRequestToGeminiTokenCount(openAIReq *ChatCompletionRequest, model *genai.GenerativeModel) ([]genai.Part, error) {
+	session, parts, err := ConvertOpenAIChatRequestToGemini(openAIReq, model)
+	if err != nil {
+		return nil, err
+	}
+	var countParts []genai.Part
+	for _, content := range session.History {
+		countParts = append(countParts, content.Parts...)
+	}
+	return append(countParts, parts...), nil
+}
+
+func ConvertGeminiTokenCountToOpenAI(geminiResp *genai.CountTokensResponse, model string) *TokenCountResponse {
+	return &TokenCountResponse{
+		Object:              "token_count",
+		Model:               model,
+		TotalTokens:         geminiResp.TotalTokens,
+		CachedContentTokens: geminiResp.CachedContentTokenCount,
+	}
+}
+
+// ConvertOpenAIEmbedRequestToGeminiTokenCount returns the texts of an embedding
+// request as parts to count.
+func ConvertOpenAIEmbedRequestToGeminiTokenCount(openAIReq *EmbedRequest) ([]genai.Part, error) {
+	inputs, err := embeddingInputs(openAIReq)
+	if err != nil {
+		return nil, err
+	}
+	var parts []genai.Part
+	for _, input := range inputs {
+		parts = append(parts, genai.Text(input.text))
+	}
+	return parts, nil
+}
+
+func ConvertGeminiTokenCountToOpenAIUsage(geminiResp *genai.CountTokensResponse) *Usage {
+	return &Usage{
+		PromptTokens: int(geminiResp.TotalTokens),
+		TotalTokens:  int(geminiResp.TotalTokens),
+	}
+}
+
+// EstimateEmbeddingUsage estimates the tokens of an embedding request from the
+// length of its inputs, without asking Gemini, returning nil if the request is
+// invalid.
+func EstimateEmbeddingUsage(openAIReq *EmbedRequest) *Usage {
+	inputs, err := embeddingInputs(openAIReq)
+	if err != nil {
+		return nil
+	}
+	tokens := 0
+	for _, input := range inputs {
+		tokens += (utf8.RuneCountInString(input.text) + charsPerToken - 1) / charsPerToken
+	}
+	return &Usage{
+		PromptTokens: tokens,
+		TotalTokens:  tokens,
+	}
+}
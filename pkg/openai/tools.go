@@ -0,0 +1,174 @@
+package openai
+
+import (
+	"encoding/json"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"slices"
+)
+
+var groundingToolTypes = []string{"googleSearch", "google_search", "googleSearchRetrieval", "google_search_retrieval"}
+
+// codeExecutionToolName is the reserved tool type or function name that enables
+// Gemini's code execution tool instead of declaring a function.
+const codeExecutionToolName = "code_execution"
+
+func applyTools(tools []*Tool, toolChoice interface{}, model *genai.GenerativeModel) error {
+	geminiTools, toolConfig, err := convertTools(tools, toolChoice)
+	if err != nil {
+		return err
+	}
+	model.Tools = geminiTools
+	model.ToolConfig = toolConfig
+	return nil
+}
+
+func convertTools(tools []*Tool, toolChoice interface{}) ([]*genai.Tool, *genai.ToolConfig, error) {
+	var declarations []*genai.FunctionDeclaration
+	var codeExecution bool
+	for i, tool := range tools {
+		// The genai SDK has no GoogleSearchRetrieval tool, so grounding cannot be enabled.
+		if slices.Contains(groundingToolTypes, tool.Type) {
+			return nil, nil, errors.Errorf("tools[%d]: Google Search grounding is not supported", i)
+		}
+		if tool.Type == codeExecutionToolName || (tool.Function != nil && tool.Function.Name == codeExecutionToolName) {
+			codeExecution = true
+			continue
+		}
+		if tool.Type != "function" || tool.Function == nil {
+			return nil, nil, errors.Errorf("tools[%d]: unsupported tool type: %s", i, tool.Type)
+		}
+		declaration := &genai.FunctionDeclaration{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+		}
+		// Gemini rejects object schemas without properties, which is how
+		// OpenAI clients describe functions that take no arguments.
+		if properties, ok := tool.Function.Parameters["properties"].(map[string]interface{}); ok && len(properties) > 0 {
+			parameters, err := ConvertJSONSchemaToGemini(tool.Function.Parameters)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "tools[%d].function.parameters", i)
+			}
+			declaration.Parameters = parameters
+		}
+		declarations = append(declarations, declaration)
+	}
+	var geminiTools []*genai.Tool
+	if len(declarations) > 0 {
+		geminiTools = append(geminiTools, &genai.Tool{FunctionDeclarations: declarations})
+	}
+	if codeExecution {
+		geminiTools = append(geminiTools, &genai.Tool{CodeExecution: &genai.CodeExecution{}})
+	}
+
+	functionCallingConfig, err := convertToolChoice(toolChoice)
+	if err != nil {
+		return nil, nil, err
+	}
+	if functionCallingConfig == nil {
+		return geminiTools, nil, nil
+	}
+	if len(declarations) == 0 && functionCallingConfig.Mode != genai.FunctionCallingNone {
+		return nil, nil, errors.New("tool_choice requires tools")
+	}
+	return geminiTools, &genai.ToolConfig{FunctionCallingConfig: functionCallingConfig}, nil
+}
+
+func convertToolChoice(toolChoice interface{}) (*genai.FunctionCallingConfig, error) {
+	switch v := toolChoice.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		switch v {
+		case "auto":
+			return &genai.FunctionCallingConfig{Mode: genai.FunctionCallingAuto}, nil
+		case "none":
+			return &genai.FunctionCallingConfig{Mode: genai.FunctionCallingNone}, nil
+		case "required":
+			return &genai.FunctionCallingConfig{Mode: genai.FunctionCallingAny}, nil
+		default:
+			return nil, errors.Errorf("unsupported tool_choice: %s", v)
+		}
+	case map[string]interface{}:
+		function, _ := v["function"].(map[string]interface{})
+		name, _ := function["name"].(string)
+		if v["type"] != "function" || name == "" {
+			return nil, errors.New("tool_choice must name a function")
+		}
+		return &genai.FunctionCallingConfig{
+			Mode:                 genai.FunctionCallingAny,
+			AllowedFunctionNames: []string{name},
+		}, nil
+	default:
+		return nil, errors.Errorf("unsupported tool_choice type: %T", v)
+	}
+}
+
+func convertToolCalls(toolCalls []*ToolCall) ([]genai.Part, error) {
+	var parts []genai.Part
+	for i, toolCall := range toolCalls {
+		if toolCall.Function == nil {
+			return nil, errors.Errorf("tool_calls[%d]: missing function", i)
+		}
+		var args map[string]any
+		if toolCall.Function.Arguments != "" {
+			if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &args); err != nil {
+				return nil, errors.Wrapf(err, "tool_calls[%d]: failed to unmarshal arguments", i)
+			}
+		}
+		parts = append(parts, genai.FunctionCall{
+			Name: toolCall.Function.Name,
+			Args: args,
+		})
+	}
+	return parts, nil
+}
+
+func convertToolMessage(message *ChatCompletionMessage, functionNames map[string]string) (genai.Part, error) {
+	name := functionNames[message.ToolCallID]
+	if name == "" {
+		name = message.Name
+	}
+	if name == "" {
+		return nil, errors.Errorf("no tool call found for tool_call_id: %s", message.ToolCallID)
+	}
+
+	text, err := messageText(message.Content)
+	if err != nil {
+		return nil, err
+	}
+	// Gemini expects a JSON object, so anything else is wrapped.
+	var response map[string]any
+	if json.Unmarshal([]byte(text), &response) != nil {
+		response = map[string]any{"content": text}
+	}
+
+	return genai.FunctionResponse{
+		Name:     name,
+		Response: response,
+	}, nil
+}
+
+func candidateToolCalls(candidate *genai.Candidate, stream bool) []*ToolCall {
+	var toolCalls []*ToolCall
+	for i, functionCall := range candidate.FunctionCalls() {
+		arguments := []byte("{}")
+		if functionCall.Args != nil {
+			// Args was decoded from JSON, so it always re-encodes.
+			arguments, _ = json.Marshal(functionCall.Args)
+		}
+		toolCall := &ToolCall{
+			ID:   NewID("call_"),
+			Type: "function",
+			Function: &FunctionCall{
+				Name:      functionCall.Name,
+				Arguments: string(arguments),
+			},
+		}
+		if stream {
+			toolCall.Index = genai.Ptr(i)
+		}
+		toolCalls = append(toolCalls, toolCall)
+	}
+	return toolCalls
+}
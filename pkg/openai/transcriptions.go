@@ -0,0 +1,127 @@
+package openai
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+const transcriptionInstruction = "Generate a verbatim transcript of the speech in this audio. Only output the transcript."
+
+// transcriptionSegmentsSchema asks Gemini for timed segments, which verbose_json,
+// srt and vtt responses are built from.
+var transcriptionSegmentsSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"segments": {
+			Type: genai.TypeArray,
+			Items: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"start": {Type: genai.TypeNumber, Description: "Start time of the segment in seconds"},
+					"end":   {Type: genai.TypeNumber, Description: "End time of the segment in seconds"},
+					"text":  {Type: genai.TypeString},
+				},
+				Required: []string{"start", "end", "text"},
+			},
+		},
+	},
+	Required: []string{"segments"},
+}
+
+func transcriptionNeedsSegments(responseFormat string) bool {
+	return responseFormat == "verbose_json" || responseFormat == "srt" || responseFormat == "vtt"
+}
+
+func ConvertOpenAITranscriptionRequestToGemini(openAIReq *TranscriptionRequest, audio genai.Blob, model *genai.GenerativeModel) ([]genai.Part, error) {
+	switch openAIReq.ResponseFormat {
+	case "", "json", "text", "verbose_json", "srt", "vtt":
+	default:
+		return nil, errors.Errorf("unsupported response_format: %s", openAIReq.ResponseFormat)
+	}
+
+	if openAIReq.Temperature != nil {
+		model.SetTemperature(*openAIReq.Temperature)
+	}
+
+	instruction := transcriptionInstruction
+	if openAIReq.Language != "" {
+		instruction += fmt.Sprintf(" The speech is in the language with ISO-639-1 code %q.", openAIReq.Language)
+	}
+	if openAIReq.Prompt != "" {
+		instruction += " Use the following text as a guide to spelling and style: " + openAIReq.Prompt
+	}
+	if transcriptionNeedsSegments(openAIReq.ResponseFormat) {
+		instruction += " Split the transcript into segments at sentence boundaries, with start and end times in seconds."
+		model.ResponseMIMEType = "application/json"
+		model.ResponseSchema = transcriptionSegmentsSchema
+	}
+
+	return []genai.Part{audio, genai.Text(instruction)}, nil
+}
+
+func ConvertGeminiTranscriptionResponseToOpenAI(geminiResp *genai.GenerateContentResponse, openAIReq *TranscriptionRequest) (*TranscriptionResponse, error) {
+	var text string
+	if len(geminiResp.Candidates) > 0 {
+		text = candidateText(geminiResp.Candidates[0])
+	}
+	if !transcriptionNeedsSegments(openAIReq.ResponseFormat) {
+		return &TranscriptionResponse{Text: strings.TrimSpace(text)}, nil
+	}
+
+	var result struct {
+		Segments []*TranscriptionSegment `json:"segments"`
+	}
+	if err := json.Unmarshal([]byte(text), &result); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal transcription segments")
+	}
+
+	openAIResp := &TranscriptionResponse{
+		Task:     "transcribe",
+		Language: openAIReq.Language,
+		Segments: []*TranscriptionSegment{},
+	}
+	var texts []string
+	for i, segment := range result.Segments {
+		segment.ID = i
+		segment.Text = strings.TrimSpace(segment.Text)
+		openAIResp.Segments = append(openAIResp.Segments, segment)
+		openAIResp.Duration = max(openAIResp.Duration, segment.End)
+		texts = append(texts, segment.Text)
+	}
+	openAIResp.Text = strings.Join(texts, " ")
+	return openAIResp, nil
+}
+
+// FormatTranscriptionSubtitles renders the segments of a transcription as srt or vtt subtitles.
+func FormatTranscriptionSubtitles(openAIResp *TranscriptionResponse, responseFormat string) string {
+	var b strings.Builder
+	separator := "."
+	if responseFormat == "vtt" {
+		b.WriteString("WEBVTT\n\n")
+	} else {
+		separator = ","
+	}
+	for _, segment := range openAIResp.Segments {
+		if responseFormat == "srt" {
+			fmt.Fprintf(&b, "%d\n", segment.ID+1)
+		}
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n",
+			formatSubtitleTimestamp(segment.Start, separator),
+			formatSubtitleTimestamp(segment.End, separator),
+			segment.Text)
+	}
+	return b.String()
+}
+
+func formatSubtitleTimestamp(seconds float64, separator string) string {
+	milliseconds := int64(seconds * 1000)
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d",
+		milliseconds/3600000,
+		milliseconds/60000%60,
+		milliseconds/1000%60,
+		separator,
+		milliseconds%1000)
+}
@@ -1,17 +1,38 @@
 package openai
 
+import "encoding/json"
+
 type EmbedRequest struct {
 	Input          interface{} `json:"input"`
 	Model          string      `json:"model"`
 	EncodingFormat string      `json:"encoding_format,omitempty"`
 	Dimensions     int         `json:"dimensions,omitempty"`
 	User           string      `json:"user,omitempty"`
+	// TaskType is a Gemini task type such as RETRIEVAL_DOCUMENT.
+	TaskType string `json:"task_type,omitempty"`
+	// Title is the title of the documents being embedded, for RETRIEVAL_DOCUMENT.
+	Title string `json:"title,omitempty"`
+	// Truncate shortens inputs longer than the model's input token limit,
+	// instead of rejecting them.
+	Truncate *bool `json:"truncate,omitempty"`
+	// Normalize scales embeddings to unit length.
+	Normalize *bool `json:"normalize,omitempty"`
+	// PartialFailures returns the embeddings of the inputs that succeed, with
+	// errors for those Gemini rejects, instead of failing the request.
+	PartialFailures *bool `json:"partial_failures,omitempty"`
+	// EmbeddingTypes are quantized embedding types (int8, uint8, binary,
+	// ubinary) to return alongside, or instead of, float.
+	EmbeddingTypes []string `json:"embedding_types,omitempty"`
 }
 
 type EmbedResponseData struct {
-	Object    string    `json:"object"`
-	Embedding []float32 `json:"embedding"`
-	Index     int       `json:"index"`
+	Object string `json:"object"`
+	// Embedding is a list of floats, or a base64 string when requested. It is
+	// omitted when only quantized embedding types are requested.
+	Embedding interface{} `json:"embedding,omitempty"`
+	// Embeddings are the quantized embeddings, by embedding type.
+	Embeddings map[string][]int `json:"embeddings,omitempty"`
+	Index      int              `json:"index"`
 }
 
 type Usage struct {
@@ -19,11 +40,18 @@ type Usage struct {
 	TotalTokens  int `json:"total_tokens"`
 }
 
+type EmbedError struct {
+	Index   int    `json:"index"`
+	Message string `json:"message"`
+}
+
 type EmbedResponse struct {
 	Object string               `json:"object"`
 	Data   []*EmbedResponseData `json:"data"`
 	Model  string               `json:"model"`
 	Usage  *Usage               `json:"usage"`
+	// Errors are the inputs that failed, when partial failures are allowed.
+	Errors []*EmbedError `json:"errors,omitempty"`
 }
 
 type ModelResponse struct {
@@ -37,3 +65,725 @@ type ModelResponseData struct {
 	Created uint   `json:"created"`
 	OwnedBy string `json:"owned_by"`
 }
+
+type ChatCompletionRequest struct {
+	Model                string                   `json:"model"`
+	Messages             []*ChatCompletionMessage `json:"messages"`
+	ResponseFormat       *ResponseFormat          `json:"response_format,omitempty"`
+	N                    int                      `json:"n,omitempty"`
+	Stop                 interface{}              `json:"stop,omitempty"`
+	Temperature          *float32                 `json:"temperature,omitempty"`
+	TopP                 *float32                 `json:"top_p,omitempty"`
+	TopK                 *int32                   `json:"top_k,omitempty"`
+	MaxTokens            *int32                   `json:"max_tokens,omitempty"`
+	MaxCompletionTokens  *int32                   `json:"max_completion_tokens,omitempty"`
+	Logprobs             bool                     `json:"logprobs,omitempty"`
+	TopLogprobs          *int                     `json:"top_logprobs,omitempty"`
+	Seed                 *int64                   `json:"seed,omitempty"`
+	PresencePenalty      *float32                 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty     *float32                 `json:"frequency_penalty,omitempty"`
+	Tools                []*Tool                  `json:"tools,omitempty"`
+	ToolChoice           interface{}              `json:"tool_choice,omitempty"`
+	CachedContent        string                   `json:"cached_content,omitempty"`
+	GeminiSafetySettings []*SafetySetting         `json:"gemini_safety_settings,omitempty"`
+	Stream               bool                     `json:"stream,omitempty"`
+	StreamOptions        *StreamOptions           `json:"stream_options,omitempty"`
+	User                 string                   `json:"user,omitempty"`
+}
+
+type ChatCompletionMessage struct {
+	Role       string      `json:"role"`
+	Content    interface{} `json:"content"`
+	Name       string      `json:"name,omitempty"`
+	ToolCalls  []*ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string      `json:"tool_call_id,omitempty"`
+}
+
+type Tool struct {
+	Type     string              `json:"type"`
+	Function *FunctionDefinition `json:"function,omitempty"`
+}
+
+type FunctionDefinition struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+type ToolCall struct {
+	Index    *int          `json:"index,omitempty"`
+	ID       string        `json:"id"`
+	Type     string        `json:"type"`
+	Function *FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage,omitempty"`
+}
+
+type SafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+type JSONSchema struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Schema      map[string]interface{} `json:"schema,omitempty"`
+	Strict      bool                   `json:"strict,omitempty"`
+}
+
+type ChatCompletionResponse struct {
+	ID                string                  `json:"id"`
+	Object            string                  `json:"object"`
+	Created           int64                   `json:"created"`
+	Model             string                  `json:"model"`
+	Choices           []*ChatCompletionChoice `json:"choices"`
+	Usage             *ChatUsage              `json:"usage,omitempty"`
+	SystemFingerprint string                  `json:"system_fingerprint,omitempty"`
+}
+
+type ChatCompletionChoice struct {
+	Index        int                    `json:"index"`
+	Message      *ChatCompletionMessage `json:"message,omitempty"`
+	Delta        *ChatCompletionMessage `json:"delta,omitempty"`
+	FinishReason *string                `json:"finish_reason"`
+}
+
+type ChatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type ErrorResponse struct {
+	Error *Error `json:"error"`
+}
+
+type Error struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+type CompletionRequest struct {
+	Model                string           `json:"model"`
+	Prompt               interface{}      `json:"prompt"`
+	Suffix               string           `json:"suffix,omitempty"`
+	MaxTokens            *int32           `json:"max_tokens,omitempty"`
+	Temperature          *float32         `json:"temperature,omitempty"`
+	TopP                 *float32         `json:"top_p,omitempty"`
+	N                    int              `json:"n,omitempty"`
+	Stream               bool             `json:"stream,omitempty"`
+	StreamOptions        *StreamOptions   `json:"stream_options,omitempty"`
+	Logprobs             *int             `json:"logprobs,omitempty"`
+	Echo                 bool             `json:"echo,omitempty"`
+	Stop                 interface{}      `json:"stop,omitempty"`
+	PresencePenalty      *float32         `json:"presence_penalty,omitempty"`
+	FrequencyPenalty     *float32         `json:"frequency_penalty,omitempty"`
+	Seed                 *int64           `json:"seed,omitempty"`
+	User                 string           `json:"user,omitempty"`
+	GeminiSafetySettings []*SafetySetting `json:"gemini_safety_settings,omitempty"`
+}
+
+type CompletionResponse struct {
+	ID                string              `json:"id"`
+	Object            string              `json:"object"`
+	Created           int64               `json:"created"`
+	Model             string              `json:"model"`
+	Choices           []*CompletionChoice `json:"choices"`
+	Usage             *ChatUsage          `json:"usage,omitempty"`
+	SystemFingerprint string              `json:"system_fingerprint,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type CachedContentRequest struct {
+	Model       string                   `json:"model"`
+	DisplayName string                   `json:"display_name,omitempty"`
+	Messages    []*ChatCompletionMessage `json:"messages"`
+	Tools       []*Tool                  `json:"tools,omitempty"`
+	ToolChoice  interface{}              `json:"tool_choice,omitempty"`
+	TTLSeconds  int64                    `json:"ttl_seconds,omitempty"`
+}
+
+type CachedContentResponse struct {
+	ID          string              `json:"id"`
+	Object      string              `json:"object"`
+	Model       string              `json:"model"`
+	DisplayName string              `json:"display_name,omitempty"`
+	CreatedAt   int64               `json:"created_at"`
+	ExpiresAt   int64               `json:"expires_at"`
+	Usage       *CachedContentUsage `json:"usage,omitempty"`
+}
+
+type CachedContentUsage struct {
+	TotalTokens int `json:"total_tokens"`
+}
+
+type CachedContentListResponse struct {
+	Object string                   `json:"object"`
+	Data   []*CachedContentResponse `json:"data"`
+}
+
+type DeleteResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+type ResponsesRequest struct {
+	Model                string           `json:"model"`
+	Input                interface{}      `json:"input"`
+	Instructions         string           `json:"instructions,omitempty"`
+	Tools                []*ResponsesTool `json:"tools,omitempty"`
+	ToolChoice           interface{}      `json:"tool_choice,omitempty"`
+	Temperature          *float32         `json:"temperature,omitempty"`
+	TopP                 *float32         `json:"top_p,omitempty"`
+	MaxOutputTokens      *int32           `json:"max_output_tokens,omitempty"`
+	Text                 *ResponsesText   `json:"text,omitempty"`
+	PreviousResponseID   string           `json:"previous_response_id,omitempty"`
+	Stream               bool             `json:"stream,omitempty"`
+	User                 string           `json:"user,omitempty"`
+	GeminiSafetySettings []*SafetySetting `json:"gemini_safety_settings,omitempty"`
+}
+
+type ResponsesTool struct {
+	Type        string                 `json:"type"`
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	Strict      bool                   `json:"strict,omitempty"`
+}
+
+type ResponsesText struct {
+	Format *ResponsesTextFormat `json:"format,omitempty"`
+}
+
+type ResponsesTextFormat struct {
+	Type        string                 `json:"type"`
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Schema      map[string]interface{} `json:"schema,omitempty"`
+	Strict      bool                   `json:"strict,omitempty"`
+}
+
+type ResponsesInputItem struct {
+	Type      string      `json:"type,omitempty"`
+	Role      string      `json:"role,omitempty"`
+	Content   interface{} `json:"content,omitempty"`
+	CallID    string      `json:"call_id,omitempty"`
+	Name      string      `json:"name,omitempty"`
+	Arguments string      `json:"arguments,omitempty"`
+	Output    interface{} `json:"output,omitempty"`
+}
+
+type ResponsesResponse struct {
+	ID                string                      `json:"id"`
+	Object            string                      `json:"object"`
+	CreatedAt         int64                       `json:"created_at"`
+	Status            string                      `json:"status"`
+	Model             string                      `json:"model"`
+	Instructions      *string                     `json:"instructions"`
+	Output            []*ResponsesOutputItem      `json:"output"`
+	IncompleteDetails *ResponsesIncompleteDetails `json:"incomplete_details"`
+	Usage             *ResponsesUsage             `json:"usage"`
+}
+
+type ResponsesOutputItem struct {
+	Type      string              `json:"type"`
+	ID        string              `json:"id"`
+	Status    string              `json:"status"`
+	Role      string              `json:"role,omitempty"`
+	Content   []*ResponsesContent `json:"content,omitempty"`
+	CallID    string              `json:"call_id,omitempty"`
+	Name      string              `json:"name,omitempty"`
+	Arguments *string             `json:"arguments,omitempty"`
+}
+
+type ResponsesContent struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+type ResponsesIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type ResponsesUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type ResponsesStreamEvent struct {
+	Type           string               `json:"type"`
+	SequenceNumber int                  `json:"sequence_number"`
+	Response       *ResponsesResponse   `json:"response,omitempty"`
+	OutputIndex    *int                 `json:"output_index,omitempty"`
+	ContentIndex   *int                 `json:"content_index,omitempty"`
+	ItemID         string               `json:"item_id,omitempty"`
+	Item           *ResponsesOutputItem `json:"item,omitempty"`
+	Part           *ResponsesContent    `json:"part,omitempty"`
+	Delta          *string              `json:"delta,omitempty"`
+	Text           *string              `json:"text,omitempty"`
+	Arguments      *string              `json:"arguments,omitempty"`
+}
+
+type AnthropicMessagesRequest struct {
+	Model                string               `json:"model"`
+	Messages             []*AnthropicMessage  `json:"messages"`
+	System               interface{}          `json:"system,omitempty"`
+	MaxTokens            *int32               `json:"max_tokens,omitempty"`
+	StopSequences        []string             `json:"stop_sequences,omitempty"`
+	Temperature          *float32             `json:"temperature,omitempty"`
+	TopP                 *float32             `json:"top_p,omitempty"`
+	TopK                 *int32               `json:"top_k,omitempty"`
+	Tools                []*AnthropicTool     `json:"tools,omitempty"`
+	ToolChoice           *AnthropicToolChoice `json:"tool_choice,omitempty"`
+	Metadata             *AnthropicMetadata   `json:"metadata,omitempty"`
+	Stream               bool                 `json:"stream,omitempty"`
+	GeminiSafetySettings []*SafetySetting     `json:"gemini_safety_settings,omitempty"`
+}
+
+type AnthropicMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+type AnthropicContentBlock struct {
+	Type      string      `json:"type"`
+	Text      *string     `json:"text,omitempty"`
+	ID        string      `json:"id,omitempty"`
+	Name      string      `json:"name,omitempty"`
+	Input     interface{} `json:"input,omitempty"`
+	ToolUseID string      `json:"tool_use_id,omitempty"`
+	Content   interface{} `json:"content,omitempty"`
+	IsError   bool        `json:"is_error,omitempty"`
+}
+
+type AnthropicTool struct {
+	Type        string                 `json:"type,omitempty"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	InputSchema map[string]interface{} `json:"input_schema,omitempty"`
+}
+
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type AnthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+type AnthropicMessagesResponse struct {
+	ID           string                   `json:"id"`
+	Type         string                   `json:"type"`
+	Role         string                   `json:"role"`
+	Model        string                   `json:"model"`
+	Content      []*AnthropicContentBlock `json:"content"`
+	StopReason   *string                  `json:"stop_reason"`
+	StopSequence *string                  `json:"stop_sequence"`
+	Usage        *AnthropicUsage          `json:"usage"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type AnthropicStreamEvent struct {
+	Type         string                     `json:"type"`
+	Message      *AnthropicMessagesResponse `json:"message,omitempty"`
+	Index        *int                       `json:"index,omitempty"`
+	ContentBlock *AnthropicContentBlock     `json:"content_block,omitempty"`
+	Delta        *AnthropicStreamDelta      `json:"delta,omitempty"`
+	Usage        *AnthropicUsage            `json:"usage,omitempty"`
+}
+
+type AnthropicErrorResponse struct {
+	Type  string          `json:"type"`
+	Error *AnthropicError `json:"error"`
+}
+
+type AnthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type AnthropicStreamDelta struct {
+	Type        string  `json:"type,omitempty"`
+	Text        *string `json:"text,omitempty"`
+	PartialJSON *string `json:"partial_json,omitempty"`
+	StopReason  *string `json:"stop_reason,omitempty"`
+}
+
+type OllamaEmbedRequest struct {
+	Model string      `json:"model"`
+	Input interface{} `json:"input,omitempty"`
+	// Prompt is the input of the older /api/embeddings endpoint.
+	Prompt string `json:"prompt,omitempty"`
+}
+
+type OllamaEmbedResponse struct {
+	Model      string      `json:"model"`
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+type OllamaEmbeddingsResponse struct {
+	Embedding []float32 `json:"embedding"`
+}
+
+type OllamaChatRequest struct {
+	Model    string           `json:"model"`
+	Messages []*OllamaMessage `json:"messages"`
+	Format   interface{}      `json:"format,omitempty"`
+	Options  *OllamaOptions   `json:"options,omitempty"`
+	Tools    []*Tool          `json:"tools,omitempty"`
+	// Stream defaults to true when omitted.
+	Stream *bool `json:"stream,omitempty"`
+}
+
+type OllamaMessage struct {
+	Role      string            `json:"role"`
+	Content   string            `json:"content"`
+	Images    []string          `json:"images,omitempty"`
+	ToolCalls []*OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string            `json:"tool_name,omitempty"`
+}
+
+type OllamaToolCall struct {
+	Function *OllamaFunctionCall `json:"function"`
+}
+
+type OllamaFunctionCall struct {
+	Name      string                 `json:"name"`
+	Arguments map[string]interface{} `json:"arguments"`
+}
+
+type OllamaOptions struct {
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	TopK        *int32   `json:"top_k,omitempty"`
+	NumPredict  *int32   `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int64   `json:"seed,omitempty"`
+}
+
+type OllamaChatResponse struct {
+	Model           string         `json:"model"`
+	CreatedAt       string         `json:"created_at"`
+	Message         *OllamaMessage `json:"message"`
+	Done            bool           `json:"done"`
+	DoneReason      string         `json:"done_reason,omitempty"`
+	PromptEvalCount int            `json:"prompt_eval_count,omitempty"`
+	EvalCount       int            `json:"eval_count,omitempty"`
+}
+
+type OllamaTagsResponse struct {
+	Models []*OllamaModel `json:"models"`
+}
+
+type OllamaModel struct {
+	Name       string `json:"name"`
+	Model      string `json:"model"`
+	ModifiedAt string `json:"modified_at"`
+	Size       int64  `json:"size"`
+	Digest     string `json:"digest"`
+}
+
+type TranscriptionRequest struct {
+	Model          string
+	Language       string
+	Prompt         string
+	ResponseFormat string
+	Temperature    *float32
+}
+
+type TranscriptionResponse struct {
+	Task     string                  `json:"task,omitempty"`
+	Language string                  `json:"language,omitempty"`
+	Duration float64                 `json:"duration,omitempty"`
+	Text     string                  `json:"text"`
+	Segments []*TranscriptionSegment `json:"segments,omitempty"`
+}
+
+type TranscriptionSegment struct {
+	ID    int     `json:"id"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+type ModerationRequest struct {
+	Input interface{} `json:"input"`
+	Model string      `json:"model,omitempty"`
+}
+
+type ModerationResponse struct {
+	ID      string              `json:"id"`
+	Model   string              `json:"model"`
+	Results []*ModerationResult `json:"results"`
+}
+
+type ModerationResult struct {
+	Flagged        bool               `json:"flagged"`
+	Categories     map[string]bool    `json:"categories"`
+	CategoryScores map[string]float64 `json:"category_scores"`
+}
+
+type FileResponse struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+}
+
+type FileListResponse struct {
+	Object string          `json:"object"`
+	Data   []*FileResponse `json:"data"`
+}
+
+type BatchRequest struct {
+	InputFileID      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+type BatchResponse struct {
+	ID               string              `json:"id"`
+	Object           string              `json:"object"`
+	Endpoint         string              `json:"endpoint"`
+	Errors           *BatchErrors        `json:"errors"`
+	InputFileID      string              `json:"input_file_id"`
+	CompletionWindow string              `json:"completion_window"`
+	Status           string              `json:"status"`
+	OutputFileID     *string             `json:"output_file_id"`
+	ErrorFileID      *string             `json:"error_file_id"`
+	CreatedAt        int64               `json:"created_at"`
+	InProgressAt     *int64              `json:"in_progress_at"`
+	ExpiresAt        *int64              `json:"expires_at"`
+	FinalizingAt     *int64              `json:"finalizing_at"`
+	CompletedAt      *int64              `json:"completed_at"`
+	FailedAt         *int64              `json:"failed_at"`
+	ExpiredAt        *int64              `json:"expired_at"`
+	CancellingAt     *int64              `json:"cancelling_at"`
+	CancelledAt      *int64              `json:"cancelled_at"`
+	RequestCounts    *BatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string   `json:"metadata"`
+}
+
+type BatchErrors struct {
+	Object string        `json:"object"`
+	Data   []*BatchError `json:"data"`
+}
+
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    *int   `json:"line"`
+}
+
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+type BatchListResponse struct {
+	Object  string           `json:"object"`
+	Data    []*BatchResponse `json:"data"`
+	FirstID *string          `json:"first_id"`
+	LastID  *string          `json:"last_id"`
+	HasMore bool             `json:"has_more"`
+}
+
+type BatchInputLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+type BatchOutputLine struct {
+	ID       string               `json:"id"`
+	CustomID string               `json:"custom_id"`
+	Response *BatchOutputResponse `json:"response"`
+	Error    *BatchError          `json:"error"`
+}
+
+type BatchOutputResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type CohereEmbedRequest struct {
+	Model          string   `json:"model"`
+	Texts          []string `json:"texts"`
+	InputType      string   `json:"input_type,omitempty"`
+	EmbeddingTypes []string `json:"embedding_types,omitempty"`
+	Truncate       string   `json:"truncate,omitempty"`
+}
+
+type CohereEmbedResponse struct {
+	ID           string      `json:"id"`
+	ResponseType string      `json:"response_type"`
+	Embeddings   interface{} `json:"embeddings"`
+	Texts        []string    `json:"texts"`
+	Meta         *CohereMeta `json:"meta"`
+}
+
+// CohereEmbedByTypeResponse is a response of Cohere's v2 embed API, with
+// embeddings by embedding type.
+type CohereEmbedByTypeResponse struct {
+	Embeddings struct {
+		Float [][]float32 `json:"float"`
+	} `json:"embeddings"`
+}
+
+// ProviderEmbedRequest is a request to the embeddings API of an
+// OpenAI-compatible provider, such as Voyage AI.
+type ProviderEmbedRequest struct {
+	Input     []string `json:"input"`
+	Model     string   `json:"model"`
+	InputType string   `json:"input_type,omitempty"`
+}
+
+type ProviderEmbedResponse struct {
+	Data []*ProviderEmbedResponseData `json:"data"`
+}
+
+type ProviderEmbedResponseData struct {
+	Embedding []float32 `json:"embedding"`
+	Index     int       `json:"index"`
+}
+
+type CohereMeta struct {
+	APIVersion *CohereAPIVersion `json:"api_version"`
+}
+
+type CohereAPIVersion struct {
+	Version string `json:"version"`
+}
+
+type TEIEmbedRequest struct {
+	Inputs interface{} `json:"inputs"`
+	// Normalize defaults to true when omitted.
+	Normalize *bool `json:"normalize,omitempty"`
+	Truncate  *bool `json:"truncate,omitempty"`
+}
+
+type TEIInfoResponse struct {
+	ModelID            string                 `json:"model_id"`
+	ModelDtype         string                 `json:"model_dtype"`
+	ModelType          map[string]interface{} `json:"model_type"`
+	MaxClientBatchSize int                    `json:"max_client_batch_size"`
+	Version            string                 `json:"version"`
+}
+
+type RerankRequest struct {
+	Model string `json:"model"`
+	Query string `json:"query"`
+	// Documents are strings, or objects with a text field.
+	Documents       []interface{} `json:"documents"`
+	TopN            *int          `json:"top_n,omitempty"`
+	ReturnDocuments bool          `json:"return_documents,omitempty"`
+}
+
+type RerankResponse struct {
+	ID      string          `json:"id"`
+	Model   string          `json:"model"`
+	Results []*RerankResult `json:"results"`
+	Meta    *CohereMeta     `json:"meta"`
+}
+
+type RerankResult struct {
+	Index          int             `json:"index"`
+	RelevanceScore float64         `json:"relevance_score"`
+	Document       *RerankDocument `json:"document,omitempty"`
+}
+
+type RerankDocument struct {
+	Text string `json:"text"`
+}
+
+type TokenCountResponse struct {
+	Object              string `json:"object"`
+	Model               string `json:"model"`
+	TotalTokens         int32  `json:"total_tokens"`
+	CachedContentTokens int32  `json:"cached_content_tokens,omitempty"`
+}
+
+type FineTuningJobRequest struct {
+	Model           string                     `json:"model"`
+	TrainingFile    string                     `json:"training_file"`
+	ValidationFile  string                     `json:"validation_file,omitempty"`
+	Hyperparameters *FineTuningHyperparameters `json:"hyperparameters,omitempty"`
+	Suffix          string                     `json:"suffix,omitempty"`
+}
+
+// FineTuningHyperparameters are numbers, or "auto" in requests.
+type FineTuningHyperparameters struct {
+	NEpochs                interface{} `json:"n_epochs,omitempty"`
+	BatchSize              interface{} `json:"batch_size,omitempty"`
+	LearningRateMultiplier interface{} `json:"learning_rate_multiplier,omitempty"`
+}
+
+type FineTuningJob struct {
+	ID              string                     `json:"id"`
+	Object          string                     `json:"object"`
+	Model           string                     `json:"model"`
+	CreatedAt       int64                      `json:"created_at"`
+	FinishedAt      *int64                     `json:"finished_at"`
+	FineTunedModel  *string                    `json:"fine_tuned_model"`
+	Status          string                     `json:"status"`
+	TrainingFile    string                     `json:"training_file"`
+	ValidationFile  *string                    `json:"validation_file"`
+	Hyperparameters *FineTuningHyperparameters `json:"hyperparameters"`
+	ResultFiles     []string                   `json:"result_files"`
+	TrainedTokens   *int                       `json:"trained_tokens"`
+	Error           *FineTuningJobError        `json:"error"`
+}
+
+type FineTuningJobError struct {
+	Code    string  `json:"code"`
+	Message string  `json:"message"`
+	Param   *string `json:"param"`
+}
+
+type FineTuningJobListResponse struct {
+	Object  string           `json:"object"`
+	Data    []*FineTuningJob `json:"data"`
+	HasMore bool             `json:"has_more"`
+}
+
+type FineTuningTrainingExample struct {
+	Messages   []*ChatCompletionMessage `json:"messages,omitempty"`
+	Prompt     string                   `json:"prompt,omitempty"`
+	Completion string                   `json:"completion,omitempty"`
+}
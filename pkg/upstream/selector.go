@@ -0,0 +1,164 @@
+package upstream
+
+import (
+	"github.com/pkg/errors"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Strategies are the names of the key selection strategies.
+var Strategies = []string{"round-robin", "weighted", "least-loaded", "random"}
+
+// Clients is the state of the clients that a KeySelector picks from, by index.
+type Clients interface {
+	// Available reports whether a client can be given requests, such as
+	// whether its key is healthy and within its budgets.
+	Available(i int) bool
+	// InFlight returns the number of requests in flight on a client.
+	InFlight(i int) int
+}
+
+// KeySelector picks the client for each request from a group of clients with
+// weights. Clients with a weight of zero are never picked, and clients that
+// are not available are skipped, unless none are.
+type KeySelector interface {
+	Select(clients Clients) int
+}
+
+// NewKeySelector creates the selector of a strategy for clients with the given
+// weights, by index. At least one weight must be positive.
+func NewKeySelector(strategy string, weights []int) (KeySelector, error) {
+	var active []int
+	for i, weight := range weights {
+		if weight > 0 {
+			active = append(active, i)
+		}
+	}
+	if len(active) == 0 {
+		return nil, errors.New("no clients to select from")
+	}
+	switch strategy {
+	case "round-robin":
+		return &scheduleSelector{schedule: active}, nil
+	case "weighted":
+		return &scheduleSelector{schedule: weightedSchedule(weights)}, nil
+	case "least-loaded":
+		return &leastLoadedSelector{weights: weights, active: active}, nil
+	case "random":
+		return newRandomSelector(weights, active), nil
+	default:
+		return nil, errors.Errorf("unknown key selection strategy: %s", strategy)
+	}
+}
+
+// scheduleSelector uses clients in turn by a schedule, in which clients can
+// appear more than once.
+type scheduleSelector struct {
+	schedule []int
+	turn     atomic.Uint32
+}
+
+func (s *scheduleSelector) Select(clients Clients) int {
+	turn := s.turn.Add(1)
+	n := uint32(len(s.schedule))
+	for j := range n {
+		if i := s.schedule[(turn+j)%n]; clients.Available(i) {
+			return i
+		}
+	}
+	return s.schedule[turn%n]
+}
+
+// weightedSchedule orders clients in proportion to their weights with smooth
+// weighted round-robin, which spreads each client's turns out rather than
+// giving them in a row. Clients with a weight of zero are left out.
+func weightedSchedule(weights []int) []int {
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	current := make([]int, len(weights))
+	schedule := make([]int, 0, total)
+	for range total {
+		best := -1
+		for i, weight := range weights {
+			if weight == 0 {
+				continue
+			}
+			current[i] += weight
+			if best < 0 || current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// leastLoadedSelector uses the client with the fewest requests in flight for
+// its weight.
+type leastLoadedSelector struct {
+	weights []int
+	active  []int
+	turn    atomic.Uint32
+}
+
+func (s *leastLoadedSelector) Select(clients Clients) int {
+	// Ties go to the first client from a rotating start, so idle clients share requests.
+	n := uint32(len(s.active))
+	start := s.turn.Add(1)
+	best := -1
+	for j := range n {
+		i := s.active[(start+j)%n]
+		if !clients.Available(i) {
+			continue
+		}
+		if best < 0 || clients.InFlight(i)*s.weights[best] < clients.InFlight(best)*s.weights[i] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return s.active[start%n]
+	}
+	return best
+}
+
+// randomSelector uses a random client, with probabilities in proportion to
+// the weights of their keys.
+type randomSelector struct {
+	weights []int
+	active  []int
+	total   int
+}
+
+func newRandomSelector(weights []int, active []int) *randomSelector {
+	s := &randomSelector{weights: weights, active: active}
+	for _, i := range active {
+		s.total += weights[i]
+	}
+	return s
+}
+
+func (s *randomSelector) Select(clients Clients) int {
+	total := 0
+	for _, i := range s.active {
+		if clients.Available(i) {
+			total += s.weights[i]
+		}
+	}
+	all := total == 0
+	if all {
+		total = s.total
+	}
+	n := rand.Intn(total)
+	for _, i := range s.active {
+		if !all && !clients.Available(i) {
+			continue
+		}
+		if n -= s.weights[i]; n < 0 {
+			return i
+		}
+	}
+	return s.active[len(s.active)-1]
+}
@@ -0,0 +1,163 @@
+package upstream
+
+import (
+	"slices"
+	"testing"
+)
+
+// fakeClients is the state of clients for tests, by index.
+type fakeClients struct {
+	unavailable map[int]bool
+	inFlight    map[int]int
+}
+
+func (c fakeClients) Available(i int) bool {
+	return !c.unavailable[i]
+}
+
+func (c fakeClients) InFlight(i int) int {
+	return c.inFlight[i]
+}
+
+// selections counts the clients picked by n selections.
+func selections(t *testing.T, s KeySelector, clients Clients, n int) map[int]int {
+	t.Helper()
+	counts := map[int]int{}
+	for range n {
+		counts[s.Select(clients)]++
+	}
+	return counts
+}
+
+func TestWeightedSelection(t *testing.T) {
+	s, err := NewKeySelector("weighted", []int{5, 1, 0, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := selections(t, s, fakeClients{}, 800)
+	want := map[int]int{0: 500, 1: 100, 3: 200}
+	for i, n := range want {
+		if counts[i] != n {
+			t.Errorf("client %d picked %d times, want %d: %v", i, counts[i], n, counts)
+		}
+	}
+	if counts[2] != 0 {
+		t.Errorf("client 2 of weight 0 picked %d times", counts[2])
+	}
+}
+
+func TestWeightedScheduleIsSmooth(t *testing.T) {
+	// As in nginx, weights of 5, 1 and 1 give a a b a c a a rather than
+	// a a a a a b c.
+	schedule := weightedSchedule([]int{5, 1, 1})
+	want := []int{0, 0, 1, 0, 2, 0, 0}
+	if !slices.Equal(schedule, want) {
+		t.Errorf("schedule %v, want %v", schedule, want)
+	}
+}
+
+func TestSelectionSkipsUnavailableClients(t *testing.T) {
+	clients := fakeClients{unavailable: map[int]bool{1: true}}
+	for _, strategy := range Strategies {
+		t.Run(strategy, func(t *testing.T) {
+			s, err := NewKeySelector(strategy, []int{1, 3, 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts := selections(t, s, clients, 200)
+			if counts[1] != 0 {
+				t.Errorf("unavailable client 1 picked %d times: %v", counts[1], counts)
+			}
+			if counts[0] == 0 || counts[2] == 0 {
+				t.Errorf("available clients not both picked: %v", counts)
+			}
+		})
+	}
+}
+
+func TestSelectionWithNoAvailableClients(t *testing.T) {
+	clients := fakeClients{unavailable: map[int]bool{0: true, 1: true, 2: true}}
+	for _, strategy := range Strategies {
+		t.Run(strategy, func(t *testing.T) {
+			s, err := NewKeySelector(strategy, []int{1, 0, 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range selections(t, s, clients, 50) {
+				if i != 0 && i != 2 {
+					t.Errorf("picked client %d, want a client with a positive weight", i)
+				}
+			}
+		})
+	}
+}
+
+func TestLeastLoadedSelection(t *testing.T) {
+	s, err := NewKeySelector("least-loaded", []int{1, 2, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		inFlight map[int]int
+		want     int
+	}{
+		// Client 1 has twice the weight, so 3 in flight weighs less than 2.
+		{map[int]int{0: 2, 1: 3, 2: 2}, 1},
+		{map[int]int{0: 2, 1: 5, 2: 3}, 0},
+		{map[int]int{0: 4, 1: 8, 2: 1}, 2},
+	}
+	for _, test := range tests {
+		for range 3 {
+			if i := s.Select(fakeClients{inFlight: test.inFlight}); i != test.want {
+				t.Errorf("in flight %v: picked client %d, want %d", test.inFlight, i, test.want)
+			}
+		}
+	}
+}
+
+func TestLeastLoadedSelectionSharesIdleClients(t *testing.T) {
+	s, err := NewKeySelector("least-loaded", []int{1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := selections(t, s, fakeClients{}, 300)
+	for i := range 3 {
+		if counts[i] != 100 {
+			t.Errorf("idle client %d picked %d times, want 100: %v", i, counts[i], counts)
+		}
+	}
+}
+
+func TestRandomSelection(t *testing.T) {
+	s, err := NewKeySelector("random", []int{1, 3, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20000
+	counts := selections(t, s, fakeClients{}, n)
+	if counts[2] != 0 {
+		t.Errorf("client 2 of weight 0 picked %d times", counts[2])
+	}
+	// Client 1 is expected 3/4 of the time, with a standard deviation of about
+	// 61, so the bounds are over 8 of them away.
+	if counts[1] < 14500 || counts[1] > 15500 {
+		t.Errorf("client 1 picked %d times of %d, want about %d", counts[1], n, n*3/4)
+	}
+}
+
+func TestNewKeySelectorWithZeroWeights(t *testing.T) {
+	for _, strategy := range Strategies {
+		if _, err := NewKeySelector(strategy, []int{0, 0}); err == nil {
+			t.Errorf("%s: no error for all-zero weights", strategy)
+		}
+	}
+	if _, err := NewKeySelector("round-robin", nil); err == nil {
+		t.Error("no error for no clients")
+	}
+}
+
+func TestNewKeySelectorWithUnknownStrategy(t *testing.T) {
+	if _, err := NewKeySelector("fastest", []int{1}); err == nil {
+		t.Error("no error for an unknown strategy")
+	}
+}
@@ -0,0 +1,51 @@
+package upstream
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+// SelectSticky picks the client for an identity, such as a tenant, so that its
+// requests keep going to the same client. Clients are ranked for each identity
+// by weighted rendezvous hashing, so that only the identities of a client move
+// when it is added or removed, and the first available client is picked, or
+// the first client if none are. At least one weight must be positive.
+func SelectSticky(identity string, weights []int, clients Clients) int {
+	best, bestAvailable := -1, -1
+	var bestScore, bestAvailableScore float64
+	for i, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		score := rendezvousScore(identity, i, weight)
+		if best < 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+		if (bestAvailable < 0 || score > bestAvailableScore) && clients.Available(i) {
+			bestAvailable, bestAvailableScore = i, score
+		}
+	}
+	if bestAvailable >= 0 {
+		return bestAvailable
+	}
+	return best
+}
+
+// rendezvousScore scores a client for an identity, such that each client has
+// the highest score for a share of identities in proportion to its weight.
+func rendezvousScore(identity string, i int, weight int) float64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(identity))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(strconv.Itoa(i)))
+	// FNV mixes its last bytes poorly, so the hash is mixed further, as in
+	// SplitMix64, before it is taken as a number in (0, 1), whose log is
+	// finite and negative.
+	x := h.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(u)
+}
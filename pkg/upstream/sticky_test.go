@@ -0,0 +1,103 @@
+package upstream
+
+import (
+	"strconv"
+	"testing"
+)
+
+// stickyIdentities are the identities that sticky selection is tested with.
+func stickyIdentities() []string {
+	identities := make([]string, 2000)
+	for i := range identities {
+		identities[i] = "tenant-" + strconv.Itoa(i)
+	}
+	return identities
+}
+
+func TestSelectStickyIsStable(t *testing.T) {
+	weights := []int{1, 1, 1, 1}
+	for _, identity := range stickyIdentities() {
+		first := SelectSticky(identity, weights, fakeClients{})
+		for range 3 {
+			if i := SelectSticky(identity, weights, fakeClients{}); i != first {
+				t.Fatalf("%s picked client %d, then %d", identity, first, i)
+			}
+		}
+	}
+}
+
+func TestSelectStickyWhenClientsAreAdded(t *testing.T) {
+	before := []int{1, 1, 1}
+	after := []int{1, 1, 1, 1}
+	moved := 0
+	for _, identity := range stickyIdentities() {
+		old := SelectSticky(identity, before, fakeClients{})
+		i := SelectSticky(identity, after, fakeClients{})
+		if i != old {
+			if i != 3 {
+				t.Errorf("%s moved from client %d to %d, not the added client", identity, old, i)
+			}
+			moved++
+		}
+	}
+	// About a quarter of identities move to the added client.
+	if moved < 400 || moved > 600 {
+		t.Errorf("%d of 2000 identities moved, want about 500", moved)
+	}
+}
+
+func TestSelectStickyWhenClientsAreRemoved(t *testing.T) {
+	before := []int{1, 1, 1, 1}
+	// A removed client keeps its index with a weight of zero.
+	after := []int{1, 0, 1, 1}
+	for _, identity := range stickyIdentities() {
+		old := SelectSticky(identity, before, fakeClients{})
+		i := SelectSticky(identity, after, fakeClients{})
+		if old != 1 && i != old {
+			t.Errorf("%s moved from client %d to %d, though client 1 was removed", identity, old, i)
+		}
+		if i == 1 {
+			t.Errorf("%s picked removed client 1", identity)
+		}
+	}
+}
+
+func TestSelectStickyWeights(t *testing.T) {
+	counts := map[int]int{}
+	for _, identity := range stickyIdentities() {
+		counts[SelectSticky(identity, []int{1, 3}, fakeClients{})]++
+	}
+	if counts[1] < 1350 || counts[1] > 1650 {
+		t.Errorf("client 1 of weight 3 picked for %d of 2000 identities, want about 1500", counts[1])
+	}
+}
+
+func TestSelectStickySkipsUnavailableClients(t *testing.T) {
+	weights := []int{1, 1, 1}
+	clients := fakeClients{unavailable: map[int]bool{0: true}}
+	for _, identity := range stickyIdentities() {
+		old := SelectSticky(identity, weights, fakeClients{})
+		i := SelectSticky(identity, weights, clients)
+		if i == 0 {
+			t.Fatalf("%s picked unavailable client 0", identity)
+		}
+		if old != 0 && i != old {
+			t.Errorf("%s moved from available client %d to %d", identity, old, i)
+		}
+	}
+	none := fakeClients{unavailable: map[int]bool{0: true, 1: true, 2: true}}
+	for _, identity := range stickyIdentities()[:100] {
+		if i, want := SelectSticky(identity, weights, none), SelectSticky(identity, weights, fakeClients{}); i != want {
+			t.Errorf("%s with no available clients picked client %d, want its first choice %d", identity, i, want)
+		}
+	}
+}
+
+func TestSelectStickyWithZeroWeights(t *testing.T) {
+	if i := SelectSticky("tenant", []int{0, 0, 0}, fakeClients{}); i != -1 {
+		t.Errorf("picked client %d with all-zero weights, want -1", i)
+	}
+	if i := SelectSticky("tenant", nil, fakeClients{}); i != -1 {
+		t.Errorf("picked client %d with no clients, want -1", i)
+	}
+}
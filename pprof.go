@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pprofEndpoint        = "/debug/pprof/"
+	pprofProfileEndpoint = "/debug/pprof/profile"
+	pprofTraceEndpoint   = "/debug/pprof/trace"
+
+	// maxProfileDuration is the longest CPU profile or execution trace served.
+	maxProfileDuration = 5 * time.Minute
+)
+
+// newMetricsMux returns the routes of MetricsListenAddr: metricsEndpoint, and
+// the profiles of /debug/pprof/ if Pprof is set. net/http/pprof is not used
+// as it registers them on http.DefaultServeMux, served to clients on
+// ListenAddr.
+func newMetricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsEndpoint, metricsHandler)
+	if Pprof {
+		mux.HandleFunc(pprofEndpoint, pprofHandler)
+		mux.HandleFunc(pprofProfileEndpoint, pprofProfileHandler)
+		mux.HandleFunc(pprofTraceEndpoint, pprofTraceHandler)
+	}
+	return mux
+}
+
+// pprofHandler serves the profile named by the path, e.g. heap or goroutine,
+// in the form go tool pprof reads, or as text with ?debug=1 or 2, running a
+// garbage collection first with ?gc=1. /debug/pprof/ itself lists them.
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, pprofEndpoint)
+	if name == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "%d\t%s\n", p.Count(), p.Name())
+		}
+		fmt.Fprintln(w, "\tprofile?seconds=30")
+		fmt.Fprintln(w, "\ttrace?seconds=1")
+		return
+	}
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.Error(w, "Unknown profile: "+name, http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if name == "heap" && r.URL.Query().Get("gc") == "1" {
+		runtime.GC()
+	}
+	if debug != 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	if err := p.WriteTo(w, debug); err != nil {
+		log.Error().Err(errors.Wrapf(err, "failed to write %s profile", name)).Msg("")
+	}
+}
+
+// pprofProfileHandler serves a CPU profile of the next ?seconds, 30 by default.
+func pprofProfileHandler(w http.ResponseWriter, r *http.Request) {
+	duration, ok := profileDuration(w, r, 30*time.Second)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		// Only one CPU profile can run at a time.
+		http.Error(w, "Could not enable CPU profiling: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer pprof.StopCPUProfile()
+	sleepForProfile(r, duration)
+}
+
+// pprofTraceHandler serves an execution trace of the next ?seconds, 1 by
+// default, for go tool trace.
+func pprofTraceHandler(w http.ResponseWriter, r *http.Request) {
+	duration, ok := profileDuration(w, r, time.Second)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		http.Error(w, "Could not enable tracing: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer trace.Stop()
+	sleepForProfile(r, duration)
+}
+
+// profileDuration returns the ?seconds of a profile, or def, extending the
+// write deadline of the response past it, or responds with an error if it is
+// invalid.
+func profileDuration(w http.ResponseWriter, r *http.Request, def time.Duration) (time.Duration, bool) {
+	duration := def
+	if s := r.URL.Query().Get("seconds"); s != "" {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil || seconds <= 0 || time.Duration(seconds*float64(time.Second)) > maxProfileDuration {
+			http.Error(w, fmt.Sprintf("seconds must be a positive number up to %d", int(maxProfileDuration.Seconds())), http.StatusBadRequest)
+			return 0, false
+		}
+		duration = time.Duration(seconds * float64(time.Second))
+	}
+	if WriteTimeout > 0 {
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(duration + WriteTimeout))
+	}
+	return duration, true
+}
+
+// sleepForProfile waits for duration, or until the client of r goes away.
+func sleepForProfile(r *http.Request, duration time.Duration) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
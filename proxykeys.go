@@ -0,0 +1,106 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// proxyKeyContextKey is the context key of the ID of the proxy API key of a
+// request, or the subject of its JWT.
+type proxyKeyContextKey struct{}
+
+// proxyKeys are the IDs of the proxy API keys by key, from ProxyApiKeys.
+var proxyKeys map[string]string
+
+// parseProxyKeys parses proxy API keys in the form KEY;KEY.
+func parseProxyKeys(s string) map[string]string {
+	keys := map[string]string{}
+	for _, key := range strings.Split(s, ";") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys[key] = keyID(key)
+		}
+	}
+	return keys
+}
+
+// requestToken returns the API key of a request: its bearer token, or else its
+// api-key header, as Azure OpenAI clients send, or x-api-key, as Anthropic
+// clients send.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if token := r.Header.Get("Api-Key"); token != "" {
+		return token
+	}
+	return r.Header.Get("X-Api-Key")
+}
+
+// proxyKeyHandler requires requests to present one of proxyKeys, an enabled key
+// of adminKeys, a JWT signed with the keys of JWTJwksURL, or a token that
+// OIDCIntrospectionURL finds active, when any of them is set, before they are
+// handled by next. Other
+// tokens are left to VirtualKeysFile and KeyPassthrough when they are set, and
+// rejected with a 401 otherwise. Scrapes of metricsEndpoint on ListenAddr are
+// let through, so that per-key metrics are only kept from clients by serving
+// them on MetricsListenAddr.
+func proxyKeyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(proxyKeys) == 0 && adminKeys == nil && JWTJwksURL == "" && OIDCIntrospectionURL == "" || metricsRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := requestToken(r)
+		if id, ok := proxyKeys[token]; ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyKeyContextKey{}, id)))
+			return
+		}
+		if adminKeys != nil {
+			if id, ok := adminKeys.use(token, time.Now()); ok {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyKeyContextKey{}, id)))
+				return
+			}
+		}
+		if JWTJwksURL != "" && strings.Count(token, ".") == 2 {
+			claims, err := verifyJWT(token, time.Now())
+			if err != nil {
+				writeInvalidAPIKey(w, r, errors.Wrap(err, "invalid JWT"))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyKeyContextKey{}, cmp.Or(claims.Subject, keyID(token)))))
+			return
+		}
+		if OIDCIntrospectionURL != "" && token != "" {
+			id, active, err := tokenIntrospections.introspect(token, time.Now())
+			if err != nil {
+				writeInvalidAPIKey(w, r, err)
+				return
+			}
+			if active {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyKeyContextKey{}, id)))
+				return
+			}
+		}
+		if token != "" && (VirtualKeysFile != "" || KeyPassthrough) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writeInvalidAPIKey(w, r, errors.New("request has no valid proxy API key"))
+	})
+}
+
+// writeInvalidAPIKey rejects a request without a valid API key with a 401.
+func writeInvalidAPIKey(w http.ResponseWriter, r *http.Request, err error) {
+	code := "invalid_api_key"
+	writeErrorResponse(w, http.StatusUnauthorized, &openai.Error{
+		Message: "Incorrect API key provided",
+		Type:    "invalid_request_error",
+		Code:    &code,
+	})
+	noteError(r.Context(), err)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rateLimit is the state of a limit of the proxy, as reported to clients in
+// OpenAI's rate limit headers.
+type rateLimit struct {
+	limit     int
+	remaining int
+	// reset is how long until the limit resets.
+	reset time.Duration
+}
+
+// tighterRateLimit returns b if it has fewer remaining than a, or a is not
+// set, and a otherwise.
+func tighterRateLimit(a rateLimit, ok bool, b rateLimit) rateLimit {
+	if !ok || b.remaining < a.remaining {
+		return b
+	}
+	return a
+}
+
+// setRateLimitHeaders sets OpenAI's x-ratelimit headers of requests to the
+// tightest of the budgets of a virtual key, its tenant and the keys of group g
+// of a pool, any of which can be nil, and of tokens to the tenant's budget.
+// Headers are not set for unlimited requests or tokens.
+func setRateLimitHeaders(h http.Header, vk *virtualKey, pool *keyPool, g *keyGroup, now time.Time) {
+	var requests rateLimit
+	limited := false
+	if vk != nil {
+		if limit, ok := vk.budget.state(now); ok {
+			requests, limited = tighterRateLimit(requests, limited, limit), true
+		}
+		if vk.tenant != nil {
+			if limit, ok := vk.tenant.budget.state(now); ok {
+				requests, limited = tighterRateLimit(requests, limited, limit), true
+			}
+			if limit, ok := vk.tenant.tokens.state(now); ok {
+				setRateLimitHeader(h, "tokens", limit)
+			}
+		}
+	}
+	if pool != nil {
+		if limit, ok := pool.state(g, now); ok {
+			requests, limited = tighterRateLimit(requests, limited, limit), true
+		}
+	}
+	if limited {
+		setRateLimitHeader(h, "requests", requests)
+	}
+}
+
+func setRateLimitHeader(h http.Header, name string, limit rateLimit) {
+	h.Set("X-Ratelimit-Limit-"+name, strconv.Itoa(limit.limit))
+	h.Set("X-Ratelimit-Remaining-"+name, strconv.Itoa(limit.remaining))
+	// Resets are durations, e.g. 6m0s, as OpenAI's are.
+	h.Set("X-Ratelimit-Reset-"+name, max(0, limit.reset).Round(time.Millisecond).String())
+}
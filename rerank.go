@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+func rerankHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+		return
+	}
+
+	var rerankReq openai.RerankRequest
+	err = json.Unmarshal(body, &rerankReq)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+		return
+	}
+
+	// Cohere and Jina clients send their own rerank model names, which Gemini does not know.
+	model := rerankReq.Model
+	if model == "" || strings.Contains(model, "rerank") {
+		model = GeminiRerankModel
+	}
+
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	noteRequest(r.Context(), model, useIndex)
+
+	queryModel := geminiClient(useIndex).EmbeddingModel(model)
+	documentModel := geminiClient(useIndex).EmbeddingModel(model)
+
+	geminiBatchReqs, err := openai.ConvertRerankRequestToGemini(&rerankReq, queryModel, documentModel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert rerank request to Gemini request"))
+		return
+	}
+
+	queryResp, err := queryModel.EmbedContent(r.Context(), genai.Text(rerankReq.Query))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to embed query"))
+		return
+	}
+
+	var documentEmbeddings []*genai.ContentEmbedding
+	for _, geminiBatchReq := range geminiBatchReqs {
+		geminiBatchResp, err := documentModel.BatchEmbedContents(r.Context(), geminiBatchReq)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			noteError(r.Context(), errors.Wrap(err, "failed to batch embed contents"))
+			return
+		}
+		documentEmbeddings = append(documentEmbeddings, geminiBatchResp.Embeddings...)
+	}
+
+	writeJSON(w, r, openai.ConvertGeminiResponsesToRerank(queryResp, documentEmbeddings, &rerankReq, openai.NewID("")))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+func responsesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+		return
+	}
+
+	var openAIReq openai.ResponsesRequest
+	err = json.Unmarshal(body, &openAIReq)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+		return
+	}
+
+	chatReq, err := openai.ConvertOpenAIResponsesRequestToChat(&openAIReq)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert OpenAI request to Gemini request"))
+		return
+	}
+
+	useIndex, err := chatClient(r.Context(), chatReq)
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	noteRequest(r.Context(), openAIReq.Model, useIndex)
+
+	generativeModel := geminiClient(useIndex).GenerativeModel(openAIReq.Model)
+	generativeModel.SafetySettings = defaultSafetySettings
+
+	session, parts, err := openai.ConvertOpenAIChatRequestToGemini(chatReq, generativeModel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert OpenAI request to Gemini request"))
+		return
+	}
+
+	id := openai.NewID("resp_")
+	created := time.Now().Unix()
+
+	if openAIReq.Stream {
+		stream := openai.NewResponsesStream(id, created, openAIReq.Model, openAIReq.Instructions)
+		converter := streamConverter{
+			start: func() []serverSentEvent {
+				return responsesServerSentEvents(stream.Start())
+			},
+			chunk: func(geminiResp *genai.GenerateContentResponse) []serverSentEvent {
+				return responsesServerSentEvents(stream.Convert(geminiResp))
+			},
+			finish: func(*genai.UsageMetadata) []serverSentEvent {
+				return responsesServerSentEvents(stream.Finish())
+			},
+		}
+		streamGeminiResponses(w, r, session.SendMessageStream(r.Context(), parts...), converter)
+		return
+	}
+
+	geminiResp, err := session.SendMessage(r.Context(), parts...)
+	var blockedErr *genai.BlockedError
+	if errors.As(err, &blockedErr) {
+		var openAIErr *openai.Error
+		geminiResp, openAIErr = openai.ConvertGeminiBlockedErrorToOpenAI(blockedErr)
+		if openAIErr != nil {
+			writeErrorResponse(w, http.StatusBadRequest, openAIErr)
+			noteError(r.Context(), errors.Wrap(err, "generation was blocked"))
+			return
+		}
+		err = nil
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to generate content"))
+		return
+	}
+
+	chatResp := openai.ConvertGeminiChatResponseToOpenAI(geminiResp, id, created, openAIReq.Model)
+	openAIResp := openai.ConvertChatCompletionToResponses(chatResp, openAIReq.Instructions)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(openAIResp)
+	if err != nil {
+		noteError(r.Context(), errors.Wrap(err, "failed to encode response"))
+		return
+	}
+}
+
+func responsesServerSentEvents(events []*openai.ResponsesStreamEvent) []serverSentEvent {
+	serverSentEvents := make([]serverSentEvent, len(events))
+	for i, event := range events {
+		serverSentEvents[i] = serverSentEvent{event: event.Type, data: event}
+	}
+	return serverSentEvents
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retryBudgetReserve is how many retries the retry budget can save up, so that
+// bursts of failures after quiet periods can still be retried.
+const retryBudgetReserve = 10
+
+var (
+	upstreamRetries          = newCounter("gemini_proxy_upstream_retries_total", "Requests to the Gemini API retried, by method and reason.")
+	upstreamRetriesExhausted = newCounter("gemini_proxy_upstream_retry_budget_exhausted_total", "Requests to the Gemini API not retried as the retry budget was spent, by method and reason.")
+)
+
+// retryReason returns why a response to a request should be retried: it was
+// rate limited, Gemini failed or timed out, or the request failed without a
+// response. Responses that should not be retried have no reason.
+func retryReason(req *http.Request, resp *http.Response, err error) string {
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		return ""
+	case err != nil:
+		return "network_error"
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return "rate_limited"
+	case resp.StatusCode == http.StatusGatewayTimeout:
+		// Gemini returns DEADLINE_EXCEEDED as a 504.
+		return "deadline_exceeded"
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return "server_error"
+	default:
+		return ""
+	}
+}
+
+// retryDelay returns how long to wait before a retry, doubling RetryBaseDelay
+// with each attempt, less up to RetryJitter of it at random.
+func retryDelay(attempt int) time.Duration {
+	delay := RetryBaseDelay << attempt
+	return delay - time.Duration(RetryJitter*rand.Float64()*float64(delay))
+}
+
+// retryBudget limits retries to RetryBudget of the requests to Gemini, so that
+// retries do not multiply the load on Gemini while it is failing.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+}
+
+var upstreamRetryBudget = &retryBudget{tokens: retryBudgetReserve}
+
+// deposit adds to the budget for a request.
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+RetryBudget, retryBudgetReserve)
+}
+
+// withdraw takes a retry from the budget, reporting whether there was one.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
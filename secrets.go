@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2/google"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	secretManagerScheme = "gcp-secret-manager://"
+	vaultScheme         = "vault://"
+	// secretTimeout bounds each read of GeminiApiKeySecret.
+	secretTimeout = 10 * time.Second
+)
+
+// readSecretApiKeys reads the Gemini API keys from GeminiApiKeySecret, either a
+// GCP Secret Manager secret version, gcp-secret-manager://projects/P/secrets/S/versions/V,
+// or a field of a HashiCorp Vault secret, vault://PATH#FIELD. Vault secrets are
+// read from VAULT_ADDR with VAULT_TOKEN, and the field defaults to GEMINI_API_KEY.
+func readSecretApiKeys() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	switch {
+	case strings.HasPrefix(GeminiApiKeySecret, secretManagerScheme):
+		return readSecretManagerSecret(ctx, strings.TrimPrefix(GeminiApiKeySecret, secretManagerScheme))
+	case strings.HasPrefix(GeminiApiKeySecret, vaultScheme):
+		path, field, _ := strings.Cut(strings.TrimPrefix(GeminiApiKeySecret, vaultScheme), "#")
+		if field == "" {
+			field = "GEMINI_API_KEY"
+		}
+		return readVaultSecret(ctx, path, field)
+	default:
+		return "", errors.New("GEMINI_API_KEY_SECRET must start with gcp-secret-manager:// or vault://")
+	}
+}
+
+// readSecretManagerSecret accesses a GCP Secret Manager secret version with the
+// application default credentials.
+func readSecretManagerSecret(ctx context.Context, name string) (string, error) {
+	client, err := google.DefaultClient(ctx, cloudPlatformScope)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find Google credentials")
+	}
+	var secret struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	err = getSecretJSON(ctx, client, "https://secretmanager.googleapis.com/v1/"+name+":access", nil, &secret)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to access secret")
+	}
+	data, err := base64.StdEncoding.DecodeString(secret.Payload.Data)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode secret")
+	}
+	return string(data), nil
+}
+
+// readVaultSecret reads a field of a Vault secret, from either version of the
+// KV secrets engine.
+func readVaultSecret(ctx context.Context, path string, field string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is required for Vault secrets")
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	header := http.Header{"X-Vault-Token": {os.Getenv("VAULT_TOKEN")}}
+	err := getSecretJSON(ctx, http.DefaultClient, strings.TrimSuffix(addr, "/")+"/v1/"+path, header, &secret)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read Vault secret")
+	}
+	data := secret.Data
+	// KV version 2 nests the secret's data in its metadata.
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", errors.Errorf("Vault secret has no field %s", field)
+	}
+	return value, nil
+}
+
+func getSecretJSON(ctx context.Context, client *http.Client, url string, header http.Header, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// newServer returns a server of handler on addr, with the configured timeouts.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		ReadTimeout:       ReadTimeout,
+		WriteTimeout:      WriteTimeout,
+		IdleTimeout:       IdleTimeout,
+	}
+}
+
+// serve serves server, and adminServer and metricsServer if they are not nil,
+// until SIGTERM or SIGINT. They then stop accepting connections, and requests
+// in flight are given ShutdownTimeout to finish before the Gemini clients are
+// closed.
+func serve(server *http.Server, adminServer *http.Server, metricsServer *http.Server) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	if adminServer != nil {
+		go func() {
+			log.Info().Msgf("Serving the admin API on %s", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal().Err(err).Msg("Failed to listen and serve the admin API")
+			}
+		}()
+	}
+	if metricsServer != nil {
+		go func() {
+			log.Info().Bool("pprof", Pprof).Msgf("Serving metrics on %s", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal().Err(err).Msg("Failed to listen and serve metrics")
+			}
+		}()
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if server.TLSConfig == nil {
+			log.Info().Bool("h2c", H2C).Msgf("Listening on %s", server.Addr)
+			serveErr <- server.ListenAndServe()
+			return
+		}
+		log.Info().Bool("client-certs", TLSClientCAFile != "").Msgf("Listening with TLS on %s", server.Addr)
+		serveErr <- server.ListenAndServeTLS("", "")
+	}()
+
+	select {
+	case err := <-serveErr:
+		log.Fatal().Err(err).Msg("Failed to listen and serve")
+	case sig := <-stop:
+		log.Info().Str("signal", sig.String()).Dur("timeout", ShutdownTimeout).Msg("Shutting down")
+	}
+	// A second signal stops the proxy without waiting.
+	signal.Reset(syscall.SIGTERM, os.Interrupt)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if adminServer != nil {
+		go func() {
+			_ = adminServer.Shutdown(ctx)
+		}()
+	}
+	if metricsServer != nil {
+		go func() {
+			_ = metricsServer.Shutdown(ctx)
+		}()
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error().Err(errors.Wrap(err, "failed to finish requests in flight")).Msg("")
+	}
+	if tracing() {
+		flushSpans()
+	}
+	if OTelMetricsExporter == "otlp" {
+		flushMetrics()
+	}
+	if err := keys().close(); err != nil {
+		log.Error().Err(err).Msg("")
+	}
+	if adminKeys != nil {
+		adminKeys.mu.Lock()
+		if adminKeys.dirty {
+			if err := adminKeys.save(); err != nil {
+				log.Error().Err(err).Msg("")
+			}
+		}
+		adminKeys.mu.Unlock()
+	}
+	log.Info().Msg("Shut down")
+}
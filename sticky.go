@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// stickyIdentityKey is the context key of the identity of the client of a
+// request, for StickyKeys.
+type stickyIdentityKey struct{}
+
+// stickyKeyHandler identifies the client of each request by its virtual key or
+// proxy API key, or failing that the user field of a JSON request body, when
+// StickyKeys is set, before it is handled by next. Requests without either are
+// spread across the keys as usual.
+func stickyKeyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !StickyKeys {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var identity string
+		if vk, ok := r.Context().Value(virtualKeyContextKey{}).(*virtualKey); ok {
+			identity = "key:" + vk.id
+		} else if id, ok := r.Context().Value(proxyKeyContextKey{}).(string); ok {
+			identity = "key:" + id
+		} else if user := requestUser(r); user != "" {
+			identity = "user:" + user
+		}
+		if identity != "" {
+			r = r.WithContext(context.WithValue(r.Context(), stickyIdentityKey{}, identity))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestUser returns the user field of a JSON request body, leaving the body
+// to be read again.
+func requestUser(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method != http.MethodPost || mediaType == "multipart/form-data" {
+		return ""
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var fields struct {
+		User string `json:"user"`
+	}
+	_ = json.Unmarshal(body, &fields)
+	return fields.User
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+	"net/http"
+)
+
+// streamConverter converts Gemini stream responses into the events of an OpenAI-style stream.
+type streamConverter struct {
+	// start returns the events written before the first chunk, may be nil.
+	start func() []serverSentEvent
+	chunk func(*genai.GenerateContentResponse) []serverSentEvent
+	// finish returns the events that close the stream, given the final usage.
+	finish func(*genai.UsageMetadata) []serverSentEvent
+	// ndjson writes the event data as newline-delimited JSON, as Ollama
+	// streams, instead of server-sent events.
+	ndjson bool
+	// writeError responds to streams that fail before they start, for
+	// endpoints whose errors are not OpenAI's, may be nil.
+	writeError func(w http.ResponseWriter, statusCode int, message string)
+	// error returns the events that report that a stream failed once it has
+	// started, may be nil, in which case the stream just ends.
+	error func(message string) []serverSentEvent
+}
+
+func (c streamConverter) write(w http.ResponseWriter, events []serverSentEvent) error {
+	if c.ndjson {
+		return writeJSONLines(w, events)
+	}
+	return writeServerSentEvents(w, events)
+}
+
+type serverSentEvent struct {
+	// event is the event name, omitted when empty.
+	event string
+	data  interface{}
+}
+
+// rawEventData is written as is instead of being encoded as JSON.
+type rawEventData string
+
+var doneEvent = serverSentEvent{data: rawEventData("[DONE]")}
+
+// chatStreamFinish ends a chat or completions stream, with a final usage chunk
+// when one is requested.
+func chatStreamFinish(usage func(*genai.UsageMetadata) interface{}) func(*genai.UsageMetadata) []serverSentEvent {
+	return func(usageMetadata *genai.UsageMetadata) []serverSentEvent {
+		if usage == nil {
+			return []serverSentEvent{doneEvent}
+		}
+		return []serverSentEvent{{data: usage(usageMetadata)}, doneEvent}
+	}
+}
+
+func streamGeminiResponses(w http.ResponseWriter, r *http.Request, iter generateContentStream, converter streamConverter) {
+	// Pull the first response before committing to a streaming response so upstream
+	// errors can still be reported with a proper status code.
+	geminiResp, err := iter.Next()
+	var blockedErr *genai.BlockedError
+	if errors.As(err, &blockedErr) {
+		var openAIErr *openai.Error
+		geminiResp, openAIErr = openai.ConvertGeminiBlockedErrorToOpenAI(blockedErr)
+		if openAIErr != nil {
+			if converter.writeError != nil {
+				converter.writeError(w, http.StatusBadRequest, openAIErr.Message)
+			} else {
+				writeErrorResponse(w, http.StatusBadRequest, openAIErr)
+			}
+			noteError(r.Context(), errors.Wrap(err, "generation was blocked"))
+			return
+		}
+		err = nil
+	}
+	if err != nil && err != iterator.Done {
+		if converter.writeError != nil {
+			converter.writeError(w, http.StatusInternalServerError, "Internal Server Error")
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		noteError(r.Context(), errors.Wrap(err, "failed to generate content"))
+		return
+	}
+
+	if converter.ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	if converter.start != nil {
+		err = converter.write(w, converter.start())
+		if err != nil {
+			noteError(r.Context(), errors.Wrap(err, "failed to write stream start"))
+			return
+		}
+	}
+
+	// Each chunk carries the usage so far, so the last one seen is the total.
+	var usageMetadata *genai.UsageMetadata
+	for err == nil {
+		if geminiResp.UsageMetadata != nil {
+			usageMetadata = geminiResp.UsageMetadata
+		}
+		err = converter.write(w, converter.chunk(geminiResp))
+		if err != nil {
+			noteError(r.Context(), errors.Wrap(err, "failed to write stream chunk"))
+			return
+		}
+		geminiResp, err = iter.Next()
+		if errors.As(err, &blockedErr) {
+			// Close out the stream with a content_filter finish reason.
+			candidate := blockedErr.Candidate
+			if candidate == nil {
+				candidate = &genai.Candidate{FinishReason: genai.FinishReasonSafety}
+			}
+			geminiResp = &genai.GenerateContentResponse{Candidates: []*genai.Candidate{candidate}}
+			err = converter.write(w, converter.chunk(geminiResp))
+			if err != nil {
+				noteError(r.Context(), errors.Wrap(err, "failed to write stream chunk"))
+				return
+			}
+			err = iterator.Done
+		}
+	}
+	if err != iterator.Done {
+		// Headers have already been sent, so the best we can do is log and end
+		// the stream, with an error event if the endpoint has one.
+		if converter.error != nil {
+			_ = converter.write(w, converter.error("Internal Server Error"))
+		}
+		noteError(r.Context(), errors.Wrap(err, "failed to generate content"))
+		return
+	}
+
+	err = converter.write(w, converter.finish(usageMetadata))
+	if err != nil {
+		noteError(r.Context(), errors.Wrap(err, "failed to write stream end"))
+		return
+	}
+}
+
+func writeServerSentEvents(w http.ResponseWriter, events []serverSentEvent) error {
+	for _, event := range events {
+		var data []byte
+		if raw, ok := event.data.(rawEventData); ok {
+			data = []byte(raw)
+		} else {
+			var err error
+			data, err = json.Marshal(event.data)
+			if err != nil {
+				return err
+			}
+		}
+		if event.event != "" {
+			_, err := fmt.Fprintf(w, "event: %s\n", event.event)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "data: %s\n\n", data)
+		if err != nil {
+			return err
+		}
+	}
+	flush(w)
+	return nil
+}
+
+func writeJSONLines(w http.ResponseWriter, events []serverSentEvent) error {
+	encoder := json.NewEncoder(w)
+	for _, event := range events {
+		if err := encoder.Encode(event.data); err != nil {
+			return err
+		}
+	}
+	flush(w)
+	return nil
+}
+
+func flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
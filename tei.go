@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+)
+
+func teiEmbedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+		return
+	}
+
+	var teiReq openai.TEIEmbedRequest
+	err = json.Unmarshal(body, &teiReq)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+		return
+	}
+
+	openAIReq := openai.ConvertTEIEmbedRequestToOpenAI(&teiReq, TEIModel)
+
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	noteRequest(r.Context(), openAIReq.Model, useIndex)
+
+	geminiBatchResp, _, err := batchEmbedContents(r.Context(), useIndex, openAIReq)
+	var invalidErr invalidEmbedRequestError
+	if errors.As(err, &invalidErr) {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", invalidErr.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to batch embed contents"))
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to batch embed contents"))
+		return
+	}
+
+	writeJSON(w, r, openai.ConvertGeminiResponseToTEI(geminiBatchResp))
+}
+
+func teiInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, r, openai.ConvertModelToTEIInfo(TEIModel))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	tenantRequests = newCounter("gemini_proxy_tenant_requests_total", "Requests to the proxy with the virtual keys of a tenant, by tenant and status code.")
+	tenantTokens   = newCounter("gemini_proxy_tenant_tokens_total", "Tokens used by the requests to Gemini of a tenant, by tenant.")
+)
+
+// tenantUsageTail is how much of the end of a response body is kept to match
+// token counts split across reads, which is more than their longest match.
+const tenantUsageTail = 64
+
+// totalTokenCount matches the total token count of the usage metadata of a
+// Gemini response, which streamed responses repeat as it grows.
+var totalTokenCount = regexp.MustCompile(`"totalTokenCount":\s*(\d+)`)
+
+// tenant is a named group of virtual keys, such as a team, which share request
+// and token budgets and a set of models.
+type tenant struct {
+	name string
+	// models are the models the tenant can use, as path.Match patterns, or nil for all.
+	models []string
+	// endpoints are the paths the tenant can use, as path.Match patterns, or nil for all.
+	endpoints []string
+	// budget counts the tenant's requests to the proxy against its budgets.
+	budget *keyBudget
+	// tokens counts the tokens of the tenant's requests to Gemini.
+	tokens *tokenBudget
+}
+
+// allows reports whether the tenant can use a model.
+func (t *tenant) allows(model string) bool {
+	return matchesPatterns(t.models, strings.TrimPrefix(model, "models/"))
+}
+
+// exhaustedUntil returns when the tenant has requests and tokens again if it is
+// out of either, or the zero time otherwise.
+func (t *tenant) exhaustedUntil(now time.Time) time.Time {
+	until := t.budget.exhaustedUntil(now)
+	if tokensUntil := t.tokens.exhaustedUntil(now); tokensUntil.After(until) {
+		until = tokensUntil
+	}
+	return until
+}
+
+// tokenBudget counts tokens in days from midnight Pacific time, as Gemini's
+// quotas are. Tokens are only known once Gemini responds, so requests in flight
+// can take the count past the limit.
+type tokenBudget struct {
+	mu    sync.Mutex
+	limit int
+	day   time.Time
+	count int
+}
+
+func (b *tokenBudget) setLimit(limit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+}
+
+func (b *tokenBudget) roll(now time.Time) {
+	if day := startOfPacificDay(now); !day.Equal(b.day) {
+		b.day, b.count = day, 0
+	}
+}
+
+// add counts tokens against the budget.
+func (b *tokenBudget) add(now time.Time, tokens int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(now)
+	b.count += tokens
+}
+
+// exhaustedUntil returns the start of the next day if the budget is exhausted,
+// or the zero time otherwise.
+func (b *tokenBudget) exhaustedUntil(now time.Time) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(now)
+	if b.limit > 0 && b.count >= b.limit {
+		return startOfPacificDay(now).AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+// state returns the budget's limit, or false if it is unlimited.
+func (b *tokenBudget) state(now time.Time) (rateLimit, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(now)
+	if b.limit <= 0 {
+		return rateLimit{}, false
+	}
+	return rateLimit{limit: b.limit, remaining: max(0, b.limit-b.count), reset: startOfPacificDay(now).AddDate(0, 0, 1).Sub(now)}, true
+}
+
+// tenantUsageBody is the body of a Gemini response to a request of a tenant,
+// which counts the response's tokens against the tenant when it is closed.
+type tenantUsageBody struct {
+	io.ReadCloser
+	tenant *tenant
+	// tail is the end of the body read so far, to match counts split across reads.
+	tail   []byte
+	tokens int
+	closed bool
+}
+
+func (b *tenantUsageBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	data := append(b.tail, p[:n]...)
+	for _, match := range totalTokenCount.FindAllSubmatch(data, -1) {
+		if tokens, err := strconv.Atoi(string(match[1])); err == nil {
+			b.tokens = max(b.tokens, tokens)
+		}
+	}
+	// Counts are matched again with the next read, which the maximum ignores.
+	b.tail = append(b.tail[:0], data[max(0, len(data)-tenantUsageTail):]...)
+	return n, err
+}
+
+func (b *tenantUsageBody) Close() error {
+	if !b.closed && b.tokens > 0 {
+		b.tenant.tokens.add(time.Now(), b.tokens)
+		tenantTokens.add(float64(b.tokens), "tenant", b.tenant.name)
+	}
+	b.closed = true
+	return b.ReadCloser.Close()
+}
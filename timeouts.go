@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"net/http"
+	"path"
+	"time"
+)
+
+// defaultUpstreamTimeouts are the upstream timeouts of endpoints, by path.Match
+// pattern, unless UpstreamTimeouts sets them. Generation can take minutes;
+// other endpoints use UpstreamTimeout.
+var defaultUpstreamTimeouts = map[string]time.Duration{
+	openAIEmbeddingsEndpoint:                 time.Minute,
+	openAIChatCompletionsEndpoint:            10 * time.Minute,
+	openAICompletionsEndpoint:                10 * time.Minute,
+	openAIResponsesEndpoint:                  10 * time.Minute,
+	anthropicMessagesEndpoint:                10 * time.Minute,
+	ollamaChatEndpoint:                       10 * time.Minute,
+	openAITranscriptionsEndpoint:             10 * time.Minute,
+	"/openai/deployments/*/embeddings":       time.Minute,
+	"/openai/deployments/*/chat/completions": 10 * time.Minute,
+	"/openai/deployments/*/completions":      10 * time.Minute,
+}
+
+// upstreamTimeouts are the upstream timeouts of endpoints, by path.Match pattern.
+var upstreamTimeouts map[string]time.Duration
+
+// parseUpstreamTimeouts parses timeouts in the form ENDPOINT=DURATION;ENDPOINT=DURATION
+// over the defaults, where endpoints are path.Match patterns of request paths.
+func parseUpstreamTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for endpoint, timeout := range defaultUpstreamTimeouts {
+		timeouts[endpoint] = timeout
+	}
+	mappings, err := parseModelMap(s)
+	if err != nil {
+		return nil, err
+	}
+	for endpoint, timeout := range mappings {
+		if _, err := path.Match(endpoint, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid endpoint %s", endpoint)
+		}
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d < 0 {
+			return nil, errors.Errorf("timeout of %s must be a non-negative duration", endpoint)
+		}
+		timeouts[endpoint] = d
+	}
+	return timeouts, nil
+}
+
+// upstreamTimeout returns the upstream timeout of a request path, zero for none.
+func upstreamTimeout(urlPath string) time.Duration {
+	if timeout, ok := upstreamTimeouts[urlPath]; ok {
+		return timeout
+	}
+	for endpoint, timeout := range upstreamTimeouts {
+		if ok, _ := path.Match(endpoint, urlPath); ok {
+			return timeout
+		}
+	}
+	return UpstreamTimeout
+}
+
+// upstreamTimeoutHandler gives requests the upstream timeout of their endpoint
+// as a deadline before they are handled by next, so that requests to Gemini
+// that take longer are cancelled. Requests that fail because of it are
+// responded to with a 504, unless their responses have started.
+func upstreamTimeoutHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := upstreamTimeout(r.URL.Path)
+		if timeout == 0 || metricsRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		ow := &errorOverrideWriter{statusWriter: statusWriter{ResponseWriter: w}, override: func(w http.ResponseWriter, status int) bool {
+			// Requests cancelled by their clients are not timed out.
+			if status < http.StatusInternalServerError || !errors.Is(ctx.Err(), context.DeadlineExceeded) || r.Context().Err() != nil {
+				return false
+			}
+			code := "timeout"
+			writeErrorResponse(w, http.StatusGatewayTimeout, &openai.Error{
+				Message: "The request to Gemini timed out after " + timeout.String(),
+				Type:    "server_error",
+				Code:    &code,
+			})
+			noteError(r.Context(), errors.Errorf("upstream request timed out after %s", timeout))
+			return true
+		}}
+		next.ServeHTTP(ow, r.WithContext(ctx))
+	})
+}
+
+// errorOverrideWriter lets override respond instead of a handler, when it
+// reports that it has from the status of the handler's response. The rest of
+// the handler's response is then dropped.
+type errorOverrideWriter struct {
+	statusWriter
+	override   func(w http.ResponseWriter, status int) bool
+	overridden bool
+}
+
+func (w *errorOverrideWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	if w.overridden = w.override(w.ResponseWriter, status); w.overridden {
+		w.status = status
+		return
+	}
+	w.statusWriter.WriteHeader(status)
+}
+
+func (w *errorOverrideWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.overridden {
+		return len(b), nil
+	}
+	return w.statusWriter.Write(b)
+}
+
+// Flush flushes streamed responses.
+func (w *errorOverrideWriter) Flush() {
+	if !w.overridden {
+		w.statusWriter.Flush()
+	}
+}
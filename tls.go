@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certFilePollInterval is how often TLSCertFile and TLSKeyFile are checked for
+// changes.
+const certFilePollInterval = 30 * time.Second
+
+// certReloader serves the certificate of TLSCertFile and TLSKeyFile, reloading
+// it when they change, such as when cert-manager renews it.
+type certReloader struct {
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// certPEM and keyPEM are the contents of the files the certificate was loaded from.
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// reload loads the certificate again if its files have changed. The previous
+// certificate is kept if they cannot be loaded, as when only one of them has
+// been written yet.
+func (c *certReloader) reload() error {
+	certPEM, err := os.ReadFile(TLSCertFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read TLS_CERT_FILE")
+	}
+	keyPEM, err := os.ReadFile(TLSKeyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read TLS_KEY_FILE")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if bytes.Equal(certPEM, c.certPEM) && bytes.Equal(keyPEM, c.keyPEM) {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return errors.Wrap(err, "failed to load TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	reloaded := c.cert != nil
+	c.cert, c.certPEM, c.keyPEM = &cert, certPEM, keyPEM
+	if reloaded {
+		log.Info().Msg("Reloaded TLS certificate")
+	}
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// watch reloads the certificate on SIGHUP, and when its files change.
+func (c *certReloader) watch() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(certFilePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hangup:
+		case <-ticker.C:
+		}
+		if err := c.reload(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload TLS certificate")
+		}
+	}
+}
+
+// serverTLSConfig returns the TLS config of the listener, serving TLSCertFile
+// and, when TLSClientCAFile is set, requiring clients to present certificates
+// signed by one of its CAs. The certificate is reloaded when it changes.
+func serverTLSConfig() (*tls.Config, error) {
+	certs := &certReloader{}
+	if err := certs.reload(); err != nil {
+		return nil, err
+	}
+	go certs.watch()
+	config := &tls.Config{
+		GetCertificate: certs.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if TLSClientCAFile != "" {
+		pem, err := os.ReadFile(TLSClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read TLS_CLIENT_CA_FILE")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("TLS_CLIENT_CA_FILE has no PEM certificates")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
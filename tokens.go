@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+)
+
+func countTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to read request body"))
+		return
+	}
+
+	var openAIReq openai.ChatCompletionRequest
+	err = json.Unmarshal(body, &openAIReq)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to unmarshal request body"))
+		return
+	}
+
+	useIndex, err := chatClient(r.Context(), &openAIReq)
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	noteRequest(r.Context(), openAIReq.Model, useIndex)
+
+	generativeModel := geminiClient(useIndex).GenerativeModel(openAIReq.Model)
+
+	parts, err := openai.ConvertOpenAIChatRequestToGeminiTokenCount(&openAIReq, generativeModel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert OpenAI request to Gemini request"))
+		return
+	}
+
+	geminiResp, err := generativeModel.CountTokens(r.Context(), parts...)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to count tokens"))
+		return
+	}
+
+	writeJSON(w, r, openai.ConvertGeminiTokenCountToOpenAI(geminiResp, openAIReq.Model))
+}
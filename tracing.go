@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/rs/zerolog/log"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// spanExportInterval is how often ended spans are sent to OTLPEndpoint, and
+	// maxQueuedSpans how many are kept until then. Spans beyond it are dropped.
+	spanExportInterval = 5 * time.Second
+	maxQueuedSpans     = 2048
+
+	spanKindServer  = 2
+	spanKindClient  = 3
+	spanStatusError = 2
+)
+
+// spanContextKey is the context key of the span of a request.
+type spanContextKey struct{}
+
+// span is a span of a trace, sent to OTLPEndpoint in OTLP's JSON encoding once
+// it ends, if it is sampled.
+type span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	sampled    bool
+	traceState string
+
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes []otlpKeyValue
+	failed     bool
+}
+
+var (
+	spansMu     sync.Mutex
+	queuedSpans []*span
+)
+
+// tracing reports whether spans are sent anywhere.
+func tracing() bool {
+	return OTLPEndpoint != ""
+}
+
+// spanFromContext returns the span of a context, or nil if it has none.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// startSpan starts a span that is a child of the span of ctx, or of the trace
+// context of traceparent and tracestate headers, or else the root of a new
+// trace, sampled with OTelTracesSamplerArg.
+func startSpan(ctx context.Context, name string, kind int, header http.Header) (context.Context, *span) {
+	s := &span{name: name, kind: kind, start: time.Now()}
+	_, _ = rand.Read(s.spanID[:])
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID, s.parentID, s.sampled, s.traceState = parent.traceID, parent.spanID, parent.sampled, parent.traceState
+	} else if traceID, parentID, sampled, ok := parseTraceparent(header.Get("Traceparent")); ok {
+		s.traceID, s.parentID, s.sampled, s.traceState = traceID, parentID, sampled, header.Get("Tracestate")
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+		s.sampled = mathrand.Float64() < OTelTracesSamplerArg
+	}
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// parseTraceparent parses a W3C traceparent header, of the form
+// VERSION-TRACEID-PARENTID-FLAGS in hex.
+func parseTraceparent(s string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return traceID, parentID, false, false
+	}
+	var flags [1]byte
+	for i, part := range [][]byte{traceID[:], parentID[:], flags[:]} {
+		if n, err := hex.Decode(part, []byte(parts[i+1])); err != nil || n != len(part) || len(parts[i+1]) != 2*len(part) {
+			return traceID, parentID, false, false
+		}
+	}
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// traceparent returns the W3C traceparent header of the span, for upstream
+// requests made within it.
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// setTraceHeaders sets the traceparent and tracestate headers of an upstream
+// request to those of a span.
+func (s *span) setTraceHeaders(h http.Header) {
+	h.Set("Traceparent", s.traceparent())
+	if s.traceState != "" {
+		h.Set("Tracestate", s.traceState)
+	}
+}
+
+// setAttributes adds attributes to the span.
+func (s *span) setAttributes(attributes ...otlpKeyValue) {
+	s.attributes = append(s.attributes, attributes...)
+}
+
+// finish ends the span, with an error status if it failed, queueing it to be
+// sent if it is sampled.
+func (s *span) finish(failed bool) {
+	s.end = time.Now()
+	s.failed = failed
+	if !s.sampled || !tracing() {
+		return
+	}
+	spansMu.Lock()
+	defer spansMu.Unlock()
+	if len(queuedSpans) < maxQueuedSpans {
+		queuedSpans = append(queuedSpans, s)
+	}
+}
+
+// otlp returns the span in OTLP's JSON encoding.
+func (s *span) otlp() map[string]interface{} {
+	v := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": otlpTime(s.start),
+		"endTimeUnixNano":   otlpTime(s.end),
+		"attributes":        s.attributes,
+	}
+	if s.parentID != [8]byte{} {
+		v["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.traceState != "" {
+		v["traceState"] = s.traceState
+	}
+	if s.failed {
+		v["status"] = map[string]int{"code": spanStatusError}
+	}
+	return v
+}
+
+// exportSpans sends the spans that have ended to OTLPEndpoint every
+// spanExportInterval.
+func exportSpans() {
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		flushSpans()
+	}
+}
+
+// flushSpans sends the spans that have ended to OTLPEndpoint. Spans that fail
+// to send are dropped.
+func flushSpans() {
+	spansMu.Lock()
+	spans := queuedSpans
+	queuedSpans = nil
+	spansMu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	encoded := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		encoded[i] = s.otlp()
+	}
+	err := postOTLP("/v1/traces", map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource": otlpResource(),
+			"scopeSpans": []map[string]interface{}{{
+				"scope": map[string]string{"name": otlpScopeName},
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Error().Err(err).Int("spans", len(spans)).Msg("Failed to export spans")
+	}
+}
+
+// tracingHandler traces requests to the proxy with a server span, continuing
+// the trace of their traceparent header, if any, before they are handled by
+// next. Requests to metricsEndpoint are not traced.
+func tracingHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracing() || metricsRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		endpoint := requestEndpoint(r)
+		ctx, s := startSpan(r.Context(), r.Method+" "+endpoint, spanKindServer, r.Header)
+		if s.sampled {
+			noteTrace(ctx, hex.EncodeToString(s.traceID[:]))
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.setAttributes(
+			stringAttribute("http.request.method", r.Method),
+			stringAttribute("http.route", endpoint),
+			stringAttribute("url.path", r.URL.Path),
+			stringAttribute("user_agent.original", r.Header.Get("User-Agent")),
+			intAttribute("http.response.status_code", status),
+		)
+		if id := requestID(ctx); id != "" {
+			s.setAttributes(stringAttribute("request.id", id))
+		}
+		s.finish(status >= http.StatusInternalServerError)
+	})
+}
+
+// tracingTransport traces upstream requests with client spans, children of the
+// span of the request's context, sending the trace context upstream.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+var (
+	// upstreamTransport sends requests to Gemini and other upstreams, and
+	// upstreamClient those the proxy makes itself.
+	upstreamTransport http.RoundTripper = &tracingTransport{base: http.DefaultTransport}
+	upstreamClient                      = &http.Client{Transport: upstreamTransport}
+)
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !tracing() || spanFromContext(req.Context()) == nil {
+		return t.base.RoundTrip(req)
+	}
+	_, s := startSpan(req.Context(), upstreamMethod(req), spanKindClient, nil)
+	req = req.Clone(req.Context())
+	s.setTraceHeaders(req.Header)
+	resp, err := t.base.RoundTrip(req)
+
+	s.setAttributes(
+		stringAttribute("http.request.method", req.Method),
+		stringAttribute("server.address", req.URL.Hostname()),
+		stringAttribute("url.path", req.URL.Path),
+	)
+	if model := upstreamModel(req); model != "" {
+		s.setAttributes(stringAttribute("gen_ai.request.model", model))
+	}
+	if err != nil {
+		errorType := "error"
+		if req.Context().Err() != nil {
+			errorType = "cancelled"
+		}
+		s.setAttributes(stringAttribute("error.type", errorType))
+		s.finish(true)
+		return resp, err
+	}
+	s.setAttributes(intAttribute("http.response.status_code", resp.StatusCode))
+	s.finish(resp.StatusCode >= http.StatusBadRequest)
+	return resp, err
+}
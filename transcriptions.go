@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/pkg/errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxTranscriptionFileSize matches the upload limit of the OpenAI API.
+const maxTranscriptionFileSize = 25 << 20
+
+func transcriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxTranscriptionFileSize+1<<20)
+	err := r.ParseMultipartForm(maxTranscriptionFileSize)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to parse multipart form"))
+		return
+	}
+
+	openAIReq := openai.TranscriptionRequest{
+		Model:          r.FormValue("model"),
+		Language:       r.FormValue("language"),
+		Prompt:         r.FormValue("prompt"),
+		ResponseFormat: r.FormValue("response_format"),
+	}
+	if temperature := r.FormValue("temperature"); temperature != "" {
+		t, err := strconv.ParseFloat(temperature, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "temperature must be a number")
+			noteError(r.Context(), errors.Wrap(err, "failed to parse temperature"))
+			return
+		}
+		openAIReq.Temperature = genai.Ptr(float32(t))
+	}
+	// Whisper clients send their own model names, which Gemini does not know.
+	model := openAIReq.Model
+	if model == "" || strings.HasPrefix(model, "whisper") {
+		model = GeminiTranscriptionModel
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "file is required")
+		noteError(r.Context(), errors.Wrap(err, "failed to read file"))
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		noteError(r.Context(), errors.Wrap(err, "failed to read file"))
+		return
+	}
+	mimeType := header.Header.Get("Content-Type")
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = mime.TypeByExtension(filepath.Ext(header.Filename))
+	}
+	if !strings.HasPrefix(mimeType, "audio/") && !strings.HasPrefix(mimeType, "video/") {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "unsupported file type: "+header.Filename)
+		noteError(r.Context(), errors.Errorf("unsupported file content type: %s", mimeType))
+		return
+	}
+
+	useIndex, err := nextClient(r.Context())
+	if err != nil {
+		writeNoKeyAvailable(w, r, err)
+		return
+	}
+	defer doneClient(useIndex)
+	noteRequest(r.Context(), model, useIndex)
+
+	generativeModel := geminiClient(useIndex).GenerativeModel(model)
+	generativeModel.SafetySettings = defaultSafetySettings
+
+	parts, err := openai.ConvertOpenAITranscriptionRequestToGemini(&openAIReq, genai.Blob{MIMEType: mimeType, Data: data}, generativeModel)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		noteError(r.Context(), errors.Wrap(err, "failed to convert OpenAI request to Gemini request"))
+		return
+	}
+
+	geminiResp, err := generativeModel.GenerateContent(r.Context(), parts...)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to generate content"))
+		return
+	}
+
+	openAIResp, err := openai.ConvertGeminiTranscriptionResponseToOpenAI(geminiResp, &openAIReq)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		noteError(r.Context(), errors.Wrap(err, "failed to convert Gemini response"))
+		return
+	}
+
+	switch openAIReq.ResponseFormat {
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = io.WriteString(w, openAIResp.Text+"\n")
+	case "srt", "vtt":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = io.WriteString(w, openai.FormatTranscriptionSubtitles(openAIResp, openAIReq.ResponseFormat))
+	default:
+		writeJSON(w, r, openAIResp)
+		return
+	}
+	if err != nil {
+		noteError(r.Context(), errors.Wrap(err, "failed to write response"))
+	}
+}
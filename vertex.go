@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vertexScheme       = "vertex://"
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// vertexBackend sends the Gemini API requests of a key entry to Vertex AI, in
+// the form vertex://PROJECT/REGION, authenticated with Google credentials
+// instead of an API key. Generation, token counting and embeddings are
+// supported; other methods, such as those of files and cached contents, are not.
+//
+// Entries can list several regions, vertex://PROJECT/REGION1,REGION2, in order
+// of preference. Requests go to the first region that is not degraded, and
+// fail over to the next on errors, rate limits, or responses slower than
+// VertexFailoverLatency, which degrade the region for KeyCircuitCooldown.
+type vertexBackend struct {
+	project     string
+	regions     []*vertexRegion
+	tokenSource oauth2.TokenSource
+}
+
+type vertexRegion struct {
+	name string
+
+	mu            sync.Mutex
+	degradedUntil time.Time
+}
+
+// newVertexBackend creates the backend of a Vertex AI key entry, using the
+// service account key in credentialsFile, or the application default
+// credentials if it is empty.
+func newVertexBackend(entry string, credentialsFile string) (*vertexBackend, error) {
+	project, regions, ok := strings.Cut(strings.TrimPrefix(entry, vertexScheme), "/")
+	if !ok || project == "" || regions == "" {
+		return nil, errors.New("Vertex AI entries must be in the form vertex://PROJECT/REGION")
+	}
+	v := &vertexBackend{project: project}
+	for _, region := range strings.Split(regions, ",") {
+		if region == "" {
+			return nil, errors.New("Vertex AI regions must not be empty")
+		}
+		v.regions = append(v.regions, &vertexRegion{name: region})
+	}
+	ctx := context.Background()
+	var credentials *google.Credentials
+	var err error
+	if credentialsFile != "" {
+		b, readErr := os.ReadFile(credentialsFile)
+		if readErr != nil {
+			return nil, errors.Wrap(readErr, "failed to read Vertex AI credentials")
+		}
+		credentials, err = google.CredentialsFromJSON(ctx, b, cloudPlatformScope)
+	} else {
+		credentials, err = google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find Vertex AI credentials")
+	}
+	v.tokenSource = credentials.TokenSource
+	return v, nil
+}
+
+// degraded reports whether requests should prefer other regions.
+func (r *vertexRegion) degraded(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return now.Before(r.degradedUntil)
+}
+
+func (r *vertexRegion) degrade(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.degradedUntil = now.Add(KeyCircuitCooldown)
+}
+
+// orderedRegions returns the regions in order of preference, with degraded
+// regions last, as they are still tried if all others fail.
+func (v *vertexBackend) orderedRegions(now time.Time) []*vertexRegion {
+	var healthy, degraded []*vertexRegion
+	for _, region := range v.regions {
+		if region.degraded(now) {
+			degraded = append(degraded, region)
+		} else {
+			healthy = append(healthy, region)
+		}
+	}
+	return append(healthy, degraded...)
+}
+
+// roundTrip sends a request to Vertex AI, recording each region tried in the
+// upstream metrics of the key entry id.
+func (v *vertexBackend) roundTrip(req *http.Request, id string) (*http.Response, error) {
+	_, rest, _ := strings.Cut(req.URL.Path, "/models/")
+	model, method, ok := strings.Cut(rest, ":")
+	if !ok {
+		// Model info is answered as unknown, so that callers treat it as such.
+		status := http.StatusNotImplemented
+		if req.Method == http.MethodGet && rest != "" {
+			status = http.StatusNotFound
+		}
+		return googleErrorResponse(req, status, req.Method+" "+req.URL.Path+" is not supported with Vertex AI"), nil
+	}
+
+	vertexMethod := method
+	embed := method == "embedContent" || method == "batchEmbedContents"
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if embed {
+			// Vertex AI embeds through its prediction API.
+			vertexMethod = "predict"
+			body, err = convertEmbedRequestToVertex(body, method == "batchEmbedContents")
+		} else {
+			body, err = removeVertexRequestModel(body)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	token, err := v.tokenSource.Token()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get Vertex AI token")
+	}
+
+	var resp *http.Response
+	regions := v.orderedRegions(time.Now())
+	for i, region := range regions {
+		vertexReq := req.Clone(req.Context())
+		vertexReq.Host = ""
+		vertexReq.URL.Scheme = "https"
+		vertexReq.URL.Host = region.name + "-aiplatform.googleapis.com"
+		if region.name == "global" {
+			vertexReq.URL.Host = "aiplatform.googleapis.com"
+		}
+		vertexReq.URL.Path = fmt.Sprintf("/v1/projects/%s/locations/%s/publishers/google/models/%s:%s", v.project, region.name, model, vertexMethod)
+		vertexReq.URL.RawPath = ""
+		if req.Body != nil {
+			vertexReq.Body = io.NopCloser(bytes.NewReader(body))
+			vertexReq.ContentLength = int64(len(body))
+			vertexReq.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		vertexReq.Header.Del("X-Goog-Api-Key")
+		token.SetAuthHeader(vertexReq)
+
+		start := time.Now()
+		resp, err = upstreamTransport.RoundTrip(vertexReq)
+		observeUpstreamRequest(req, id, region.name, start, resp, err)
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+		failed := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		if failed || VertexFailoverLatency > 0 && time.Since(start) > VertexFailoverLatency {
+			region.degrade(time.Now())
+		}
+		if !failed || i == len(regions)-1 {
+			break
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		log.Warn().Str("key", id).Str("region", region.name).Str("next-region", regions[i+1].name).Msg("Failing over Vertex AI request to the next region")
+	}
+	if err != nil || !embed || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err = convertVertexPredictionsToEmbed(respBody, method == "batchEmbedContents")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	resp.ContentLength = int64(len(respBody))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// removeVertexRequestModel removes the model from the body of a request, as it
+// is named by the Vertex AI resource instead.
+func removeVertexRequestModel(body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal request")
+	}
+	if _, ok := fields["model"]; !ok {
+		return body, nil
+	}
+	delete(fields, "model")
+	return json.Marshal(fields)
+}
+
+// vertexEmbedRequest is the part of a Gemini embedContent request used by Vertex AI.
+type vertexEmbedRequest struct {
+	Content struct {
+		Parts []struct {
+			Text string `json:"text"`
+		} `json:"parts"`
+	} `json:"content"`
+	// TaskType is the task type's number, as the API client encodes enums.
+	TaskType             json.Number `json:"taskType"`
+	Title                string      `json:"title"`
+	OutputDimensionality *int        `json:"outputDimensionality"`
+}
+
+// convertEmbedRequestToVertex converts the body of an embedContent, or of a
+// batchEmbedContents if batch is set, to that of a Vertex AI predict request.
+func convertEmbedRequestToVertex(body []byte, batch bool) ([]byte, error) {
+	var requests []vertexEmbedRequest
+	if batch {
+		var batchReq struct {
+			Requests []vertexEmbedRequest `json:"requests"`
+		}
+		if err := json.Unmarshal(body, &batchReq); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal embedding request")
+		}
+		requests = batchReq.Requests
+	} else {
+		var request vertexEmbedRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal embedding request")
+		}
+		requests = []vertexEmbedRequest{request}
+	}
+
+	instances := make([]map[string]string, len(requests))
+	parameters := map[string]interface{}{}
+	for i, request := range requests {
+		var text strings.Builder
+		for _, part := range request.Content.Parts {
+			text.WriteString(part.Text)
+		}
+		instances[i] = map[string]string{"content": text.String()}
+		if taskType, err := request.TaskType.Int64(); err == nil && taskType != 0 {
+			instances[i]["task_type"] = generativelanguagepb.TaskType_name[int32(taskType)]
+		}
+		if request.Title != "" {
+			instances[i]["title"] = request.Title
+		}
+		if request.OutputDimensionality != nil {
+			parameters["outputDimensionality"] = *request.OutputDimensionality
+		}
+	}
+	return json.Marshal(map[string]interface{}{"instances": instances, "parameters": parameters})
+}
+
+// convertVertexPredictionsToEmbed converts the body of a Vertex AI predict
+// response to that of an embedContent, or of a batchEmbedContents if batch is set.
+func convertVertexPredictionsToEmbed(body []byte, batch bool) ([]byte, error) {
+	var predictResp struct {
+		Predictions []struct {
+			Embeddings struct {
+				Values []float32 `json:"values"`
+			} `json:"embeddings"`
+		} `json:"predictions"`
+	}
+	if err := json.Unmarshal(body, &predictResp); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal Vertex AI predictions")
+	}
+	embeddings := make([]map[string][]float32, len(predictResp.Predictions))
+	for i, prediction := range predictResp.Predictions {
+		embeddings[i] = map[string][]float32{"values": prediction.Embeddings.Values}
+	}
+	if batch {
+		return json.Marshal(map[string]interface{}{"embeddings": embeddings})
+	}
+	if len(embeddings) != 1 {
+		return nil, errors.Errorf("expected 1 Vertex AI prediction, got %d", len(embeddings))
+	}
+	return json.Marshal(map[string]interface{}{"embedding": embeddings[0]})
+}
+
+// googleErrorResponse builds a Google API error response for a request that
+// the proxy answers itself.
+func googleErrorResponse(req *http.Request, status int, message string) *http.Response {
+	body, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": message, "status": http.StatusText(status)},
+	})
+	return &http.Response{
+		StatusCode:    status,
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"github.com/cheahjs/gemini-to-openai-proxy/pkg/openai"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// virtualKey is an API key issued by the proxy, which spreads its requests
+// across a named key pool, within its own budgets, and only for its models.
+type virtualKey struct {
+	// id identifies the key in logs and for sticky routing without revealing it.
+	id string
+	// pool is the name of the key pool, or "" for the configured keys.
+	pool string
+	// models are the models the key can use, as path.Match patterns, or nil for all.
+	models []string
+	// endpoints are the paths the key can use, as path.Match patterns, or nil for all.
+	endpoints []string
+	// budget counts the key's requests to the proxy against its budgets.
+	budget *keyBudget
+	// tenant is the tenant the key belongs to, if any.
+	tenant *tenant
+}
+
+// virtualKeysConfig is the contents of VirtualKeysFile.
+type virtualKeysConfig struct {
+	// Pools are named key pools, in the form of GEMINI_API_KEY.
+	Pools map[string]string `json:"pools"`
+	// Tenants are named groups of keys, with budgets and models of their own.
+	Tenants map[string]struct {
+		RPM       int      `json:"rpm"`
+		RPD       int      `json:"rpd"`
+		TPD       int      `json:"tpd"`
+		Models    []string `json:"models"`
+		Endpoints []string `json:"endpoints"`
+	} `json:"tenants"`
+	Keys map[string]struct {
+		Pool      string   `json:"pool"`
+		Tenant    string   `json:"tenant"`
+		RPM       int      `json:"rpm"`
+		RPD       int      `json:"rpd"`
+		Models    []string `json:"models"`
+		Endpoints []string `json:"endpoints"`
+	} `json:"keys"`
+}
+
+// virtualKeyContextKey is the context key of the virtual key of a request.
+type virtualKeyContextKey struct{}
+
+// currentVirtualKeys are the virtual keys, by key, as of the last reload.
+var currentVirtualKeys atomic.Pointer[map[string]*virtualKey]
+
+// currentTenants are the tenants, by name, as of the last reload.
+var currentTenants = map[string]*tenant{}
+
+// loadVirtualKeys reads VirtualKeysFile, adding the keys of its pools to pool
+// as groups, and returns its virtual keys. Virtual keys and tenants keep the
+// requests and tokens counted against their budgets across reloads.
+func loadVirtualKeys(pool *keyPool) (map[string]*virtualKey, error) {
+	b, err := os.ReadFile(VirtualKeysFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read VIRTUAL_KEYS_FILE")
+	}
+	var config virtualKeysConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal VIRTUAL_KEYS_FILE")
+	}
+
+	pool.groups = map[string]*keyGroup{}
+	for name, s := range config.Pools {
+		poolKeys, err := parseApiKeys(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse keys of pool %s", name)
+		}
+		if len(poolKeys) == 0 {
+			return nil, errors.Errorf("pool %s has no keys", name)
+		}
+		var indexes []int
+		for _, key := range poolKeys {
+			index := slices.Index(pool.keys, key.key)
+			if index < 0 {
+				index, err = pool.add(key)
+				if err != nil {
+					return nil, err
+				}
+			}
+			pool.budgets[index].setLimits(key.limits)
+			indexes = append(indexes, index)
+		}
+		g := &keyGroup{weights: make([]int, len(pool.keys))}
+		for i, index := range indexes {
+			g.weights[index] += poolKeys[i].weight
+		}
+		if err := g.newSelector(); err != nil {
+			return nil, err
+		}
+		pool.groups[name] = g
+	}
+
+	tenants := map[string]*tenant{}
+	for name, c := range config.Tenants {
+		if c.RPM < 0 || c.RPD < 0 || c.TPD < 0 {
+			return nil, errors.Errorf("tenant %s: rpm, rpd and tpd must be non-negative", name)
+		}
+		for _, model := range c.Models {
+			if _, err := path.Match(model, ""); err != nil {
+				return nil, errors.Wrapf(err, "tenant %s: invalid model %s", name, model)
+			}
+		}
+		for _, endpoint := range c.Endpoints {
+			if _, err := path.Match(endpoint, ""); err != nil {
+				return nil, errors.Wrapf(err, "tenant %s: invalid endpoint %s", name, endpoint)
+			}
+		}
+		t, ok := currentTenants[name]
+		if !ok {
+			t = &tenant{name: name, budget: &keyBudget{}, tokens: &tokenBudget{}}
+		}
+		t.budget.setLimits(keyLimits{rpm: c.RPM, rpd: c.RPD})
+		t.tokens.setLimit(c.TPD)
+		tenants[name] = &tenant{name: name, models: c.Models, endpoints: c.Endpoints, budget: t.budget, tokens: t.tokens}
+	}
+
+	var old map[string]*virtualKey
+	if p := currentVirtualKeys.Load(); p != nil {
+		old = *p
+	}
+	virtualKeys := map[string]*virtualKey{}
+	for key, c := range config.Keys {
+		if _, ok := pool.groups[c.Pool]; c.Pool != "" && !ok {
+			return nil, errors.Errorf("virtual key %s has unknown pool %s", keyID(key), c.Pool)
+		}
+		if c.Pool == "" && pool.selector == nil {
+			return nil, errors.Errorf("virtual key %s has no pool, and there are no Gemini API keys", keyID(key))
+		}
+		if _, ok := tenants[c.Tenant]; c.Tenant != "" && !ok {
+			return nil, errors.Errorf("virtual key %s has unknown tenant %s", keyID(key), c.Tenant)
+		}
+		if c.RPM < 0 || c.RPD < 0 {
+			return nil, errors.Errorf("virtual key %s: rpm and rpd must be non-negative", keyID(key))
+		}
+		for _, model := range c.Models {
+			if _, err := path.Match(model, ""); err != nil {
+				return nil, errors.Wrapf(err, "virtual key %s: invalid model %s", keyID(key), model)
+			}
+		}
+		for _, endpoint := range c.Endpoints {
+			if _, err := path.Match(endpoint, ""); err != nil {
+				return nil, errors.Wrapf(err, "virtual key %s: invalid endpoint %s", keyID(key), endpoint)
+			}
+		}
+		budget := &keyBudget{}
+		if vk, ok := old[key]; ok {
+			budget = vk.budget
+		}
+		budget.setLimits(keyLimits{rpm: c.RPM, rpd: c.RPD})
+		virtualKeys[key] = &virtualKey{
+			id:        keyID(key),
+			pool:      c.Pool,
+			models:    c.Models,
+			endpoints: c.Endpoints,
+			budget:    budget,
+			tenant:    tenants[c.Tenant],
+		}
+	}
+	currentTenants = tenants
+	log.Info().Int("pools", len(pool.groups)).Int("tenants", len(tenants)).Int("keys", len(virtualKeys)).Msg("Loaded virtual keys")
+	return virtualKeys, nil
+}
+
+// allows reports whether the key, and its tenant, can use a model.
+func (vk *virtualKey) allows(model string) bool {
+	if vk.tenant != nil && !vk.tenant.allows(model) {
+		return false
+	}
+	return matchesPatterns(vk.models, strings.TrimPrefix(model, "models/"))
+}
+
+// allowsEndpoint reports whether the key, and its tenant, can use the endpoint
+// at a path.
+func (vk *virtualKey) allowsEndpoint(urlPath string) bool {
+	return (vk.tenant == nil || matchesPatterns(vk.tenant.endpoints, urlPath)) && matchesPatterns(vk.endpoints, urlPath)
+}
+
+// matchesPatterns reports whether s matches one of patterns, which are
+// path.Match patterns, or nil to match everything.
+func matchesPatterns(patterns []string, s string) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedModel reports whether the virtual key of a request, if any, can use a model.
+func allowedModel(ctx context.Context, model string) bool {
+	vk, ok := ctx.Value(virtualKeyContextKey{}).(*virtualKey)
+	return !ok || vk.allows(model)
+}
+
+// writeModelNotAllowed rejects a request for a model its virtual key cannot use.
+func writeModelNotAllowed(w http.ResponseWriter, r *http.Request, model string) {
+	code := "model_not_allowed"
+	writeErrorResponse(w, http.StatusForbidden, &openai.Error{
+		Message: "The model '" + model + "' is not allowed for this API key",
+		Type:    "invalid_request_error",
+		Code:    &code,
+	})
+	noteError(r.Context(), errors.Errorf("model %s is not allowed for virtual key", model))
+}
+
+// virtualKeyHandler requires requests to present a virtual key, in any of the
+// places requestToken reads, when VirtualKeysFile is set, before they are
+// handled by next. With KeyPassthrough, other tokens are used as Gemini API
+// keys instead.
+// Requests with a proxy API key are left to it, and requests for endpoints a
+// virtual key or its tenant cannot use are rejected with a 403.
+// Requests beyond the budgets of a virtual key or its tenant are rejected with a
+// 429, and the requests of tenants are counted by status code.
+func virtualKeyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(proxyKeyContextKey{}).(string); ok || VirtualKeysFile == "" || metricsRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := requestToken(r)
+		vk, ok := (*currentVirtualKeys.Load())[token]
+		if !ok {
+			if KeyPassthrough && token != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			code := "invalid_api_key"
+			writeErrorResponse(w, http.StatusUnauthorized, &openai.Error{
+				Message: "Incorrect API key provided",
+				Type:    "invalid_request_error",
+				Code:    &code,
+			})
+			noteError(r.Context(), errors.New("request has no valid virtual key"))
+			return
+		}
+
+		if !vk.allowsEndpoint(r.URL.Path) {
+			code := "endpoint_not_allowed"
+			writeErrorResponse(w, http.StatusForbidden, &openai.Error{
+				Message: "The endpoint " + r.URL.Path + " is not allowed for this API key",
+				Type:    "invalid_request_error",
+				Code:    &code,
+			})
+			noteError(r.Context(), errors.Errorf("endpoint is not allowed for virtual key %s", vk.id))
+			return
+		}
+		now := time.Now()
+		if until := vk.budget.exhaustedUntil(now); !until.IsZero() {
+			writeOutOfBudget(w, r, vk, "The API key is out of its request budget", until.Sub(now))
+			return
+		}
+		if vk.tenant != nil {
+			if until := vk.tenant.exhaustedUntil(now); !until.IsZero() {
+				writeOutOfBudget(w, r, vk, "The tenant "+vk.tenant.name+" is out of its budget", until.Sub(now))
+				return
+			}
+			vk.tenant.budget.take(now)
+		}
+		vk.budget.take(now)
+		r = r.WithContext(context.WithValue(r.Context(), virtualKeyContextKey{}, vk))
+		if vk.tenant == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		tenantRequests.add(1, "tenant", vk.tenant.name, "code", strconv.Itoa(cmp.Or(sw.status, http.StatusOK)))
+	})
+}
+
+// writeOutOfBudget rejects a request of a virtual key that is out of budget
+// with a 429, to be retried after a delay.
+func writeOutOfBudget(w http.ResponseWriter, r *http.Request, vk *virtualKey, message string, delay time.Duration) {
+	if vk.tenant != nil {
+		tenantRequests.add(1, "tenant", vk.tenant.name, "code", strconv.Itoa(http.StatusTooManyRequests))
+	}
+	setRateLimitHeaders(w.Header(), vk, nil, nil, time.Now())
+	retryAfter := int(math.Ceil(delay.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	code := "rate_limit_exceeded"
+	writeErrorResponse(w, http.StatusTooManyRequests, &openai.Error{
+		Message: message + ", retry after " + strconv.Itoa(retryAfter) + " seconds",
+		Type:    "requests",
+		Code:    &code,
+	})
+	noteError(r.Context(), errors.Errorf("virtual key %s is out of budget", vk.id))
+}